@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// runtimeFlags are the flags of the serve command which can be changed at runtime through
+// the admin endpoints: the detection parameters, the mask, its opacity, the overlay mode and the
+// debug rendering.
+var runtimeFlags = map[string]bool{
+	"min": true, "max": true, "shift": true, "scale": true, "angle": true, "iou": true,
+	"preprocess": true, "max-dim": true, "detect-scale": true, "landmarks": true, "upscale": true,
+	"q": true, "min-ipd": true, "max-ipd": true, "landmark-q": true, "mirror": true, "nms": true,
+	"nms-sigma": true, "mask": true, "mode": true, "opacity": true, "debug": true,
+}
+
+// secretFlags are the flags left out of the configuration dump.
+var secretFlags = map[string]bool{"admin-token": true}
+
+// serverConfig is a snapshot of the processing settings of the server. The requests use
+// the snapshot current at their start, so the changes don't affect the requests in progress.
+type serverConfig struct {
+	// gen is the generation of the configuration, incremented by every change.
+	gen int
+	// detector holds the detection settings, cloned by the pooled detectors.
+	detector *facemask.Detector
+	renderer facemask.Renderer
+	// debug draws the landmark mesh over the faces, to check the landmark quality.
+	debug bool
+	// params are the processing settings, the flags other than the serverFlags.
+	params map[string]string
+}
+
+// flagSnapshot is the state of the flags a configuration is built from, so it's built
+// without holding the lock.
+type flagSnapshot struct {
+	gen      int
+	detector *facemask.Detector
+	values   map[string]string
+}
+
+// snapshot returns the snapshot of the current flags for the configuration of the generation.
+// The caller must hold the lock.
+func (s *server) snapshot(gen int) flagSnapshot {
+	values := make(map[string]string)
+	s.flags.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return flagSnapshot{gen: gen, detector: s.fd.Clone(), values: values}
+}
+
+// newConfig creates the configuration from the snapshot of the flags. The detection
+// settings are checked over a blank image, so an invalid configuration is rejected up front.
+func (s *server) newConfig(snap flagSnapshot) (*serverConfig, error) {
+	opacity, err := strconv.ParseFloat(snap.values["opacity"], 64)
+	if err != nil || opacity <= 0 || opacity > 1 {
+		return nil, errors.New("the mask opacity must be between 0 and 1")
+	}
+	renderer, err := overlayRenderer(s.assetPath(snap.values["mask"]), snap.values["mode"], opacity)
+	if err != nil {
+		return nil, err
+	}
+	// The cascades never finish scanning with the too small scale factors.
+	if snap.detector.ScaleFactor < 1.05 {
+		return nil, errors.New("scale factor must be greater than 1.05")
+	}
+	detector := snap.detector
+	detector.FaceCascade = s.assetPath(detector.FaceCascade)
+	detector.EyesCascade = s.assetPath(detector.EyesCascade)
+	detector.FlplocDir = s.assetPath(detector.FlplocDir)
+	if _, err := detector.Clone().DetectImage(image.NewGray(image.Rect(0, 0, 64, 64))); err != nil {
+		return nil, fmt.Errorf("invalid detection settings: %v", err)
+	}
+
+	params := make(map[string]string)
+	for name, value := range snap.values {
+		if !serverFlags[name] {
+			params[name] = value
+		}
+	}
+	return &serverConfig{
+		gen:      snap.gen,
+		detector: detector,
+		renderer: renderer,
+		debug:    snap.values["debug"] == "true",
+		params:   params,
+	}, nil
+}
+
+// overlayRenderer returns the renderer of the overlay mode, with the mask of the mask modes.
+func overlayRenderer(mask, mode string, opacity float64) (facemask.Renderer, error) {
+	// The mask images are loaded at the first rendering, so the missing ones are reported up front.
+	if mode == "mask" || mode == "mask3d" {
+		if _, err := os.Stat(mask); err != nil {
+			return nil, fmt.Errorf("error loading the mask: %v", err)
+		}
+	}
+	switch {
+	case mode == "mask":
+		r, err := maskRenderer(mask, maskOptions{opacity: opacity})
+		if err != nil {
+			return nil, fmt.Errorf("error loading the mask: %v", err)
+		}
+		return r, nil
+	case mode == "mask3d" && !isMaskPack(mask):
+		return facemask.NewMask3DRenderer(mask), nil
+	}
+	r, err := facemask.Lookup(mode)
+	if err != nil {
+		return nil, fmt.Errorf("overlay mode not supported: %v", err)
+	}
+	return r, nil
+}
+
+// config returns the current configuration.
+func (s *server) config() *serverConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg
+}
+
+// update changes the flags and switches to the new configuration. In case any of the
+// values is invalid, none of them is changed.
+func (s *server) update(changes map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name := range changes {
+		if !runtimeFlags[name] {
+			return fmt.Errorf("%s can't be changed at runtime", name)
+		}
+	}
+	restore, err := s.setFlags(changes)
+	if err != nil {
+		return err
+	}
+	cfg, err := s.newConfig(s.snapshot(s.cfg.gen + 1))
+	if err != nil {
+		restore()
+		return err
+	}
+	s.cfg = cfg
+	s.tenants.reset()
+	return nil
+}
+
+// setFlags changes the flags, returning the function restoring their previous values. In case
+// any of the values is invalid, none of them is changed. The caller must hold the lock.
+func (s *server) setFlags(values map[string]string) (func(), error) {
+	previous := make(map[string]string)
+	restore := func() {
+		for name, value := range previous {
+			s.flags.Set(name, value)
+		}
+	}
+	for name, value := range values {
+		previous[name] = s.flags.Lookup(name).Value.String()
+		if err := s.flags.Set(name, value); err != nil {
+			restore()
+			return nil, fmt.Errorf("invalid value %q for %s: %v", value, name, err)
+		}
+	}
+	return restore, nil
+}
+
+// dump returns the values of all the flags, the effective configuration of the server.
+func (s *server) dump() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	values := make(map[string]string)
+	s.flags.VisitAll(func(f *flag.Flag) {
+		if !secretFlags[f.Name] {
+			values[f.Name] = f.Value.String()
+		}
+	})
+	return values
+}
+
+// handleConfig returns the effective configuration on GET, and changes the runtime flags
+// of the JSON object of flag names and values on PATCH.
+func (s *server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var values map[string]interface{}
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&values); err != nil {
+			http.Error(w, fmt.Sprintf("invalid configuration: %v", err), http.StatusBadRequest)
+			return
+		}
+		changes := make(map[string]string, len(values))
+		names := make([]string, 0, len(values))
+		for name, v := range values {
+			changes[name] = fmt.Sprint(v)
+			names = append(names, name+"="+changes[name])
+		}
+		if err := s.update(changes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sort.Strings(names)
+		log.Printf("%s %s: configuration changed: %s", requestID(r.Context()), s.clientIP(r), strings.Join(names, " "))
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s.dump())
+}
+
+// admin authenticates the requests of the admin endpoints by the bearer token.
+func (s *server) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="facemask"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// allFaces is the name of the whole frame in the analytics, next to the privacy zones.
+const allFaces = "all"
+
+// faceCount is the face count of a zone aggregated over an interval.
+type faceCount struct {
+	Frames int     `json:"frames"`
+	Avg    float64 `json:"avg"`
+	Max    int     `json:"max"`
+
+	sum int
+}
+
+func (fc *faceCount) add(faces int) {
+	fc.Frames++
+	fc.sum += faces
+	if faces > fc.Max {
+		fc.Max = faces
+	}
+	fc.Avg = math.Round(float64(fc.sum)/float64(fc.Frames)*100) / 100
+}
+
+// analyticsRecord are the face counts of an interval, of the whole frame and of each zone.
+type analyticsRecord struct {
+	Start time.Time             `json:"start"`
+	End   time.Time             `json:"end"`
+	Zones map[string]*faceCount `json:"zones"`
+}
+
+// faceAnalytics counts the faces of the stream frames, turning the stream into an occupancy
+// counter. The counts of the whole frame and of the privacy zones, which the faces belong
+// to by their center, are written to the file as JSON Lines or CSV records summarizing
+// every interval, and the counts of the latest frame are exposed as Prometheus gauges.
+type faceAnalytics struct {
+	interval time.Duration
+	zones    *facemask.PrivacyZones
+	file     *os.File
+	// write writes the record into the file.
+	write func(*analyticsRecord) error
+
+	mu     sync.Mutex
+	record *analyticsRecord
+	// current are the face counts of the latest frame by zone, frames the number of the frames.
+	current map[string]int
+	frames  int
+}
+
+// newFaceAnalytics creates the analytics written to the file, in CSV format if its extension
+// is .csv and JSON Lines otherwise. Without a file only the gauges are updated.
+func newFaceAnalytics(path string, interval time.Duration, zones *facemask.PrivacyZones) (*faceAnalytics, error) {
+	fa := &faceAnalytics{interval: interval, zones: zones, current: make(map[string]int)}
+	if path == "" {
+		return fa, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fa.file = f
+
+	if strings.ToLower(filepath.Ext(path)) != ".csv" {
+		enc := json.NewEncoder(f)
+		fa.write = func(r *analyticsRecord) error { return enc.Encode(r) }
+		return fa, nil
+	}
+	w := csv.NewWriter(f)
+	// The header is written only into a new file, the records are appended to an existing one.
+	if fi, err := f.Stat(); err == nil && fi.Size() == 0 {
+		w.Write([]string{"start", "end", "zone", "frames", "avg", "max"})
+	}
+	fa.write = func(r *analyticsRecord) error {
+		for _, zone := range fa.zoneNames() {
+			c := r.Zones[zone]
+			w.Write([]string{
+				r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339), zone,
+				strconv.Itoa(c.Frames), strconv.FormatFloat(c.Avg, 'f', 2, 64), strconv.Itoa(c.Max),
+			})
+		}
+		w.Flush()
+		return w.Error()
+	}
+	return fa, nil
+}
+
+// zoneNames returns the names of the counted zones, the whole frame first.
+func (fa *faceAnalytics) zoneNames() []string {
+	names := []string{allFaces}
+	if fa.zones != nil {
+		for i, z := range fa.zones.Zones {
+			name := z.Name
+			if name == "" {
+				name = fmt.Sprintf("zone%d", i+1)
+			}
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// add counts the faces of the next frame, writing the record of the previous interval once it's over.
+func (fa *faceAnalytics) add(infos []facemask.FaceInfo) error {
+	now := time.Now()
+	counts := map[string]int{allFaces: len(infos)}
+	if fa.zones != nil {
+		names := fa.zoneNames()[1:]
+		for i := range fa.zones.Zones {
+			n := 0
+			for _, face := range infos {
+				if fa.zones.Zones[i].Contains(face.Col, face.Row) {
+					n++
+				}
+			}
+			counts[names[i]] += n
+		}
+	}
+
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	fa.current = counts
+	fa.frames++
+	var err error
+	if fa.record != nil && now.Sub(fa.record.Start) >= fa.interval {
+		err = fa.flush(now)
+	}
+	if fa.record == nil {
+		fa.record = &analyticsRecord{Start: now, Zones: make(map[string]*faceCount)}
+		for _, zone := range fa.zoneNames() {
+			fa.record.Zones[zone] = new(faceCount)
+		}
+	}
+	for zone, n := range counts {
+		fa.record.Zones[zone].add(n)
+	}
+	return err
+}
+
+// flush writes the record of the current interval, ending at the time.
+func (fa *faceAnalytics) flush(end time.Time) error {
+	r := fa.record
+	fa.record = nil
+	if r == nil || fa.write == nil {
+		return nil
+	}
+	r.End = end
+	return fa.write(r)
+}
+
+// Close writes the record of the last, partial interval and closes the file.
+func (fa *faceAnalytics) Close() error {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	err := fa.flush(time.Now())
+	if fa.file != nil {
+		if cerr := fa.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// ServeHTTP exposes the face counts of the latest frame in the Prometheus text format.
+func (fa *faceAnalytics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP facemask_frames_total Number of the processed stream frames.")
+	fmt.Fprintln(w, "# TYPE facemask_frames_total counter")
+	fmt.Fprintf(w, "facemask_frames_total %d\n", fa.frames)
+	fmt.Fprintln(w, "# HELP facemask_faces Number of the faces on the latest frame, in the whole frame and in the privacy zones.")
+	fmt.Fprintln(w, "# TYPE facemask_faces gauge")
+	for _, zone := range fa.zoneNames() {
+		fmt.Fprintf(w, "facemask_faces{zone=%q} %d\n", zone, fa.current[zone])
+	}
+}
+
+// serveMetrics serves the Prometheus metrics of the analytics at /metrics on the address.
+func serveMetrics(addr string, fa *faceAnalytics) (io.Closer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", fa)
+	server := &http.Server{Handler: mux}
+	go server.Serve(ln)
+	return server, nil
+}
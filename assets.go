@@ -0,0 +1,72 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// embedded holds the default cascades and mask, so the binary runs without the asset
+// directories next to it, e.g. from a scratch container.
+//
+//go:embed assets cascades
+var embedded embed.FS
+
+// embeddedAssets extracts the embedded assets into a temporary directory when any of the
+// asset paths is missing from the file system, since the cascades are read from files. It
+// returns the directory, to be removed by the caller, or an empty string when all the assets exist.
+func embeddedAssets(paths ...string) (string, error) {
+	missing := false
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			continue
+		}
+		if _, err := fs.Stat(embedded, filepath.ToSlash(p)); err == nil {
+			missing = true
+		}
+	}
+	if !missing {
+		return "", nil
+	}
+
+	dir, err := ioutil.TempDir("", "facemask-assets")
+	if err != nil {
+		return "", err
+	}
+	err = fs.WalkDir(embedded, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(path))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := embedded.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, data, 0644)
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// extractedPath returns the path of the extracted copy of the embedded asset, in case the
+// asset is missing from the file system.
+func extractedPath(dir, path string) string {
+	if dir == "" {
+		return path
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	if _, err := fs.Stat(embedded, filepath.ToSlash(path)); err != nil {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	facemask "github.com/esimov/facemask/core"
+)
+
+// auditRecord is the audit record of an image processed by the server. It holds no pixel
+// data, unless the thumbnails of the masked outputs are enabled for review.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Client    string    `json:"client"`
+	Endpoint  string    `json:"endpoint"`
+	// Source is the SHA-256 hash of the uploaded image, and Size its size in bytes.
+	Source string `json:"source_sha256,omitempty"`
+	Size   int    `json:"size"`
+	Faces  int    `json:"faces"`
+	// Params are the effective settings the image was processed with.
+	Params   map[string]string `json:"params"`
+	Duration float64           `json:"duration_ms"`
+	Status   int               `json:"status"`
+	Error    string            `json:"error,omitempty"`
+	// Thumbnail is the base64 encoded JPEG thumbnail of the masked output.
+	Thumbnail string `json:"thumbnail,omitempty"`
+}
+
+// auditLog writes an audit record per image processed by the server as JSON Lines, for the
+// compliance deployments which have to account for every redaction. The methods of a nil
+// auditLog do nothing.
+type auditLog struct {
+	// thumbnail is the size of the thumbnails of the masked outputs, 0 disables them.
+	thumbnail int
+
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+}
+
+// openAuditLog opens the audit log appending to the file, or writing to the standard
+// output for -. The file is readable by its owner only.
+func openAuditLog(path string, thumbnail int) (*auditLog, error) {
+	if path == "-" {
+		return &auditLog{thumbnail: thumbnail, w: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{thumbnail: thumbnail, w: f, file: f}, nil
+}
+
+// write writes the record, completing its processing time.
+func (al *auditLog) write(rec *auditRecord, start time.Time) error {
+	if al == nil {
+		return nil
+	}
+	rec.Duration = float64(time.Since(start).Microseconds()) / 1000
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	_, err = al.w.Write(append(data, '\n'))
+	return err
+}
+
+// addThumbnail adds the thumbnail of the masked output to the record, if enabled.
+func (al *auditLog) addThumbnail(rec *auditRecord, img image.Image) {
+	if al == nil || al.thumbnail == 0 {
+		return
+	}
+	if b := img.Bounds(); b.Dx() > al.thumbnail || b.Dy() > al.thumbnail {
+		img = imaging.Fit(img, al.thumbnail, al.thumbnail, imaging.Lanczos)
+	}
+	var buf bytes.Buffer
+	if err := facemask.Encode(&buf, img, facemask.JPEG); err == nil {
+		rec.Thumbnail = base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+}
+
+// Close closes the file of the audit log.
+func (al *auditLog) Close() error {
+	if al == nil || al.file == nil {
+		return nil
+	}
+	return al.file.Close()
+}
+
+// requestIDKey is the context key of the ID of a request.
+type requestIDKey struct{}
+
+// withRequestID identifies the requests by the X-Request-ID header set by the proxies or
+// the clients, generating one when it's missing, and returns it in the response header.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			var b [16]byte
+			rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+		}
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID reports whether the request ID is short and printable, so it can't
+// forge the log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the ID of the request.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
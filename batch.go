@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// defaultOutTemplate is the output naming template of the batch mode.
+const defaultOutTemplate = "{dir}/{name}.{ext}"
+
+// imageTypes are the supported image file extensions.
+var imageTypes = []string{".jpg", ".jpeg", ".png"}
+
+// output resolves the destination path of a processed image.
+type output struct {
+	// path is the fixed destination; when empty the template is expanded.
+	path     string
+	template string
+	dir      string
+	// root is the source directory of the batch mode, whose directory
+	// structure is preserved under the output directory.
+	root    string
+	profile string
+}
+
+// resolve returns the destination path of the source image with the provided number of faces.
+// The template variables are {dir} (the output directory), {name} (the source file name
+// without extension), {ext} (the source extension), {faces} (the number of processed faces),
+// {date} (the processing date) and {profile} (the configuration profile name).
+func (o output) resolve(source string, faces int) (string, error) {
+	path := o.path
+	if path == "" {
+		dir := o.dir
+		if o.root != "" {
+			// The sources outside of the root are written directly into the output directory.
+			rel, err := filepath.Rel(o.root, filepath.Dir(source))
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				dir = filepath.Join(o.dir, rel)
+			}
+		}
+		ext := filepath.Ext(source)
+		path = strings.NewReplacer(
+			"{dir}", dir,
+			"{name}", strings.TrimSuffix(filepath.Base(source), ext),
+			"{ext}", strings.TrimPrefix(ext, "."),
+			"{faces}", strconv.Itoa(faces),
+			"{date}", time.Now().Format("2006-01-02"),
+			"{profile}", o.profile,
+		).Replace(o.template)
+	}
+	if !outputSupported(source, path) {
+		return "", fmt.Errorf("output file type not supported: %v", filepath.Ext(path))
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// outputSupported reports whether the source can be written to the destination: the PDF
+// documents and the TIFF files are written in their own format, the images as JPEG or PNG.
+func outputSupported(source, destination string) bool {
+	switch {
+	case isPDF(source):
+		return isPDF(destination)
+	case isTIFF(source):
+		return isTIFF(destination)
+	}
+	return inSlice(strings.ToLower(filepath.Ext(destination)), imageTypes)
+}
+
+// copyOutput copies the temporary output file from its beginning into the destination.
+func copyOutput(destination string, tmp *os.File) error {
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, tmp); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// listImages returns the image files of the directory, sorted by name. The include and
+// exclude patterns are matched against the file name, or against the path relative to
+// the directory when they contain a slash, where ** matches any number of directories.
+// Without include patterns the JPEG and PNG files are listed.
+func listImages(root string, recursive bool, include, exclude []string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			if path != root && (!recursive || matchAny(exclude, rel+"/")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if matchAny(exclude, rel) {
+			return nil
+		}
+		if len(include) == 0 && !inSlice(strings.ToLower(filepath.Ext(path)), imageTypes) ||
+			len(include) > 0 && !matchAny(include, rel) {
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readFileList reads the source paths listed line by line in the file,
+// or in the standard input in case the path is "-". Empty lines are ignored.
+func readFileList(path string) ([]string, error) {
+	r := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var files []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, scanner.Err()
+}
+
+// splitPatterns splits the comma separated list of patterns.
+func splitPatterns(list string) []string {
+	var patterns []string
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// matchAny reports whether the slash separated relative path matches any of the patterns.
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if !strings.Contains(p, "/") {
+			if ok, _ := filepath.Match(p, path.Base(rel)); ok {
+				return true
+			}
+			continue
+		}
+		if matchPath(strings.Split(p, "/"), strings.Split(rel, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath matches the path segments against the pattern segments, where
+// the ** segment matches any number of path segments.
+func matchPath(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchPath(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// processImage detects the faces of the source image and renders the overlays. The returned
+// encode function writes the result to the resolved output path, which is returned too, and
+// to its thumbnail and its sidecar report when enabled; it doesn't use the detector, so it
+// can run while the next image is processed.
+func processImage(fd *facemask.Detector, renderer facemask.Renderer, source string, out output, heatmap, layer string, regions bool, thumb int, sidecar bool) (facemask.Report, string, func() error, error) {
+	var (
+		infos []facemask.FaceInfo
+		err   error
+	)
+	// The heatmap requires the raw detections, which are not cached.
+	if heatmap != "" {
+		faces, derr := fd.DetectFaces(source)
+		infos, err = fd.LocalizeFaces(faces), derr
+	} else {
+		infos, err = fd.DetectCached(source)
+	}
+	if err != nil {
+		return facemask.Report{}, "", nil, fmt.Errorf("detection error: %v", err)
+	}
+	if heatmap != "" {
+		if err := facemask.SaveImage(heatmap, fd.Heatmap()); err != nil {
+			return facemask.Report{}, "", nil, fmt.Errorf("error creating the heatmap: %v", err)
+		}
+	}
+
+	if err := fd.Render(infos, renderer); err != nil {
+		return facemask.Report{}, "", nil, fmt.Errorf("error rendering the overlays: %v", err)
+	}
+	if layer != "" {
+		if err := facemask.SaveImage(layer, fd.Layer()); err != nil {
+			return facemask.Report{}, "", nil, fmt.Errorf("error creating the overlay layer: %v", err)
+		}
+	}
+	destination, err := out.resolve(source, len(infos))
+	if err != nil {
+		return facemask.Report{}, "", nil, err
+	}
+	var sinks facemask.MultiSink
+	if regions && isJPEG(source) && isJPEG(destination) {
+		// The regions are encoded over the source blocks kept by the detector, right away.
+		if err := saveRegions(fd, source, destination); err != nil {
+			return facemask.Report{}, "", nil, fmt.Errorf("error creating the image output: %v", err)
+		}
+	} else {
+		sinks = append(sinks, facemask.FileSink(destination))
+	}
+	if thumb > 0 {
+		sinks = append(sinks, facemask.ThumbnailSink{Path: thumbPath(destination, out.root != ""), Size: thumb})
+	}
+	if sidecar {
+		sinks = append(sinks, facemask.ReportSink(strings.TrimSuffix(destination, filepath.Ext(destination))+".json"))
+	}
+	result, report := fd.Result(), facemask.NewReport(source, infos)
+	encode := func() error {
+		if err := sinks.Write(result, report); err != nil {
+			return fmt.Errorf("error creating the output: %v", err)
+		}
+		return nil
+	}
+	return report, destination, encode, nil
+}
+
+// thumbPath returns the path of the thumbnail of the output image: in batch mode the
+// thumbnails are written into a thumbs directory next to the output, otherwise next
+// to the output with the _thumb suffix.
+func thumbPath(destination string, batch bool) string {
+	if batch {
+		return filepath.Join(filepath.Dir(destination), "thumbs", filepath.Base(destination))
+	}
+	ext := filepath.Ext(destination)
+	return strings.TrimSuffix(destination, ext) + "_thumb" + ext
+}
+
+// isJPEG reports whether the file is a JPEG image, based on its extension.
+func isJPEG(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".jpg" || ext == ".jpeg"
+}
+
+// saveRegions writes the result re-encoding only the blocks of the source JPEG image
+// changed by the overlays. The images which can't be re-encoded by regions, like the
+// progressive JPEG images, are encoded as a whole.
+func saveRegions(fd *facemask.Detector, source, destination string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	if err := fd.OverlayRegionsTo(&buf, f); err != nil {
+		if err == facemask.ErrRegionEncode {
+			return fd.Save(destination)
+		}
+		return err
+	}
+	return ioutil.WriteFile(destination, buf.Bytes(), 0644)
+}
+
+// batchError is a file failed in the batch run.
+type batchError struct {
+	Source string `json:"source"`
+	Error  string `json:"error"`
+}
+
+// writeErrorReport writes the failed files of the batch run as a JSON array.
+func writeErrorReport(path string, failures []batchError) error {
+	if failures == nil {
+		failures = []batchError{}
+	}
+	data, err := json.MarshalIndent(failures, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// blinkWindow is the number of frames within which the blinks of a trigger have to happen,
+// about one and a half seconds of a webcam stream.
+const blinkWindow = 45
+
+// blinkTrigger takes a snapshot of the stream when the subject, i.e. the largest face of
+// the frame, blinks the required number of times in a row, like a photo booth remote.
+type blinkTrigger struct {
+	snapshots *snapshots
+	blinks    int
+
+	counter facemask.BlinkCounter
+	// times are the frame numbers of the recent blinks.
+	times []int
+}
+
+// update tracks the eyes of the subject on the frame, which has been rendered already,
+// and saves the snapshot once the subject has blinked enough times.
+func (bt *blinkTrigger) update(fd *facemask.Detector, frame int, infos []facemask.FaceInfo) error {
+	subject := -1
+	for i, face := range infos {
+		if subject < 0 || face.Scale > infos[subject].Scale {
+			subject = i
+		}
+	}
+	if subject < 0 {
+		return nil
+	}
+	openness, ok := fd.EyeOpenness(infos[subject])
+	if !ok || !bt.counter.Update(openness) {
+		return nil
+	}
+
+	times := bt.times[:0]
+	for _, t := range bt.times {
+		if frame-t < blinkWindow {
+			times = append(times, t)
+		}
+	}
+	bt.times = append(times, frame)
+	if len(bt.times) < bt.blinks {
+		return nil
+	}
+	bt.times = bt.times[:0]
+	path, err := bt.snapshots.save(fd)
+	if err != nil {
+		return err
+	}
+	log.Printf("Blink trigger at frame %d: %s", frame, path)
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// broadcastFormats are the container formats of the live streaming protocols,
+// by the URL scheme of the destination.
+var broadcastFormats = map[string]string{
+	"rtmp":  "flv",
+	"rtmps": "flv",
+	"rtsp":  "rtsp",
+	"srt":   "mpegts",
+	"udp":   "mpegts",
+	"http":  "hls",
+}
+
+// hlsSegment is the duration of the HLS segments in seconds, which is also the keyframe interval.
+const hlsSegment = 1
+
+// cameraDevice is the path prefix of the video devices of Linux, like the virtual cameras
+// of v4l2loopback.
+const cameraDevice = "/dev/video"
+
+// isBroadcast reports whether the destination is the URL of a live streaming server,
+// like the RTMP ingest of a streaming service or the SRT listener of OBS, the
+// http:// URL of an HLS playlist served by facemask itself, or a virtual camera.
+func isBroadcast(dest string) bool {
+	if strings.HasPrefix(dest, cameraDevice) {
+		return true
+	}
+	u, err := url.Parse(dest)
+	if err != nil || broadcastFormats[u.Scheme] == "" {
+		return false
+	}
+	return u.Scheme != "http" || path.Ext(u.Path) == ".m3u8"
+}
+
+// broadcaster publishes the masked MJPEG frames written to it as a live H.264 stream. The
+// encoding and the protocol are handled by ffmpeg, which reads the frames from its standard
+// input and timestamps them at their arrival, so the stream follows the pace of the source.
+// The HLS segments are written by ffmpeg into a temporary directory served over HTTP. The
+// frames of a virtual camera are written raw into the v4l2loopback device, so the video
+// calls and the other camera applications show the masked video.
+type broadcaster struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	server *http.Server
+	dir    string
+}
+
+// startBroadcast starts streaming to the URL.
+func startBroadcast(dest string) (*broadcaster, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	b := new(broadcaster)
+	format := broadcastFormats[u.Scheme]
+	args := []string{"-hide_banner", "-loglevel", "error",
+		"-use_wallclock_as_timestamps", "1", "-f", "mjpeg", "-i", "-"}
+	if strings.HasPrefix(dest, cameraDevice) {
+		format = "v4l2"
+	} else {
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency")
+	}
+	args = append(args, "-pix_fmt", "yuv420p")
+	switch format {
+	case "rtsp":
+		args = append(args, "-f", format, "-rtsp_transport", "tcp", dest)
+	case "hls":
+		if b.dir, err = ioutil.TempDir("", "facemask"); err != nil {
+			return nil, err
+		}
+		args = append(args, "-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegment),
+			"-f", format, "-hls_time", fmt.Sprint(hlsSegment), "-hls_list_size", "6", "-hls_flags", "delete_segments",
+			filepath.Join(b.dir, path.Base(u.Path)))
+		ln, err := net.Listen("tcp", u.Host)
+		if err != nil {
+			os.RemoveAll(b.dir)
+			return nil, err
+		}
+		b.server = &http.Server{Handler: http.StripPrefix(path.Dir(u.Path), hlsHandler(b.dir))}
+		go b.server.Serve(ln)
+	default:
+		args = append(args, "-f", format, dest)
+	}
+
+	b.cmd = exec.Command("ffmpeg", args...)
+	b.cmd.Stdout, b.cmd.Stderr = os.Stderr, os.Stderr
+	if b.stdin, err = b.cmd.StdinPipe(); err == nil {
+		if err = b.cmd.Start(); err != nil {
+			err = fmt.Errorf("error starting ffmpeg: %v", err)
+		}
+	}
+	if err != nil {
+		b.stop()
+		return nil, err
+	}
+	return b, nil
+}
+
+// hlsHandler serves the HLS playlist and segments of the directory. The playlist
+// changes with every segment, so it's not cached.
+func hlsHandler(dir string) http.Handler {
+	fs := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		switch path.Ext(r.URL.Path) {
+		case ".m3u8":
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Header().Set("Cache-Control", "no-cache")
+		case ".ts":
+			w.Header().Set("Content-Type", "video/mp2t")
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		fs.ServeHTTP(w, r)
+	})
+}
+
+// Write implements the io.Writer interface.
+func (b *broadcaster) Write(p []byte) (int, error) {
+	return b.stdin.Write(p)
+}
+
+// Close ends the stream and waits for ffmpeg to flush it.
+func (b *broadcaster) Close() error {
+	b.stdin.Close()
+	err := b.cmd.Wait()
+	b.stop()
+	if err != nil {
+		return fmt.Errorf("ffmpeg: %v", err)
+	}
+	return nil
+}
+
+// stop stops the HLS server and removes the segments.
+func (b *broadcaster) stop() {
+	if b.server != nil {
+		b.server.Close()
+	}
+	if b.dir != "" {
+		os.RemoveAll(b.dir)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// checkCommand runs the mask wearing compliance check: it counts the faces
+// wearing and not wearing a mask, and optionally writes the annotated image.
+func checkCommand(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	flags := checkFlags(fs)
+	fd, classifier := flags.fd, flags.classifier
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: facemask check -in input.jpg [-out annotated.png]\n\n")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	defer fd.Close()
+
+	if len(*flags.source) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	faces, err := fd.DetectFaces(*flags.source)
+	if err != nil {
+		log.Fatalf("Detection error: %v", err)
+	}
+	cr := &facemask.ComplianceRenderer{Classifier: classifier()}
+	if err := fd.RenderFaces(faces, cr); err != nil {
+		log.Fatalf("Error checking the faces: %v", err)
+	}
+	if *flags.destination != "" {
+		if err := fd.Save(*flags.destination); err != nil {
+			log.Fatalf("Error creating the image output: %v", err)
+		}
+	}
+
+	fmt.Printf("faces: %d\nmasked: %d\nunmasked: %d\n", cr.Masked+cr.Unmasked, cr.Masked, cr.Unmasked)
+}
+
+// checkSettings are the settings of the flags of the check command.
+type checkSettings struct {
+	source      *string
+	destination *string
+	fd          *facemask.Detector
+	classifier  func() facemask.MaskClassifier
+}
+
+// checkFlags defines the flags of the check command.
+func checkFlags(fs *flag.FlagSet) *checkSettings {
+	return &checkSettings{
+		source:      fs.String("in", "", "Source image"),
+		destination: fs.String("out", "", "Annotated destination image (optional)"),
+		fd:          detectorFlags(fs),
+		classifier:  classifierFlags(fs),
+	}
+}
+
+// classifierFlags registers the mask classifier flags and returns a function
+// creating the classifier configured by them, to be called after the flags are parsed.
+func classifierFlags(fs *flag.FlagSet) func() facemask.MaskClassifier {
+	var (
+		cascade   = fs.String("mask-cascade", "", "Pigo cascade trained on masked faces (default: skin color heuristic)")
+		threshold = fs.Float64("mask-threshold", 0.6, "Masked face score threshold, 5.0 is used with -mask-cascade unless set")
+	)
+	return func() facemask.MaskClassifier {
+		if *cascade == "" {
+			return &facemask.ColorClassifier{Threshold: *threshold}
+		}
+		qThresh := 5.0
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "mask-threshold" {
+				qThresh = *threshold
+			}
+		})
+		cc, err := facemask.NewCascadeClassifier(*cascade, float32(qThresh))
+		if err != nil {
+			log.Fatalf("Error loading the mask cascade: %v", err)
+		}
+		return cc
+	}
+}
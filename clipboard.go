@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// clipboardTarget is the source and destination name of the clipboard.
+const clipboardTarget = "clipboard"
+
+// readClipboard writes the image of the clipboard into the clipboard.png image
+// of a new temporary directory. The caller removes the directory.
+func readClipboard() (string, error) {
+	dir, err := ioutil.TempDir("", "facemask")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, clipboardTarget+".png")
+	if err := runClipboard(false, path); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() == 0 {
+		os.RemoveAll(dir)
+		return "", errors.New("the clipboard contains no image")
+	}
+	return path, nil
+}
+
+// writeClipboard puts the PNG image into the clipboard.
+func writeClipboard(path string) error {
+	return runClipboard(true, path)
+}
+
+// runClipboard copies the PNG image between the file and the clipboard, with osascript on macOS,
+// PowerShell on Windows and wl-clipboard (Wayland) or xclip (X11) on the other systems.
+func runClipboard(write bool, path string) error {
+	var (
+		cmd *exec.Cmd
+		// file is connected to the standard input or output of the command.
+		file string
+	)
+	switch runtime.GOOS {
+	case "darwin":
+		if write {
+			cmd = exec.Command("osascript", "-e", fmt.Sprintf("set the clipboard to (read (POSIX file %q) as «class PNGf»)", path))
+		} else {
+			cmd = exec.Command("osascript",
+				"-e", fmt.Sprintf("set f to open for access (POSIX file %q) with write permission", path),
+				"-e", "write (the clipboard as «class PNGf») to f",
+				"-e", "close access f")
+		}
+	case "windows":
+		quoted := "'" + strings.Replace(path, "'", "''", -1) + "'"
+		script := "Add-Type -AssemblyName System.Windows.Forms,System.Drawing\n"
+		if write {
+			script += "[System.Windows.Forms.Clipboard]::SetImage([System.Drawing.Image]::FromFile(" + quoted + "))"
+		} else {
+			script += "$img = [System.Windows.Forms.Clipboard]::GetImage()\nif ($img -eq $null) { exit 1 }\n" +
+				"$img.Save(" + quoted + ", [System.Drawing.Imaging.ImageFormat]::Png)"
+		}
+		cmd = exec.Command("powershell", "-STA", "-NoProfile", "-NonInteractive", "-Command", script)
+	default:
+		file = path
+		_, errWayland := exec.LookPath("wl-copy")
+		_, errX11 := exec.LookPath("xclip")
+		switch {
+		case os.Getenv("WAYLAND_DISPLAY") != "" && errWayland == nil && write:
+			cmd = exec.Command("wl-copy", "--type", "image/png")
+		case os.Getenv("WAYLAND_DISPLAY") != "" && errWayland == nil:
+			cmd = exec.Command("wl-paste", "--no-newline", "--type", "image/png")
+		case errX11 == nil && write:
+			cmd = exec.Command("xclip", "-selection", "clipboard", "-t", "image/png", "-i")
+		case errX11 == nil:
+			cmd = exec.Command("xclip", "-selection", "clipboard", "-t", "image/png", "-o")
+		default:
+			return errors.New("the clipboard access requires wl-clipboard or xclip")
+		}
+	}
+
+	if file != "" {
+		if write {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			cmd.Stdin = f
+		} else {
+			f, err := os.Create(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			cmd.Stdout = f
+		}
+	}
+	// xclip and wl-copy stay in the background serving the clipboard, holding the
+	// inherited descriptors, so their error output isn't captured through a pipe.
+	var stderr bytes.Buffer
+	if !write || file == "" {
+		cmd.Stderr = &stderr
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// envPrefix is the prefix of the environment variables mapped to the command line flags.
+const envPrefix = "FACEMASK_"
+
+// defaultConfigFile is the configuration file looked up in the user's home directory
+// when no explicit config file has been provided.
+const defaultConfigFile = ".facemask.yaml"
+
+// config holds the named profiles defined in the configuration file.
+// A profile is a set of flag name and value pairs, so every command line flag
+// can be part of a profile without having to be declared twice.
+type config struct {
+	profile  string
+	profiles map[string]map[string]string
+}
+
+// parseFlags parses the command line arguments, then fills in the flags which were not
+// provided explicitly. The settings precedence is: command line flags, FACEMASK_*
+// environment variables, configuration profile and finally the flag defaults.
+// It returns the name of the applied profile.
+func parseFlags(fs *flag.FlagSet, args []string) string {
+	configFile, profile := configFlags(fs)
+	fs.Parse(args)
+
+	if err := applyEnv(fs); err != nil {
+		log.Fatalf("Error reading the environment variables: %v", err)
+	}
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Error loading the configuration file: %v", err)
+	}
+	name, err := cfg.apply(fs, *profile)
+	if err != nil {
+		log.Fatalf("Error applying the configuration profile: %v", err)
+	}
+	return name
+}
+
+// loadConfig reads the configuration file. In case the path is empty it falls back
+// to ~/.facemask.yaml, which is allowed to be missing.
+func loadConfig(path string) (*config, error) {
+	optional := false
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return &config{}, nil
+		}
+		path = filepath.Join(home, defaultConfigFile)
+		optional = true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if optional && os.IsNotExist(err) {
+			return &config{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg, err := parseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// parseConfig parses the subset of YAML used by the configuration file:
+//
+//	profile: party
+//	profiles:
+//	  party:
+//	    mask: assets/party.png
+//	    min: 40
+//
+// Only scalar values, comments and block mappings are supported.
+func parseConfig(r io.Reader) (*config, error) {
+	cfg := &config{profiles: make(map[string]map[string]string)}
+	scanner := bufio.NewScanner(r)
+
+	var (
+		section       string
+		profile       string
+		profileIndent int
+		line          int
+	)
+	for scanner.Scan() {
+		line++
+		text := stripComment(scanner.Text())
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		indent := len(text) - len(strings.TrimLeft(text, " "))
+		key, value, ok := splitKeyValue(text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value pair", line)
+		}
+
+		switch {
+		case indent == 0:
+			section, profile = key, ""
+			switch key {
+			case "profile":
+				cfg.profile = value
+			case "profiles":
+				if value != "" {
+					return nil, fmt.Errorf("line %d: profiles must be a mapping", line)
+				}
+			default:
+				return nil, fmt.Errorf("line %d: unknown key %q", line, key)
+			}
+		case section == "profiles" && (profile == "" || indent <= profileIndent):
+			if value != "" {
+				return nil, fmt.Errorf("line %d: profile %q must be a mapping", line, key)
+			}
+			profile, profileIndent = key, indent
+			cfg.profiles[profile] = make(map[string]string)
+		case profile != "":
+			cfg.profiles[profile][key] = value
+		default:
+			return nil, fmt.Errorf("line %d: unexpected indentation", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// apply sets the flags defined by the named profile, or by the default profile of the file
+// in case the name is empty, and returns the applied profile name. Flags provided explicitly
+// on the command line or through environment variables take precedence over the profile values.
+func (c *config) apply(fs *flag.FlagSet, name string) (string, error) {
+	if name == "" {
+		name = c.profile
+	}
+	if name == "" {
+		return "", nil
+	}
+	values, ok := c.profiles[name]
+	if !ok {
+		return "", fmt.Errorf("profile %q not found", name)
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	var known map[string]bool
+	for key, value := range values {
+		// A profile is shared by all the commands, so the options of the other commands
+		// are skipped and only the options of none of them are reported.
+		if fs.Lookup(key) == nil {
+			if known == nil {
+				known = knownOptions()
+			}
+			if !known[key] {
+				return "", fmt.Errorf("profile %q: unknown option %q", name, key)
+			}
+			continue
+		}
+		if explicit[key] {
+			continue
+		}
+		if err := fs.Set(key, value); err != nil {
+			return "", fmt.Errorf("profile %q: invalid value for %q: %v", name, key, err)
+		}
+	}
+	return name, nil
+}
+
+// configFlags defines the flags of the configuration file and of its profile, which are
+// shared by all the commands.
+func configFlags(fs *flag.FlagSet) (configFile, profile *string) {
+	configFile = fs.String("config", "", "Configuration file (default ~/.facemask.yaml)")
+	profile = fs.String("profile", "", "Configuration profile name")
+	return configFile, profile
+}
+
+// knownOptions returns the names of the flags of all the commands, defined over scratch
+// flag sets.
+func knownOptions() map[string]bool {
+	known := make(map[string]bool)
+	for _, define := range []func(fs *flag.FlagSet){
+		func(fs *flag.FlagSet) { maskFlags(fs) },
+		func(fs *flag.FlagSet) { checkFlags(fs) },
+		func(fs *flag.FlagSet) { evalFlags(fs) },
+		func(fs *flag.FlagSet) { queueFlags(fs) },
+		func(fs *flag.FlagSet) { restyleFlags(fs) },
+		func(fs *flag.FlagSet) { selftestFlags(fs) },
+		func(fs *flag.FlagSet) { serveFlags(fs) },
+		func(fs *flag.FlagSet) { tuneFlags(fs) },
+		func(fs *flag.FlagSet) { workerFlags(fs) },
+		func(fs *flag.FlagSet) { configFlags(fs) },
+	} {
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		define(fs)
+		fs.VisitAll(func(f *flag.Flag) {
+			known[f.Name] = true
+		})
+	}
+	return known
+}
+
+// applyEnv sets the flags which have a corresponding FACEMASK_* environment variable,
+// e.g. FACEMASK_MIN for -min or FACEMASK_FLPDIR for -flpdir. Flags provided
+// explicitly on the command line take precedence over the environment.
+func applyEnv(fs *flag.FlagSet) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] {
+			return
+		}
+		name := envName(f.Name)
+		if value, ok := os.LookupEnv(name); ok {
+			if e := fs.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("invalid value for %s: %v", name, e)
+			}
+		}
+	})
+	return err
+}
+
+// envName returns the environment variable name corresponding to a flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// stripComment removes the trailing comment from a line, ignoring the # signs
+// which are part of a quoted string.
+func stripComment(s string) string {
+	var quote rune
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return strings.TrimRight(s[:i], " \t")
+		}
+	}
+	return strings.TrimRight(s, " \t")
+}
+
+// splitKeyValue splits a "key: value" line and unquotes the value.
+func splitKeyValue(s string) (string, string, bool) {
+	idx := strings.Index(s, ":")
+	if idx < 0 {
+		return "", "", false
+	}
+	key := strings.TrimSpace(s[:idx])
+	value := strings.TrimSpace(s[idx+1:])
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	return key, value, key != ""
+}
@@ -0,0 +1,41 @@
+package facemask
+
+import "image"
+
+// mergeAlpha composes the result of the source image with transparency, e.g. a cut-out
+// portrait. The drawing context stores the premultiplied 8 bit colors, which lose the
+// precision of the translucent pixels, so the pixels left untouched by the overlays, i.e.
+// still equal to the premultiplied copy of the source, keep their original values, while
+// the overlay pixels are converted back to non-premultiplied colors.
+func mergeAlpha(base *image.NRGBA, rendered *image.RGBA) *image.NRGBA {
+	b := rendered.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			si := base.PixOffset(x, y)
+			ri := rendered.PixOffset(b.Min.X+x, b.Min.Y+y)
+			di := dst.PixOffset(x, y)
+			s, r := base.Pix[si:si+4], rendered.Pix[ri:ri+4]
+			if premultiply(s[0], s[3]) == r[0] && premultiply(s[1], s[3]) == r[1] &&
+				premultiply(s[2], s[3]) == r[2] && s[3] == r[3] {
+				copy(dst.Pix[di:di+4], s)
+				continue
+			}
+			a := uint32(r[3])
+			if a == 0 {
+				continue
+			}
+			dst.Pix[di+0] = uint8(uint32(r[0]) * 0xff / a)
+			dst.Pix[di+1] = uint8(uint32(r[1]) * 0xff / a)
+			dst.Pix[di+2] = uint8(uint32(r[2]) * 0xff / a)
+			dst.Pix[di+3] = r[3]
+		}
+	}
+	return dst
+}
+
+// premultiply returns the color channel multiplied by the alpha, rounded the same
+// way as image/draw does when it draws the NRGBA images onto the RGBA ones.
+func premultiply(c, a uint8) uint8 {
+	return uint8(uint32(c) * (uint32(a) * 0x101) / 0xff >> 8)
+}
@@ -0,0 +1,128 @@
+package facemask
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/fogleman/gg"
+)
+
+// The named anchor regions of the face.
+const (
+	AnchorForehead = "forehead"
+	AnchorEyes     = "eyes"
+	AnchorNose     = "nose"
+	AnchorMouth    = "mouth"
+	AnchorChin     = "chin"
+)
+
+// AnchorNames lists the named anchor regions from the top of the face to the bottom.
+var AnchorNames = []string{AnchorForehead, AnchorEyes, AnchorNose, AnchorMouth, AnchorChin}
+
+// isAnchor reports whether the name is one of the named anchor regions.
+func isAnchor(name string) bool {
+	for _, a := range AnchorNames {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Anchor is a canonical region of the face, on which the overlays are placed. Rect is the
+// region of the upright face centered at Center, which follows the head rotated by Angle
+// degrees counterclockwise, the same way as the mask transform.
+type Anchor struct {
+	Center image.Point     `json:"center"`
+	Rect   image.Rectangle `json:"rect"`
+	Angle  float64         `json:"angle"`
+}
+
+// Anchor computes the named anchor region of the face from its landmark points. The regions
+// are sized relative to the interpupillary distance; the missing points are estimated from
+// the pupils, which in turn fall back to their typical position in the face box.
+func (face FaceInfo) Anchor(name string) (Anchor, error) {
+	lx, ly, rx, ry := eyePoints(face)
+	ipd := math.Max(1, math.Hypot(rx-lx, ry-ly))
+	theta := math.Atan2(ry-ly, rx-lx)
+	// The vertical axis of the face, pointing down from the eyes towards the chin.
+	vx, vy := -math.Sin(theta), math.Cos(theta)
+	ex, ey := (lx+rx)/2, (ly+ry)/2
+	along := func(d float64) (float64, float64) {
+		return ex + vx*d*ipd, ey + vy*d*ipd
+	}
+	// dist is the distance of the point from the eyes along the vertical axis, in ipd units.
+	dist := func(x, y float64) float64 {
+		return ((x-ex)*vx + (y-ey)*vy) / ipd
+	}
+
+	var cx, cy, w, h float64
+	switch name {
+	case AnchorForehead:
+		// Over the eyebrows, which are estimated when they weren't localized.
+		bx, by := along(-0.35)
+		l, lok := face.Landmarks["left_eyebrow_middle"]
+		r, rok := face.Landmarks["right_eyebrow_middle"]
+		if lok && rok && validPoint(l) && validPoint(r) {
+			bx, by = along(math.Min(dist(float64(l.Col+r.Col)/2, float64(l.Row+r.Row)/2), -0.1))
+		}
+		cx, cy = bx-vx*0.4*ipd, by-vy*0.4*ipd
+		w, h = 2*ipd, 0.7*ipd
+	case AnchorEyes:
+		cx, cy = ex, ey
+		w, h = 2*ipd, 0.6*ipd
+	case AnchorNose:
+		d := 0.65
+		if p, ok := face.Landmarks["nose_tip"]; ok && validPoint(p) {
+			d = math.Max(dist(float64(p.Col), float64(p.Row)), 0.3)
+		}
+		cx, cy = along(d * 0.55)
+		w, h = 0.6*ipd, d*1.1*ipd
+	case AnchorMouth:
+		mx, my, mw := face.mouth(along)
+		cx, cy = mx, my
+		w, h = 1.4*mw, 0.7*mw
+	case AnchorChin:
+		mx, my, _ := face.mouth(along)
+		chx, chy := along(1.6)
+		if x, y, ok := estimateChin(face); ok {
+			chx, chy = x, y
+		}
+		d := math.Max(dist(chx, chy)-dist(mx, my), 0.2)
+		cx, cy = mx+vx*d*0.65*ipd, my+vy*d*0.65*ipd
+		w, h = ipd, d*0.8*ipd
+	default:
+		return Anchor{}, fmt.Errorf("unknown anchor %q (available: %v)", name, AnchorNames)
+	}
+
+	center := image.Pt(int(math.Round(cx)), int(math.Round(cy)))
+	min := image.Pt(int(math.Round(cx-w/2)), int(math.Round(cy-h/2)))
+	return Anchor{
+		Center: center,
+		Rect:   image.Rectangle{Min: min, Max: min.Add(image.Pt(int(math.Round(w)), int(math.Round(h))))},
+		Angle:  -gg.Degrees(theta),
+	}, nil
+}
+
+// Anchors computes all the named anchor regions of the face.
+func (face FaceInfo) Anchors() map[string]Anchor {
+	anchors := make(map[string]Anchor, len(AnchorNames))
+	for _, name := range AnchorNames {
+		anchors[name], _ = face.Anchor(name)
+	}
+	return anchors
+}
+
+// mouth returns the center and the width of the mouth, estimated below
+// the eyes when the mouth corners weren't localized.
+func (face FaceInfo) mouth(along func(d float64) (float64, float64)) (x, y, width float64) {
+	ml, mr := face.MouthLeft, face.MouthRight
+	if !validPoint(ml) || !validPoint(mr) {
+		lx, ly, rx, ry := eyePoints(face)
+		x, y = along(1.1)
+		return x, y, 0.9 * math.Hypot(rx-lx, ry-ly)
+	}
+	x, y = float64(ml.Col+mr.Col)/2, float64(ml.Row+mr.Row)/2
+	return x, y, math.Max(1, math.Hypot(float64(mr.Col-ml.Col), float64(mr.Row-ml.Row)))
+}
@@ -0,0 +1,67 @@
+package facemask
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"sync"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// Backend is implemented by the alternative face detection backends.
+// The returned detections should follow the Pigo conventions: the row and the column
+// of the face center, the face size and a detection score comparable with the Pigo score,
+// so the pupil localization and the compositing can consume them unchanged.
+// The backends holding native resources also implement io.Closer; they are opened once
+// per detector and its clones, and closed by Detector.Close.
+type Backend interface {
+	Detect(img image.Image) ([]pigo.Detection, error)
+}
+
+// BackendOpener creates a backend from the provided model file.
+type BackendOpener func(model string) (Backend, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]BackendOpener)
+)
+
+// RegisterBackend makes a face detection backend available under the provided name.
+// The backends requiring external libraries register themselves only when
+// they are enabled through build tags.
+func RegisterBackend(name string, open BackendOpener) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if open == nil {
+		panic("facemask: RegisterBackend opener is nil")
+	}
+	backends[name] = open
+}
+
+// OpenBackend opens the backend registered under the provided name.
+func OpenBackend(name, model string) (Backend, error) {
+	backendsMu.RLock()
+	open, ok := backends[name]
+	backendsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown detection backend %q (available: %v)", name, Backends())
+	}
+	return open(model)
+}
+
+// Backends returns the sorted list of the available detection backends.
+// The default Pigo cascade detector is always available.
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	names := []string{"pigo"}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
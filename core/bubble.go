@@ -0,0 +1,102 @@
+package facemask
+
+import (
+	"math"
+	"strings"
+
+	"github.com/fogleman/gg"
+)
+
+// DefaultBubbleText is the text of the speech bubbles of the bubble mode.
+const DefaultBubbleText = "Wear a mask!"
+
+// BubbleRenderer draws a speech bubble beside the face, pointing to the mouth. The font
+// size follows the face size and it's reduced until the wrapped text fits in the bubble.
+type BubbleRenderer struct {
+	Text string
+}
+
+// Render implements the Renderer interface.
+func (br *BubbleRenderer) Render(ctx *gg.Context, face FaceInfo) error {
+	text := strings.TrimSpace(br.Text)
+	if text == "" {
+		return nil
+	}
+	s := float64(face.Scale)
+	// The bubble of the large faces is limited to a part of the image.
+	width := math.Min(s, float64(ctx.Width())*0.4)
+	pad := width * 0.08
+
+	ctx.Push()
+	defer ctx.Pop()
+
+	var lines []string
+	for size := width / 5; ; size *= 0.9 {
+		f, err := goFontFace(math.Max(size, 6))
+		if err != nil {
+			return err
+		}
+		ctx.SetFontFace(f)
+		lines = ctx.WordWrap(text, width-2*pad)
+		if size <= 6 || float64(len(lines))*ctx.FontHeight()*1.4 <= width*0.6 && fitsWidth(ctx, lines, width-2*pad) {
+			break
+		}
+	}
+	height := float64(len(lines))*ctx.FontHeight()*1.4 + 2*pad
+
+	// The bubble is placed over the top right corner of the face, or the top left one
+	// when it doesn't fit into the image on the right. It's kept inside the image.
+	gap := s * 0.15
+	x := float64(face.Col) + s/2 + gap
+	tipX := float64(face.Col) + s*0.25
+	if x+width > float64(ctx.Width()) {
+		x = float64(face.Col) - s/2 - gap - width
+		tipX = float64(face.Col) - s*0.25
+	}
+	x = clamp(x, 1, math.Max(1, float64(ctx.Width())-width-1))
+	y := clamp(float64(face.Row)-s/2-height*0.3, 1, math.Max(1, float64(ctx.Height())-height-1))
+	tipY := float64(face.Row) + s*0.2
+	if validPoint(face.MouthLeft) && validPoint(face.MouthRight) {
+		tipY = float64(face.MouthLeft.Row+face.MouthRight.Row) / 2
+	}
+
+	// The outline of the bubble and its tail is a single path, the tail leaving
+	// the bottom of the bubble on its side facing the face.
+	baseX := x + width*0.2
+	if tipX > x {
+		baseX = x + width*0.8
+	}
+	r := pad * 1.5
+	ctx.MoveTo(x+r, y)
+	ctx.LineTo(x+width-r, y)
+	ctx.DrawArc(x+width-r, y+r, r, -math.Pi/2, 0)
+	ctx.LineTo(x+width, y+height-r)
+	ctx.DrawArc(x+width-r, y+height-r, r, 0, math.Pi/2)
+	ctx.LineTo(baseX+pad, y+height)
+	ctx.LineTo(tipX, tipY)
+	ctx.LineTo(baseX-pad, y+height)
+	ctx.LineTo(x+r, y+height)
+	ctx.DrawArc(x+r, y+height-r, r, math.Pi/2, math.Pi)
+	ctx.LineTo(x, y+r)
+	ctx.DrawArc(x+r, y+r, r, math.Pi, 3*math.Pi/2)
+	ctx.ClosePath()
+	ctx.SetRGB(1, 1, 1)
+	ctx.FillPreserve()
+	ctx.SetRGB(0, 0, 0)
+	ctx.SetLineWidth(math.Max(1, s*0.015))
+	ctx.Stroke()
+
+	ctx.DrawStringWrapped(strings.Join(lines, "\n"), x+width/2, y+height/2, 0.5, 0.5, width-2*pad, 1.4, gg.AlignCenter)
+	return nil
+}
+
+// fitsWidth reports whether all the lines fit into the width, since the words longer
+// than the width are not broken by the word wrapping.
+func fitsWidth(ctx *gg.Context, lines []string, width float64) bool {
+	for _, line := range lines {
+		if w, _ := ctx.MeasureString(line); w > width {
+			return false
+		}
+	}
+	return true
+}
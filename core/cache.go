@@ -0,0 +1,167 @@
+package facemask
+
+import (
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// cascadeCache holds the unpacked cascades, which are read-only once unpacked,
+// so it can be shared by the detectors running concurrently.
+type cascadeCache struct {
+	mu          sync.Mutex
+	classifiers map[string]*pigo.Pigo
+	puploc      string
+	flploc      string
+	plc         *puplocCascade
+	flpcs       map[string]*puplocCascade
+	// backends are the opened detection backends by name and model. They are released by Close.
+	backends map[backendKey]Backend
+}
+
+// backendKey identifies an opened detection backend.
+type backendKey struct {
+	name, model string
+}
+
+// imageCache holds the decoded source image with its preprocessed grayscale pixels,
+// which are reused by the subsequent detections over the same image. This way the
+// multi-pass modes, like the parameter tuning running the detection over the same
+// image many times, don't pay their cost repeatedly.
+type imageCache struct {
+	source     string
+	maxDim     int
+	modTime    time.Time
+	preprocess string
+	image      *image.NRGBA
+	pixels     []uint8
+	// profile is the embedded ICC color profile of the image.
+	profile []byte
+	// deep is the decoded high bit depth image, nil for the 8 bit images.
+	deep image.Image
+}
+
+// loadImage returns the decoded source image and its preprocessed grayscale pixels,
+// reusing them when the same unchanged image has been processed with the same preprocessing.
+// The returned pixels must not be modified.
+func (c *imageCache) load(source string, maxDim int, spec string) (*image.NRGBA, []uint8, error) {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.image != nil && c.source == source && c.maxDim == maxDim && c.modTime.Equal(fi.ModTime()) {
+		if c.preprocess == spec {
+			return c.image, c.pixels, nil
+		}
+	} else {
+		c.image, c.deep, err = decodeImage(source, maxDim)
+		if err != nil {
+			c.image = nil
+			return nil, nil, err
+		}
+		c.source, c.maxDim, c.modTime = source, maxDim, fi.ModTime()
+		c.profile = readICCFile(source)
+	}
+
+	pixels := pigo.RgbToGrayscale(c.image)
+	cols, rows := c.image.Bounds().Max.X, c.image.Bounds().Max.Y
+	if err := preprocess(pixels, cols, rows, spec); err != nil {
+		c.preprocess, c.pixels = "", nil
+		c.image = nil
+		return nil, nil, err
+	}
+	c.preprocess, c.pixels = spec, pixels
+	return c.image, c.pixels, nil
+}
+
+// loadClassifier returns the unpacked face cascade.
+func (c *cascadeCache) loadClassifier(path string) (*pigo.Pigo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if classifier, ok := c.classifiers[path]; ok {
+		return classifier, nil
+	}
+	faceCascade, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := pigo.NewPigo()
+	// Unpack the binary file. This will return the number of cascade trees,
+	// the tree depth, the threshold and the prediction from tree's leaf nodes.
+	classifier, err := p.Unpack(faceCascade)
+	if err != nil {
+		return nil, err
+	}
+	if c.classifiers == nil {
+		c.classifiers = make(map[string]*pigo.Pigo)
+	}
+	c.classifiers[path] = classifier
+	return classifier, nil
+}
+
+// loadBackend returns the detection backend of the name and the model, opening it on the
+// first use. The backends run the detections one at a time, so they are shared by the
+// detectors running concurrently too.
+func (c *cascadeCache) loadBackend(name, model string) (Backend, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := backendKey{name, model}
+	if backend, ok := c.backends[key]; ok {
+		return backend, nil
+	}
+	backend, err := OpenBackend(name, model)
+	if err != nil {
+		return nil, err
+	}
+	if c.backends == nil {
+		c.backends = make(map[backendKey]Backend)
+	}
+	c.backends[key] = backend
+	return backend, nil
+}
+
+// close releases the opened detection backends implementing io.Closer.
+func (c *cascadeCache) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var first error
+	for key, backend := range c.backends {
+		if closer, ok := backend.(io.Closer); ok {
+			if err := closer.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+		delete(c.backends, key)
+	}
+	return first
+}
+
+// loadLocalizers returns the unpacked pupil and facial landmark point cascades.
+func (c *cascadeCache) loadLocalizers(eyesPath, flpDir string) (*puplocCascade, map[string]*puplocCascade, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.plc != nil && c.puploc == eyesPath && c.flploc == flpDir {
+		return c.plc, c.flpcs, nil
+	}
+	eyes, err := readPuploc(eyesPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	landmarks, err := readLandmarkCascades(flpDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.plc, c.flpcs = eyes, landmarks
+	c.puploc, c.flploc = eyesPath, flpDir
+	return eyes, landmarks, nil
+}
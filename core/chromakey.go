@@ -0,0 +1,58 @@
+package facemask
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// DefaultKeyTolerance is the default color distance of the keyed out pixels.
+const DefaultKeyTolerance = 20
+
+// ChromaKey knocks out the solid background of the mask assets without an alpha channel,
+// common for the downloaded clip art.
+type ChromaKey struct {
+	Color color.Color
+	// Tolerance is the largest distance from the key color, in 8 bit RGB units, of the
+	// pixels made fully transparent. The pixels up to twice as far are faded out, which
+	// removes the fringe left by the antialiasing of the background edge.
+	Tolerance float64
+}
+
+// NewChromaKey returns the chroma key of the color in the #rgb or #rrggbb notation.
+func NewChromaKey(hexColor string, tolerance float64) (*ChromaKey, error) {
+	c, err := parseHexColor(hexColor)
+	if err != nil {
+		return nil, err
+	}
+	if tolerance < 0 {
+		return nil, fmt.Errorf("invalid key tolerance: %v", tolerance)
+	}
+	return &ChromaKey{Color: c, Tolerance: tolerance}, nil
+}
+
+// Apply returns a copy of the image with the pixels close to the key color made transparent.
+func (k *ChromaKey) Apply(img image.Image) *image.NRGBA {
+	dst := imaging.Clone(img)
+	kr, kg, kb, _ := k.Color.RGBA()
+	fr, fg, fb := float64(kr>>8), float64(kg>>8), float64(kb>>8)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		d := math.Sqrt(sq(float64(dst.Pix[i])-fr) + sq(float64(dst.Pix[i+1])-fg) + sq(float64(dst.Pix[i+2])-fb))
+		if d >= 2*k.Tolerance {
+			continue
+		}
+		var a float64
+		if d > k.Tolerance {
+			a = (d - k.Tolerance) / k.Tolerance
+		}
+		dst.Pix[i+3] = uint8(float64(dst.Pix[i+3]) * a)
+	}
+	return dst
+}
+
+func sq(v float64) float64 {
+	return v * v
+}
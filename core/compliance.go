@@ -0,0 +1,163 @@
+package facemask
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+
+	"github.com/disintegration/imaging"
+	pigo "github.com/esimov/pigo/core"
+	"github.com/fogleman/gg"
+)
+
+// MaskClassifier decides whether a detected face already wears a real mask.
+// Besides the decision it returns the classification score, which is
+// specific to the classifier implementation.
+type MaskClassifier interface {
+	Masked(img image.Image, face FaceInfo) (bool, float64, error)
+}
+
+// ColorClassifier is a heuristic mask classifier comparing the ratio of the skin colored
+// pixels of the forehead with the ratio of the skin colored pixels around the mouth.
+// A real mask covers the lower part of the face, so the two ratios diverge.
+type ColorClassifier struct {
+	// Threshold is the minimum score (between 0 and 1) above which the face is considered masked.
+	Threshold float64
+}
+
+// Masked implements the MaskClassifier interface.
+func (cc *ColorClassifier) Masked(img image.Image, face FaceInfo) (bool, float64, error) {
+	s := float64(face.Scale)
+	region := func(x0, y0, x1, y1 float64) image.Rectangle {
+		return image.Rect(
+			face.Col+int(x0*s), face.Row+int(y0*s),
+			face.Col+int(x1*s), face.Row+int(y1*s),
+		)
+	}
+	forehead := skinRatio(img, region(-0.15, -0.3, 0.15, -0.18))
+	mouth := skinRatio(img, region(-0.18, 0.12, 0.18, 0.3))
+
+	// The forehead might be covered by hair or a hat, in which case
+	// the mouth region is compared with a fixed reference ratio.
+	score := 1 - mouth/math.Max(forehead, 0.3)
+	score = math.Max(0, math.Min(1, score))
+
+	return score > cc.Threshold, score, nil
+}
+
+// CascadeClassifier uses a Pigo cascade trained on masked faces as mask classifier.
+// The face is considered masked when the cascade detects a face of similar size
+// within the face region with a detection score above the threshold.
+type CascadeClassifier struct {
+	Threshold  float32
+	classifier *pigo.Pigo
+}
+
+// NewCascadeClassifier loads the Pigo cascade trained on masked faces.
+func NewCascadeClassifier(cascade string, threshold float32) (*CascadeClassifier, error) {
+	data, err := ioutil.ReadFile(cascade)
+	if err != nil {
+		return nil, err
+	}
+	classifier, err := pigo.NewPigo().Unpack(data)
+	if err != nil {
+		return nil, err
+	}
+	return &CascadeClassifier{Threshold: threshold, classifier: classifier}, nil
+}
+
+// Masked implements the MaskClassifier interface.
+func (cc *CascadeClassifier) Masked(img image.Image, face FaceInfo) (bool, float64, error) {
+	r := int(float64(face.Scale) * 0.6)
+	rect := image.Rect(face.Col-r, face.Row-r, face.Col+r, face.Row+r).Intersect(img.Bounds())
+	if rect.Empty() {
+		return false, 0, nil
+	}
+	crop := imaging.Crop(img, rect)
+	cols, rows := crop.Bounds().Dx(), crop.Bounds().Dy()
+
+	dets := cc.classifier.RunCascade(pigo.CascadeParams{
+		MinSize:     int(float64(face.Scale) * 0.7),
+		MaxSize:     int(float64(face.Scale) * 1.2),
+		ShiftFactor: 0.1,
+		ScaleFactor: 1.1,
+		ImageParams: pigo.ImageParams{
+			Pixels: pigo.RgbToGrayscale(crop),
+			Rows:   rows,
+			Cols:   cols,
+			Dim:    cols,
+		},
+	}, 0.0)
+
+	var score float32
+	for _, det := range dets {
+		if det.Q > score {
+			score = det.Q
+		}
+	}
+	return score > cc.Threshold, float64(score), nil
+}
+
+// ComplianceRenderer annotates the faces with their mask wearing status:
+// the masked faces are marked with a green rectangle, the others with a red one.
+// It also counts the masked and unmasked faces.
+type ComplianceRenderer struct {
+	Classifier MaskClassifier
+	Masked     int
+	Unmasked   int
+}
+
+// Render implements the Renderer interface.
+func (cr *ComplianceRenderer) Render(ctx *gg.Context, face FaceInfo) error {
+	masked, _, err := cr.Classifier.Masked(ctx.Image(), face)
+	if err != nil {
+		return err
+	}
+	c := color.RGBA{R: 255, A: 255}
+	if masked {
+		c = color.RGBA{G: 255, A: 255}
+		cr.Masked++
+	} else {
+		cr.Unmasked++
+	}
+	half := float64(face.Scale) / 2
+	ctx.DrawRectangle(float64(face.Col)-half, float64(face.Row)-half, float64(face.Scale), float64(face.Scale))
+	ctx.SetLineWidth(math.Max(2, float64(face.Scale)*0.02))
+	ctx.SetStrokeStyle(gg.NewSolidPattern(c))
+	ctx.Stroke()
+
+	return nil
+}
+
+// SkipMasked wraps the renderer so the faces classified as already wearing
+// a mask are left untouched, avoiding the double overlays in mixed crowds.
+func SkipMasked(r Renderer, c MaskClassifier) Renderer {
+	return RendererFunc(func(ctx *gg.Context, face FaceInfo) error {
+		masked, _, err := c.Masked(ctx.Image(), face)
+		if err != nil {
+			return err
+		}
+		if masked {
+			return nil
+		}
+		return r.Render(ctx, face)
+	})
+}
+
+// skinRatio returns the ratio of the skin colored pixels within the region.
+func skinRatio(img image.Image, rect image.Rectangle) float64 {
+	rect = rect.Intersect(img.Bounds())
+	if rect.Empty() {
+		return 0
+	}
+	var skin int
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			if isSkin(img.At(x, y)) {
+				skin++
+			}
+		}
+	}
+	return float64(skin) / float64(rect.Dx()*rect.Dy())
+}
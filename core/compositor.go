@@ -0,0 +1,83 @@
+package facemask
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/fogleman/gg"
+)
+
+// Compositor draws the mask images over the image of the drawing context: the mask is
+// resized to the size of the transform rectangle, rotated by its angle and alpha blended
+// with the top left corner of its rotated bounds at the top left corner of the rectangle.
+type Compositor interface {
+	Composite(ctx *gg.Context, mask image.Image, t MaskTransform) error
+}
+
+// CompositorOpener creates a compositor.
+type CompositorOpener func() (Compositor, error)
+
+var (
+	compositorsMu sync.RWMutex
+	compositors   = make(map[string]CompositorOpener)
+)
+
+// RegisterCompositor makes a compositor available under the provided name. The compositors
+// requiring external libraries register themselves only when they are enabled through build tags.
+func RegisterCompositor(name string, open CompositorOpener) {
+	compositorsMu.Lock()
+	defer compositorsMu.Unlock()
+
+	if open == nil {
+		panic("facemask: RegisterCompositor opener is nil")
+	}
+	compositors[name] = open
+}
+
+// OpenCompositor opens the compositor registered under the provided name.
+func OpenCompositor(name string) (Compositor, error) {
+	if name == "" || name == "cpu" {
+		return CPUCompositor{}, nil
+	}
+	compositorsMu.RLock()
+	open, ok := compositors[name]
+	compositorsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown compositor %q (available: %v)", name, Compositors())
+	}
+	return open()
+}
+
+// Compositors returns the sorted list of the available compositors.
+// The default CPU compositor is always available.
+func Compositors() []string {
+	compositorsMu.RLock()
+	defer compositorsMu.RUnlock()
+
+	names := []string{"cpu"}
+	for name := range compositors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CPUCompositor is the default compositor, resizing the masks with the Lanczos filter.
+type CPUCompositor struct{}
+
+// Composite implements the Compositor interface.
+func (CPUCompositor) Composite(ctx *gg.Context, mask image.Image, t MaskTransform) error {
+	if mask.Bounds().Size() != t.Rect.Size() {
+		mask = imaging.Resize(mask, t.Rect.Dx(), t.Rect.Dy(), imaging.Lanczos)
+	}
+	if t.Angle != 0 {
+		mask = imaging.Rotate(mask, t.Angle, color.Transparent)
+	}
+	ctx.DrawImage(mask, t.Rect.Min.X, t.Rect.Min.Y)
+	return nil
+}
@@ -0,0 +1,66 @@
+package facemask
+
+import (
+	"math/rand"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// confidenceTolerance is the distance between the two localizations of a point, relative
+// to the face size, at which the confidence of the point drops to zero.
+const confidenceTolerance = 0.08
+
+// The names of the pupils in the landmark confidences.
+const (
+	pointLeftEye  = "left_eye"
+	pointRightEye = "right_eye"
+)
+
+// localizeConfidence estimates the confidence of the localized pupils and landmark points.
+// The cascades return no score, but they localize the points as the median of randomly
+// perturbed runs: on a reliable fit the perturbed runs agree, while on an unreliable one
+// they scatter. So every point is localized a second time, and its confidence decreases
+// with the distance between the two runs.
+func (fd *Detector) localizeConfidence(face pigo.Detection, params pigo.ImageParams, leftEye, rightEye *pigo.Puploc, landmarks map[string]*pigo.Puploc, rnd *rand.Rand) map[string]float64 {
+	left, right := pupilStarts(face)
+	tolerance := confidenceTolerance * float64(face.Scale)
+	conf := map[string]float64{
+		pointLeftEye:  pointConfidence(leftEye, fd.plc.run(left, params, fd.Angle, false, rnd), tolerance),
+		pointRightEye: pointConfidence(rightEye, fd.plc.run(right, params, fd.Angle, false, rnd), tolerance),
+	}
+	if !validPoint(leftEye) || !validPoint(rightEye) {
+		for name := range landmarks {
+			conf[name] = 0
+		}
+		return conf
+	}
+	again := localizeLandmarks(fd.flpcs, fd.landmarks, leftEye, rightEye, params, localizePerturbs, rnd)
+	for name, p := range landmarks {
+		conf[name] = pointConfidence(p, again[name], tolerance)
+	}
+	return conf
+}
+
+// pointConfidence returns the confidence of the point localized as p and then as q.
+func pointConfidence(p, q *pigo.Puploc, tolerance float64) float64 {
+	if !validPoint(p) || !validPoint(q) || tolerance <= 0 {
+		return 0
+	}
+	return clamp(1-distance(p.Col, p.Row, q.Col, q.Row)/tolerance, 0, 1)
+}
+
+// landmarkQ returns the confidence of the landmark fit: the lowest confidence of the
+// pupils and the mouth corners, which the overlays are aligned to.
+func landmarkQ(conf map[string]float64) float64 {
+	q := 1.0
+	for _, name := range []string{pointLeftEye, pointRightEye, "mouth_left", "mouth_right"} {
+		c, ok := conf[name]
+		if !ok {
+			continue
+		}
+		if c < q {
+			q = c
+		}
+	}
+	return q
+}
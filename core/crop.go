@@ -0,0 +1,44 @@
+package facemask
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/fogleman/gg"
+)
+
+// facesBounds returns the bounding box of all the faces extended on each side by the margin
+// relative to the box size, limited to the image bounds. It's empty when there are no faces.
+func facesBounds(infos []FaceInfo, margin float64, bounds image.Rectangle) image.Rectangle {
+	var rect image.Rectangle
+	for _, face := range infos {
+		r := face.Scale / 2
+		rect = rect.Union(image.Rect(face.Col-r, face.Row-r, face.Col+r, face.Row+r))
+	}
+	if rect.Empty() {
+		return rect
+	}
+	dx := int(math.Round(float64(rect.Dx()) * margin))
+	dy := int(math.Round(float64(rect.Dy()) * margin))
+	return image.Rect(rect.Min.X-dx, rect.Min.Y-dy, rect.Max.X+dx, rect.Max.Y+dy).Intersect(bounds)
+}
+
+// cropTo crops the processed image, with its source copies, to the rectangle.
+func (fd *Detector) cropTo(rect image.Rectangle) {
+	size := image.Rect(0, 0, rect.Dx(), rect.Dy())
+	rgba := image.NewRGBA(size)
+	draw.Draw(rgba, size, fd.ctx.Image(), rect.Min, draw.Src)
+	fd.ctx = gg.NewContextForRGBA(rgba)
+
+	src := image.NewNRGBA(size)
+	draw.Draw(src, size, fd.src, rect.Min, draw.Src)
+	fd.src = src
+
+	// The 16 bit source keeps its coordinates, which mergeDeep maps to the cropped image.
+	if sub, ok := fd.deep.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		fd.deep = sub.SubImage(rect.Add(fd.deep.Bounds().Min))
+	}
+}
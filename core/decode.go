@@ -0,0 +1,190 @@
+package facemask
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/disintegration/imaging"
+	pigo "github.com/esimov/pigo/core"
+)
+
+// ErrMalformedImage is returned for the images crashing the decoders.
+var ErrMalformedImage = errors.New("malformed image")
+
+// decodeImage decodes the image file. In case maxDim is positive and the image is larger,
+// it's downscaled so its larger side doesn't exceed maxDim.
+//
+// The baseline JPEG images are reduced by a power of two factor while they are decoded, with
+// the DCT scaling of libjpeg, so a huge photo is never decoded at its full size; the standard
+// decoder doesn't support the scaling itself. The progressive ones are reduced straight from
+// the decoded YCbCr planes, without the full size RGBA copy.
+//
+// The high bit depth images are also returned as decoded, so their precision can be
+// preserved in the output. The second result is nil for the 8 bit and the downscaled images.
+// The JPEG images are turned upright by their Exif orientation.
+func decodeImage(path string, maxDim int) (*image.NRGBA, image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	return decodeReader(f, maxDim)
+}
+
+// decodeReader decodes the image read from f, downscaling it and turning it upright like decodeImage.
+// The panics of the decoders over the malformed images are returned as errors, so an untrusted
+// image can't crash the server or the workers.
+func decodeReader(f io.ReadSeeker, maxDim int) (img *image.NRGBA, deep image.Image, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			img, deep, err = nil, nil, fmt.Errorf("%w: %v", ErrMalformedImage, r)
+		}
+	}()
+	orientation := readOrientation(f)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	img, deep, err = decodeSized(f, maxDim)
+	if err != nil || orientation == 1 {
+		return img, deep, err
+	}
+	return orient(img, orientation), nil, nil
+}
+
+// decodeSized decodes the image read from f as it's stored, downscaling it like decodeImage.
+func decodeSized(f io.ReadSeeker, maxDim int) (*image.NRGBA, image.Image, error) {
+	if maxDim > 0 {
+		cfg, _, err := image.DecodeConfig(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		if cfg.Width > maxDim || cfg.Height > maxDim {
+			img, err := decodeScaled(f, cfg, maxDim)
+			return img, nil, err
+		}
+	}
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isDeep(src) {
+		return toNRGBA(src), src, nil
+	}
+	return toNRGBA(src), nil, nil
+}
+
+// decodeScaled decodes the image larger than maxDim, downscaling it.
+func decodeScaled(f io.Reader, cfg image.Config, maxDim int) (*image.NRGBA, error) {
+	factor := 1
+	for factor < 8 && maxInt(cfg.Width, cfg.Height)/(factor*2) >= maxDim {
+		factor *= 2
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if factor > 1 {
+		if img, err := decodeJPEGReduced(data, factor); err == nil {
+			if img.Bounds().Dx() <= maxDim && img.Bounds().Dy() <= maxDim {
+				return img, nil
+			}
+			return fitImage(img, maxDim), nil
+		}
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if ycc, ok := src.(*image.YCbCr); ok {
+		img := reduceYCbCr(ycc, factor)
+		if img.Bounds().Dx() <= maxDim && img.Bounds().Dy() <= maxDim {
+			return img, nil
+		}
+		src = img
+	}
+	return fitImage(src, maxDim), nil
+}
+
+// fitImage downscales the image so its larger side doesn't exceed maxDim.
+func fitImage(src image.Image, maxDim int) *image.NRGBA {
+	b := src.Bounds()
+	if maxDim <= 0 || (b.Dx() <= maxDim && b.Dy() <= maxDim) {
+		return toNRGBA(src)
+	}
+	return imaging.Fit(src, maxDim, maxDim, imaging.Linear)
+}
+
+// toNRGBA normalizes the color model of the decoded image to RGB. The grayscale scans and
+// the CMYK JPEG images of the print workflows, which the decoder returns already uninverted
+// in case of the Adobe ones, are converted explicitly; the other models are left to Pigo.
+func toNRGBA(src image.Image) *image.NRGBA {
+	b := src.Bounds()
+	switch src := src.(type) {
+	case *image.Gray:
+		dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				v := src.Pix[src.PixOffset(b.Min.X+x, b.Min.Y+y)]
+				off := dst.PixOffset(x, y)
+				dst.Pix[off], dst.Pix[off+1], dst.Pix[off+2], dst.Pix[off+3] = v, v, v, 255
+			}
+		}
+		return dst
+	case *image.CMYK:
+		dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				i := src.PixOffset(b.Min.X+x, b.Min.Y+y)
+				r, g, bl := color.CMYKToRGB(src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3])
+				off := dst.PixOffset(x, y)
+				dst.Pix[off], dst.Pix[off+1], dst.Pix[off+2], dst.Pix[off+3] = r, g, bl, 255
+			}
+		}
+		return dst
+	}
+	return pigo.ImgToNRGBA(src)
+}
+
+// reduceYCbCr converts the YCbCr image to RGB while shrinking it by the factor,
+// averaging the factor x factor pixel blocks.
+func reduceYCbCr(src *image.YCbCr, factor int) *image.NRGBA {
+	b := src.Bounds()
+	w, h := b.Dx()/factor, b.Dy()/factor
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	n := factor * factor
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var yy, cb, cr int
+			for dy := 0; dy < factor; dy++ {
+				for dx := 0; dx < factor; dx++ {
+					px, py := b.Min.X+x*factor+dx, b.Min.Y+y*factor+dy
+					yy += int(src.Y[src.YOffset(px, py)])
+					ci := src.COffset(px, py)
+					cb += int(src.Cb[ci])
+					cr += int(src.Cr[ci])
+				}
+			}
+			r, g, bl := color.YCbCrToRGB(uint8(yy/n), uint8(cb/n), uint8(cr/n))
+			off := dst.PixOffset(x, y)
+			dst.Pix[off], dst.Pix[off+1], dst.Pix[off+2], dst.Pix[off+3] = r, g, bl, 255
+		}
+	}
+	return dst
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,63 @@
+package facemask
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDecodeColorModels(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		// want are the colors of the 8x8 blocks of the image, left to right.
+		want []color.NRGBA
+	}{
+		{
+			name: "cmyk",
+			path: "testdata/cmyk.jpg",
+			want: []color.NRGBA{
+				{0, 255, 255, 255}, // cyan
+				{191, 95, 0, 255},  // orange with 25% black
+				{0, 0, 0, 255},     // black
+				{255, 255, 255, 255},
+			},
+		},
+		{
+			name: "gray",
+			path: "testdata/gray.jpg",
+			want: []color.NRGBA{
+				{0, 0, 0, 255},
+				{64, 64, 64, 255},
+				{160, 160, 160, 255},
+				{255, 255, 255, 255},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, deep, err := decodeImage(tt.path, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deep != nil {
+				t.Errorf("got a high bit depth copy of an 8 bit image")
+			}
+			if got, want := img.Bounds(), image.Rect(0, 0, 8*len(tt.want), 8); got != want {
+				t.Fatalf("bounds %v, want %v", got, want)
+			}
+			for i, want := range tt.want {
+				for _, p := range []image.Point{{8*i + 1, 1}, {8*i + 4, 4}, {8*i + 6, 6}} {
+					if got := img.NRGBAAt(p.X, p.Y); !colorNear(got, want, 1) {
+						t.Errorf("pixel %v is %v, want %v", p, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// colorNear reports whether the channels of the colors differ at most by tol.
+func colorNear(a, b color.NRGBA, tol int) bool {
+	return pixelDelta(a, b) <= tol
+}
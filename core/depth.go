@@ -0,0 +1,35 @@
+package facemask
+
+import (
+	"image"
+	"image/color"
+)
+
+// isDeep reports whether the image has more than 8 bits per channel.
+func isDeep(img image.Image) bool {
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+// mergeDeep composes the 16 bit result of the high bit depth source: the pixels left
+// untouched by the overlays, i.e. still equal to their 8 bit copy, keep the original
+// values, while the overlay pixels are expanded from the rendered 8 bit image.
+func mergeDeep(deep image.Image, base *image.NRGBA, rendered image.Image) *image.NRGBA64 {
+	b := deep.Bounds()
+	dst := image.NewNRGBA64(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r, g, bl, a := rendered.At(x, y).RGBA()
+			br, bg, bb, ba := base.NRGBAAt(x, y).RGBA()
+			if r>>8 == br>>8 && g>>8 == bg>>8 && bl>>8 == bb>>8 && a>>8 == ba>>8 {
+				dst.Set(x, y, color.NRGBA64Model.Convert(deep.At(b.Min.X+x, b.Min.Y+y)))
+				continue
+			}
+			dst.Set(x, y, color.NRGBA64Model.Convert(rendered.At(x, y)))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,179 @@
+package facemask
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DetectionCache stores the localized faces of the processed images in a directory, keyed
+// by the content hash of the images, so processing the same images again, e.g. with a
+// different mask or overlay mode, skips the detection entirely. Every image has a single
+// entry, holding the faces of its last detection together with the detection settings;
+// the entries detected with other settings are not reused, but replaced.
+type DetectionCache struct {
+	Dir string
+}
+
+// cacheEntry is the cached detection of an image.
+type cacheEntry struct {
+	Settings string `json:"settings"`
+	// MaxDim is the size limit of the detected image, which the face coordinates refer to.
+	MaxDim int        `json:"max_dim,omitempty"`
+	Faces  []FaceInfo `json:"faces"`
+}
+
+// NewDetectionCache returns the detection cache stored in the directory, creating it when it doesn't exist.
+func NewDetectionCache(dir string) (*DetectionCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DetectionCache{Dir: dir}, nil
+}
+
+// fileHash returns the SHA-256 hash of the file content.
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// path returns the path of the cache entry of the image content hash.
+func (c *DetectionCache) path(hash string) string {
+	return filepath.Join(c.Dir, hash+".json")
+}
+
+// load returns the cached entry of the image content hash.
+func (c *DetectionCache) load(hash string) (*cacheEntry, error) {
+	data, err := ioutil.ReadFile(c.path(hash))
+	if err != nil {
+		return nil, err
+	}
+	entry := new(cacheEntry)
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, fmt.Errorf("%s: %v", c.path(hash), err)
+	}
+	return entry, nil
+}
+
+// store writes the cache entry of the image content hash. The entry is written into
+// a temporary file first, so the concurrent readers never see a partial entry.
+func (c *DetectionCache) store(hash string, entry *cacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(c.Dir, hash+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(hash))
+}
+
+// settings describes the detector settings the localized faces depend on. The cascades
+// are identified by their paths, so the cache is not invalidated by retrained cascades.
+func (fd *Detector) settings() string {
+	return fmt.Sprintf("%q %q %q %q %q %d %d %g %g %g %g %q %g %q %d %g %d %g %t %t %g %g %g %q",
+		fd.FaceCascade, fd.EyesCascade, fd.FlplocDir, fd.Backend, fd.Model,
+		fd.MinSize, fd.MaxSize, fd.ShiftFactor, fd.ScaleFactor, fd.Angle, fd.IouThreshold,
+		fd.NMS, fd.NMSSigma, fd.Preprocess, fd.MaxDim, fd.DetectScale, fd.UpscaleBelow, fd.QThreshold,
+		fd.Mirror, fd.Confidence, fd.LandmarkQ, fd.MinIPD, fd.MaxIPD, fd.Landmarks)
+}
+
+// DetectCached detects the faces of the source image and localizes them, like DetectFaces
+// followed by LocalizeFaces, reusing the faces stored in the Cache when the same image has
+// been processed with the same settings. The cached faces are the ones kept by the
+// OnFaceDetected hook of the first detection. Without a cache it just detects the faces.
+func (fd *Detector) DetectCached(source string) ([]FaceInfo, error) {
+	if fd.Cache == nil {
+		faces, err := fd.DetectFaces(source)
+		if err != nil {
+			return nil, err
+		}
+		return fd.LocalizeFaces(faces), nil
+	}
+	hash, err := fileHash(source)
+	if err != nil {
+		return nil, err
+	}
+	settings := fd.settings()
+	if entry, err := fd.Cache.load(hash); err == nil && entry.Settings == settings {
+		if err := fd.LoadImage(source); err != nil {
+			return nil, err
+		}
+		return entry.Faces, nil
+	}
+	faces, err := fd.DetectFaces(source)
+	if err != nil {
+		return nil, err
+	}
+	infos := fd.LocalizeFaces(faces)
+	if err := fd.Cache.store(hash, &cacheEntry{Settings: settings, MaxDim: fd.MaxDim, Faces: infos}); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// ErrNotCached is returned by LoadCached for the images missing from the cache.
+var ErrNotCached = errors.New("image not in the detection cache")
+
+// LoadCached loads the source image and returns its faces stored in the Cache, whatever
+// settings they were detected with, without running the detection. The image is decoded
+// with the size limit it was detected with, so the faces match it. Since only the overlays
+// are rendered, restyling the already processed images costs the decoding and the encoding.
+func (fd *Detector) LoadCached(source string) ([]FaceInfo, error) {
+	if fd.Cache == nil {
+		return nil, ErrNotCached
+	}
+	hash, err := fileHash(source)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := fd.Cache.load(hash)
+	if os.IsNotExist(err) {
+		return nil, ErrNotCached
+	}
+	if err != nil {
+		return nil, err
+	}
+	fd.MaxDim = entry.MaxDim
+	if err := fd.LoadImage(source); err != nil {
+		return nil, err
+	}
+	return entry.Faces, nil
+}
+
+// LoadImage loads the source image into the detector without running the detection, so the
+// overlays can be rendered over the faces detected earlier, e.g. the cached ones.
+func (fd *Detector) LoadImage(source string) error {
+	src, pixels, err := fd.image.load(source, fd.MaxDim, fd.Preprocess)
+	if err != nil {
+		return err
+	}
+	fd.profile, fd.deep = fd.image.profile, fd.image.deep
+	fd.windows = nil
+	return fd.prepare(src, pixels)
+}
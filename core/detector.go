@@ -0,0 +1,707 @@
+// Package facemask implements the face detection and the overlay compositing
+// used by the facemask command line tool, so it can also be used as a library.
+package facemask
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	pigo "github.com/esimov/pigo/core"
+	"github.com/fogleman/gg"
+)
+
+// Detector contains the Pigo face detector general settings.
+//
+// A detector processes one image at a time: the stages of an image (DetectFaces,
+// LocalizeFaces, Render and Image) share the state of the detector, so it must not be
+// used by multiple goroutines at once. The detectors don't share any mutable state
+// with each other though, so distinct detectors can be used concurrently, e.g. one per
+// worker; Clone returns such a detector sharing the already unpacked cascades.
+type Detector struct {
+	Angle        float64
+	Destination  string
+	MinSize      int
+	MaxSize      int
+	ShiftFactor  float64
+	ScaleFactor  float64
+	IouThreshold float64
+	// FaceCascade is the face cascade file. Several cascades can be provided as
+	// a comma separated list, in which case their detections are fused.
+	FaceCascade string
+	EyesCascade string
+	FlplocDir   string
+	// Backend is the name of the face detection backend. It defaults to the Pigo
+	// cascade classifier; the pupils and the landmark points are always localized by Pigo.
+	Backend string
+	// Model is the model file used by the alternative detection backends.
+	Model string
+	// NMS is the suppression method of the overlapping detections: cluster, hard or soft.
+	NMS string
+	// NMSSigma is the Gaussian decay parameter of the Soft-NMS.
+	NMSSigma float64
+	// Preprocess is the comma separated list of contrast enhancements applied to the
+	// grayscale image before the detection: equalize, clahe, gamma=<value>, lowlight or denoise.
+	Preprocess string
+	// MaxDim limits the larger side of the processed images; the larger images are
+	// downscaled while they are decoded. Zero keeps the original size.
+	MaxDim int
+	// DetectScale runs the face cascades over a copy of the grayscale image downscaled by
+	// this factor, e.g. 0.5 for the 4K videos, while the pupils and the landmark points are
+	// still localized at the full resolution. MinSize and MaxSize remain relative to the full
+	// resolution. Zero or 1 keeps the full resolution.
+	DetectScale float64
+	// UpscaleBelow is the face size in pixels under which the face region is upscaled
+	// before the pupil and landmark localization, which is unreliable on small faces.
+	// Zero disables the upscaling.
+	UpscaleBelow int
+	// Landmarks are the names of the landmark points localized on every face, or of their
+	// groups: eyebrows, eyes, nose and mouth (see LandmarkNames). The mouth corners are
+	// always localized. Nil localizes all the points; fewer points localize faster.
+	Landmarks []string
+	// MinIPD and MaxIPD are the plausible range of the interpupillary distance relative to
+	// the face size; the detections with the pupils localized outside of it are rejected as
+	// false positives. Adults are around 0.36 and children around 0.45. Zero disables a bound.
+	MinIPD float64
+	MaxIPD float64
+	// Confidence localizes every point twice to estimate the confidence of the landmark fit,
+	// provided by FaceInfo.Confidence and FaceInfo.LandmarkQ.
+	Confidence bool
+	// LandmarkQ is the minimum confidence of the landmark fit, under which the overlay is
+	// placed relative to the face box instead. It implies Confidence. Zero disables it.
+	LandmarkQ float64
+	// Mirror also runs the Pigo cascades over the horizontally flipped image and merges the
+	// detections, which finds the faces the cascade is asymmetric about, at twice the cost.
+	Mirror bool
+	// QThreshold is the minimum detection quality of the faces. Zero means the default of 5.
+	QThreshold float64
+	// PreserveDepth keeps the precision of the 16 bit images in the result: the pixels not
+	// covered by the overlays keep their original values. Otherwise the result is 8 bit.
+	PreserveDepth bool
+	// ReuseContext reuses the pixels of the drawing context across the images of the same
+	// size, e.g. the video frames, instead of allocating them for every image. The image
+	// returned by Image is then overwritten by the next detection; Result copies it.
+	ReuseContext bool
+	// Overlay is the renderer of the overlays drawn by Process.
+	Overlay Renderer
+	// AutoCrop crops the result of Render to the bounding box of all the faces, extended on
+	// each side by CropMargin relative to the box size. The images without faces are kept whole.
+	AutoCrop   bool
+	CropMargin float64
+	// Label is the text drawn by Render under each face, after the overlays. Nil disables it.
+	Label *Label
+	// Watermark is stamped over the image by Render, after the overlays. Nil disables it.
+	Watermark *Watermark
+	// Zones are blurred by Render after the overlays and the labels, whether or not they
+	// contain faces. Nil disables them.
+	Zones *PrivacyZones
+	// Hooks are the callbacks invoked at the pipeline stages.
+	Hooks Hooks
+	// Cache stores the faces localized by DetectCached. Nil disables the caching.
+	Cache *DetectionCache
+	// Limits bound the images loaded by DetectSource. The zero value doesn't limit them.
+	Limits SourceLimits
+	// Seed makes the localization reproducible. The pupil and landmark localization perturbs
+	// its search windows randomly; with a non-zero seed the perturbations of every face are
+	// derived from the seed and the face, so the same image always gets the same points
+	// whatever the other detectors localize concurrently. Zero leaves them random.
+	Seed int64
+
+	// ctx is the drawing context of the processed image, and canvas the pixels reused by
+	// ReuseContext.
+	ctx    *gg.Context
+	canvas *image.RGBA
+	// params holds the grayscale pixels of the processed image.
+	params pigo.ImageParams
+	plc    *puplocCascade
+	flpcs  map[string]*puplocCascade
+	// rnd perturbs the search windows of the localization, not shared with the clones.
+	rnd *rand.Rand
+	// landmarks is the set of the localized landmark points, nil for all of them.
+	landmarks map[string]bool
+	// windows are the raw cascade detections of the last image, used by the heatmap.
+	windows []pigo.Detection
+	// profile is the ICC color profile of the processed image, embedded into the output.
+	profile []byte
+	// src and deep are the 8 bit and the high bit depth copies of the processed image,
+	// the latter being nil for the 8 bit images.
+	src      *image.NRGBA
+	deep     image.Image
+	image    imageCache
+	cascades *cascadeCache
+}
+
+// Clone returns a detector with the same settings, which shares the unpacked cascades
+// of the original one, but none of the per image state, so the two can be used concurrently.
+func (fd *Detector) Clone() *Detector {
+	fd.initCascades()
+	return &Detector{
+		Angle:         fd.Angle,
+		Destination:   fd.Destination,
+		MinSize:       fd.MinSize,
+		MaxSize:       fd.MaxSize,
+		ShiftFactor:   fd.ShiftFactor,
+		ScaleFactor:   fd.ScaleFactor,
+		IouThreshold:  fd.IouThreshold,
+		FaceCascade:   fd.FaceCascade,
+		EyesCascade:   fd.EyesCascade,
+		FlplocDir:     fd.FlplocDir,
+		Backend:       fd.Backend,
+		Model:         fd.Model,
+		NMS:           fd.NMS,
+		NMSSigma:      fd.NMSSigma,
+		Preprocess:    fd.Preprocess,
+		MaxDim:        fd.MaxDim,
+		DetectScale:   fd.DetectScale,
+		Landmarks:     fd.Landmarks,
+		UpscaleBelow:  fd.UpscaleBelow,
+		QThreshold:    fd.QThreshold,
+		Mirror:        fd.Mirror,
+		Confidence:    fd.Confidence,
+		LandmarkQ:     fd.LandmarkQ,
+		MinIPD:        fd.MinIPD,
+		MaxIPD:        fd.MaxIPD,
+		PreserveDepth: fd.PreserveDepth,
+		ReuseContext:  fd.ReuseContext,
+		Overlay:       fd.Overlay,
+		AutoCrop:      fd.AutoCrop,
+		CropMargin:    fd.CropMargin,
+		Label:         fd.Label,
+		Watermark:     fd.Watermark,
+		Zones:         fd.Zones,
+		Hooks:         fd.Hooks,
+		Cache:         fd.Cache,
+		Limits:        fd.Limits,
+		Seed:          fd.Seed,
+		cascades:      fd.cascades,
+	}
+}
+
+// initCascades creates the cascade cache of the detector.
+func (fd *Detector) initCascades() {
+	if fd.cascades == nil {
+		fd.cascades = new(cascadeCache)
+	}
+}
+
+// Close releases the detection backend opened by the detector, e.g. the onnxruntime session,
+// which is shared with its clones, so it is called once the detector and all its clones
+// are done. The detector opens the backend again if used afterwards.
+func (fd *Detector) Close() error {
+	if fd.cascades == nil {
+		return nil
+	}
+	return fd.cascades.close()
+}
+
+// defaultQThreshold is the detection quality threshold used when none is provided.
+const defaultQThreshold = 5.0
+
+// errScaleFactor is returned for the too small scale factors.
+var errScaleFactor = errors.New("scale factor must be greater than 1.05")
+
+// DetectFaces run the detection algorithm over the provided source image.
+func (fd *Detector) DetectFaces(source string) ([]pigo.Detection, error) {
+	start := time.Now()
+	src, pixels, err := fd.image.load(source, fd.MaxDim, fd.Preprocess)
+	fd.stage(StageDecode, start, err)
+	if err != nil {
+		return nil, err
+	}
+	fd.profile, fd.deep = fd.image.profile, fd.image.deep
+
+	start = time.Now()
+	faces, err := fd.detect(src, pixels)
+	fd.stage(StageDetect, start, err)
+	return faces, err
+}
+
+// DetectImage runs the detection algorithm over an image already in memory, e.g. an
+// uploaded file or a video frame. The image is copied, so it's not modified by the overlays.
+func (fd *Detector) DetectImage(img image.Image) ([]pigo.Detection, error) {
+	start := time.Now()
+	src := fitImage(img, fd.MaxDim)
+	fd.profile, fd.deep = nil, nil
+	if isDeep(img) && src.Bounds().Size() == img.Bounds().Size() {
+		fd.deep = img
+	}
+	fd.stage(StageDecode, start, nil)
+	return fd.detectImage(src)
+}
+
+// DetectReader decodes the image read from r and runs the detection algorithm over it.
+func (fd *Detector) DetectReader(r io.Reader) ([]pigo.Detection, error) {
+	start := time.Now()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		fd.stage(StageDecode, start, err)
+		return nil, err
+	}
+	src, deep, err := decodeReader(bytes.NewReader(data), fd.MaxDim)
+	if err != nil {
+		fd.stage(StageDecode, start, err)
+		return nil, err
+	}
+	fd.profile, fd.deep = readICC(bytes.NewReader(data)), deep
+	fd.stage(StageDecode, start, nil)
+	return fd.detectImage(src)
+}
+
+// LoadReader decodes the image read from r into the detector without running the detection,
+// so the overlays can be rendered at the placements computed earlier.
+func (fd *Detector) LoadReader(r io.Reader) (err error) {
+	start := time.Now()
+	defer func() { fd.stage(StageDecode, start, err) }()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	src, deep, err := decodeReader(bytes.NewReader(data), fd.MaxDim)
+	if err != nil {
+		return err
+	}
+	fd.profile, fd.deep = readICC(bytes.NewReader(data)), deep
+	fd.windows = nil
+	return fd.prepare(src, pigo.RgbToGrayscale(src))
+}
+
+// detectImage converts the decoded image to grayscale and runs the detection over it.
+func (fd *Detector) detectImage(src *image.NRGBA) (faces []pigo.Detection, err error) {
+	start := time.Now()
+	defer func() { fd.stage(StageDetect, start, err) }()
+
+	pixels := pigo.RgbToGrayscale(src)
+	if err := preprocess(pixels, src.Bounds().Dx(), src.Bounds().Dy(), fd.Preprocess); err != nil {
+		return nil, err
+	}
+	return fd.detect(src, pixels)
+}
+
+// detect runs the detection over the decoded source image and its grayscale pixels.
+func (fd *Detector) detect(src *image.NRGBA, pixels []uint8) ([]pigo.Detection, error) {
+	if err := fd.prepare(src, pixels); err != nil {
+		return nil, err
+	}
+	fd.windows = nil
+	if fd.Backend != "" && fd.Backend != "pigo" {
+		fd.initCascades()
+		backend, err := fd.cascades.loadBackend(fd.Backend, fd.Model)
+		if err != nil {
+			return nil, err
+		}
+		return backend.Detect(src)
+	}
+
+	cParams := pigo.CascadeParams{
+		MinSize:     fd.MinSize,
+		MaxSize:     fd.MaxSize,
+		ShiftFactor: fd.ShiftFactor,
+		ScaleFactor: fd.ScaleFactor,
+		ImageParams: fd.params,
+	}
+	// The cascades may run over a downscaled copy, their detections are mapped back at the end.
+	scale := fd.DetectScale
+	if scale > 0 && scale < 1 {
+		cParams.ImageParams = downscaleParams(fd.params, scale)
+		cParams.MinSize = int(math.Round(float64(fd.MinSize) * scale))
+		cParams.MaxSize = int(math.Round(float64(fd.MaxSize) * scale))
+	} else {
+		scale = 1
+	}
+	cols := cParams.ImageParams.Cols
+
+	var mirrored pigo.CascadeParams
+	if fd.Mirror {
+		mirrored = cParams
+		mirrored.ImageParams = mirrorParams(cParams.ImageParams)
+	}
+
+	// Run every face cascade and fuse their detections.
+	var sets [][]pigo.Detection
+	for _, cascade := range strings.Split(fd.FaceCascade, ",") {
+		classifier, err := fd.cascades.loadClassifier(strings.TrimSpace(cascade))
+		if err != nil {
+			return nil, err
+		}
+
+		// Run the classifier over the obtained leaf nodes and return the detection results.
+		// The result contains quadruplets representing the row, column, scale and detection score.
+		faces := classifier.RunCascade(cParams, fd.Angle)
+		fd.windows = append(fd.windows, faces...)
+
+		// Suppress the overlapping detections based on their intersection over union (IoU).
+		faces, err = suppress(classifier, faces, fd.NMS, fd.IouThreshold, fd.NMSSigma)
+		if err != nil {
+			return nil, err
+		}
+		if fd.Mirror {
+			flipped := unmirror(classifier.RunCascade(mirrored, mirrorAngle(fd.Angle)), cols)
+			fd.windows = append(fd.windows, flipped...)
+			if flipped, err = suppress(classifier, flipped, fd.NMS, fd.IouThreshold, fd.NMSSigma); err != nil {
+				return nil, err
+			}
+			faces = mergeMirrored(faces, flipped, fd.IouThreshold)
+		}
+		sets = append(sets, faces)
+	}
+	faces := sets[0]
+	if len(sets) > 1 {
+		faces = fuseDetections(sets, fd.IouThreshold)
+	}
+	if scale != 1 {
+		fd.windows = upscaleDetections(fd.windows, scale)
+		faces = upscaleDetections(faces, scale)
+	}
+	return faces, nil
+}
+
+// prepare sets up the drawing context and the localization cascades for the decoded
+// source image and its grayscale pixels.
+func (fd *Detector) prepare(src *image.NRGBA, pixels []uint8) error {
+	var err error
+	cols, rows := src.Bounds().Max.X, src.Bounds().Max.Y
+	fd.src = src
+
+	// Copy the source into the drawing context directly, rather than drawing it through gg.
+	// The copy overwrites all the pixels, so a reused context needs no clearing.
+	fd.ctx = fd.newContext(cols, rows)
+	rgba := fd.ctx.Image().(*image.RGBA)
+	draw.Draw(rgba, rgba.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	fd.params = pigo.ImageParams{
+		Pixels: pixels,
+		Rows:   rows,
+		Cols:   cols,
+		Dim:    cols,
+	}
+
+	if fd.landmarks, err = landmarkSet(fd.Landmarks); err != nil {
+		return err
+	}
+	fd.initCascades()
+	fd.plc, fd.flpcs, err = fd.cascades.loadLocalizers(fd.EyesCascade, fd.FlplocDir)
+	return err
+}
+
+// newContext returns a fresh drawing context of the image size. With ReuseContext it draws
+// into the pixels of the previous image of the same size, which are the costly part to
+// allocate; they are overwritten by prepare with the new image.
+func (fd *Detector) newContext(cols, rows int) *gg.Context {
+	if !fd.ReuseContext {
+		return gg.NewContextForRGBA(image.NewRGBA(image.Rect(0, 0, cols, rows)))
+	}
+	if fd.canvas == nil || fd.canvas.Rect.Dx() != cols || fd.canvas.Rect.Dy() != rows {
+		fd.canvas = image.NewRGBA(image.Rect(0, 0, cols, rows))
+	}
+	return gg.NewContextForRGBA(fd.canvas)
+}
+
+// LocalizeFaces localizes the pupils and the facial landmark points of the detected faces
+// which are above the detection quality threshold.
+func (fd *Detector) LocalizeFaces(faces []pigo.Detection) []FaceInfo {
+	defer fd.stage(StageLandmark, time.Now(), nil)
+
+	var (
+		qThresh = float32(fd.QThreshold)
+		infos   []FaceInfo
+	)
+
+	if qThresh == 0 {
+		qThresh = defaultQThreshold
+	}
+	for _, face := range faces {
+		if face.Q > qThresh {
+			var leftEye, rightEye *pigo.Puploc
+			var landmarks map[string]*pigo.Puploc
+			var conf map[string]float64
+			confidence := fd.Confidence || fd.LandmarkQ > 0
+			rnd := fd.random(face)
+			if fd.UpscaleBelow > 0 && face.Scale < fd.UpscaleBelow {
+				// Localize the points over the upscaled face region, then map them back.
+				params, scaled, unscale := upscaleRegion(fd.params, face, upscaleTarget)
+				leftEye, rightEye, landmarks = fd.localize(scaled, params, rnd)
+				if confidence {
+					conf = fd.localizeConfidence(scaled, params, leftEye, rightEye, landmarks, rnd)
+				}
+				leftEye, rightEye = unscale(leftEye), unscale(rightEye)
+				for name, p := range landmarks {
+					landmarks[name] = unscale(p)
+				}
+			} else {
+				leftEye, rightEye, landmarks = fd.localize(face, fd.params, rnd)
+				if confidence {
+					conf = fd.localizeConfidence(face, fd.params, leftEye, rightEye, landmarks, rnd)
+				}
+			}
+			info := FaceInfo{
+				Detection:  face,
+				LeftEye:    leftEye,
+				RightEye:   rightEye,
+				MouthLeft:  landmarks["mouth_left"],
+				MouthRight: landmarks["mouth_right"],
+				Landmarks:  landmarks,
+				Confidence: conf,
+			}
+			if conf != nil {
+				info.LandmarkQ = landmarkQ(conf)
+			}
+			if !ipdInRange(info, fd.MinIPD, fd.MaxIPD) {
+				continue
+			}
+			if pose, ok := EstimatePose(info); ok {
+				info.Pose = pose
+			}
+			// Fall back to the scale based placement for the partially covered faces and
+			// the low confidence fits, rather than aligning the overlay to unreliable landmark points.
+			if !landmarksPlausible(info) || fd.LandmarkQ > 0 && info.LandmarkQ < fd.LandmarkQ {
+				info.Occluded = true
+				info.MouthLeft, info.MouthRight = fallbackMouth(face)
+			}
+			if fd.Hooks.OnFaceDetected != nil && !fd.Hooks.OnFaceDetected(&info) {
+				continue
+			}
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// random returns the random source of the localization of the face. With the Seed of the
+// detector it's seeded from it and from the face first.
+func (fd *Detector) random(face pigo.Detection) *rand.Rand {
+	if fd.rnd == nil {
+		fd.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if fd.Seed != 0 {
+		fd.rnd.Seed(fd.Seed ^ int64(face.Row)<<40 ^ int64(face.Col)<<20 ^ int64(face.Scale))
+	}
+	return fd.rnd
+}
+
+// localizePerturbs is the number of the perturbed runs of the localization cascades.
+const localizePerturbs = 63
+
+// pupilStarts returns the initial regions of the pupil localization, relative to the face box.
+func pupilStarts(face pigo.Detection) (left, right pigo.Puploc) {
+	left = pigo.Puploc{
+		Row:      face.Row - int(0.075*float32(face.Scale)),
+		Col:      face.Col - int(0.175*float32(face.Scale)),
+		Scale:    float32(face.Scale) * 0.25,
+		Perturbs: localizePerturbs,
+	}
+	right = pigo.Puploc{
+		Row:      face.Row - int(0.075*float32(face.Scale)),
+		Col:      face.Col + int(0.185*float32(face.Scale)),
+		Scale:    float32(face.Scale) * 0.25,
+		Perturbs: localizePerturbs,
+	}
+	return left, right
+}
+
+// localize localizes the pupils and the landmark points of the face over the image.
+func (fd *Detector) localize(face pigo.Detection, params pigo.ImageParams, rnd *rand.Rand) (*pigo.Puploc, *pigo.Puploc, map[string]*pigo.Puploc) {
+	left, right := pupilStarts(face)
+	leftEye := fd.plc.run(left, params, fd.Angle, false, rnd)
+	rightEye := fd.plc.run(right, params, fd.Angle, false, rnd)
+
+	return leftEye, rightEye, localizeLandmarks(fd.flpcs, fd.landmarks, leftEye, rightEye, params, localizePerturbs, rnd)
+}
+
+// Process detects the faces of the source image and renders the overlay
+// over them, returning the localized faces. The resulting image is returned
+// by Image. A nil overlay defaults to the mask renderer.
+func (fd *Detector) Process(source string) ([]FaceInfo, error) {
+	faces, err := fd.DetectFaces(source)
+	if err != nil {
+		return nil, err
+	}
+	infos := fd.LocalizeFaces(faces)
+	overlay := fd.Overlay
+	if overlay == nil {
+		overlay = defaultOverlay
+	}
+	if err := fd.Render(infos, overlay); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// defaultOverlay is the renderer used by Process when no overlay is set.
+var defaultOverlay = NewMaskRenderer(DefaultMask)
+
+// RenderFaces renders the overlay over each of the detected faces with the provided renderer.
+func (fd *Detector) RenderFaces(faces []pigo.Detection, r Renderer) error {
+	return fd.Render(fd.LocalizeFaces(faces), r)
+}
+
+// Render renders the overlay over each of the localized faces with the provided renderer,
+// then draws the face labels, blurs the privacy zones, crops the image to the faces and
+// stamps the watermark, as configured. The composite hooks are not invoked for the group
+// renderers, which draw all the faces at once.
+func (fd *Detector) Render(infos []FaceInfo, r Renderer) (err error) {
+	start := time.Now()
+	defer func() { fd.stage(StageComposite, start, err) }()
+
+	var labels []string
+	if fd.Label != nil {
+		var err error
+		if labels, err = fd.Label.texts(fd.ctx.Image(), infos); err != nil {
+			return err
+		}
+	}
+	if gr, ok := r.(GroupRenderer); ok {
+		if err := gr.RenderAll(fd.ctx, infos); err != nil {
+			return err
+		}
+	} else {
+		for _, face := range infos {
+			if err := fd.renderFace(fd.ctx, r, face); err != nil {
+				return err
+			}
+		}
+	}
+	for i, text := range labels {
+		fd.Label.draw(fd.ctx, infos[i], text)
+	}
+	if fd.Zones != nil {
+		if dst, ok := fd.ctx.Image().(draw.Image); ok {
+			fd.Zones.Draw(dst)
+		}
+	}
+	if fd.AutoCrop {
+		if rect := facesBounds(infos, fd.CropMargin, fd.ctx.Image().Bounds()); !rect.Empty() {
+			fd.cropTo(rect)
+		}
+	}
+	if fd.Watermark != nil {
+		if dst, ok := fd.ctx.Image().(draw.Image); ok {
+			fd.Watermark.Draw(dst)
+		}
+	}
+	return nil
+}
+
+// DrawFaces renders the overlay over the detected faces and encodes
+// the resulting image into the destination file.
+func (fd *Detector) DrawFaces(faces []pigo.Detection, r Renderer) error {
+	if err := fd.RenderFaces(faces, r); err != nil {
+		return err
+	}
+	return fd.Save(fd.Destination)
+}
+
+// Canvas returns the drawing context of the last detected image, so the applications can
+// draw over the whole image after Render, e.g. a status text over the video frames.
+func (fd *Detector) Canvas() *gg.Context {
+	return fd.ctx
+}
+
+// Image returns the image of the last detection, including the rendered overlays.
+// It's a 16 bit image in case the source is one and PreserveDepth is set. The alpha
+// channel of the source images with transparency is preserved.
+func (fd *Detector) Image() image.Image {
+	if fd.PreserveDepth && fd.deep != nil {
+		return mergeDeep(fd.deep, fd.src, fd.ctx.Image())
+	}
+	if rgba, ok := fd.ctx.Image().(*image.RGBA); ok && !fd.src.Opaque() {
+		return mergeAlpha(fd.src, rgba)
+	}
+	return fd.ctx.Image()
+}
+
+// ColorProfile returns the ICC color profile embedded in the source image of the last
+// detection, or nil when it has none.
+func (fd *Detector) ColorProfile() []byte {
+	return fd.profile
+}
+
+// Result is the image of a detection, including the rendered overlays, detached from the
+// detector: it's not affected by the next detections, so it can be encoded on another
+// goroutine while the detector processes the next image.
+type Result struct {
+	img     image.Image
+	profile []byte
+}
+
+// Result returns the image of the last detection, including the rendered overlays. With
+// ReuseContext the pixels of the drawing context are copied, since the next detection draws
+// over them; otherwise every detection gets a context of its own, which is handed over as is.
+func (fd *Detector) Result() *Result {
+	img := fd.Image()
+	if rgba, ok := img.(*image.RGBA); ok && fd.ReuseContext && img == fd.ctx.Image() {
+		img = &image.RGBA{
+			Pix:    append([]uint8(nil), rgba.Pix...),
+			Stride: rgba.Stride,
+			Rect:   rgba.Rect,
+		}
+	}
+	return &Result{img: img, profile: fd.profile}
+}
+
+// Save encodes the image of the last detection, including the rendered overlays, into
+// the destination file, preserving the color profile of the source image. The image format
+// is determined from the file extension.
+func (fd *Detector) Save(destination string) error {
+	start := time.Now()
+	// The image is encoded right away, so it needs no detached copy.
+	err := (&Result{img: fd.Image(), profile: fd.profile}).Save(destination)
+	fd.stage(StageEncode, start, err)
+	return err
+}
+
+// SaveThumbnail encodes a copy of the image of the last detection downscaled to fit into
+// a square of the size, preserving the color profile of the source image. The smaller
+// images are not upscaled.
+func (fd *Detector) SaveThumbnail(destination string, size int) error {
+	return fd.Result().SaveThumbnail(destination, size)
+}
+
+// Save encodes the image into the destination file, like Detector.Save.
+func (r *Result) Save(destination string) error {
+	return saveImage(destination, r.img, r.profile)
+}
+
+// SaveThumbnail encodes a downscaled copy of the image, like Detector.SaveThumbnail.
+func (r *Result) SaveThumbnail(destination string, size int) error {
+	img := r.img
+	if b := img.Bounds(); b.Dx() > size || b.Dy() > size {
+		img = imaging.Fit(img, size, size, imaging.Lanczos)
+	}
+	return saveImage(destination, img, r.profile)
+}
+
+// SaveImage encodes the image into the destination file. The image format
+// is determined from the file extension.
+func SaveImage(destination string, img image.Image) error {
+	return saveImage(destination, img, nil)
+}
+
+// saveImage encodes the image into the destination file with the ICC profile embedded.
+func saveImage(destination string, img image.Image, profile []byte) error {
+	format, ok := FormatFromExt(destination)
+	if !ok {
+		return fmt.Errorf("output file type not supported: %v", filepath.Ext(destination))
+	}
+	// The existing file is truncated, so no bytes of a longer previous image remain.
+	output, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	if err := encodeICC(output, img, format, profile); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
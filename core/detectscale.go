@@ -0,0 +1,41 @@
+package facemask
+
+import (
+	"math"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// downscaleParams returns the grayscale image downscaled by the factor below 1, each pixel
+// being the average of the source pixels it covers, so the small details don't alias.
+func downscaleParams(params pigo.ImageParams, scale float64) pigo.ImageParams {
+	cols := int(math.Max(1, math.Round(float64(params.Cols)*scale)))
+	rows := int(math.Max(1, math.Round(float64(params.Rows)*scale)))
+	pixels := make([]uint8, cols*rows)
+	for y := 0; y < rows; y++ {
+		y0 := y * params.Rows / rows
+		y1 := clampInt((y+1)*params.Rows/rows, y0+1, params.Rows)
+		for x := 0; x < cols; x++ {
+			x0 := x * params.Cols / cols
+			x1 := clampInt((x+1)*params.Cols/cols, x0+1, params.Cols)
+			sum := 0
+			for sy := y0; sy < y1; sy++ {
+				for _, v := range params.Pixels[sy*params.Dim+x0 : sy*params.Dim+x1] {
+					sum += int(v)
+				}
+			}
+			pixels[y*cols+x] = uint8(sum / ((y1 - y0) * (x1 - x0)))
+		}
+	}
+	return pigo.ImageParams{Pixels: pixels, Rows: rows, Cols: cols, Dim: cols}
+}
+
+// upscaleDetections maps the detections over the image downscaled by the factor back to the original image.
+func upscaleDetections(dets []pigo.Detection, scale float64) []pigo.Detection {
+	for i := range dets {
+		dets[i].Row = int(float64(dets[i].Row)/scale + 0.5)
+		dets[i].Col = int(float64(dets[i].Col)/scale + 0.5)
+		dets[i].Scale = int(float64(dets[i].Scale)/scale + 0.5)
+	}
+	return dets
+}
@@ -0,0 +1,65 @@
+package facemask
+
+import (
+	"sort"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// fuseDetections merges the detections of several cascades. The detections of different
+// cascades overlapping by more than the IoU threshold are fused into their score weighted
+// average with the summed score, so the faces found by more cascades are more confident,
+// while the faces found by a single cascade are kept with their own score.
+func fuseDetections(sets [][]pigo.Detection, iouThreshold float64) []pigo.Detection {
+	type member struct {
+		det pigo.Detection
+		set int
+	}
+	var all []member
+	for i, set := range sets {
+		for _, d := range set {
+			all = append(all, member{d, i})
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].det.Q > all[j].det.Q })
+
+	used := make([]bool, len(all))
+	var fused []pigo.Detection
+	for i := range all {
+		if used[i] {
+			continue
+		}
+		used[i] = true
+		group := []pigo.Detection{all[i].det}
+		seen := map[int]bool{all[i].set: true}
+		for j := i + 1; j < len(all); j++ {
+			// Fuse at most one detection per cascade into the group.
+			if used[j] || seen[all[j].set] || detectionIoU(all[i].det, all[j].det) <= iouThreshold {
+				continue
+			}
+			used[j] = true
+			seen[all[j].set] = true
+			group = append(group, all[j].det)
+		}
+
+		var r, c, s, q float64
+		for _, d := range group {
+			w := float64(d.Q)
+			r += float64(d.Row) * w
+			c += float64(d.Col) * w
+			s += float64(d.Scale) * w
+			q += w
+		}
+		if q <= 0 {
+			fused = append(fused, all[i].det)
+			continue
+		}
+		fused = append(fused, pigo.Detection{
+			Row:   int(r/q + 0.5),
+			Col:   int(c/q + 0.5),
+			Scale: int(s/q + 0.5),
+			Q:     float32(q),
+		})
+	}
+	return fused
+}
@@ -0,0 +1,204 @@
+package facemask
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// Box is an axis aligned face bounding box in pixels.
+type Box struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// DetectionBox returns the bounding box of the detection.
+func DetectionBox(d pigo.Detection) Box {
+	s := float64(d.Scale)
+	return Box{X: float64(d.Col) - s/2, Y: float64(d.Row) - s/2, Width: s, Height: s}
+}
+
+// IoU returns the intersection over union of the two boxes.
+func (b Box) IoU(o Box) float64 {
+	w := math.Min(b.X+b.Width, o.X+o.Width) - math.Max(b.X, o.X)
+	h := math.Min(b.Y+b.Height, o.Y+o.Height) - math.Max(b.Y, o.Y)
+	if w <= 0 || h <= 0 {
+		return 0
+	}
+	inter := w * h
+	return inter / (b.Width*b.Height + o.Width*o.Height - inter)
+}
+
+// LoadTruth reads the ground truth face boxes of a set of images, keyed by the image
+// file name. The format is chosen by the file extension and the content:
+//
+// A JSON object mapping the image file names to the list of face boxes:
+//
+//	{"group.jpg": [{"x": 10, "y": 20, "width": 64, "height": 64}]}
+//
+// A COCO annotation file, using the bbox of every annotation of the images.
+//
+// A CSV file with a file,x,y,width,height record per face; a header line is allowed.
+func LoadTruth(path string) (map[string][]Box, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(filepath.Ext(path)) == ".csv" {
+		return parseTruthCSV(bytes.NewReader(data))
+	}
+
+	var coco struct {
+		Images []struct {
+			ID       int64  `json:"id"`
+			FileName string `json:"file_name"`
+		} `json:"images"`
+		Annotations []struct {
+			ImageID int64     `json:"image_id"`
+			BBox    []float64 `json:"bbox"`
+		} `json:"annotations"`
+	}
+	if err := json.Unmarshal(data, &coco); err == nil && coco.Images != nil {
+		files := make(map[int64]string)
+		truth := make(map[string][]Box)
+		for _, img := range coco.Images {
+			files[img.ID] = img.FileName
+			truth[img.FileName] = nil
+		}
+		for _, a := range coco.Annotations {
+			file, ok := files[a.ImageID]
+			if !ok || len(a.BBox) != 4 {
+				return nil, fmt.Errorf("invalid annotation of image %d", a.ImageID)
+			}
+			truth[file] = append(truth[file], Box{X: a.BBox[0], Y: a.BBox[1], Width: a.BBox[2], Height: a.BBox[3]})
+		}
+		return truth, nil
+	}
+
+	truth := make(map[string][]Box)
+	if err := json.Unmarshal(data, &truth); err != nil {
+		return nil, err
+	}
+	return truth, nil
+}
+
+// parseTruthCSV parses the file,x,y,width,height records of the ground truth CSV file.
+func parseTruthCSV(r io.Reader) (map[string][]Box, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	truth := make(map[string][]Box)
+	for i, rec := range records {
+		if len(rec) != 5 {
+			return nil, fmt.Errorf("line %d: expected file,x,y,width,height", i+1)
+		}
+		var v [4]float64
+		for k := range v {
+			if v[k], err = strconv.ParseFloat(strings.TrimSpace(rec[k+1]), 64); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			if i == 0 {
+				continue // header
+			}
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		file := strings.TrimSpace(rec[0])
+		truth[file] = append(truth[file], Box{X: v[0], Y: v[1], Width: v[2], Height: v[3]})
+	}
+	return truth, nil
+}
+
+// Evaluation accumulates the detection accuracy against the ground truth boxes.
+type Evaluation struct {
+	TruePositives  int
+	FalsePositives int
+	FalseNegatives int
+	// IoUSum is the sum of the intersection over union of the matched detections.
+	IoUSum float64
+}
+
+// Add matches the detections of an image to its ground truth boxes. A detection is
+// a true positive when it overlaps an unmatched ground truth box by at least minIoU;
+// the detections are matched in the descending order of their score.
+func (e *Evaluation) Add(dets []pigo.Detection, truth []Box, minIoU float64) {
+	dets = append([]pigo.Detection(nil), dets...)
+	sort.SliceStable(dets, func(i, j int) bool { return dets[i].Q > dets[j].Q })
+
+	matched := make([]bool, len(truth))
+	for _, d := range dets {
+		box := DetectionBox(d)
+		best, bestIoU := -1, minIoU
+		for i, t := range truth {
+			if iou := box.IoU(t); !matched[i] && iou >= bestIoU {
+				best, bestIoU = i, iou
+			}
+		}
+		if best < 0 {
+			e.FalsePositives++
+			continue
+		}
+		matched[best] = true
+		e.TruePositives++
+		e.IoUSum += bestIoU
+	}
+	e.FalseNegatives += len(truth) - countTrue(matched)
+}
+
+// Precision returns the fraction of the detections which are faces.
+func (e *Evaluation) Precision() float64 {
+	return ratio(e.TruePositives, e.TruePositives+e.FalsePositives)
+}
+
+// Recall returns the fraction of the faces which have been detected.
+func (e *Evaluation) Recall() float64 {
+	return ratio(e.TruePositives, e.TruePositives+e.FalseNegatives)
+}
+
+// F1 returns the harmonic mean of the precision and the recall.
+func (e *Evaluation) F1() float64 {
+	p, r := e.Precision(), e.Recall()
+	if p+r == 0 {
+		return 0
+	}
+	return 2 * p * r / (p + r)
+}
+
+// MeanIoU returns the average intersection over union of the matched detections.
+func (e *Evaluation) MeanIoU() float64 {
+	if e.TruePositives == 0 {
+		return 0
+	}
+	return e.IoUSum / float64(e.TruePositives)
+}
+
+func ratio(a, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+func countTrue(v []bool) int {
+	var n int
+	for _, b := range v {
+		if b {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,116 @@
+package facemask
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+// exifSignature starts the APP1 segment of the Exif metadata of the JPEG images.
+var exifSignature = []byte("Exif\x00\x00")
+
+// exifOrientationTag is the Exif tag of the orientation of the camera.
+const exifOrientationTag = 0x0112
+
+// readOrientation returns the Exif orientation of the JPEG image, between 1 and 8, or 1 when
+// it has none. The phones store the photos as captured by the sensor, with the orientation
+// telling the viewers how to rotate them.
+func readOrientation(r io.Reader) int {
+	br := bufio.NewReader(r)
+	var marker [4]byte
+	if _, err := io.ReadFull(br, marker[:2]); err != nil || marker[0] != 0xff || marker[1] != 0xd8 {
+		return 1
+	}
+	for {
+		if _, err := io.ReadFull(br, marker[:2]); err != nil || marker[0] != 0xff {
+			return 1
+		}
+		switch {
+		case marker[1] == 0xda || marker[1] == 0xd9: // start of scan, end of image
+			return 1
+		case marker[1] == 0x01 || marker[1] >= 0xd0 && marker[1] <= 0xd7:
+			continue
+		}
+		if _, err := io.ReadFull(br, marker[2:]); err != nil {
+			return 1
+		}
+		n := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if n < 0 {
+			return 1
+		}
+		if marker[1] != 0xe1 {
+			if _, err := br.Discard(n); err != nil {
+				return 1
+			}
+			continue
+		}
+		segment := make([]byte, n)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return 1
+		}
+		if bytes.HasPrefix(segment, exifSignature) {
+			return tiffOrientation(segment[len(exifSignature):])
+		}
+	}
+}
+
+// tiffOrientation returns the orientation tag of the first IFD of the TIFF structure of the Exif data.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		// The orientation is a SHORT value stored in the entry itself.
+		if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+			return o
+		}
+		return 1
+	}
+	return 1
+}
+
+// orient rotates and flips the decoded image by its Exif orientation, so it's upright.
+func orient(img *image.NRGBA, orientation int) *image.NRGBA {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
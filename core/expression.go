@@ -0,0 +1,170 @@
+package facemask
+
+import (
+	"image"
+	"math"
+
+	pigo "github.com/esimov/pigo/core"
+	"github.com/fogleman/gg"
+)
+
+// The facial expressions recognized by the built-in classifier.
+const (
+	ExpressionSmile   = "smile"
+	ExpressionNeutral = "neutral"
+)
+
+// ExpressionClassifier estimates the facial expression of a face.
+type ExpressionClassifier interface {
+	Expression(img image.Image, face FaceInfo) (string, float64, error)
+}
+
+// defaultSmileRatio is the default mouth width to interpupillary distance ratio
+// above which the face is considered smiling.
+const defaultSmileRatio = 0.9
+
+// SmileClassifier is a landmark based smile detector: a smiling mouth is wider
+// relative to the interpupillary distance than a neutral one.
+type SmileClassifier struct {
+	// WidthRatio is the mouth width to interpupillary distance ratio above which the face is smiling.
+	WidthRatio float64
+}
+
+// Expression implements the ExpressionClassifier interface.
+// The returned score is the mouth width to interpupillary distance ratio.
+func (sc *SmileClassifier) Expression(img image.Image, face FaceInfo) (string, float64, error) {
+	if !validPoint(face.LeftEye) || !validPoint(face.RightEye) ||
+		!validPoint(face.MouthLeft) || !validPoint(face.MouthRight) {
+		return ExpressionNeutral, 0, nil
+	}
+	ipd := distance(face.LeftEye.Col, face.LeftEye.Row, face.RightEye.Col, face.RightEye.Row)
+	if ipd == 0 {
+		return ExpressionNeutral, 0, nil
+	}
+	ratio := distance(face.MouthLeft.Col, face.MouthLeft.Row, face.MouthRight.Col, face.MouthRight.Row) / ipd
+	if ratio > sc.WidthRatio {
+		return ExpressionSmile, ratio, nil
+	}
+	return ExpressionNeutral, ratio, nil
+}
+
+// ExpressionRenderer selects the renderer by the facial expression of each face.
+// The faces with an expression without an associated renderer are rendered
+// with the Default renderer, or left untouched if it is nil.
+type ExpressionRenderer struct {
+	Classifier ExpressionClassifier
+	Renderers  map[string]Renderer
+	Default    Renderer
+}
+
+// Render implements the Renderer interface.
+func (er *ExpressionRenderer) Render(ctx *gg.Context, face FaceInfo) error {
+	expr, _, err := er.Classifier.Expression(ctx.Image(), face)
+	if err != nil {
+		return err
+	}
+	r, ok := er.Renderers[expr]
+	if !ok {
+		r = er.Default
+	}
+	if r == nil {
+		return nil
+	}
+	return r.Render(ctx, face)
+}
+
+// BadgeRenderer draws an emoji like badge next to the face, reflecting its facial expression.
+type BadgeRenderer struct {
+	Classifier ExpressionClassifier
+}
+
+// Render implements the Renderer interface.
+func (br *BadgeRenderer) Render(ctx *gg.Context, face FaceInfo) error {
+	expr, _, err := br.Classifier.Expression(ctx.Image(), face)
+	if err != nil {
+		return err
+	}
+	r := float64(face.Scale) * 0.15
+	x := float64(face.Col) + float64(face.Scale)/2 + r
+	y := float64(face.Row) - float64(face.Scale)/2 + r
+	drawSmiley(ctx, x, y, r, expr == ExpressionSmile)
+
+	return nil
+}
+
+// drawSmiley draws a smiley face centered at x, y, smiling or with a straight mouth.
+func drawSmiley(ctx *gg.Context, x, y, r float64, smile bool) {
+	ctx.Push()
+	defer ctx.Pop()
+
+	ctx.DrawCircle(x, y, r)
+	ctx.SetRGB255(255, 204, 77)
+	ctx.FillPreserve()
+	ctx.SetRGB255(102, 69, 0)
+	ctx.SetLineWidth(math.Max(1, r*0.08))
+	ctx.Stroke()
+
+	ctx.DrawCircle(x-r*0.35, y-r*0.25, r*0.12)
+	ctx.DrawCircle(x+r*0.35, y-r*0.25, r*0.12)
+	ctx.Fill()
+
+	if smile {
+		ctx.DrawArc(x, y+r*0.05, r*0.5, 0.15*math.Pi, 0.85*math.Pi)
+	} else {
+		ctx.DrawLine(x-r*0.4, y+r*0.4, x+r*0.4, y+r*0.4)
+	}
+	ctx.Stroke()
+}
+
+// validPoint reports whether the localized point is usable.
+func validPoint(p *pigo.Puploc) bool {
+	return p != nil && p.Row >= 0 && p.Col >= 0
+}
+
+func distance(x1, y1, x2, y2 int) float64 {
+	return math.Hypot(float64(x2-x1), float64(y2-y1))
+}
+
+// EmojiRenderer fully covers the face with an emoji, scaled to the face size and
+// rotated with the head. The emoji image is selected by the facial expression
+// from Emojis, falling back to the image registered for the empty expression.
+// Without any image a smiley reflecting the expression is drawn.
+type EmojiRenderer struct {
+	Classifier ExpressionClassifier
+	Emojis     map[string]image.Image
+}
+
+// Render implements the Renderer interface.
+func (er *EmojiRenderer) Render(ctx *gg.Context, face FaceInfo) error {
+	expr, _, err := er.Classifier.Expression(ctx.Image(), face)
+	if err != nil {
+		return err
+	}
+	size := float64(face.Scale) * 1.1
+	x, y := float64(face.Col), float64(face.Row)
+
+	emoji, ok := er.Emojis[expr]
+	if !ok {
+		emoji, ok = er.Emojis[""]
+	}
+	if !ok {
+		drawSmiley(ctx, x, y, size/2, expr == ExpressionSmile)
+		return nil
+	}
+
+	var angle float64
+	if validPoint(face.LeftEye) && validPoint(face.RightEye) {
+		angle = math.Atan2(float64(face.RightEye.Row-face.LeftEye.Row), float64(face.RightEye.Col-face.LeftEye.Col))
+	}
+	dx, dy := float64(emoji.Bounds().Dx()), float64(emoji.Bounds().Dy())
+	scale := size / math.Max(dx, dy)
+
+	ctx.Push()
+	ctx.Translate(x, y)
+	ctx.Rotate(angle)
+	ctx.Scale(scale, scale)
+	ctx.DrawImageAnchored(emoji, 0, 0, 0.5, 0.5)
+	ctx.Pop()
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package facemask
+
+import "math"
+
+// The eye measurements relative to the interpupillary distance: eyeRegionRatio is the half
+// size of the region examined around the pupils, and irisHeightRatio the visible height
+// of the iris of an open eye, which is about a fifth of the distance across, but partly
+// covered by the eyelids.
+const (
+	eyeRegionRatio  = 0.15
+	irisHeightRatio = 0.1
+)
+
+// EyeOpenness estimates how open the eyes of the face are in the last detected image, from
+// 0 for the closed eyes to 1 for the open ones. The landmark cascades provide no eyelid
+// points, so it's measured from the grayscale image: an open eye shows the dark iris as
+// a tall blob at the pupil, while a closed eye only shows the thin line of the eyelashes.
+// It returns false when the pupils are not localized.
+func (fd *Detector) EyeOpenness(face FaceInfo) (float64, bool) {
+	if !validPoint(face.LeftEye) || !validPoint(face.RightEye) {
+		return 0, false
+	}
+	ipd := distance(face.LeftEye.Col, face.LeftEye.Row, face.RightEye.Col, face.RightEye.Row)
+	if ipd < 1 {
+		return 0, false
+	}
+	left := darkExtent(fd.params.Pixels, fd.params.Cols, fd.params.Rows, fd.params.Dim, face.LeftEye.Col, face.LeftEye.Row, ipd)
+	right := darkExtent(fd.params.Pixels, fd.params.Cols, fd.params.Rows, fd.params.Dim, face.RightEye.Col, face.RightEye.Row, ipd)
+	return clamp((left+right)/2/(irisHeightRatio*ipd), 0, 1), true
+}
+
+// darkExtent returns the height of the dark run through the pupil in the grayscale image:
+// the rows of a narrow strip at the pupil which are darker than the midpoint between the
+// darkest pixel and the mean of the eye region.
+func darkExtent(pixels []uint8, cols, rows, dim, px, py int, ipd float64) float64 {
+	r := int(math.Ceil(eyeRegionRatio * ipd))
+	strip := r/3 + 1
+	x0, x1 := clampInt(px-r, 0, cols), clampInt(px+r+1, 0, cols)
+	y0, y1 := clampInt(py-r, 0, rows), clampInt(py+r+1, 0, rows)
+	if x1 <= x0 || y1 <= y0 || py < y0 || py >= y1 {
+		return 0
+	}
+	sum, min := 0, 255
+	for y := y0; y < y1; y++ {
+		for _, v := range pixels[y*dim+x0 : y*dim+x1] {
+			sum += int(v)
+			if int(v) < min {
+				min = int(v)
+			}
+		}
+	}
+	mean := float64(sum) / float64((x1-x0)*(y1-y0))
+	threshold := (float64(min) + mean) / 2
+
+	sx0, sx1 := clampInt(px-strip, x0, x1), clampInt(px+strip+1, x0, x1)
+	dark := func(y int) bool {
+		s := 0
+		for _, v := range pixels[y*dim+sx0 : y*dim+sx1] {
+			s += int(v)
+		}
+		return float64(s)/float64(sx1-sx0) < threshold
+	}
+	// The run grows from the pupil row, allowing for the localization to be a row off.
+	start := py
+	if !dark(start) {
+		if start+1 < y1 && dark(start+1) {
+			start++
+		} else if start-1 >= y0 && dark(start-1) {
+			start--
+		} else {
+			return 0
+		}
+	}
+	top, bottom := start, start
+	for top-1 >= y0 && dark(top-1) {
+		top--
+	}
+	for bottom+1 < y1 && dark(bottom+1) {
+		bottom++
+	}
+	return float64(bottom - top + 1)
+}
+
+// defaultBlinkRatio is the fraction of the usual eye openness under which the eyes are closed.
+const defaultBlinkRatio = 0.5
+
+// BlinkCounter detects the blinks of a face over the frames of a video from its eye
+// openness. The measured openness depends on the person and on the lighting, so the
+// eyes are considered closed when it drops under Ratio of its running average over
+// the frames with the open eyes.
+type BlinkCounter struct {
+	// Ratio is the fraction of the usual openness under which the eyes are closed.
+	// Zero means the default of 0.5.
+	Ratio float64
+
+	baseline float64
+	closed   bool
+}
+
+// Update adds the eye openness of the next frame and reports whether a blink has just
+// completed, i.e. the eyes open again after being closed.
+func (bc *BlinkCounter) Update(openness float64) bool {
+	ratio := bc.Ratio
+	if ratio == 0 {
+		ratio = defaultBlinkRatio
+	}
+	if bc.baseline == 0 {
+		bc.baseline = openness
+		return false
+	}
+	if openness < bc.baseline*ratio {
+		bc.closed = true
+		return false
+	}
+	// The baseline adapts slowly, so a blink lasting a few frames doesn't lower it.
+	bc.baseline = 0.9*bc.baseline + 0.1*openness
+	blinked := bc.closed
+	bc.closed = false
+	return blinked
+}
@@ -0,0 +1,98 @@
+package facemask
+
+import (
+	"image"
+	"math"
+
+	pigo "github.com/esimov/pigo/core"
+	"github.com/fogleman/gg"
+)
+
+// Face is the self describing result of a processed face, exposing the
+// detection in the image types instead of the raw Pigo quadruplets.
+type Face struct {
+	// Box is the bounding box of the face.
+	Box image.Rectangle `json:"box"`
+	// Score is the detection quality of the face.
+	Score float32 `json:"score"`
+	// LeftEye and RightEye are the pupil positions, nil when they were not localized.
+	LeftEye  *image.Point `json:"left_eye,omitempty"`
+	RightEye *image.Point `json:"right_eye,omitempty"`
+	// Landmarks holds the localized facial landmark points by name.
+	Landmarks map[string]image.Point `json:"landmarks,omitempty"`
+	// Roll is the lean angle of the eyes line in degrees, positive when the head leans clockwise.
+	Roll float64 `json:"roll"`
+	// Yaw is the estimated head turn in degrees, valid when Pose is not nil.
+	Yaw float64 `json:"yaw"`
+	// Pose is the estimated head pose, nil when it could not be estimated.
+	Pose *HeadPose `json:"pose,omitempty"`
+	// Occluded is set when the landmark points were not reliable.
+	Occluded bool `json:"occluded"`
+	// Anchors are the named anchor regions of the face, on which the overlays are placed.
+	Anchors map[string]Anchor `json:"anchors,omitempty"`
+	// Mask is the placement of the mask overlay, nil when the detector overlay is not a mask.
+	Mask *MaskTransform `json:"mask,omitempty"`
+}
+
+// Faces converts the localized faces of the last detection into their self describing form.
+// The mask transform is computed for the overlay of the detector, which defaults to the mask renderer.
+func (fd *Detector) Faces(infos []FaceInfo) ([]Face, error) {
+	overlay := fd.Overlay
+	if overlay == nil {
+		overlay = defaultOverlay
+	}
+	faces := make([]Face, 0, len(infos))
+	for _, info := range infos {
+		face := NewFace(info)
+		if mr, ok := overlay.(*MaskRenderer); ok {
+			t, err := mr.Transform(fd.ctx.Image(), info)
+			if err != nil {
+				return nil, err
+			}
+			face.Mask = &t
+		}
+		faces = append(faces, face)
+	}
+	return faces, nil
+}
+
+// NewFace converts the localized face into its self describing form, without the mask transform.
+func NewFace(info FaceInfo) Face {
+	half := info.Scale / 2
+	face := Face{
+		Box:      image.Rect(info.Col-half, info.Row-half, info.Col+half, info.Row+half),
+		Score:    info.Q,
+		LeftEye:  facePoint(info.LeftEye),
+		RightEye: facePoint(info.RightEye),
+		Pose:     info.Pose,
+		Occluded: info.Occluded,
+		Anchors:  info.Anchors(),
+	}
+	if len(info.Landmarks) > 0 {
+		face.Landmarks = make(map[string]image.Point, len(info.Landmarks))
+		for name, p := range info.Landmarks {
+			if validPoint(p) {
+				face.Landmarks[name] = image.Pt(p.Col, p.Row)
+			}
+		}
+	}
+	if face.LeftEye != nil && face.RightEye != nil {
+		face.Roll = gg.Degrees(math.Atan2(
+			float64(face.RightEye.Y-face.LeftEye.Y),
+			float64(face.RightEye.X-face.LeftEye.X),
+		))
+	} else if info.Pose != nil {
+		face.Roll = info.Pose.Roll
+	}
+	if info.Pose != nil {
+		face.Yaw = info.Pose.Yaw
+	}
+	return face
+}
+
+func facePoint(p *pigo.Puploc) *image.Point {
+	if !validPoint(p) {
+		return nil
+	}
+	return &image.Point{X: p.Col, Y: p.Row}
+}
@@ -0,0 +1,71 @@
+package facemask
+
+import "image"
+
+// featherAlpha softens the alpha edge of the overlay over the radius in pixels: the alpha
+// channel is box blurred twice, which approximates a Gaussian, then stretched so the edge,
+// where the blur is half transparent, becomes fully transparent. This way the edge fades
+// inwards and no halo is added outside of the overlay. The blurred alpha is only used where
+// it's lower than the original. The pixels beyond the image bounds count as transparent.
+func featherAlpha(img *image.NRGBA, radius int) *image.NRGBA {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if radius <= 0 || w == 0 || h == 0 {
+		return img
+	}
+	alpha := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			alpha[y*w+x] = float64(img.Pix[y*img.Stride+x*4+3])
+		}
+	}
+	// Two passes of the blur spread the edge over twice the radius, of which
+	// the inner half remains after the stretching.
+	r := (radius + 1) / 2
+	tmp := make([]float64, w*h)
+	for pass := 0; pass < 2; pass++ {
+		boxBlur(alpha, tmp, w, h, r, 1, w)
+		boxBlur(tmp, alpha, h, w, r, w, 1)
+	}
+
+	dst := image.NewNRGBA(img.Bounds())
+	copy(dst.Pix, img.Pix)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*dst.Stride + x*4 + 3
+			if a := clamp(2*alpha[y*w+x]-255, 0, 255); a < float64(dst.Pix[i]) {
+				dst.Pix[i] = uint8(a)
+			}
+		}
+	}
+	return dst
+}
+
+// boxBlur blurs the lines of the src values into dst with a box of the radius. The lines
+// have n values step apart, and the lines start stride apart from each other.
+func boxBlur(src, dst []float64, n, lines, radius, step, stride int) {
+	size := float64(2*radius + 1)
+	for l := 0; l < lines; l++ {
+		start := l * stride
+		var sum float64
+		for i := 0; i <= radius && i < n; i++ {
+			sum += src[start+i*step]
+		}
+		for i := 0; i < n; i++ {
+			dst[start+i*step] = sum / size
+			if j := i + radius + 1; j < n {
+				sum += src[start+j*step]
+			}
+			if j := i - radius; j >= 0 {
+				sum -= src[start+j*step]
+			}
+		}
+	}
+}
+
+// fadeAlpha scales the alpha channel of the overlay by the opacity, in place.
+func fadeAlpha(img *image.NRGBA, opacity float64) *image.NRGBA {
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = uint8(float64(img.Pix[i])*opacity + 0.5)
+	}
+	return img
+}
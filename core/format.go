@@ -0,0 +1,64 @@
+package facemask
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Format is the encoding format of the output images.
+type Format int
+
+// The supported output formats.
+const (
+	JPEG Format = iota
+	PNG
+)
+
+// String returns the name of the format.
+func (f Format) String() string {
+	switch f {
+	case JPEG:
+		return "jpeg"
+	case PNG:
+		return "png"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// FormatFromExt returns the format matching the extension of the file name.
+func FormatFromExt(name string) (Format, bool) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg":
+		return JPEG, true
+	case ".png":
+		return PNG, true
+	}
+	return 0, false
+}
+
+// Encode writes the image to w in the provided format.
+func Encode(w io.Writer, img image.Image, format Format) error {
+	switch format {
+	case JPEG:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 100})
+	case PNG:
+		return png.Encode(w, img)
+	}
+	return fmt.Errorf("unsupported image format: %v", format)
+}
+
+// OverlayTo encodes the image of the last detection, including the rendered overlays, to w,
+// preserving the color profile of the source image. Together with DetectImage or DetectReader
+// it processes the images without temporary files.
+func (fd *Detector) OverlayTo(w io.Writer, format Format) error {
+	start := time.Now()
+	err := encodeICC(w, fd.Image(), format, fd.profile)
+	fd.stage(StageEncode, start, err)
+	return err
+}
@@ -0,0 +1,81 @@
+package facemask
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"testing"
+)
+
+// The fuzz tests run the parsers of the untrusted input of the server: the images, the mask
+// pack manifests and the mask placements of the composite endpoint. A panic is a bug of the
+// parser the fuzzer reports.
+//
+//	go test -fuzz FuzzDecode -fuzztime 10m ./core
+
+// fuzzLimits bound the fuzzed images, far below the limits of the server, so every input
+// is decoded quickly.
+var fuzzLimits = SourceLimits{MaxSize: 1 << 20, MaxPixels: 1 << 20}
+
+// fuzzSeeds adds the sample files to the seed corpus of the fuzz test.
+func fuzzSeeds(f *testing.F, files ...string) {
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+// FuzzDecode runs the image ingestion path over the data: the format sniffing with the size
+// limits, the Exif orientation and the ICC profile readers, the decoding, and the JPEG parser
+// of the region recompression and of the reduced decoding.
+func FuzzDecode(f *testing.F) {
+	fuzzSeeds(f, "testdata/cmyk.jpg", "testdata/gray.jpg", "testdata/alpha.png", "../testdata/face.jpg")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		readOrientation(bytes.NewReader(data))
+		readICC(bytes.NewReader(data))
+		parseJPEG(data)
+		if _, _, err := ReadSource(BytesSource{Label: "fuzz", Data: data}, fuzzLimits); err != nil {
+			return
+		}
+		// The reduced decoding isn't guarded against the panics, unlike the decoders.
+		decodeJPEGReduced(data, 2)
+		decodeReader(bytes.NewReader(data), 0)
+	})
+}
+
+// FuzzManifest parses the data as the manifest of a mask pack.
+func FuzzManifest(f *testing.F) {
+	fuzzSeeds(f, "testdata/manifest.json")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := ParseManifest(data, ".")
+		if err != nil {
+			return
+		}
+		for _, asset := range m.Masks {
+			m.Path(asset)
+		}
+	})
+}
+
+// FuzzTransforms parses the data as the mask placements of the composite endpoint and
+// checks them against the bounds of an image.
+func FuzzTransforms(f *testing.F) {
+	fuzzSeeds(f, "testdata/transforms.json")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		transforms, err := ParseTransforms(data, 1000)
+		if err != nil {
+			return
+		}
+		if err := CheckTransforms(transforms, image.Rect(0, 0, 640, 480)); err != nil {
+			return
+		}
+		for i, tr := range transforms {
+			if tr.Rect.Empty() {
+				t.Errorf("empty transform %d accepted: %v", i, tr.Rect)
+			}
+		}
+	})
+}
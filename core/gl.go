@@ -0,0 +1,307 @@
+//go:build gl
+// +build gl
+
+package facemask
+
+/*
+#cgo LDFLAGS: -lEGL -lGLESv2
+#include <EGL/egl.h>
+#include <EGL/eglext.h>
+#include <GLES2/gl2.h>
+
+static EGLDisplay fm_display;
+static EGLSurface fm_surface;
+static EGLContext fm_context;
+static GLuint fm_program, fm_fbo, fm_target, fm_mask;
+static GLint fm_pos, fm_uv, fm_sampler;
+
+static const char *fm_vertex =
+	"attribute vec2 pos;\n"
+	"attribute vec2 uv;\n"
+	"varying vec2 v_uv;\n"
+	"void main() {\n"
+	"	v_uv = uv;\n"
+	"	gl_Position = vec4(pos, 0.0, 1.0);\n"
+	"}\n";
+
+// The mask texture holds premultiplied colors, so it's filtered without dark fringes
+// and blended as it is over the premultiplied image.
+static const char *fm_fragment =
+	"precision mediump float;\n"
+	"uniform sampler2D mask;\n"
+	"varying vec2 v_uv;\n"
+	"void main() {\n"
+	"	gl_FragColor = texture2D(mask, v_uv);\n"
+	"}\n";
+
+static GLuint fm_shader(GLenum type, const char *src) {
+	GLint ok;
+	GLuint shader = glCreateShader(type);
+	glShaderSource(shader, 1, &src, NULL);
+	glCompileShader(shader);
+	glGetShaderiv(shader, GL_COMPILE_STATUS, &ok);
+	return ok ? shader : 0;
+}
+
+static void fm_texture(GLuint tex) {
+	glBindTexture(GL_TEXTURE_2D, tex);
+	glTexParameteri(GL_TEXTURE_2D, GL_TEXTURE_MIN_FILTER, GL_LINEAR);
+	glTexParameteri(GL_TEXTURE_2D, GL_TEXTURE_MAG_FILTER, GL_LINEAR);
+	glTexParameteri(GL_TEXTURE_2D, GL_TEXTURE_WRAP_S, GL_CLAMP_TO_EDGE);
+	glTexParameteri(GL_TEXTURE_2D, GL_TEXTURE_WRAP_T, GL_CLAMP_TO_EDGE);
+}
+
+// fm_display_open returns the default display, or on the headless machines the surfaceless
+// display of Mesa, which renders without any window system.
+static EGLDisplay fm_display_open() {
+	PFNEGLGETPLATFORMDISPLAYEXTPROC get_platform_display;
+	EGLDisplay display = eglGetDisplay(EGL_DEFAULT_DISPLAY);
+
+	if (display != EGL_NO_DISPLAY && eglInitialize(display, NULL, NULL)) {
+		return display;
+	}
+	get_platform_display = (PFNEGLGETPLATFORMDISPLAYEXTPROC)eglGetProcAddress("eglGetPlatformDisplayEXT");
+	if (!get_platform_display) {
+		return EGL_NO_DISPLAY;
+	}
+	display = get_platform_display(EGL_PLATFORM_SURFACELESS_MESA, EGL_DEFAULT_DISPLAY, NULL);
+	if (display == EGL_NO_DISPLAY || !eglInitialize(display, NULL, NULL)) {
+		return EGL_NO_DISPLAY;
+	}
+	return display;
+}
+
+// fm_init creates the offscreen OpenGL ES 2 context and the blending program on the
+// calling thread. It returns the error message, or NULL on success.
+static const char* fm_init() {
+	EGLint config_attrs[] = {
+		EGL_SURFACE_TYPE, EGL_PBUFFER_BIT,
+		EGL_RENDERABLE_TYPE, EGL_OPENGL_ES2_BIT,
+		EGL_RED_SIZE, 8, EGL_GREEN_SIZE, 8, EGL_BLUE_SIZE, 8, EGL_ALPHA_SIZE, 8,
+		EGL_NONE,
+	};
+	EGLint surface_attrs[] = {EGL_WIDTH, 1, EGL_HEIGHT, 1, EGL_NONE};
+	EGLint context_attrs[] = {EGL_CONTEXT_CLIENT_VERSION, 2, EGL_NONE};
+	EGLConfig config;
+	EGLint n;
+	GLint ok;
+	GLuint vs, fs;
+
+	fm_display = fm_display_open();
+	if (fm_display == EGL_NO_DISPLAY) {
+		return "no EGL display";
+	}
+	// All the rendering goes to a framebuffer object, so the displays without the
+	// pbuffer surfaces are used without any surface.
+	fm_surface = EGL_NO_SURFACE;
+	if (eglChooseConfig(fm_display, config_attrs, &config, 1, &n) && n > 0) {
+		fm_surface = eglCreatePbufferSurface(fm_display, config, surface_attrs);
+	} else {
+		config_attrs[1] = 0;
+		if (!eglChooseConfig(fm_display, config_attrs, &config, 1, &n) || n == 0) {
+			return "no EGL configuration supporting OpenGL ES 2";
+		}
+	}
+	eglBindAPI(EGL_OPENGL_ES_API);
+	fm_context = eglCreateContext(fm_display, config, EGL_NO_CONTEXT, context_attrs);
+	if (fm_context == EGL_NO_CONTEXT) {
+		return "can't create the OpenGL ES 2 context";
+	}
+	if (!eglMakeCurrent(fm_display, fm_surface, fm_surface, fm_context)) {
+		return "can't activate the OpenGL ES 2 context";
+	}
+
+	vs = fm_shader(GL_VERTEX_SHADER, fm_vertex);
+	fs = fm_shader(GL_FRAGMENT_SHADER, fm_fragment);
+	if (!vs || !fs) {
+		return "can't compile the shaders";
+	}
+	fm_program = glCreateProgram();
+	glAttachShader(fm_program, vs);
+	glAttachShader(fm_program, fs);
+	glLinkProgram(fm_program);
+	glGetProgramiv(fm_program, GL_LINK_STATUS, &ok);
+	if (!ok) {
+		return "can't link the shaders";
+	}
+	fm_pos = glGetAttribLocation(fm_program, "pos");
+	fm_uv = glGetAttribLocation(fm_program, "uv");
+	fm_sampler = glGetUniformLocation(fm_program, "mask");
+
+	glGenFramebuffers(1, &fm_fbo);
+	glGenTextures(1, &fm_target);
+	glGenTextures(1, &fm_mask);
+	fm_texture(fm_target);
+	fm_texture(fm_mask);
+	glPixelStorei(GL_UNPACK_ALIGNMENT, 1);
+	glPixelStorei(GL_PACK_ALIGNMENT, 1);
+	return NULL;
+}
+
+// fm_upload_mask uploads the premultiplied pixels of the mask image.
+static void fm_upload_mask(const void *pix, int w, int h) {
+	glBindTexture(GL_TEXTURE_2D, fm_mask);
+	glTexImage2D(GL_TEXTURE_2D, 0, GL_RGBA, w, h, 0, GL_RGBA, GL_UNSIGNED_BYTE, pix);
+}
+
+// fm_composite blends the mask over the w x h premultiplied pixels, which are updated in place.
+// The quad holds the corners of the mask in normalized device coordinates, in the top left,
+// top right, bottom left and bottom right order. It returns the error message, or NULL on success.
+static const char* fm_composite(void *pix, int w, int h, const float *quad) {
+	static const float uv[] = {0, 0, 1, 0, 0, 1, 1, 1};
+
+	// The pixels are uploaded as the render target, so they are the background of the blending.
+	glBindTexture(GL_TEXTURE_2D, fm_target);
+	glTexImage2D(GL_TEXTURE_2D, 0, GL_RGBA, w, h, 0, GL_RGBA, GL_UNSIGNED_BYTE, pix);
+	glBindFramebuffer(GL_FRAMEBUFFER, fm_fbo);
+	glFramebufferTexture2D(GL_FRAMEBUFFER, GL_COLOR_ATTACHMENT0, GL_TEXTURE_2D, fm_target, 0);
+	if (glCheckFramebufferStatus(GL_FRAMEBUFFER) != GL_FRAMEBUFFER_COMPLETE) {
+		return "incomplete framebuffer";
+	}
+	glViewport(0, 0, w, h);
+
+	glUseProgram(fm_program);
+	glActiveTexture(GL_TEXTURE0);
+	glBindTexture(GL_TEXTURE_2D, fm_mask);
+	glUniform1i(fm_sampler, 0);
+	glVertexAttribPointer(fm_pos, 2, GL_FLOAT, GL_FALSE, 0, quad);
+	glEnableVertexAttribArray(fm_pos);
+	glVertexAttribPointer(fm_uv, 2, GL_FLOAT, GL_FALSE, 0, uv);
+	glEnableVertexAttribArray(fm_uv);
+	glEnable(GL_BLEND);
+	glBlendFunc(GL_ONE, GL_ONE_MINUS_SRC_ALPHA);
+	glDrawArrays(GL_TRIANGLE_STRIP, 0, 4);
+
+	glReadPixels(0, 0, w, h, GL_RGBA, GL_UNSIGNED_BYTE, pix);
+	if (glGetError() != GL_NO_ERROR) {
+		return "OpenGL ES error";
+	}
+	return NULL;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"reflect"
+	"runtime"
+	"unsafe"
+
+	"github.com/fogleman/gg"
+)
+
+func init() {
+	RegisterCompositor("gl", func() (Compositor, error) {
+		return newGLCompositor()
+	})
+}
+
+// glCompositor resizes, rotates and blends the masks on the GPU with OpenGL ES 2, through
+// an offscreen EGL context. The masks are resized with the bilinear filter, so they look
+// best when they are not much larger than the overlays. The context is bound to a
+// single OS thread, which runs all the OpenGL calls.
+type glCompositor struct {
+	calls chan func()
+	// mask is the mask image uploaded last, which is not uploaded again while it's drawn.
+	mask image.Image
+}
+
+// newGLCompositor creates the OpenGL ES context on its own locked OS thread.
+func newGLCompositor() (*glCompositor, error) {
+	gc := &glCompositor{calls: make(chan func())}
+	errc := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		if msg := C.fm_init(); msg != nil {
+			errc <- fmt.Errorf("gl compositor: %s", C.GoString(msg))
+			return
+		}
+		errc <- nil
+		for call := range gc.calls {
+			call()
+		}
+	}()
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return gc, nil
+}
+
+// Composite implements the Compositor interface. Only the region of the image under the
+// rotated mask is copied to the GPU and back.
+func (gc *glCompositor) Composite(ctx *gg.Context, mask image.Image, t MaskTransform) error {
+	dst, ok := ctx.Image().(*image.RGBA)
+	if !ok {
+		return errors.New("gl compositor: unsupported image type")
+	}
+	w, h := float64(t.Rect.Dx()), float64(t.Rect.Dy())
+	sin, cos := math.Sincos(t.Angle * math.Pi / 180)
+	bw, bh := math.Abs(w*cos)+math.Abs(h*sin), math.Abs(w*sin)+math.Abs(h*cos)
+	region := image.Rect(0, 0, int(math.Ceil(bw)), int(math.Ceil(bh))).Add(t.Rect.Min).Intersect(dst.Bounds())
+	if region.Empty() || mask.Bounds().Empty() {
+		return nil
+	}
+
+	// The corners of the mask rotated counterclockwise around the center of its rotated
+	// bounds, mapped into the normalized device coordinates of the region. The rows are
+	// not flipped, since the region is read back in the order it's uploaded.
+	cx, cy := float64(t.Rect.Min.X)+bw/2, float64(t.Rect.Min.Y)+bh/2
+	var quad [8]C.float
+	for i, c := range [4][2]float64{{-w / 2, -h / 2}, {w / 2, -h / 2}, {-w / 2, h / 2}, {w / 2, h / 2}} {
+		x := cx + c[0]*cos + c[1]*sin - float64(region.Min.X)
+		y := cy - c[0]*sin + c[1]*cos - float64(region.Min.Y)
+		quad[2*i] = C.float(2*x/float64(region.Dx()) - 1)
+		quad[2*i+1] = C.float(2*y/float64(region.Dy()) - 1)
+	}
+
+	rw, rh := region.Dx(), region.Dy()
+	pix := make([]uint8, rw*rh*4)
+	for y := 0; y < rh; y++ {
+		i := dst.PixOffset(region.Min.X, region.Min.Y+y)
+		copy(pix[y*rw*4:(y+1)*rw*4], dst.Pix[i:i+rw*4])
+	}
+
+	var msg *C.char
+	gc.call(func() {
+		if !gc.uploaded(mask) {
+			// Drawing into an RGBA image premultiplies the colors.
+			b := mask.Bounds()
+			rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+			draw.Draw(rgba, rgba.Bounds(), mask, b.Min, draw.Src)
+			C.fm_upload_mask(unsafe.Pointer(&rgba.Pix[0]), C.int(b.Dx()), C.int(b.Dy()))
+			gc.mask = mask
+		}
+		if msg = C.fm_composite(unsafe.Pointer(&pix[0]), C.int(rw), C.int(rh), &quad[0]); msg != nil {
+			gc.mask = nil
+		}
+	})
+	if msg != nil {
+		return fmt.Errorf("gl compositor: %s", C.GoString(msg))
+	}
+
+	for y := 0; y < rh; y++ {
+		i := dst.PixOffset(region.Min.X, region.Min.Y+y)
+		copy(dst.Pix[i:i+rw*4], pix[y*rw*4:(y+1)*rw*4])
+	}
+	return nil
+}
+
+// call runs the function on the thread of the OpenGL context and waits for it.
+func (gc *glCompositor) call(fn func()) {
+	done := make(chan struct{})
+	gc.calls <- func() {
+		defer close(done)
+		fn()
+	}
+	<-done
+}
+
+// uploaded reports whether the mask is the image uploaded last. Only the
+// images referenced by pointers, like the decoded ones, are compared.
+func (gc *glCompositor) uploaded(mask image.Image) bool {
+	return gc.mask != nil && reflect.TypeOf(mask).Kind() == reflect.Ptr && gc.mask == mask
+}
@@ -0,0 +1,74 @@
+package facemask
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+const (
+	// bridgeEdgeThreshold is the mean vertical gradient of the nose bridge region
+	// above which a glasses frame is assumed to cross it.
+	bridgeEdgeThreshold = 12
+	// highlightThreshold is the ratio of the saturated pixels around the eyes
+	// above which the specular highlights of the lenses are assumed.
+	highlightThreshold = 0.04
+)
+
+// HasGlasses reports whether the face wears eyeglasses. The detection is based on
+// two cues: the frame bridge crossing the nose between the eyes, which produces strong
+// horizontal edges, and the specular highlights reflected by the lenses.
+func HasGlasses(img image.Image, face FaceInfo) bool {
+	lx, ly, rx, ry := eyePoints(face)
+	ipd := math.Hypot(rx-lx, ry-ly)
+	if ipd < 4 {
+		return false
+	}
+	cx, cy := (lx+rx)/2, (ly+ry)/2
+
+	bridge := image.Rect(
+		int(cx-ipd*0.15), int(cy-ipd*0.2),
+		int(cx+ipd*0.15), int(cy+ipd*0.15),
+	).Intersect(img.Bounds())
+	if edges := verticalGradient(img, bridge); edges > bridgeEdgeThreshold {
+		return true
+	}
+
+	var highlights, total int
+	for _, ex := range []float64{lx, rx} {
+		eye := image.Rect(
+			int(ex-ipd*0.3), int(cy-ipd*0.2),
+			int(ex+ipd*0.3), int(cy+ipd*0.2),
+		).Intersect(img.Bounds())
+		for y := eye.Min.Y; y < eye.Max.Y; y++ {
+			for x := eye.Min.X; x < eye.Max.X; x++ {
+				if luminance(img.At(x, y)) > 245 {
+					highlights++
+				}
+				total++
+			}
+		}
+	}
+	return total > 0 && float64(highlights)/float64(total) > highlightThreshold
+}
+
+// verticalGradient returns the mean absolute vertical luminance gradient of the region.
+func verticalGradient(img image.Image, rect image.Rectangle) float64 {
+	if rect.Dx() < 1 || rect.Dy() < 2 {
+		return 0
+	}
+	var sum float64
+	for x := rect.Min.X; x < rect.Max.X; x++ {
+		prev := luminance(img.At(x, rect.Min.Y))
+		for y := rect.Min.Y + 1; y < rect.Max.Y; y++ {
+			cur := luminance(img.At(x, y))
+			sum += math.Abs(cur - prev)
+			prev = cur
+		}
+	}
+	return sum / float64(rect.Dx()*(rect.Dy()-1))
+}
+
+func luminance(c color.Color) float64 {
+	return float64(color.GrayModel.Convert(c).(color.Gray).Y)
+}
@@ -0,0 +1,233 @@
+package facemask
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+)
+
+// Tolerance bounds the differences of an output from its golden image, so the regression
+// checks survive the rounding changes of the compositing while catching the misplaced masks.
+type Tolerance struct {
+	// MinSSIM is the minimum structural similarity of the luma of the images, 1 for the
+	// identical images.
+	MinSSIM float64
+	// MaxDelta is the largest difference of a channel of a pixel still counted as unchanged.
+	MaxDelta int
+	// MaxChanged is the maximum fraction of the changed pixels.
+	MaxChanged float64
+}
+
+// DefaultTolerance accepts the small rounding differences of the resampling and the encoding.
+var DefaultTolerance = Tolerance{MinSSIM: 0.99, MaxDelta: 8, MaxChanged: 0.001}
+
+// ImageDiff is the difference of an image from its golden image.
+type ImageDiff struct {
+	// SSIM is the mean structural similarity of the luma of the images.
+	SSIM float64
+	// MaxDelta is the largest difference of a channel of a pixel.
+	MaxDelta int
+	// Changed is the fraction of the pixels differing more than the MaxDelta of the tolerance.
+	Changed float64
+}
+
+// String returns the summary of the difference.
+func (d ImageDiff) String() string {
+	return fmt.Sprintf("ssim %.4f, max delta %d, changed %.3f%%", d.SSIM, d.MaxDelta, d.Changed*100)
+}
+
+// ssimWindow is the size of the windows of the structural similarity, and ssimStride
+// their distance.
+const (
+	ssimWindow = 8
+	ssimStride = 4
+)
+
+// CompareImages compares the image with its golden image, returning the error describing
+// the differences exceeding the tolerance. The images of different sizes always differ.
+func CompareImages(got, want image.Image, tol Tolerance) (ImageDiff, error) {
+	gb, wb := got.Bounds(), want.Bounds()
+	if gb.Dx() != wb.Dx() || gb.Dy() != wb.Dy() {
+		return ImageDiff{}, fmt.Errorf("size %dx%d, want %dx%d", gb.Dx(), gb.Dy(), wb.Dx(), wb.Dy())
+	}
+	w, h := gb.Dx(), gb.Dy()
+	gl, wl := make([]float64, w*h), make([]float64, w*h)
+	var diff ImageDiff
+	changed := 0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			g := color.NRGBAModel.Convert(got.At(gb.Min.X+x, gb.Min.Y+y)).(color.NRGBA)
+			c := color.NRGBAModel.Convert(want.At(wb.Min.X+x, wb.Min.Y+y)).(color.NRGBA)
+			delta := pixelDelta(g, c)
+			if delta > diff.MaxDelta {
+				diff.MaxDelta = delta
+			}
+			if delta > tol.MaxDelta {
+				changed++
+			}
+			gl[y*w+x], wl[y*w+x] = luma(g), luma(c)
+		}
+	}
+	if w*h > 0 {
+		diff.Changed = float64(changed) / float64(w*h)
+	}
+	diff.SSIM = ssim(gl, wl, w, h)
+
+	switch {
+	case diff.SSIM < tol.MinSSIM:
+		return diff, fmt.Errorf("%v: ssim below %.4f", diff, tol.MinSSIM)
+	case diff.Changed > tol.MaxChanged:
+		return diff, fmt.Errorf("%v: more than %.3f%% changed", diff, tol.MaxChanged*100)
+	}
+	return diff, nil
+}
+
+// ssim returns the mean structural similarity of the luma planes over the windows of the
+// planes. The planes smaller than a window are compared as a whole.
+func ssim(a, b []float64, w, h int) float64 {
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+	ww, wh := ssimWindow, ssimWindow
+	if w < ww {
+		ww = w
+	}
+	if h < wh {
+		wh = h
+	}
+	if ww == 0 || wh == 0 {
+		return 1
+	}
+	var sum float64
+	windows := 0
+	for y0 := 0; y0+wh <= h; y0 += ssimStride {
+		for x0 := 0; x0+ww <= w; x0 += ssimStride {
+			var ma, mb float64
+			for y := y0; y < y0+wh; y++ {
+				for x := x0; x < x0+ww; x++ {
+					ma += a[y*w+x]
+					mb += b[y*w+x]
+				}
+			}
+			n := float64(ww * wh)
+			ma, mb = ma/n, mb/n
+			var va, vb, cov float64
+			for y := y0; y < y0+wh; y++ {
+				for x := x0; x < x0+ww; x++ {
+					da, db := a[y*w+x]-ma, b[y*w+x]-mb
+					va += da * da
+					vb += db * db
+					cov += da * db
+				}
+			}
+			va, vb, cov = va/n, vb/n, cov/n
+			sum += (2*ma*mb + c1) * (2*cov + c2) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+			windows++
+		}
+	}
+	return sum / float64(windows)
+}
+
+// DiffImage returns the golden image dimmed, with the pixels of the image differing more
+// than the MaxDelta of the tolerance in red, to locate the regressions.
+func DiffImage(got, want image.Image, tol Tolerance) image.Image {
+	gb, wb := got.Bounds(), want.Bounds()
+	w, h := wb.Dx(), wb.Dy()
+	if gb.Dx() < w {
+		w = gb.Dx()
+	}
+	if gb.Dy() < h {
+		h = gb.Dy()
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, wb.Dx(), wb.Dy()))
+	for y := 0; y < wb.Dy(); y++ {
+		for x := 0; x < wb.Dx(); x++ {
+			c := color.NRGBAModel.Convert(want.At(wb.Min.X+x, wb.Min.Y+y)).(color.NRGBA)
+			v := uint8(luma(c) / 3)
+			dst.SetNRGBA(x, y, color.NRGBA{R: v, G: v, B: v, A: 255})
+			if x >= w || y >= h {
+				continue
+			}
+			g := color.NRGBAModel.Convert(got.At(gb.Min.X+x, gb.Min.Y+y)).(color.NRGBA)
+			if pixelDelta(g, c) > tol.MaxDelta {
+				dst.SetNRGBA(x, y, color.NRGBA{R: 255, A: 255})
+			}
+		}
+	}
+	return dst
+}
+
+// TB is the part of testing.TB used by CheckGolden, so the library doesn't depend on the
+// testing package.
+type TB interface {
+	Helper()
+	Fatalf(format string, args ...interface{})
+}
+
+// CheckGolden compares the image with the golden PNG image of the path in a Go test, failing
+// the test in case they differ more than the tolerance. With the FACEMASK_UPDATE_GOLDEN
+// environment variable set, or if the golden image doesn't exist yet, the golden image is
+// written instead, so the intended changes of the output are reviewed as image diffs.
+func CheckGolden(t TB, got image.Image, golden string, tol Tolerance) {
+	t.Helper()
+	if _, err := os.Stat(golden); os.Getenv("FACEMASK_UPDATE_GOLDEN") != "" || os.IsNotExist(err) {
+		if err := WriteGolden(golden, got); err != nil {
+			t.Fatalf("error writing the golden image %s: %v", golden, err)
+		}
+		return
+	}
+	want, err := ReadGolden(golden)
+	if err != nil {
+		t.Fatalf("error reading the golden image %s: %v", golden, err)
+	}
+	if _, err := CompareImages(got, want, tol); err != nil {
+		t.Fatalf("%s: %v", golden, err)
+	}
+}
+
+// ReadGolden decodes the golden PNG image.
+func ReadGolden(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+// WriteGolden encodes the image as the golden PNG image of the path, creating its directory.
+// PNG is lossless, so the golden images don't drift with the JPEG encoder.
+func WriteGolden(path string, img image.Image) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// luma returns the luma of the color, weighted by its alpha.
+func luma(c color.NRGBA) float64 {
+	return (0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)) * float64(c.A) / 255
+}
+
+// pixelDelta returns the largest difference of the channels of the two colors.
+func pixelDelta(a, b color.NRGBA) int {
+	delta := func(x, y uint8) int {
+		if x > y {
+			return int(x - y)
+		}
+		return int(y - x)
+	}
+	return maxInt(maxInt(delta(a.R, b.R), delta(a.G, b.G)), maxInt(delta(a.B, b.B), delta(a.A, b.A)))
+}
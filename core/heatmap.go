@@ -0,0 +1,92 @@
+package facemask
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// Heatmap renders the scores of the sliding windows classified as faces by the cascade
+// of the last detection as a color heatmap over the source image. Each window spreads
+// its score around its center over the window stride, so the map shows where and how
+// strongly the cascade responded before the overlapping detections were suppressed.
+func (fd *Detector) Heatmap() image.Image {
+	bounds := fd.ctx.Image().Bounds()
+	out := image.NewNRGBA(bounds)
+	draw.Draw(out, bounds, fd.ctx.Image(), bounds.Min, draw.Src)
+
+	cols, rows := bounds.Dx(), bounds.Dy()
+	scores := make([]float64, cols*rows)
+	var max float64
+	for _, w := range fd.windows {
+		splatScore(scores, cols, rows, w, math.Max(1, fd.ShiftFactor*float64(w.Scale)))
+	}
+	for _, s := range scores {
+		max = math.Max(max, s)
+	}
+	if max == 0 {
+		return out
+	}
+
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			v := scores[y*cols+x] / max
+			if v <= 0 {
+				continue
+			}
+			c := heatColor(v)
+			a := 0.25 + 0.5*v
+			off := out.PixOffset(x, y)
+			out.Pix[off] = uint8(float64(out.Pix[off])*(1-a) + float64(c.R)*a)
+			out.Pix[off+1] = uint8(float64(out.Pix[off+1])*(1-a) + float64(c.G)*a)
+			out.Pix[off+2] = uint8(float64(out.Pix[off+2])*(1-a) + float64(c.B)*a)
+		}
+	}
+	return out
+}
+
+// splatScore adds the window score to the map around the window center,
+// with a linear falloff over the radius.
+func splatScore(scores []float64, cols, rows int, w pigo.Detection, radius float64) {
+	r := int(math.Ceil(radius))
+	for y := w.Row - r; y <= w.Row+r; y++ {
+		if y < 0 || y >= rows {
+			continue
+		}
+		for x := w.Col - r; x <= w.Col+r; x++ {
+			if x < 0 || x >= cols {
+				continue
+			}
+			d := math.Hypot(float64(x-w.Col), float64(y-w.Row))
+			if d > radius {
+				continue
+			}
+			scores[y*cols+x] += float64(w.Q) * (1 - d/(radius+1))
+		}
+	}
+}
+
+// heatColor maps the value between 0 and 1 onto a blue, green, yellow, red color scale.
+func heatColor(v float64) color.NRGBA {
+	stops := []color.NRGBA{
+		{0, 0, 255, 255},
+		{0, 255, 255, 255},
+		{0, 255, 0, 255},
+		{255, 255, 0, 255},
+		{255, 0, 0, 255},
+	}
+	pos := clamp(v, 0, 1) * float64(len(stops)-1)
+	i := int(pos)
+	if i >= len(stops)-1 {
+		return stops[len(stops)-1]
+	}
+	t := pos - float64(i)
+	lerp := func(a, b uint8) uint8 {
+		return uint8(float64(a)*(1-t) + float64(b)*t)
+	}
+	a, b := stops[i], stops[i+1]
+	return color.NRGBA{lerp(a.R, b.R), lerp(a.G, b.G), lerp(a.B, b.B), 255}
+}
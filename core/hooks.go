@@ -0,0 +1,68 @@
+package facemask
+
+import (
+	"time"
+
+	"github.com/fogleman/gg"
+)
+
+// The pipeline stages reported to the OnStage hook.
+const (
+	StageDecode    = "decode"
+	StageDetect    = "detect"
+	StageLandmark  = "landmark"
+	StageComposite = "composite"
+	StageEncode    = "encode"
+)
+
+// Hooks are the callbacks invoked by the detector at the pipeline stages, so the embedding
+// applications can veto faces, adjust the overlay placement or collect custom metrics.
+// Any of the hooks may be nil.
+type Hooks struct {
+	// OnFaceDetected is called for every localized face. Returning false vetoes
+	// the face: it's dropped from the results and no overlay is drawn over it.
+	OnFaceDetected func(face *FaceInfo) bool
+	// BeforeComposite is called before the overlay is drawn over the face. It may
+	// adjust the face or the transformation of the drawing context, which is
+	// restored after the face is rendered. An error aborts the rendering.
+	BeforeComposite func(ctx *gg.Context, face *FaceInfo) error
+	// AfterComposite is called after the overlay has been drawn over the face,
+	// with the error of the renderer, if any.
+	AfterComposite func(ctx *gg.Context, face FaceInfo, err error)
+	// OnStage is called at the end of every pipeline stage of an image with the start of
+	// the stage and its error, e.g. to trace or to time the stages. The encoding is reported
+	// by OverlayTo and Save of the detector, not by the detached Results.
+	OnStage func(stage string, start time.Time, err error)
+}
+
+// WithHooks sets the pipeline hooks of the detector.
+func WithHooks(hooks Hooks) Option {
+	return func(fd *Detector) error {
+		fd.Hooks = hooks
+		return nil
+	}
+}
+
+// renderFace renders the overlay over the face, running the composite hooks around it.
+func (fd *Detector) renderFace(ctx *gg.Context, r Renderer, face FaceInfo) error {
+	ctx.Push()
+	defer ctx.Pop()
+
+	if fd.Hooks.BeforeComposite != nil {
+		if err := fd.Hooks.BeforeComposite(ctx, &face); err != nil {
+			return err
+		}
+	}
+	err := r.Render(ctx, face)
+	if fd.Hooks.AfterComposite != nil {
+		fd.Hooks.AfterComposite(ctx, face, err)
+	}
+	return err
+}
+
+// stage reports the end of the pipeline stage to the OnStage hook.
+func (fd *Detector) stage(name string, start time.Time, err error) {
+	if fd.Hooks.OnStage != nil {
+		fd.Hooks.OnStage(name, start, err)
+	}
+}
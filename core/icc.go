@@ -0,0 +1,219 @@
+package facemask
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// The ICC profile is embedded in the JPEG images in APP2 segments starting with this
+// signature, followed by the sequence number and the count of the segments.
+var (
+	iccSignature = []byte("ICC_PROFILE\x00")
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// iccChunkSize is the largest part of the profile fitting into a JPEG segment.
+const iccChunkSize = 65533 - 14
+
+// readICC returns the ICC color profile embedded in the JPEG or PNG image, or nil when
+// there is none. The profile is only copied, never interpreted, so the wide gamut
+// photos (Display P3, Adobe RGB) keep their colors when they are encoded again.
+// The profiles of the CMYK and grayscale images are dropped, since the output is RGB.
+func readICC(r io.Reader) []byte {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(pngSignature))
+	if err != nil {
+		return nil
+	}
+	var profile []byte
+	if bytes.Equal(head, pngSignature) {
+		profile = readPNGICC(br)
+	} else if head[0] == 0xff && head[1] == 0xd8 {
+		profile = readJPEGICC(br)
+	}
+	// The color space signature of the profile header.
+	if len(profile) < 20 || string(profile[16:20]) != "RGB " {
+		return nil
+	}
+	return profile
+}
+
+// readICCFile returns the ICC color profile embedded in the image file.
+func readICCFile(path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	return readICC(f)
+}
+
+// readJPEGICC collects the profile from the APP2 segments preceding the image data.
+func readJPEGICC(r *bufio.Reader) []byte {
+	r.Discard(2)
+	var chunks [][]byte
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(r, marker[:2]); err != nil || marker[0] != 0xff {
+			return nil
+		}
+		switch {
+		case marker[1] == 0xda || marker[1] == 0xd9: // start of scan, end of image
+			return joinICC(chunks)
+		case marker[1] == 0x01 || marker[1] >= 0xd0 && marker[1] <= 0xd7:
+			continue
+		}
+		if _, err := io.ReadFull(r, marker[2:]); err != nil {
+			return nil
+		}
+		n := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if n < 0 {
+			return nil
+		}
+		if marker[1] != 0xe2 {
+			if _, err := r.Discard(n); err != nil {
+				return nil
+			}
+			continue
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil
+		}
+		if len(data) < len(iccSignature)+2 || !bytes.Equal(data[:len(iccSignature)], iccSignature) {
+			continue
+		}
+		seq, count := int(data[len(iccSignature)]), int(data[len(iccSignature)+1])
+		if seq < 1 || seq > count {
+			return nil
+		}
+		if chunks == nil {
+			chunks = make([][]byte, count)
+		}
+		if count != len(chunks) {
+			return nil
+		}
+		chunks[seq-1] = data[len(iccSignature)+2:]
+	}
+}
+
+// joinICC joins the profile chunks, which may be stored in any order.
+func joinICC(chunks [][]byte) []byte {
+	var profile []byte
+	for _, c := range chunks {
+		if c == nil {
+			return nil
+		}
+		profile = append(profile, c...)
+	}
+	return profile
+}
+
+// readPNGICC decompresses the profile of the iCCP chunk preceding the image data.
+func readPNGICC(r *bufio.Reader) []byte {
+	r.Discard(len(pngSignature))
+	for {
+		var head [8]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return nil
+		}
+		n := int(binary.BigEndian.Uint32(head[:4]))
+		switch string(head[4:]) {
+		case "IDAT", "IEND":
+			return nil
+		case "iCCP":
+			data := make([]byte, n)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil
+			}
+			// The profile name is followed by a null separator and the compression method.
+			i := bytes.IndexByte(data, 0)
+			if i < 0 || i+2 > len(data) {
+				return nil
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(data[i+2:]))
+			if err != nil {
+				return nil
+			}
+			profile, err := ioutil.ReadAll(zr)
+			if err != nil {
+				return nil
+			}
+			return profile
+		}
+		if _, err := r.Discard(n + 4); err != nil {
+			return nil
+		}
+	}
+}
+
+// encodeICC encodes the image like Encode, embedding the ICC profile into the output.
+func encodeICC(w io.Writer, img image.Image, format Format, profile []byte) error {
+	if len(profile) == 0 {
+		return Encode(w, img, format)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, format); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+
+	switch format {
+	case JPEG:
+		// The segments are inserted right after the start of image marker.
+		if _, err := w.Write(data[:2]); err != nil {
+			return err
+		}
+		count := (len(profile) + iccChunkSize - 1) / iccChunkSize
+		for seq := 1; len(profile) > 0; seq++ {
+			chunk := profile
+			if len(chunk) > iccChunkSize {
+				chunk = chunk[:iccChunkSize]
+			}
+			profile = profile[len(chunk):]
+
+			var seg bytes.Buffer
+			seg.Write([]byte{0xff, 0xe2})
+			binary.Write(&seg, binary.BigEndian, uint16(2+len(iccSignature)+2+len(chunk)))
+			seg.Write(iccSignature)
+			seg.Write([]byte{byte(seq), byte(count)})
+			seg.Write(chunk)
+			if _, err := w.Write(seg.Bytes()); err != nil {
+				return err
+			}
+		}
+		_, err := w.Write(data[2:])
+		return err
+	case PNG:
+		// The iCCP chunk is inserted right after the IHDR chunk.
+		ihdr := len(pngSignature) + 8 + int(binary.BigEndian.Uint32(data[len(pngSignature):])) + 4
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write(profile)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		chunk := append([]byte("iCCPicc\x00\x00"), compressed.Bytes()...)
+
+		var seg bytes.Buffer
+		binary.Write(&seg, binary.BigEndian, uint32(len(chunk)-4))
+		seg.Write(chunk)
+		binary.Write(&seg, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+
+		for _, part := range [][]byte{data[:ihdr], seg.Bytes(), data[ihdr:]} {
+			if _, err := w.Write(part); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return Encode(w, img, format)
+}
@@ -0,0 +1,44 @@
+package facemask
+
+import (
+	"image"
+	"math"
+	"math/rand"
+)
+
+// Jitter perturbs the placement of the mask on every face by a bounded random amount, so
+// in a crowd the masks look individually placed rather than identically scaled and rotated.
+type Jitter struct {
+	// Scale is the largest relative change of the mask size, e.g. 0.1 for ±10%.
+	Scale float64 `json:"scale"`
+	// Angle is the largest rotation of the mask in degrees.
+	Angle float64 `json:"angle"`
+	// Offset is the largest shift of the mask relative to its size.
+	Offset float64 `json:"offset"`
+	// Seed seeds the randomness. The jitter of a face is derived from the seed and from
+	// the face position, so with the same seed the same image always gets the same masks,
+	// regardless of the order the faces are rendered in.
+	Seed int64 `json:"seed,omitempty"`
+}
+
+// apply perturbs the transform of the mask over the face.
+func (j *Jitter) apply(t MaskTransform, face FaceInfo) MaskTransform {
+	rnd := rand.New(rand.NewSource(j.Seed ^ int64(face.Row)<<40 ^ int64(face.Col)<<20 ^ int64(face.Scale)))
+	// uniform returns a random value within ±max.
+	uniform := func(max float64) float64 {
+		return (rnd.Float64()*2 - 1) * max
+	}
+	scale := 1 + uniform(j.Scale)
+	angle := uniform(j.Angle)
+	w, h := float64(t.Rect.Dx()), float64(t.Rect.Dy())
+	dx, dy := uniform(j.Offset)*w, uniform(j.Offset)*h
+
+	cx := float64(t.Rect.Min.X) + w/2 + dx
+	cy := float64(t.Rect.Min.Y) + h/2 + dy
+	w, h = math.Max(1, w*scale), math.Max(1, h*scale)
+	min := image.Pt(int(math.Round(cx-w/2)), int(math.Round(cy-h/2)))
+	return MaskTransform{
+		Rect:  image.Rectangle{Min: min, Max: min.Add(image.Pt(int(math.Round(w)), int(math.Round(h))))},
+		Angle: t.Angle + angle,
+	}
+}
@@ -0,0 +1,795 @@
+package facemask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// ErrRegionEncode is returned by OverlayRegionsTo for the JPEG images which can't
+// be re-encoded by regions, in which case the whole image has to be encoded.
+var ErrRegionEncode = errors.New("only the baseline sequential JPEG images of the processed size can be re-encoded by regions")
+
+// unzig maps the zigzag order of the JPEG coefficients to their natural order.
+var unzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// jpegComponent is a color component of the JPEG image with its quantized
+// coefficients in zigzag order, block by block.
+type jpegComponent struct {
+	id, h, v, tq int
+	// td and ta are the DC and the AC Huffman table of the component in the scan.
+	td, ta int
+	bw, bh int
+	blocks [][64]int32
+	// plane holds the samples of the component decoded by decodeJPEGReduced.
+	plane []uint8
+}
+
+// jpegHuffman is a Huffman table as defined by a DHT segment.
+type jpegHuffman struct {
+	counts  [16]int
+	symbols []byte
+	// The canonical decoding tables, per code length.
+	mincode, maxcode [17]int
+	valptr           [17]int
+}
+
+// jpegFile is the parsed baseline JPEG image.
+type jpegFile struct {
+	width, height int
+	hmax, vmax    int
+	comps         []*jpegComponent
+	quant         [4][64]int
+	huff          [2][4]*jpegHuffman
+	restart       int
+	// head holds the segments preceding the scan except the Huffman tables,
+	// sos the scan header and tail the data following the scan.
+	head, sos, tail []byte
+	// block receives every decoded block, with its index in the component, in place of
+	// storing the coefficients in the component. Nil stores them.
+	block func(c *jpegComponent, i int, coefs *[64]int32)
+}
+
+// OverlayRegionsTo writes the result of the last detection as a JPEG image re-encoding only
+// the blocks of the original JPEG image changed by the overlays: the rest of the image is
+// transcoded losslessly, so it keeps the original quality. The original must be the JPEG image
+// the detection ran on. The metadata segments of the original, like Exif or the ICC profile,
+// are kept. ErrRegionEncode is returned for the progressive, the CMYK, the downscaled images
+// and the ones turned upright by their Exif orientation.
+func (fd *Detector) OverlayRegionsTo(w io.Writer, original io.Reader) error {
+	data, err := ioutil.ReadAll(original)
+	if err != nil {
+		return err
+	}
+	if readOrientation(bytes.NewReader(data)) != 1 {
+		return ErrRegionEncode
+	}
+	jf, err := parseJPEG(data)
+	if err != nil {
+		return err
+	}
+	rendered, ok := fd.ctx.Image().(*image.RGBA)
+	if !ok || fd.src == nil || rendered.Bounds().Dx() != jf.width || rendered.Bounds().Dy() != jf.height {
+		return ErrRegionEncode
+	}
+
+	// Re-encode the MCUs containing any pixel changed by the overlays.
+	mw, mh := 8*jf.hmax, 8*jf.vmax
+	if len(jf.comps) == 1 {
+		mw, mh = 8, 8
+	}
+	for my := 0; my*mh < jf.height; my++ {
+		for mx := 0; mx*mw < jf.width; mx++ {
+			rect := image.Rect(mx*mw, my*mh, (mx+1)*mw, (my+1)*mh).Intersect(rendered.Bounds())
+			if !regionChanged(rendered, fd.src, rect) {
+				continue
+			}
+			for _, c := range jf.comps {
+				ch, cv := c.h, c.v
+				if len(jf.comps) == 1 {
+					ch, cv = 1, 1
+				}
+				for v := 0; v < cv; v++ {
+					for h := 0; h < ch; h++ {
+						bx, by := mx*ch+h, my*cv+v
+						c.blocks[by*c.bw+bx] = jf.encodeBlock(rendered, c, bx, by)
+					}
+				}
+			}
+		}
+	}
+	return jf.write(w)
+}
+
+// regionChanged reports whether any pixel of the region differs between the images.
+func regionChanged(rendered *image.RGBA, src *image.NRGBA, rect image.Rectangle) bool {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			i, j := rendered.PixOffset(x, y), src.PixOffset(x, y)
+			if !bytes.Equal(rendered.Pix[i:i+3], src.Pix[j:j+3]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encodeBlock computes the quantized coefficients of the component block from the image.
+func (jf *jpegFile) encodeBlock(img *image.RGBA, c *jpegComponent, bx, by int) [64]int32 {
+	// The subsampled components average the pixels covered by a sample.
+	fx, fy := jf.hmax/c.h, jf.vmax/c.v
+	b := img.Bounds()
+	var samples [64]float64
+	for j := 0; j < 8; j++ {
+		for i := 0; i < 8; i++ {
+			var sum float64
+			for dy := 0; dy < fy; dy++ {
+				for dx := 0; dx < fx; dx++ {
+					x := clampInt(((bx*8+i)*fx + dx), 0, b.Dx()-1)
+					y := clampInt(((by*8+j)*fy + dy), 0, b.Dy()-1)
+					off := img.PixOffset(x, y)
+					yy, cb, cr := color.RGBToYCbCr(img.Pix[off], img.Pix[off+1], img.Pix[off+2])
+					switch {
+					case len(jf.comps) == 1 || c == jf.comps[0]:
+						sum += float64(yy)
+					case c == jf.comps[1]:
+						sum += float64(cb)
+					default:
+						sum += float64(cr)
+					}
+				}
+			}
+			samples[j*8+i] = sum/float64(fx*fy) - 128
+		}
+	}
+	coefs := fdct(samples)
+	var block [64]int32
+	q := jf.quant[c.tq]
+	for k := 0; k < 64; k++ {
+		block[k] = int32(math.Round(coefs[unzig[k]] / float64(q[k])))
+	}
+	return block
+}
+
+// dctCos holds the cosines of the discrete cosine transform.
+var dctCos = func() (t [8][8]float64) {
+	for x := 0; x < 8; x++ {
+		for u := 0; u < 8; u++ {
+			t[x][u] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / 16)
+		}
+	}
+	return t
+}()
+
+// fdct is the forward discrete cosine transform of the 8x8 block in natural order.
+func fdct(s [64]float64) [64]float64 {
+	var tmp, out [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for x := 0; x < 8; x++ {
+				sum += s[y*8+x] * dctCos[x][u]
+			}
+			tmp[y*8+u] = sum
+		}
+	}
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			var sum float64
+			for y := 0; y < 8; y++ {
+				sum += tmp[y*8+u] * dctCos[y][v]
+			}
+			cu, cv := 1.0, 1.0
+			if u == 0 {
+				cu = math.Sqrt2 / 2
+			}
+			if v == 0 {
+				cv = math.Sqrt2 / 2
+			}
+			out[v*8+u] = sum * cu * cv / 4
+		}
+	}
+	return out
+}
+
+// parseJPEG parses the segments of the baseline JPEG image and decodes its coefficients.
+func parseJPEG(data []byte) (*jpegFile, error) {
+	jf := &jpegFile{}
+	if err := jf.parse(data); err != nil {
+		return nil, err
+	}
+	return jf, nil
+}
+
+// parse parses the segments of the JPEG image and decodes its scan.
+func (jf *jpegFile) parse(data []byte) error {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return ErrRegionEncode
+	}
+	pos := 2
+	for {
+		if pos+4 > len(data) || data[pos] != 0xff {
+			return ErrRegionEncode
+		}
+		marker := data[pos+1]
+		if marker == 0xff { // fill byte
+			pos++
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if n < 2 || pos+2+n > len(data) {
+			return ErrRegionEncode
+		}
+		seg, payload := data[pos:pos+2+n], data[pos+4:pos+2+n]
+		pos += 2 + n
+
+		switch marker {
+		case 0xc0, 0xc1: // baseline and extended sequential, Huffman coded
+			if err := jf.parseFrame(payload); err != nil {
+				return err
+			}
+		case 0xc4:
+			if err := jf.parseHuffman(payload); err != nil {
+				return err
+			}
+			continue // the tables are replaced by the optimized ones
+		case 0xdb:
+			if err := jf.parseQuant(payload); err != nil {
+				return err
+			}
+		case 0xdd:
+			if len(payload) < 2 {
+				return ErrRegionEncode
+			}
+			jf.restart = int(binary.BigEndian.Uint16(payload))
+		case 0xda:
+			if err := jf.parseScan(payload); err != nil {
+				return err
+			}
+			jf.sos = seg
+			end, err := jf.decode(data[pos:])
+			if err != nil {
+				return err
+			}
+			jf.tail = data[pos+end:]
+			return nil
+		default:
+			// The other frame types (progressive, arithmetic coded, lossless) are not supported.
+			if marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc {
+				return ErrRegionEncode
+			}
+		}
+		jf.head = append(jf.head, seg...)
+	}
+}
+
+func (jf *jpegFile) parseFrame(p []byte) error {
+	if len(p) < 6 || p[0] != 8 {
+		return ErrRegionEncode
+	}
+	jf.height, jf.width = int(binary.BigEndian.Uint16(p[1:])), int(binary.BigEndian.Uint16(p[3:]))
+	n := int(p[5])
+	// Only the grayscale and the YCbCr images are supported.
+	if n != 1 && n != 3 || len(p) < 6+3*n || jf.width == 0 || jf.height == 0 {
+		return ErrRegionEncode
+	}
+	for i := 0; i < n; i++ {
+		c := &jpegComponent{id: int(p[6+3*i]), h: int(p[7+3*i] >> 4), v: int(p[7+3*i] & 15), tq: int(p[8+3*i])}
+		if c.h < 1 || c.v < 1 || c.h > 4 || c.v > 4 || c.tq > 3 {
+			return ErrRegionEncode
+		}
+		jf.hmax, jf.vmax = maxInt(jf.hmax, c.h), maxInt(jf.vmax, c.v)
+		jf.comps = append(jf.comps, c)
+	}
+	for _, c := range jf.comps {
+		if jf.hmax%c.h != 0 || jf.vmax%c.v != 0 {
+			return ErrRegionEncode
+		}
+		if n == 1 {
+			c.h, c.v, jf.hmax, jf.vmax = 1, 1, 1, 1
+			c.bw, c.bh = (jf.width+7)/8, (jf.height+7)/8
+		} else {
+			c.bw = (jf.width + 8*jf.hmax - 1) / (8 * jf.hmax) * c.h
+			c.bh = (jf.height + 8*jf.vmax - 1) / (8 * jf.vmax) * c.v
+		}
+		if jf.block == nil {
+			c.blocks = make([][64]int32, c.bw*c.bh)
+		}
+	}
+	return nil
+}
+
+func (jf *jpegFile) parseQuant(p []byte) error {
+	for len(p) > 0 {
+		precision, id := p[0]>>4, int(p[0]&15)
+		if id > 3 {
+			return ErrRegionEncode
+		}
+		size := 64 * int(precision+1)
+		if len(p) < 1+size {
+			return ErrRegionEncode
+		}
+		for k := 0; k < 64; k++ {
+			if precision == 0 {
+				jf.quant[id][k] = int(p[1+k])
+			} else {
+				jf.quant[id][k] = int(binary.BigEndian.Uint16(p[1+2*k:]))
+			}
+			if jf.quant[id][k] == 0 {
+				return ErrRegionEncode
+			}
+		}
+		p = p[1+size:]
+	}
+	return nil
+}
+
+func (jf *jpegFile) parseHuffman(p []byte) error {
+	for len(p) >= 17 {
+		class, id := int(p[0]>>4), int(p[0]&15)
+		if class > 1 || id > 3 {
+			return ErrRegionEncode
+		}
+		h := &jpegHuffman{}
+		total := 0
+		for i := 0; i < 16; i++ {
+			h.counts[i] = int(p[1+i])
+			total += h.counts[i]
+		}
+		if len(p) < 17+total {
+			return ErrRegionEncode
+		}
+		h.symbols = append([]byte(nil), p[17:17+total]...)
+		code, k := 0, 0
+		for l := 1; l <= 16; l++ {
+			h.valptr[l] = k
+			h.mincode[l] = code
+			code += h.counts[l-1]
+			k += h.counts[l-1]
+			h.maxcode[l] = code - 1
+			code <<= 1
+		}
+		jf.huff[class][id] = h
+		p = p[17+total:]
+	}
+	return nil
+}
+
+func (jf *jpegFile) parseScan(p []byte) error {
+	if len(p) < 1 || int(p[0]) != len(jf.comps) || len(p) < 1+2*len(jf.comps)+3 {
+		return ErrRegionEncode
+	}
+	// A single scan must contain all the components in the frame order.
+	for i, c := range jf.comps {
+		if int(p[1+2*i]) != c.id {
+			return ErrRegionEncode
+		}
+		c.td, c.ta = int(p[2+2*i]>>4), int(p[2+2*i]&15)
+		if c.td > 3 || c.ta > 3 || jf.huff[0][c.td] == nil || jf.huff[1][c.ta] == nil {
+			return ErrRegionEncode
+		}
+	}
+	return nil
+}
+
+// blockOrder calls fn for every block of the scan in the coding order, with the index of
+// the MCU the block belongs to and the index of the block in its component.
+func (jf *jpegFile) blockOrder(fn func(mcu int, c *jpegComponent, i int) error) error {
+	if len(jf.comps) == 1 {
+		c := jf.comps[0]
+		for i := 0; i < c.bw*c.bh; i++ {
+			if err := fn(i, c, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	mcusX := (jf.width + 8*jf.hmax - 1) / (8 * jf.hmax)
+	mcusY := (jf.height + 8*jf.vmax - 1) / (8 * jf.vmax)
+	for my := 0; my < mcusY; my++ {
+		for mx := 0; mx < mcusX; mx++ {
+			for _, c := range jf.comps {
+				for v := 0; v < c.v; v++ {
+					for h := 0; h < c.h; h++ {
+						i := (my*c.v+v)*c.bw + mx*c.h + h
+						if err := fn(my*mcusX+mx, c, i); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// decode decodes the coefficients of the scan, returning the length of the entropy coded data.
+func (jf *jpegFile) decode(data []byte) (int, error) {
+	br := &jpegBitReader{data: data}
+	preds := make(map[*jpegComponent]int32)
+	last := -1
+	var scratch [64]int32
+	err := jf.blockOrder(func(mcu int, c *jpegComponent, i int) error {
+		if mcu != last {
+			if jf.restart > 0 && mcu > 0 && mcu%jf.restart == 0 {
+				if err := br.restart(); err != nil {
+					return err
+				}
+				for k := range preds {
+					preds[k] = 0
+				}
+			}
+			last = mcu
+		}
+		block := &scratch
+		if jf.block == nil {
+			block = &c.blocks[i]
+		} else {
+			scratch = [64]int32{}
+		}
+		s, err := br.decodeHuffman(jf.huff[0][c.td])
+		if err != nil {
+			return err
+		}
+		diff, err := br.receiveExtend(s)
+		if err != nil {
+			return err
+		}
+		preds[c] += diff
+		block[0] = preds[c]
+		for k := 1; k < 64; {
+			rs, err := br.decodeHuffman(jf.huff[1][c.ta])
+			if err != nil {
+				return err
+			}
+			r, s := int(rs>>4), rs&15
+			if s == 0 {
+				if r != 15 {
+					break // end of block
+				}
+				k += 16
+				continue
+			}
+			k += r
+			if k > 63 {
+				return ErrRegionEncode
+			}
+			v, err := br.receiveExtend(s)
+			if err != nil {
+				return err
+			}
+			block[k] = v
+			k++
+		}
+		if jf.block != nil {
+			jf.block(c, i, block)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	// The scan ends at the first marker which isn't a restart marker.
+	for pos := br.pos; pos+1 < len(data); pos++ {
+		if data[pos] == 0xff && data[pos+1] != 0 && (data[pos+1] < 0xd0 || data[pos+1] > 0xd7) {
+			return pos, nil
+		}
+	}
+	return 0, ErrRegionEncode
+}
+
+// jpegBitReader reads the bits of the entropy coded data, removing the stuffed bytes.
+type jpegBitReader struct {
+	data  []byte
+	pos   int
+	bits  uint32
+	nbits int
+}
+
+func (br *jpegBitReader) bit() (uint32, error) {
+	if br.nbits == 0 {
+		if br.pos >= len(br.data) {
+			return 0, ErrRegionEncode
+		}
+		b := br.data[br.pos]
+		if b == 0xff {
+			if br.pos+1 >= len(br.data) || br.data[br.pos+1] != 0 {
+				return 0, ErrRegionEncode
+			}
+			br.pos++
+		}
+		br.pos++
+		br.bits, br.nbits = uint32(b), 8
+	}
+	br.nbits--
+	return (br.bits >> uint(br.nbits)) & 1, nil
+}
+
+func (br *jpegBitReader) decodeHuffman(h *jpegHuffman) (byte, error) {
+	code := 0
+	for l := 1; l <= 16; l++ {
+		b, err := br.bit()
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | int(b)
+		if h.counts[l-1] > 0 && code <= h.maxcode[l] && code >= h.mincode[l] {
+			return h.symbols[h.valptr[l]+code-h.mincode[l]], nil
+		}
+	}
+	return 0, ErrRegionEncode
+}
+
+func (br *jpegBitReader) receiveExtend(s byte) (int32, error) {
+	if s == 0 {
+		return 0, nil
+	}
+	if s > 16 {
+		return 0, ErrRegionEncode
+	}
+	var v int32
+	for i := byte(0); i < s; i++ {
+		b, err := br.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | int32(b)
+	}
+	if v < 1<<(s-1) {
+		v += -1<<s + 1
+	}
+	return v, nil
+}
+
+// restart skips the padding bits and the restart marker.
+func (br *jpegBitReader) restart() error {
+	br.nbits = 0
+	if br.pos+1 >= len(br.data) || br.data[br.pos] != 0xff || br.data[br.pos+1] < 0xd0 || br.data[br.pos+1] > 0xd7 {
+		return ErrRegionEncode
+	}
+	br.pos += 2
+	return nil
+}
+
+// jpegSymbols emits the Huffman symbols of the coefficients in the coding order: emit is
+// called with the table class, the table and the symbol followed by the extra bits.
+func (jf *jpegFile) jpegSymbols(emit func(class, table int, symbol byte, bits int32, size byte), restart func()) {
+	preds := make(map[*jpegComponent]int32)
+	last := -1
+	jf.blockOrder(func(mcu int, c *jpegComponent, i int) error {
+		block := &c.blocks[i]
+		if mcu != last {
+			if jf.restart > 0 && mcu > 0 && mcu%jf.restart == 0 {
+				restart()
+				for k := range preds {
+					preds[k] = 0
+				}
+			}
+			last = mcu
+		}
+		diff := block[0] - preds[c]
+		preds[c] = block[0]
+		s := bitSize(diff)
+		emit(0, c.td, s, diff, s)
+
+		run := 0
+		for k := 1; k < 64; k++ {
+			if block[k] == 0 {
+				run++
+				continue
+			}
+			for run > 15 {
+				emit(1, c.ta, 0xf0, 0, 0)
+				run -= 16
+			}
+			s := bitSize(block[k])
+			emit(1, c.ta, byte(run<<4)|s, block[k], s)
+			run = 0
+		}
+		if run > 0 {
+			emit(1, c.ta, 0x00, 0, 0) // end of block
+		}
+		return nil
+	})
+}
+
+// bitSize returns the number of bits of the magnitude of the value.
+func bitSize(v int32) byte {
+	if v < 0 {
+		v = -v
+	}
+	var s byte
+	for v > 0 {
+		s++
+		v >>= 1
+	}
+	return s
+}
+
+// write encodes the image with the Huffman tables optimized for its coefficients.
+func (jf *jpegFile) write(w io.Writer) error {
+	var freqs [2][4][257]int
+	jf.jpegSymbols(func(class, table int, symbol byte, bits int32, size byte) {
+		freqs[class][table][symbol]++
+	}, func() {})
+
+	var out bytes.Buffer
+	out.Write([]byte{0xff, 0xd8})
+	out.Write(jf.head)
+
+	var codes [2][4][256]uint16
+	var sizes [2][4][256]byte
+	for class := 0; class < 2; class++ {
+		for table := 0; table < 4; table++ {
+			if jf.huff[class][table] == nil {
+				continue
+			}
+			counts, symbols := optimalHuffman(freqs[class][table])
+			out.Write([]byte{0xff, 0xc4})
+			binary.Write(&out, binary.BigEndian, uint16(2+1+16+len(symbols)))
+			out.WriteByte(byte(class<<4 | table))
+			for _, n := range counts {
+				out.WriteByte(byte(n))
+			}
+			out.Write(symbols)
+
+			code, k := uint16(0), 0
+			for l := 1; l <= 16; l++ {
+				for i := 0; i < counts[l-1]; i++ {
+					codes[class][table][symbols[k]] = code
+					sizes[class][table][symbols[k]] = byte(l)
+					code++
+					k++
+				}
+				code <<= 1
+			}
+		}
+	}
+	out.Write(jf.sos)
+
+	bw := &jpegBitWriter{w: &out}
+	rst := 0
+	jf.jpegSymbols(func(class, table int, symbol byte, bits int32, size byte) {
+		bw.emit(uint32(codes[class][table][symbol]), sizes[class][table][symbol])
+		if size > 0 {
+			if bits < 0 {
+				bits--
+			}
+			bw.emit(uint32(bits)&(1<<size-1), size)
+		}
+	}, func() {
+		bw.flush()
+		out.Write([]byte{0xff, byte(0xd0 + rst)})
+		rst = (rst + 1) & 7
+	})
+	bw.flush()
+	out.Write(jf.tail)
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// jpegBitWriter writes the entropy coded data, stuffing the 0xff bytes.
+type jpegBitWriter struct {
+	w     *bytes.Buffer
+	bits  uint32
+	nbits byte
+}
+
+func (bw *jpegBitWriter) emit(bits uint32, size byte) {
+	for i := int(size) - 1; i >= 0; i-- {
+		bw.bits = bw.bits<<1 | (bits>>uint(i))&1
+		bw.nbits++
+		if bw.nbits == 8 {
+			bw.w.WriteByte(byte(bw.bits))
+			if byte(bw.bits) == 0xff {
+				bw.w.WriteByte(0)
+			}
+			bw.bits, bw.nbits = 0, 0
+		}
+	}
+}
+
+// flush pads the last byte with one bits.
+func (bw *jpegBitWriter) flush() {
+	if bw.nbits > 0 {
+		bw.emit(1<<(8-bw.nbits)-1, 8-bw.nbits)
+	}
+}
+
+// optimalHuffman builds the Huffman table of the symbol frequencies with the code lengths
+// limited to 16 bits and without the all ones code, as described in Annex K.2 of the JPEG
+// standard. It returns the number of codes of every length and the symbols by code length.
+func optimalHuffman(freq [257]int) ([16]int, []byte) {
+	var (
+		codesize [257]int
+		others   [257]int
+		bits     [33]int
+	)
+	// The reserved symbol 256 ensures that no symbol gets the all ones code.
+	freq[256] = 1
+	for i := range others {
+		others[i] = -1
+	}
+	for {
+		// Find the two least frequent symbols, c1 with the smallest frequency.
+		c1, c2 := -1, -1
+		for i, f := range freq {
+			if f > 0 && (c1 < 0 || f <= freq[c1]) {
+				c1 = i
+			}
+		}
+		for i, f := range freq {
+			if f > 0 && i != c1 && (c2 < 0 || f <= freq[c2]) {
+				c2 = i
+			}
+		}
+		if c2 < 0 {
+			break
+		}
+		freq[c1] += freq[c2]
+		freq[c2] = 0
+
+		codesize[c1]++
+		for others[c1] >= 0 {
+			c1 = others[c1]
+			codesize[c1]++
+		}
+		others[c1] = c2
+		codesize[c2]++
+		for others[c2] >= 0 {
+			c2 = others[c2]
+			codesize[c2]++
+		}
+	}
+	for _, size := range codesize {
+		if size > 0 {
+			bits[size]++
+		}
+	}
+	// Limit the code lengths to 16 bits.
+	for i := 32; i > 16; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+	// Remove the reserved code from the longest codes.
+	i := 16
+	for bits[i] == 0 {
+		i--
+	}
+	bits[i]--
+
+	var counts [16]int
+	copy(counts[:], bits[1:17])
+	var symbols []byte
+	for size := 1; size <= 32; size++ {
+		for s := 0; s < 256; s++ {
+			if codesize[s] == size {
+				symbols = append(symbols, byte(s))
+			}
+		}
+	}
+	return counts, symbols
+}
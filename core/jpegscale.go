@@ -0,0 +1,108 @@
+package facemask
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+)
+
+// reducedCos holds the cosines of the reduced inverse DCT of the n x n output blocks,
+// weighted by the normalization of the coefficients, for n of 1, 2 and 4.
+var reducedCos = func() (t [5][8][8]float64) {
+	for _, n := range []int{1, 2, 4} {
+		for x := 0; x < n; x++ {
+			for u := 0; u < n; u++ {
+				c := 0.5
+				if u == 0 {
+					c = math.Sqrt2 / 4
+				}
+				t[n][x][u] = c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/float64(2*n))
+			}
+		}
+	}
+	return t
+}()
+
+// decodeJPEGReduced decodes the baseline JPEG image reduced by the factor of 2, 4 or 8, like
+// the DCT scaling of libjpeg: the 8x8 blocks are turned into the 8/factor wide blocks of the
+// reduced image by the inverse DCT of their lowest frequency coefficients while the scan is
+// decoded, so neither the full size image nor its coefficients are ever held in memory.
+// ErrRegionEncode is returned for the other JPEG images, e.g. the progressive ones, which
+// have to be decoded whole.
+func decodeJPEGReduced(data []byte, factor int) (*image.NRGBA, error) {
+	n := 8 / factor
+	jf := &jpegFile{}
+	jf.block = func(c *jpegComponent, i int, coefs *[64]int32) {
+		stride := c.bw * n
+		if c.plane == nil {
+			c.plane = make([]uint8, stride*c.bh*n)
+		}
+		bx, by := i%c.bw, i/c.bw
+		idctReduced(c.plane[by*n*stride+bx*n:], stride, coefs, &jf.quant[c.tq], n)
+	}
+	if err := jf.parse(data); err != nil {
+		return nil, err
+	}
+	if len(jf.comps) == 3 && jpegRGB(jf) {
+		return nil, ErrRegionEncode
+	}
+	w, h := (jf.width+factor-1)/factor, (jf.height+factor-1)/factor
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// The subsampled components are sampled at the nearest position, like image.YCbCr.
+			var s [3]uint8
+			for k, c := range jf.comps {
+				s[k] = c.plane[(y*c.v/jf.vmax)*c.bw*n+x*c.h/jf.hmax]
+			}
+			r, g, b := s[0], s[0], s[0]
+			if len(jf.comps) == 3 {
+				r, g, b = color.YCbCrToRGB(s[0], s[1], s[2])
+			}
+			off := dst.PixOffset(x, y)
+			dst.Pix[off], dst.Pix[off+1], dst.Pix[off+2], dst.Pix[off+3] = r, g, b, 255
+		}
+	}
+	return dst, nil
+}
+
+// idctReduced computes the n x n samples of the block from its n x n lowest frequency
+// coefficients, in zigzag order, into dst with the stride.
+func idctReduced(dst []uint8, stride int, coefs *[64]int32, q *[64]int, n int) {
+	var f [64]float64
+	for k, v := range coefs {
+		if v != 0 {
+			f[unzig[k]] = float64(v) * float64(q[k])
+		}
+	}
+	cos := &reducedCos[n]
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			sum := 128.0
+			for v := 0; v < n; v++ {
+				for u := 0; u < n; u++ {
+					sum += f[v*8+u] * cos[x][u] * cos[y][v]
+				}
+			}
+			dst[y*stride+x] = uint8(math.Max(0, math.Min(255, math.Round(sum))))
+		}
+	}
+}
+
+// jpegRGB reports whether the three components of the image are RGB rather than YCbCr,
+// as marked by an Adobe APP14 segment or by the component identifiers, the way the
+// standard decoder tells them apart.
+func jpegRGB(jf *jpegFile) bool {
+	for p := jf.head; len(p) >= 4; {
+		n := 2 + int(binary.BigEndian.Uint16(p[2:]))
+		if n > len(p) {
+			break
+		}
+		if p[1] == 0xee && n >= 16 && string(p[4:9]) == "Adobe" {
+			return p[15] == 0
+		}
+		p = p[n:]
+	}
+	return jf.comps[0].id == 'R' && jf.comps[1].id == 'G' && jf.comps[2].id == 'B'
+}
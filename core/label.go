@@ -0,0 +1,169 @@
+package facemask
+
+import (
+	"encoding/csv"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fogleman/gg"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// The contents of the face labels.
+const (
+	LabelScore    = "score"
+	LabelIndex    = "index"
+	LabelIdentity = "identity"
+)
+
+// Label is the text drawn by Render under each face, for reviewing the detections
+// or name tagging the people on group photos.
+type Label struct {
+	// Content is the text of the labels: the detection score, the index of the face
+	// in the image starting from 1, or the identity recognized by Identities.
+	Content string
+	// Identities recognizes the faces labeled by identity. The unrecognized faces are not labeled.
+	Identities *IdentityRenderer
+	// Names maps the identity names to the label texts. The identities missing
+	// from it are labeled with their name.
+	Names map[string]string
+	Face  font.Face
+	Color color.Color
+}
+
+// NewLabel creates the face label of the content with the TrueType font file, or the Go
+// font when the path is empty, of the size in points and the color in hexadecimal notation.
+func NewLabel(content, fontPath string, size float64, hexColor string) (*Label, error) {
+	switch content {
+	case LabelScore, LabelIndex, LabelIdentity:
+	default:
+		return nil, fmt.Errorf("unknown label content %q", content)
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid label size: %v", size)
+	}
+	c, err := parseHexColor(hexColor)
+	if err != nil {
+		return nil, err
+	}
+	var face font.Face
+	if fontPath != "" {
+		if face, err = gg.LoadFontFace(fontPath, size); err != nil {
+			return nil, fmt.Errorf("error loading the label font: %v", err)
+		}
+	} else if face, err = goFontFace(size); err != nil {
+		return nil, err
+	}
+	return &Label{Content: content, Face: face, Color: c}, nil
+}
+
+// ReadLabelNames reads the label texts of the identities from the CSV file
+// of identity name and label text records.
+func ReadLabelNames(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	r.Comment = '#'
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(records))
+	for _, rec := range records {
+		names[strings.TrimSpace(rec[0])] = strings.TrimSpace(rec[1])
+	}
+	return names, nil
+}
+
+// texts returns the label texts of the faces. It must be called before the overlays
+// are rendered, since the identities are recognized on the source image.
+func (l *Label) texts(img image.Image, infos []FaceInfo) ([]string, error) {
+	texts := make([]string, len(infos))
+	for i, face := range infos {
+		switch l.Content {
+		case LabelScore:
+			texts[i] = strconv.FormatFloat(float64(face.Q), 'f', 1, 32)
+		case LabelIndex:
+			texts[i] = strconv.Itoa(i + 1)
+		case LabelIdentity:
+			if l.Identities == nil {
+				continue
+			}
+			id, err := l.Identities.Identify(img, face)
+			if err != nil {
+				return nil, err
+			}
+			if id == nil {
+				continue
+			}
+			texts[i] = id.Name
+			if name, ok := l.Names[id.Name]; ok {
+				texts[i] = name
+			}
+		}
+	}
+	return texts, nil
+}
+
+// draw draws the text centered under the face box over a translucent background,
+// or above the box when there's no room left under it.
+func (l *Label) draw(ctx *gg.Context, face FaceInfo, text string) {
+	if text == "" {
+		return
+	}
+	ctx.Push()
+	defer ctx.Pop()
+	ctx.SetFontFace(l.Face)
+
+	w, h := ctx.MeasureString(text)
+	pad := h / 3
+	x := float64(face.Col) - w/2
+	y := float64(face.Row+face.Scale/2) + pad
+	if y+h+2*pad > float64(ctx.Height()) {
+		y = float64(face.Row-face.Scale/2) - h - 3*pad
+	}
+	x = clamp(x, pad, float64(ctx.Width())-w-pad)
+	y = clamp(y, 0, float64(ctx.Height())-h-2*pad)
+
+	ctx.SetRGBA(0, 0, 0, 0.6)
+	ctx.DrawRectangle(x-pad, y, w+2*pad, h+2*pad)
+	ctx.Fill()
+	ctx.SetColor(l.Color)
+	ctx.DrawStringAnchored(text, x, y+pad, 0, 1)
+}
+
+// parseHexColor parses the color in the #rgb, #rrggbb or #rrggbbaa notation.
+func parseHexColor(s string) (color.Color, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 8 || err != nil {
+		return nil, fmt.Errorf("invalid color: %v", s)
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
+
+// goFontFace returns the face of the Go font of the size in points.
+func goFontFace(size float64) (font.Face, error) {
+	f, err := truetype.Parse(goregular.TTF)
+	if err != nil {
+		return nil, err
+	}
+	return truetype.NewFace(f, &truetype.Options{Size: size}), nil
+}
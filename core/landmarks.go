@@ -0,0 +1,123 @@
+package facemask
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// landmarkPoint describes a facial landmark point localized by one of the lps cascades.
+// The cascades are trained for the image left side points, the right side points
+// are obtained by running them flipped.
+type landmarkPoint struct {
+	name    string
+	cascade string
+	flip    bool
+	// dlib is the index of the point in the common 68 point dlib scheme.
+	dlib int
+}
+
+// Landmarks68 is the number of points of the dlib facial landmark scheme.
+const Landmarks68 = 68
+
+// landmarkPoints lists the points provided by the lps cascades. The left and right
+// names refer to the image sides, which in the dlib scheme are the subject's right and left.
+var landmarkPoints = []landmarkPoint{
+	{"left_eyebrow_outer", "lp46", false, 17},
+	{"left_eyebrow_middle", "lp44", false, 19},
+	{"left_eyebrow_inner", "lp42", false, 21},
+	{"right_eyebrow_inner", "lp42", true, 22},
+	{"right_eyebrow_middle", "lp44", true, 24},
+	{"right_eyebrow_outer", "lp46", true, 26},
+	{"nose_tip", "lp93", false, 30},
+	{"left_eye_outer", "lp312", false, 36},
+	{"left_eye_inner", "lp38", false, 39},
+	{"right_eye_inner", "lp38", true, 42},
+	{"right_eye_outer", "lp312", true, 45},
+	{"mouth_left", "lp84", false, 48},
+	{"upper_lip", "lp81", false, 51},
+	{"mouth_right", "lp84", true, 54},
+	{"lower_lip", "lp82", false, 57},
+}
+
+// landmarkGroups are the groups of the landmark points, selectable by their name.
+var landmarkGroups = map[string][]string{
+	"eyebrows": {"left_eyebrow_outer", "left_eyebrow_middle", "left_eyebrow_inner", "right_eyebrow_inner", "right_eyebrow_middle", "right_eyebrow_outer"},
+	"eyes":     {"left_eye_outer", "left_eye_inner", "right_eye_inner", "right_eye_outer"},
+	"nose":     {"nose_tip"},
+	"mouth":    {"mouth_left", "upper_lip", "mouth_right", "lower_lip"},
+}
+
+// LandmarkNames returns the names of the landmark points and of the point groups
+// (eyebrows, eyes, nose and mouth) selectable by Detector.Landmarks.
+func LandmarkNames() []string {
+	names := make([]string, 0, len(landmarkPoints)+len(landmarkGroups))
+	for _, lp := range landmarkPoints {
+		names = append(names, lp.name)
+	}
+	for group := range landmarkGroups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// landmarkSet resolves the names of the landmark points and point groups into the set of
+// the localized points. The mouth corners are always localized, since the overlays are
+// aligned to them. Without names it returns nil, which selects all the points.
+func landmarkSet(names []string) (map[string]bool, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	set := map[string]bool{"mouth_left": true, "mouth_right": true}
+	for _, name := range names {
+		if group, ok := landmarkGroups[name]; ok {
+			for _, point := range group {
+				set[point] = true
+			}
+			continue
+		}
+		found := false
+		for _, lp := range landmarkPoints {
+			if lp.name == name {
+				set[name], found = true, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown landmark point %q (available: %v)", name, LandmarkNames())
+		}
+	}
+	return set, nil
+}
+
+// localizeLandmarks runs the available landmark cascades of the selected points, all of them
+// if the selection is nil, and returns the points by name.
+func localizeLandmarks(flpcs map[string]*puplocCascade, selected map[string]bool, leftEye, rightEye *pigo.Puploc, params pigo.ImageParams, perturb int, rnd *rand.Rand) map[string]*pigo.Puploc {
+	points := make(map[string]*pigo.Puploc, len(landmarkPoints))
+	for _, lp := range landmarkPoints {
+		if selected != nil && !selected[lp.name] {
+			continue
+		}
+		cascade, ok := flpcs[lp.cascade]
+		if !ok {
+			continue
+		}
+		points[lp.name] = cascade.landmark(leftEye, rightEye, params, perturb, lp.flip, rnd)
+	}
+	return points
+}
+
+// Landmarks68 maps the landmark points of the face onto the 68 point dlib indexing.
+// The points not provided by the landmark cascades (e.g. the jaw line) are nil.
+func (face FaceInfo) Landmarks68() []*pigo.Puploc {
+	points := make([]*pigo.Puploc, Landmarks68)
+	for _, lp := range landmarkPoints {
+		if p, ok := face.Landmarks[lp.name]; ok && validPoint(p) {
+			points[lp.dlib] = p
+		}
+	}
+	return points
+}
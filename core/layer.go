@@ -0,0 +1,50 @@
+package facemask
+
+import (
+	"image"
+	"math"
+)
+
+// Layer returns the overlays rendered over the last detection as a separate layer with
+// a transparent background, at the resolution of the processed image, so they can be
+// blended over the source by other tools.
+//
+// The layer is extracted from the difference between the result and the source image,
+// so it includes the overlays reading the image too, like the blurring. The alpha of every
+// changed pixel is the smallest one, with which the layer composited over the source
+// reproduces the result exactly (the "color to alpha" method), so the antialiased and
+// translucent mask edges keep their softness instead of carrying the background color.
+func (fd *Detector) Layer() image.Image {
+	src := fd.src
+	rendered := fd.ctx.Image()
+	b := src.Bounds()
+	layer := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			s := src.NRGBAAt(x, y)
+			r, g, bl, _ := rendered.At(x, y).RGBA()
+			c := [3]float64{float64(r>>8) / 255, float64(g>>8) / 255, float64(bl>>8) / 255}
+			bg := [3]float64{float64(s.R) / 255, float64(s.G) / 255, float64(s.B) / 255}
+
+			var alpha float64
+			for k := 0; k < 3; k++ {
+				switch {
+				case c[k] > bg[k]:
+					alpha = math.Max(alpha, (c[k]-bg[k])/(1-bg[k]))
+				case c[k] < bg[k]:
+					alpha = math.Max(alpha, (bg[k]-c[k])/bg[k])
+				}
+			}
+			if alpha == 0 {
+				continue
+			}
+			off := layer.PixOffset(x, y)
+			for k := 0; k < 3; k++ {
+				v := (c[k] - (1-alpha)*bg[k]) / alpha
+				layer.Pix[off+k] = uint8(clamp(v, 0, 1)*255 + 0.5)
+			}
+			layer.Pix[off+3] = uint8(alpha*255 + 0.5)
+		}
+	}
+	return layer
+}
@@ -0,0 +1,242 @@
+package facemask
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fogleman/gg"
+)
+
+const (
+	// ManifestFile is the name of the manifest file of a mask pack directory.
+	ManifestFile = "manifest.json"
+
+	// The mask variants selected by the face proportions.
+	VariantAdult = "adult"
+	VariantChild = "child"
+
+	// defaultChildIPDRatio is the interpupillary distance relative to the face size
+	// above which the face is considered a child's face. Children have proportionally
+	// wider set eyes than adults, for which the ratio is around 0.36.
+	defaultChildIPDRatio = 0.42
+)
+
+// Manifest describes a mask pack: the mask assets and the parameters
+// used for selecting and placing them.
+//
+//	{
+//	  "name": "medical",
+//	  "child_ipd_ratio": 0.42,
+//	  "masks": [
+//	    {"file": "adult.png", "variant": "adult"},
+//	    {"file": "child.png", "variant": "child"},
+//	    {"file": "star.png", "anchor": "forehead"}
+//	  ]
+//	}
+//
+// The assets with an anchor are placed into the named anchor region of every face,
+// over the mask variant of the face.
+type Manifest struct {
+	Name          string      `json:"name"`
+	ChildIPDRatio float64     `json:"child_ipd_ratio,omitempty"`
+	Masks         []MaskAsset `json:"masks"`
+	// ClipSkin enables the skin region clipping of the masks.
+	ClipSkin bool `json:"clip_skin,omitempty"`
+	// WarpJaw enables the jawline aware deformation of the masks.
+	WarpJaw bool `json:"warp_jaw,omitempty"`
+	// GlassesOffset is the fraction of the mask height the masks are lowered by
+	// on the faces wearing eyeglasses.
+	GlassesOffset float64 `json:"glasses_offset,omitempty"`
+	// Relight adjusts the masks to the lighting of the faces.
+	Relight bool `json:"relight,omitempty"`
+	// Feather is the width in pixels of the softened alpha edge of the masks.
+	Feather int `json:"feather,omitempty"`
+	// Opacity makes the masks translucent, between 0 and 1.
+	Opacity float64 `json:"opacity,omitempty"`
+	// Jitter perturbs the placement of the masks randomly.
+	Jitter *Jitter `json:"jitter,omitempty"`
+	// Key is the solid background color of the mask assets knocked out, in the #rrggbb
+	// notation, and KeyTolerance its tolerance, DefaultKeyTolerance if zero.
+	Key          string  `json:"key,omitempty"`
+	KeyTolerance float64 `json:"key_tolerance,omitempty"`
+	// Compositor blends the masks, the CPUCompositor if nil. It's set by the application.
+	Compositor Compositor `json:"-"`
+	// Confined restricts the mask assets to the files of the pack directory, for the packs
+	// of untrusted origin, e.g. downloaded ones. It's set by the application.
+	Confined bool `json:"-"`
+
+	dir string
+}
+
+// MaskAsset is a mask image of the pack. The file path is relative to the manifest.
+type MaskAsset struct {
+	File    string `json:"file"`
+	Variant string `json:"variant,omitempty"`
+	// Anchor is the named anchor region of the face the asset is fitted into.
+	Anchor string `json:"anchor,omitempty"`
+}
+
+// LoadManifest reads the mask pack manifest. The path can be either
+// the manifest file or the mask pack directory containing it.
+func LoadManifest(path string) (*Manifest, error) {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, ManifestFile)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := ParseManifest(data, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// ParseManifest parses and validates the JSON manifest of the mask pack of the directory,
+// which the paths of the mask assets are relative to.
+func ParseManifest(data []byte, dir string) (*Manifest, error) {
+	m := &Manifest{dir: dir}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if len(m.Masks) == 0 {
+		return nil, errors.New("no mask assets defined")
+	}
+	for _, asset := range m.Masks {
+		if asset.Anchor != "" && !isAnchor(asset.Anchor) {
+			return nil, fmt.Errorf("%s: unknown anchor %q (available: %v)", asset.File, asset.Anchor, AnchorNames)
+		}
+	}
+	if _, err := m.chromaKey(); err != nil {
+		return nil, err
+	}
+	if m.Opacity < 0 || m.Opacity > 1 {
+		return nil, fmt.Errorf("the opacity must be between 0 and 1: %v", m.Opacity)
+	}
+	if m.ChildIPDRatio == 0 {
+		m.ChildIPDRatio = defaultChildIPDRatio
+	}
+	return m, nil
+}
+
+// Path returns the path of the mask asset resolved against the manifest directory.
+func (m *Manifest) Path(asset MaskAsset) string {
+	if filepath.IsAbs(asset.File) {
+		return asset.File
+	}
+	return filepath.Join(m.dir, asset.File)
+}
+
+// confined reports whether the path of the mask asset is within the manifest directory:
+// relative, and not escaping it with the parent directory elements.
+func (m *Manifest) confined(asset MaskAsset) bool {
+	if filepath.IsAbs(asset.File) || filepath.VolumeName(asset.File) != "" {
+		return false
+	}
+	rel := filepath.Clean(asset.File)
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Renderer returns the renderer overlaying the mask variant matching each face.
+// When the pack has no mask for the estimated variant, the adult mask is used.
+func (m *Manifest) Renderer() (Renderer, error) {
+	key, err := m.chromaKey()
+	if err != nil {
+		return nil, err
+	}
+	if m.Confined {
+		for _, asset := range m.Masks {
+			if !m.confined(asset) {
+				return nil, fmt.Errorf("%s: the mask asset is outside of the mask pack", asset.File)
+			}
+		}
+	}
+	var (
+		variants = make(map[string]Renderer)
+		anchored []Renderer
+	)
+	for _, asset := range m.Masks {
+		if asset.Anchor != "" {
+			mr := NewMaskRenderer(m.Path(asset))
+			mr.ClipSkin = m.ClipSkin
+			mr.Relight = m.Relight
+			mr.Feather = m.Feather
+			mr.Opacity = m.Opacity
+			mr.Jitter = m.Jitter
+			mr.Key = key
+			mr.Compositor = m.Compositor
+			mr.Anchor = asset.Anchor
+			anchored = append(anchored, mr)
+			continue
+		}
+		variant := asset.Variant
+		if variant == "" {
+			variant = VariantAdult
+		}
+		if _, ok := variants[variant]; !ok {
+			mr := NewMaskRenderer(m.Path(asset))
+			mr.ClipSkin = m.ClipSkin
+			mr.WarpJaw = m.WarpJaw
+			mr.GlassesOffset = m.GlassesOffset
+			mr.Relight = m.Relight
+			mr.Feather = m.Feather
+			mr.Opacity = m.Opacity
+			mr.Jitter = m.Jitter
+			mr.Key = key
+			mr.Compositor = m.Compositor
+			variants[variant] = mr
+		}
+	}
+	if _, ok := variants[VariantAdult]; !ok {
+		return nil, errors.New("the mask pack requires an adult mask variant")
+	}
+
+	return RendererFunc(func(ctx *gg.Context, face FaceInfo) error {
+		r, ok := variants[EstimateVariant(face, m.ChildIPDRatio)]
+		if !ok {
+			r = variants[VariantAdult]
+		}
+		if err := r.Render(ctx, face); err != nil {
+			return err
+		}
+		for _, r := range anchored {
+			if err := r.Render(ctx, face); err != nil {
+				return err
+			}
+		}
+		return nil
+	}), nil
+}
+
+// chromaKey returns the chroma key of the mask assets, nil when they are not keyed.
+func (m *Manifest) chromaKey() (*ChromaKey, error) {
+	if m.Key == "" {
+		return nil, nil
+	}
+	tolerance := m.KeyTolerance
+	if tolerance == 0 {
+		tolerance = DefaultKeyTolerance
+	}
+	return NewChromaKey(m.Key, tolerance)
+}
+
+// EstimateVariant estimates whether the face belongs to a child or to an adult,
+// based on the interpupillary distance relative to the face size.
+func EstimateVariant(face FaceInfo, childIPDRatio float64) string {
+	le, re := face.LeftEye, face.RightEye
+	if le == nil || re == nil || le.Row < 0 || re.Row < 0 || face.Scale == 0 {
+		return VariantAdult
+	}
+	ipd := math.Hypot(float64(re.Col-le.Col), float64(re.Row-le.Row))
+	if ipd/float64(face.Scale) > childIPDRatio {
+		return VariantChild
+	}
+	return VariantAdult
+}
@@ -0,0 +1,37 @@
+package facemask
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestManifestConfined(t *testing.T) {
+	abs, err := filepath.Abs("../testdata/face.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		file string
+		ok   bool
+	}{
+		{file: "adult.png", ok: true},
+		{file: "masks/adult.png", ok: true},
+		{file: "masks/../adult.png", ok: true},
+		{file: "..adult.png", ok: true},
+		{file: "../adult.png"},
+		{file: "masks/../../adult.png"},
+		{file: ".."},
+		{file: abs},
+	}
+	for _, tt := range tests {
+		m := &Manifest{Masks: []MaskAsset{{File: tt.file}}, dir: "pack", Confined: true}
+		if _, err := m.Renderer(); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok %v", tt.file, err, tt.ok)
+		}
+		// The local packs can refer to the shared assets.
+		m.Confined = false
+		if _, err := m.Renderer(); err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package facemask
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/fogleman/gg"
+)
+
+// The mask surface in the head model coordinates (see poseModel). It spans the face
+// from the nose bridge to below the chin and wraps around the cheeks.
+const (
+	mask3dHalfWidth = 290.0
+	mask3dTop       = -50.0
+	mask3dBottom    = 360.0
+	mask3dCols      = 24
+	mask3dRows      = 16
+)
+
+// Mask3DRenderer fits a curved 3D mask mesh to the estimated head pose and renders it
+// textured with the mask image, with perspective and Lambert shading. Compared to the flat
+// mask overlay it follows the head when it is turned or tilted. The faces without a pose
+// estimation are rendered with the flat mask renderer.
+type Mask3DRenderer struct {
+	Source string
+	// Ambient is the light intensity of the surfaces facing away from the light.
+	Ambient float64
+
+	once sync.Once
+	flat *MaskRenderer
+	mask image.Image
+	err  error
+}
+
+// NewMask3DRenderer returns a 3D mask renderer using the provided PNG file as mask texture.
+func NewMask3DRenderer(source string) *Mask3DRenderer {
+	return &Mask3DRenderer{Source: source, Ambient: 0.55}
+}
+
+// mask3dVertex is a vertex of the mask mesh projected onto the image.
+type mask3dVertex struct {
+	x, y, z float64
+	u, v    float64
+}
+
+// Render implements the Renderer interface.
+func (mr *Mask3DRenderer) Render(ctx *gg.Context, face FaceInfo) error {
+	mr.once.Do(func() {
+		mr.flat = NewMaskRenderer(mr.Source)
+		mr.mask, _, mr.err = loadMask(mr.Source)
+	})
+	if mr.err != nil {
+		return mr.err
+	}
+	cam, ok := fitCamera(face)
+	if !ok || face.Occluded {
+		return mr.flat.Render(ctx, face)
+	}
+	r3 := cross(cam.r1, cam.r2)
+
+	// The camera distance is a few head widths, which gives a moderate perspective foreshortening.
+	dist := 6 * 2 * mask3dHalfWidth * cam.scale
+	project := func(X [3]float64) mask3dVertex {
+		var d [3]float64
+		for k := 0; k < 3; k++ {
+			d[k] = X[k] - cam.mc[k]
+		}
+		z := cam.scale * dot(r3, d)
+		f := dist / (dist - z)
+		return mask3dVertex{
+			x: cam.ic[0] + cam.scale*dot(cam.r1, d)*f,
+			y: cam.ic[1] + cam.scale*dot(cam.r2, d)*f,
+			z: z,
+		}
+	}
+
+	var (
+		model [mask3dRows + 1][mask3dCols + 1][3]float64
+		verts [mask3dRows + 1][mask3dCols + 1]mask3dVertex
+	)
+	for i := 0; i <= mask3dRows; i++ {
+		for j := 0; j <= mask3dCols; j++ {
+			u, v := float64(j)/mask3dCols, float64(i)/mask3dRows
+			model[i][j] = mask3dSurface(u, v)
+			verts[i][j] = project(model[i][j])
+			verts[i][j].u, verts[i][j].v = u, v
+		}
+	}
+
+	// The texture is resized to the projected mask size, so it can be sampled without aliasing.
+	width := int(2 * mask3dHalfWidth * cam.scale)
+	height := int((mask3dBottom - mask3dTop) * cam.scale)
+	if width < 2 || height < 2 {
+		return nil
+	}
+	texture := imaging.Resize(mr.mask, width, height, imaging.Lanczos)
+
+	type triangle struct {
+		v     [3]mask3dVertex
+		shade float64
+		depth float64
+	}
+	light := normalize([3]float64{0, -0.3, 1})
+	var tris []triangle
+	for i := 0; i < mask3dRows; i++ {
+		for j := 0; j < mask3dCols; j++ {
+			for _, idx := range [2][3][2]int{
+				{{i, j}, {i + 1, j}, {i, j + 1}},
+				{{i, j + 1}, {i + 1, j}, {i + 1, j + 1}},
+			} {
+				a, b, c := model[idx[0][0]][idx[0][1]], model[idx[1][0]][idx[1][1]], model[idx[2][0]][idx[2][1]]
+				var ab, ac [3]float64
+				for k := 0; k < 3; k++ {
+					ab[k], ac[k] = b[k]-a[k], c[k]-a[k]
+				}
+				// The surface normal rotated into the camera space, pointing outwards.
+				n := cross(ac, ab)
+				n = normalize([3]float64{dot(cam.r1, n), dot(cam.r2, n), dot(r3, n)})
+				if n[2] <= 0 {
+					continue // back face
+				}
+				t := triangle{shade: mr.Ambient + (1-mr.Ambient)*math.Max(0, dot(n, light))}
+				for k, p := range idx {
+					t.v[k] = verts[p[0]][p[1]]
+					t.depth += t.v[k].z / 3
+				}
+				tris = append(tris, t)
+			}
+		}
+	}
+	// Draw the triangles from back to front.
+	sort.Slice(tris, func(i, j int) bool { return tris[i].depth < tris[j].depth })
+
+	// Render into an overlay covering only the projected mask.
+	var rect image.Rectangle
+	for _, t := range tris {
+		for _, p := range t.v {
+			rect = rect.Union(image.Rect(int(p.x)-1, int(p.y)-1, int(p.x)+2, int(p.y)+2))
+		}
+	}
+	rect = rect.Intersect(image.Rect(0, 0, ctx.Width(), ctx.Height()))
+	if rect.Empty() {
+		return nil
+	}
+	overlay := image.NewNRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	for _, t := range tris {
+		for k := range t.v {
+			t.v[k].x -= float64(rect.Min.X)
+			t.v[k].y -= float64(rect.Min.Y)
+		}
+		rasterize(overlay, texture, t.v, t.shade)
+	}
+	ctx.DrawImage(overlay, rect.Min.X, rect.Min.Y)
+
+	return nil
+}
+
+// mask3dSurface returns the point of the mask surface at the (u, v) texture coordinates.
+func mask3dSurface(u, v float64) [3]float64 {
+	x := (2*u - 1) * mask3dHalfWidth
+	y := mask3dTop + v*(mask3dBottom-mask3dTop)
+
+	// The mask is a cylinder like surface, bent backwards towards the ears,
+	// lifted over the nose and tucked under the chin.
+	z := -40 - 0.003*x*x
+	z += 60 * math.Exp(-(x*x)/(70*70)-(y*y)/(110*110))
+	if y > 200 {
+		z -= 0.002 * (y - 200) * (y - 200)
+	}
+	return [3]float64{x, y, z}
+}
+
+// rasterize draws the textured and shaded triangle over the destination image.
+func rasterize(dst *image.NRGBA, texture *image.NRGBA, v [3]mask3dVertex, shade float64) {
+	minX := math.Floor(math.Min(v[0].x, math.Min(v[1].x, v[2].x)))
+	maxX := math.Ceil(math.Max(v[0].x, math.Max(v[1].x, v[2].x)))
+	minY := math.Floor(math.Min(v[0].y, math.Min(v[1].y, v[2].y)))
+	maxY := math.Ceil(math.Max(v[0].y, math.Max(v[1].y, v[2].y)))
+	rect := image.Rect(int(minX), int(minY), int(maxX)+1, int(maxY)+1).Intersect(dst.Bounds())
+
+	area := (v[1].x-v[0].x)*(v[2].y-v[0].y) - (v[2].x-v[0].x)*(v[1].y-v[0].y)
+	if math.Abs(area) < 1e-9 {
+		return
+	}
+	tw, th := float64(texture.Bounds().Dx()-1), float64(texture.Bounds().Dy()-1)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			px, py := float64(x)+0.5, float64(y)+0.5
+			w0 := ((v[1].x-px)*(v[2].y-py) - (v[2].x-px)*(v[1].y-py)) / area
+			w1 := ((v[2].x-px)*(v[0].y-py) - (v[0].x-px)*(v[2].y-py)) / area
+			w2 := 1 - w0 - w1
+			if w0 < 0 || w1 < 0 || w2 < 0 {
+				continue
+			}
+			u := w0*v[0].u + w1*v[1].u + w2*v[2].u
+			t := w0*v[0].v + w1*v[1].v + w2*v[2].v
+			c := texture.NRGBAAt(int(u*tw+0.5), int(t*th+0.5))
+			if c.A == 0 {
+				continue
+			}
+			c.R = uint8(clamp(float64(c.R)*shade, 0, 255))
+			c.G = uint8(clamp(float64(c.G)*shade, 0, 255))
+			c.B = uint8(clamp(float64(c.B)*shade, 0, 255))
+			blendOver(dst, x, y, c)
+		}
+	}
+}
+
+// blendOver composites the color over the destination pixel.
+func blendOver(dst *image.NRGBA, x, y int, c color.NRGBA) {
+	off := dst.PixOffset(x, y)
+	sa := float64(c.A) / 255
+	da := float64(dst.Pix[off+3]) / 255
+	oa := sa + da*(1-sa)
+	if oa == 0 {
+		return
+	}
+	for k, s := range [3]uint8{c.R, c.G, c.B} {
+		d := float64(dst.Pix[off+k])
+		dst.Pix[off+k] = uint8((float64(s)*sa + d*da*(1-sa)) / oa)
+	}
+	dst.Pix[off+3] = uint8(oa * 255)
+}
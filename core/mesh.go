@@ -0,0 +1,153 @@
+package facemask
+
+import (
+	"math"
+
+	pigo "github.com/esimov/pigo/core"
+	"github.com/fogleman/gg"
+)
+
+// MeshRenderer triangulates the landmark points of the face and draws the wireframe
+// over it, which is useful both for checking the landmark quality and as a visual effect.
+type MeshRenderer struct {
+	LineWidth float64
+}
+
+type meshPoint struct {
+	x, y float64
+}
+
+type triangle struct {
+	a, b, c int
+}
+
+// Render implements the Renderer interface.
+func (mr *MeshRenderer) Render(ctx *gg.Context, face FaceInfo) error {
+	points := meshPoints(face)
+	if len(points) < 3 {
+		return nil
+	}
+	width := mr.LineWidth
+	if width <= 0 {
+		width = math.Max(1, float64(face.Scale)/200)
+	}
+
+	ctx.Push()
+	defer ctx.Pop()
+
+	ctx.SetLineWidth(width)
+	ctx.SetRGBA(0, 1, 0.8, 0.8)
+	for _, t := range delaunay(points) {
+		a, b, c := points[t.a], points[t.b], points[t.c]
+		ctx.MoveTo(a.x, a.y)
+		ctx.LineTo(b.x, b.y)
+		ctx.LineTo(c.x, c.y)
+		ctx.ClosePath()
+	}
+	ctx.Stroke()
+
+	ctx.SetRGB(1, 0.2, 0.4)
+	for _, p := range points {
+		ctx.DrawCircle(p.x, p.y, width*2)
+	}
+	ctx.Fill()
+
+	return nil
+}
+
+// meshPoints collects the pupils, the landmark points and the estimated chin of the face.
+func meshPoints(face FaceInfo) []meshPoint {
+	var points []meshPoint
+	for _, p := range []*pigo.Puploc{face.LeftEye, face.RightEye} {
+		if validPoint(p) {
+			points = append(points, meshPoint{float64(p.Col), float64(p.Row)})
+		}
+	}
+	for _, lp := range landmarkPoints {
+		if p, ok := face.Landmarks[lp.name]; ok && validPoint(p) {
+			points = append(points, meshPoint{float64(p.Col), float64(p.Row)})
+		}
+	}
+	if x, y, ok := estimateChin(face); ok {
+		points = append(points, meshPoint{x, y})
+	}
+	return points
+}
+
+// delaunay triangulates the points with the Bowyer-Watson algorithm.
+func delaunay(points []meshPoint) []triangle {
+	n := len(points)
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, p := range points {
+		minX, minY = math.Min(minX, p.x), math.Min(minY, p.y)
+		maxX, maxY = math.Max(maxX, p.x), math.Max(maxY, p.y)
+	}
+	d := math.Max(maxX-minX, maxY-minY) * 10
+	if d == 0 {
+		return nil
+	}
+	midX, midY := (minX+maxX)/2, (minY+maxY)/2
+
+	// The super triangle containing all the points is appended after the input points.
+	verts := append(append([]meshPoint(nil), points...),
+		meshPoint{midX - d, midY - d},
+		meshPoint{midX, midY + d},
+		meshPoint{midX + d, midY - d},
+	)
+	tris := []triangle{{n, n + 1, n + 2}}
+
+	for i := 0; i < n; i++ {
+		p := verts[i]
+		var (
+			kept  []triangle
+			edges [][2]int
+		)
+		for _, t := range tris {
+			if inCircumcircle(verts[t.a], verts[t.b], verts[t.c], p) {
+				edges = append(edges, [2]int{t.a, t.b}, [2]int{t.b, t.c}, [2]int{t.c, t.a})
+			} else {
+				kept = append(kept, t)
+			}
+		}
+		// The edges shared by two removed triangles are inside the polygonal hole.
+		for j, e := range edges {
+			shared := false
+			for k, f := range edges {
+				if j != k && (e[0] == f[1] && e[1] == f[0] || e[0] == f[0] && e[1] == f[1]) {
+					shared = true
+					break
+				}
+			}
+			if !shared {
+				kept = append(kept, triangle{e[0], e[1], i})
+			}
+		}
+		tris = kept
+	}
+
+	result := tris[:0]
+	for _, t := range tris {
+		if t.a < n && t.b < n && t.c < n {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// inCircumcircle reports whether the point p lies inside the circumcircle of the triangle a, b, c.
+func inCircumcircle(a, b, c, p meshPoint) bool {
+	ax, ay := a.x-p.x, a.y-p.y
+	bx, by := b.x-p.x, b.y-p.y
+	cx, cy := c.x-p.x, c.y-p.y
+	det := (ax*ax+ay*ay)*(bx*cy-cx*by) -
+		(bx*bx+by*by)*(ax*cy-cx*ay) +
+		(cx*cx+cy*cy)*(ax*by-bx*ay)
+
+	// The sign of the determinant depends on the orientation of the triangle.
+	orient := (b.x-a.x)*(c.y-a.y) - (b.y-a.y)*(c.x-a.x)
+	if orient > 0 {
+		return det > 0
+	}
+	return det < 0
+}
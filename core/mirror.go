@@ -0,0 +1,60 @@
+package facemask
+
+import (
+	"sort"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// mirrorParams returns the image parameters of the horizontally flipped grayscale image.
+func mirrorParams(params pigo.ImageParams) pigo.ImageParams {
+	flipped := make([]uint8, len(params.Pixels))
+	for y := 0; y < params.Rows; y++ {
+		row := params.Pixels[y*params.Dim : y*params.Dim+params.Cols]
+		dst := flipped[y*params.Dim : y*params.Dim+params.Cols]
+		for x, v := range row {
+			dst[params.Cols-1-x] = v
+		}
+	}
+	params.Pixels = flipped
+	return params
+}
+
+// mirrorAngle returns the detection angle over the flipped image, where 1.0 is 2*pi radians.
+func mirrorAngle(angle float64) float64 {
+	if angle == 0 {
+		return 0
+	}
+	return 1 - angle
+}
+
+// unmirror maps the detections over the flipped image back to the original image.
+func unmirror(dets []pigo.Detection, cols int) []pigo.Detection {
+	for i := range dets {
+		dets[i].Col = cols - 1 - dets[i].Col
+	}
+	return dets
+}
+
+// mergeMirrored merges the detections over the original and over the flipped image. The
+// faces found on both are kept once, with the better of the two scores, since unlike
+// the fused cascades the two passes are not independent evidence of the face.
+func mergeMirrored(dets, mirrored []pigo.Detection, iouThreshold float64) []pigo.Detection {
+	all := append(append([]pigo.Detection(nil), dets...), mirrored...)
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Q > all[j].Q })
+
+	var merged []pigo.Detection
+	for _, d := range all {
+		dup := false
+		for _, m := range merged {
+			if detectionIoU(d, m) > iouThreshold {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			merged = append(merged, d)
+		}
+	}
+	return merged
+}
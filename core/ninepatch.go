@@ -0,0 +1,113 @@
+package facemask
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// ninePatchExt is the file name suffix of the nine-patch mask assets.
+const ninePatchExt = ".9.png"
+
+// faceWidthRatio is the width of the face at the cheeks relative to the interpupillary distance.
+const faceWidthRatio = 2.2
+
+// isNinePatch reports whether the mask asset is a nine-patch image.
+func isNinePatch(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), ninePatchExt)
+}
+
+// ninePatch is a mask image whose stretchable columns, e.g. the ear straps, absorb
+// the difference between the width of the face and the width of the mask, while the
+// rest of the mask, the central panel, keeps its aspect ratio.
+type ninePatch struct {
+	img *image.NRGBA
+	// stretch are the [start, end) column ranges of the stretchable regions.
+	stretch [][2]int
+}
+
+// loadNinePatch decodes the nine-patch mask asset. As in the Android nine-patch images,
+// the opaque black pixels of the one pixel wide top border mark the horizontally stretchable
+// columns; the border is removed from the mask. The mask height is always scaled uniformly,
+// so the left border is ignored.
+func loadNinePatch(path string) (*ninePatch, error) {
+	img, err := loadPNG(path)
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	if b.Dx() < 3 || b.Dy() < 3 {
+		return nil, errors.New("nine-patch image too small")
+	}
+	np := &ninePatch{img: imaging.Crop(img, b.Inset(1))}
+	start := -1
+	for x := b.Min.X + 1; x < b.Max.X-1; x++ {
+		r, g, bl, a := img.At(x, b.Min.Y).RGBA()
+		marked := a > 0x8000 && r < 0x4000 && g < 0x4000 && bl < 0x4000
+		col := x - b.Min.X - 1
+		switch {
+		case marked && start < 0:
+			start = col
+		case !marked && start >= 0:
+			np.stretch = append(np.stretch, [2]int{start, col})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		np.stretch = append(np.stretch, [2]int{start, b.Dx() - 2})
+	}
+	if len(np.stretch) == 0 {
+		return nil, errors.New("nine-patch image without stretchable regions")
+	}
+	return np, nil
+}
+
+// resize scales the mask to the height and stretches its stretchable columns to the width.
+// When the width is too narrow even for the fixed columns, the whole mask is squeezed.
+func (np *ninePatch) resize(width, height int) *image.NRGBA {
+	w, h := np.img.Bounds().Dx(), np.img.Bounds().Dy()
+	scale := float64(height) / float64(h)
+	var stretchable int
+	for _, s := range np.stretch {
+		stretchable += s[1] - s[0]
+	}
+	fixed := float64(w-stretchable) * scale
+	if fixed >= float64(width) || stretchable == 0 {
+		return imaging.Resize(np.img, width, height, imaging.Lanczos)
+	}
+	// The stretchable regions share the remaining width in proportion to their size.
+	extra := (float64(width) - fixed) / float64(stretchable)
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	var (
+		x   int
+		pos float64
+	)
+	slice := func(from, to int, factor float64) {
+		if to <= from {
+			return
+		}
+		pos += float64(to-from) * factor
+		end := int(math.Round(pos))
+		if end > width {
+			end = width
+		}
+		if end > x {
+			part := imaging.Resize(imaging.Crop(np.img, image.Rect(from, 0, to, h)), end-x, height, imaging.Lanczos)
+			draw.Draw(dst, image.Rect(x, 0, end, height), part, image.Point{}, draw.Src)
+			x = end
+		}
+	}
+	col := 0
+	for _, s := range np.stretch {
+		slice(col, s[0], scale)
+		slice(s[0], s[1], extra)
+		col = s[1]
+	}
+	slice(col, w, scale)
+	return dst
+}
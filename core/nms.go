@@ -0,0 +1,83 @@
+package facemask
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// The suppression methods applied to the raw cascade detections.
+const (
+	// NMSCluster merges the overlapping detections into their average, which is the Pigo default.
+	NMSCluster = "cluster"
+	// NMSHard keeps the best scored detection of the overlapping ones and drops the others.
+	NMSHard = "hard"
+	// NMSSoft decays the score of the overlapping detections depending on the overlap,
+	// so the neighbouring faces in dense group photos are not suppressed.
+	NMSSoft = "soft"
+)
+
+// softNMSFloor is the fraction of the original score under which a detection is dropped by the Soft-NMS.
+const softNMSFloor = 0.1
+
+// suppress reduces the raw detections returned by the cascade with the provided suppression method.
+// The scores of the suppressed detections are added to the kept ones, so the detection quality
+// stays in the same range as with the clustering and the same threshold applies.
+func suppress(classifier *pigo.Pigo, dets []pigo.Detection, method string, iouThreshold, sigma float64) ([]pigo.Detection, error) {
+	switch method {
+	case "", NMSCluster:
+		return classifier.ClusterDetections(dets, iouThreshold), nil
+	case NMSHard, NMSSoft:
+	default:
+		return nil, fmt.Errorf("unknown suppression method %q", method)
+	}
+	if sigma <= 0 {
+		return nil, fmt.Errorf("invalid Soft-NMS sigma: %v", sigma)
+	}
+
+	type candidate struct {
+		det      pigo.Detection
+		original float32
+	}
+	rest := make([]candidate, len(dets))
+	for i, d := range dets {
+		rest[i] = candidate{d, d.Q}
+	}
+	var kept []pigo.Detection
+	for len(rest) > 0 {
+		sort.SliceStable(rest, func(i, j int) bool { return rest[i].det.Q > rest[j].det.Q })
+		best := rest[0].det
+		var next []candidate
+		for _, c := range rest[1:] {
+			iou := detectionIoU(best, c.det)
+			weight := 1.0
+			if method == NMSHard {
+				if iou > iouThreshold {
+					weight = 0
+				}
+			} else {
+				weight = math.Exp(-iou * iou / sigma)
+			}
+			best.Q += c.det.Q * float32(1-weight)
+			c.det.Q *= float32(weight)
+			if c.det.Q > c.original*softNMSFloor {
+				next = append(next, c)
+			}
+		}
+		kept = append(kept, best)
+		rest = next
+	}
+	return kept, nil
+}
+
+// detectionIoU returns the intersection over union of the two detection boxes.
+func detectionIoU(a, b pigo.Detection) float64 {
+	r1, c1, s1 := float64(a.Row), float64(a.Col), float64(a.Scale)
+	r2, c2, s2 := float64(b.Row), float64(b.Col), float64(b.Scale)
+
+	overRow := math.Max(0, math.Min(r1+s1/2, r2+s2/2)-math.Max(r1-s1/2, r2-s2/2))
+	overCol := math.Max(0, math.Min(c1+s1/2, c2+s2/2)-math.Max(c1-s1/2, c2-s2/2))
+	return overRow * overCol / (s1*s1 + s2*s2 - overRow*overCol)
+}
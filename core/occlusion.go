@@ -0,0 +1,75 @@
+package facemask
+
+import (
+	"math"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// The plausible ranges of the landmark based facial proportions,
+// relative to the interpupillary distance.
+const (
+	minMouthWidth    = 0.5
+	maxMouthWidth    = 1.4
+	minEyesToMouth   = 0.7
+	maxEyesToMouth   = 1.6
+	maxMouthShift    = 0.35
+	maxRollMouthEyes = 20 * math.Pi / 180
+)
+
+// landmarksPlausible checks the localized pupils and mouth corners against the typical
+// facial proportions. The landmark cascades return no confidence score, but an occluded
+// face (a hand over the mouth, hair across the face) yields implausible proportions.
+func landmarksPlausible(face FaceInfo) bool {
+	if !validPoint(face.LeftEye) || !validPoint(face.RightEye) ||
+		!validPoint(face.MouthLeft) || !validPoint(face.MouthRight) {
+		return false
+	}
+	lx, ly := float64(face.LeftEye.Col), float64(face.LeftEye.Row)
+	rx, ry := float64(face.RightEye.Col), float64(face.RightEye.Row)
+	mlx, mly := float64(face.MouthLeft.Col), float64(face.MouthLeft.Row)
+	mrx, mry := float64(face.MouthRight.Col), float64(face.MouthRight.Row)
+
+	ipd := math.Hypot(rx-lx, ry-ly)
+	if ipd < 1 {
+		return false
+	}
+	eyesAngle := math.Atan2(ry-ly, rx-lx)
+	mouthAngle := math.Atan2(mry-mly, mrx-mlx)
+	if math.Abs(eyesAngle-mouthAngle) > maxRollMouthEyes {
+		return false
+	}
+	if w := math.Hypot(mrx-mlx, mry-mly) / ipd; w < minMouthWidth || w > maxMouthWidth {
+		return false
+	}
+
+	// Express the mouth center in the coordinate system of the eyes.
+	dx, dy := (mlx+mrx)/2-(lx+rx)/2, (mly+mry)/2-(ly+ry)/2
+	sin, cos := math.Sincos(-eyesAngle)
+	along, across := (dx*cos-dy*sin)/ipd, (dx*sin+dy*cos)/ipd
+	if math.Abs(along) > maxMouthShift {
+		return false
+	}
+	return across >= minEyesToMouth && across <= maxEyesToMouth
+}
+
+// ipdInRange reports whether the interpupillary distance of the face relative to the face
+// size is within the range, a zero bound being disabled. The faces with the pupils not
+// localized pass, since they are not necessarily false detections.
+func ipdInRange(face FaceInfo, min, max float64) bool {
+	if !validPoint(face.LeftEye) || !validPoint(face.RightEye) || face.Scale == 0 {
+		return true
+	}
+	ratio := distance(face.LeftEye.Col, face.LeftEye.Row, face.RightEye.Col, face.RightEye.Row) / float64(face.Scale)
+	return (min <= 0 || ratio >= min) && (max <= 0 || ratio <= max)
+}
+
+// fallbackMouth returns the mouth corners placed at their typical position
+// relative to the face box, used when the localized landmarks are not reliable.
+func fallbackMouth(face pigo.Detection) (*pigo.Puploc, *pigo.Puploc) {
+	s := float32(face.Scale)
+	row := face.Row + int(0.32*s)
+	left := &pigo.Puploc{Row: row, Col: face.Col - int(0.155*s), Scale: s * 0.25}
+	right := &pigo.Puploc{Row: row, Col: face.Col + int(0.155*s), Scale: s * 0.25}
+	return left, right
+}
@@ -0,0 +1,255 @@
+//go:build onnx
+// +build onnx
+
+package facemask
+
+/*
+#cgo LDFLAGS: -lonnxruntime
+#include <stdlib.h>
+#include <string.h>
+#include <onnxruntime_c_api.h>
+
+static const OrtApi *ort;
+
+static void fm_init() {
+	ort = OrtGetApiBase()->GetApi(ORT_API_VERSION);
+}
+
+static char* fm_status_message(OrtStatus *status) {
+	char *msg = strdup(ort->GetErrorMessage(status));
+	ort->ReleaseStatus(status);
+	return msg;
+}
+
+static OrtStatus* fm_create_session(const char *model, OrtEnv **env, OrtSession **session) {
+	OrtSessionOptions *opts;
+	OrtStatus *status = ort->CreateEnv(ORT_LOGGING_LEVEL_WARNING, "facemask", env);
+	if (status) return status;
+	status = ort->CreateSessionOptions(&opts);
+	if (status) {
+		ort->ReleaseEnv(*env);
+		return status;
+	}
+	status = ort->CreateSession(*env, model, opts, session);
+	ort->ReleaseSessionOptions(opts);
+	if (status) ort->ReleaseEnv(*env);
+	return status;
+}
+
+static void fm_release_session(OrtEnv *env, OrtSession *session) {
+	ort->ReleaseSession(session);
+	ort->ReleaseEnv(env);
+}
+
+static OrtStatus* fm_copy_output(OrtValue *value, float **data, size_t *count) {
+	OrtTensorTypeAndShapeInfo *info;
+	float *src;
+	OrtStatus *status = ort->GetTensorTypeAndShape(value, &info);
+	if (status) return status;
+	status = ort->GetTensorShapeElementCount(info, count);
+	ort->ReleaseTensorTypeAndShapeInfo(info);
+	if (status) return status;
+	status = ort->GetTensorMutableData(value, (void**)&src);
+	if (status) return status;
+	*data = malloc(sizeof(float) * (*count));
+	memcpy(*data, src, sizeof(float) * (*count));
+	return NULL;
+}
+
+// fm_run feeds the 1x3xHxW input tensor to the UltraFace network and copies
+// the "scores" (1xNx2) and "boxes" (1xNx4) outputs into newly allocated buffers.
+static OrtStatus* fm_run(OrtSession *session, float *input, int64_t h, int64_t w,
+	float **scores, size_t *nscores, float **boxes, size_t *nboxes) {
+	OrtMemoryInfo *mem;
+	OrtValue *in = NULL;
+	OrtValue *out[2] = {NULL, NULL};
+	int64_t shape[4] = {1, 3, h, w};
+	const char *inNames[] = {"input"};
+	const char *outNames[] = {"scores", "boxes"};
+
+	OrtStatus *status = ort->CreateCpuMemoryInfo(OrtArenaAllocator, OrtMemTypeDefault, &mem);
+	if (status) return status;
+	status = ort->CreateTensorWithDataAsOrtValue(mem, input, sizeof(float)*3*h*w, shape, 4,
+		ONNX_TENSOR_ELEMENT_DATA_TYPE_FLOAT, &in);
+	ort->ReleaseMemoryInfo(mem);
+	if (status) return status;
+
+	status = ort->Run(session, NULL, inNames, (const OrtValue* const*)&in, 1, outNames, 2, out);
+	ort->ReleaseValue(in);
+	if (status) return status;
+
+	status = fm_copy_output(out[0], scores, nscores);
+	if (!status) {
+		status = fm_copy_output(out[1], boxes, nboxes);
+		if (status) {
+			free(*scores);
+			*scores = NULL;
+		}
+	}
+	ort->ReleaseValue(out[0]);
+	ort->ReleaseValue(out[1]);
+	return status;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"math"
+	"sort"
+	"sync"
+	"unsafe"
+
+	"github.com/disintegration/imaging"
+	pigo "github.com/esimov/pigo/core"
+)
+
+const (
+	// The input size of the UltraFace version-RFB-320 model.
+	onnxInputWidth  = 320
+	onnxInputHeight = 240
+	// onnxScoreThreshold is the minimum face probability of a candidate box.
+	onnxScoreThreshold = 0.7
+	// onnxIouThreshold is the overlap above which the weaker candidate box is suppressed.
+	onnxIouThreshold = 0.3
+	// onnxScoreScale maps the face probability onto the Pigo detection score range.
+	onnxScoreScale = 10
+)
+
+var onnxInit sync.Once
+
+func init() {
+	RegisterBackend("onnx", openOnnx)
+}
+
+// onnxBackend runs an UltraFace ONNX face detector through the onnxruntime C library.
+type onnxBackend struct {
+	mu      sync.Mutex
+	env     *C.OrtEnv
+	session *C.OrtSession
+}
+
+type onnxBox struct {
+	x1, y1, x2, y2 float64
+	score          float64
+}
+
+func openOnnx(model string) (Backend, error) {
+	if model == "" {
+		return nil, errors.New("the onnx backend requires a model file")
+	}
+	onnxInit.Do(func() { C.fm_init() })
+
+	path := C.CString(model)
+	defer C.free(unsafe.Pointer(path))
+
+	b := &onnxBackend{}
+	if status := C.fm_create_session(path, &b.env, &b.session); status != nil {
+		return nil, onnxError(status)
+	}
+	return b, nil
+}
+
+// Detect implements the Backend interface.
+func (b *onnxBackend) Detect(img image.Image) ([]pigo.Detection, error) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	resized := imaging.Resize(img, onnxInputWidth, onnxInputHeight, imaging.Linear)
+
+	// The network expects a normalized planar RGB input.
+	plane := onnxInputWidth * onnxInputHeight
+	input := (*[1 << 28]C.float)(C.malloc(C.size_t(3 * plane * 4)))[: 3*plane : 3*plane]
+	defer C.free(unsafe.Pointer(&input[0]))
+
+	for i := 0; i < plane; i++ {
+		for c := 0; c < 3; c++ {
+			input[c*plane+i] = C.float((float64(resized.Pix[i*4+c]) - 127) / 128)
+		}
+	}
+
+	var (
+		scores, boxes   *C.float
+		nscores, nboxes C.size_t
+	)
+	b.mu.Lock()
+	status := C.fm_run(b.session, &input[0], onnxInputHeight, onnxInputWidth, &scores, &nscores, &boxes, &nboxes)
+	b.mu.Unlock()
+	if status != nil {
+		return nil, onnxError(status)
+	}
+	defer C.free(unsafe.Pointer(scores))
+	defer C.free(unsafe.Pointer(boxes))
+
+	s := (*[1 << 28]C.float)(unsafe.Pointer(scores))[:nscores:nscores]
+	bx := (*[1 << 28]C.float)(unsafe.Pointer(boxes))[:nboxes:nboxes]
+
+	var candidates []onnxBox
+	for i := 0; i < int(nscores)/2 && i*4+3 < int(nboxes); i++ {
+		score := float64(s[i*2+1])
+		if score < onnxScoreThreshold {
+			continue
+		}
+		candidates = append(candidates, onnxBox{
+			x1:    float64(bx[i*4]) * float64(w),
+			y1:    float64(bx[i*4+1]) * float64(h),
+			x2:    float64(bx[i*4+2]) * float64(w),
+			y2:    float64(bx[i*4+3]) * float64(h),
+			score: score,
+		})
+	}
+
+	var faces []pigo.Detection
+	for _, box := range suppressBoxes(candidates, onnxIouThreshold) {
+		faces = append(faces, pigo.Detection{
+			Row:   int((box.y1 + box.y2) / 2),
+			Col:   int((box.x1 + box.x2) / 2),
+			Scale: int(math.Max(box.x2-box.x1, box.y2-box.y1)),
+			Q:     float32(box.score * onnxScoreScale),
+		})
+	}
+	return faces, nil
+}
+
+// Close releases the onnxruntime session.
+func (b *onnxBackend) Close() error {
+	C.fm_release_session(b.env, b.session)
+	return nil
+}
+
+// suppressBoxes applies a greedy non-maximum suppression over the candidate boxes.
+func suppressBoxes(boxes []onnxBox, iouThreshold float64) []onnxBox {
+	sort.Slice(boxes, func(i, j int) bool {
+		return boxes[i].score > boxes[j].score
+	})
+	var kept []onnxBox
+	for _, box := range boxes {
+		keep := true
+		for _, k := range kept {
+			if boxIoU(box, k) > iouThreshold {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			kept = append(kept, box)
+		}
+	}
+	return kept
+}
+
+func boxIoU(a, b onnxBox) float64 {
+	w := math.Min(a.x2, b.x2) - math.Max(a.x1, b.x1)
+	h := math.Min(a.y2, b.y2) - math.Max(a.y1, b.y1)
+	if w <= 0 || h <= 0 {
+		return 0
+	}
+	inter := w * h
+	union := (a.x2-a.x1)*(a.y2-a.y1) + (b.x2-b.x1)*(b.y2-b.y1) - inter
+	return inter / union
+}
+
+func onnxError(status *C.OrtStatus) error {
+	msg := C.fm_status_message(status)
+	defer C.free(unsafe.Pointer(msg))
+	return errors.New("onnx: " + C.GoString(msg))
+}
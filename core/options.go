@@ -0,0 +1,204 @@
+package facemask
+
+import (
+	"image"
+	"image/png"
+	"io"
+)
+
+// The default detector settings, matching the defaults of the facemask command.
+const (
+	DefaultFaceCascade = "cascades/facefinder"
+	DefaultEyesCascade = "cascades/puploc"
+	DefaultFlplocDir   = "cascades/lps"
+)
+
+// Option configures the detector created by New.
+type Option func(*Detector) error
+
+// New returns a detector with sensible defaults, customized by the provided options:
+//
+//	fd, err := facemask.New(facemask.WithMinSize(40), facemask.WithQualityThreshold(6.5))
+func New(opts ...Option) (*Detector, error) {
+	fd := &Detector{
+		FaceCascade:  DefaultFaceCascade,
+		EyesCascade:  DefaultEyesCascade,
+		FlplocDir:    DefaultFlplocDir,
+		MinSize:      20,
+		MaxSize:      1000,
+		ShiftFactor:  0.1,
+		ScaleFactor:  1.1,
+		IouThreshold: 0.2,
+		NMS:          NMSCluster,
+		NMSSigma:     0.1,
+		QThreshold:   defaultQThreshold,
+		Overlay:      NewMaskRenderer(DefaultMask),
+	}
+	for _, opt := range opts {
+		if err := opt(fd); err != nil {
+			return nil, err
+		}
+	}
+	return fd, nil
+}
+
+// WithCascades sets the face, the pupil localization and the facial landmark cascades.
+func WithCascades(face, eyes, flplocDir string) Option {
+	return func(fd *Detector) error {
+		fd.FaceCascade, fd.EyesCascade, fd.FlplocDir = face, eyes, flplocDir
+		return nil
+	}
+}
+
+// WithMinSize sets the minimum face size in pixels.
+func WithMinSize(size int) Option {
+	return func(fd *Detector) error {
+		fd.MinSize = size
+		return nil
+	}
+}
+
+// WithMaxSize sets the maximum face size in pixels.
+func WithMaxSize(size int) Option {
+	return func(fd *Detector) error {
+		fd.MaxSize = size
+		return nil
+	}
+}
+
+// WithShiftFactor sets the shift of the detection window as the percentage of its size.
+func WithShiftFactor(shift float64) Option {
+	return func(fd *Detector) error {
+		fd.ShiftFactor = shift
+		return nil
+	}
+}
+
+// WithScaleFactor sets the scaling of the detection window between the scales.
+func WithScaleFactor(scale float64) Option {
+	return func(fd *Detector) error {
+		if scale < 1.05 {
+			return errScaleFactor
+		}
+		fd.ScaleFactor = scale
+		return nil
+	}
+}
+
+// WithAngle sets the detection angle, where 1.0 is 2*pi radians.
+func WithAngle(angle float64) Option {
+	return func(fd *Detector) error {
+		fd.Angle = angle
+		return nil
+	}
+}
+
+// WithIoUThreshold sets the intersection over union threshold of the overlapping detections.
+func WithIoUThreshold(iou float64) Option {
+	return func(fd *Detector) error {
+		fd.IouThreshold = iou
+		return nil
+	}
+}
+
+// WithQualityThreshold sets the minimum detection quality of the faces.
+func WithQualityThreshold(q float64) Option {
+	return func(fd *Detector) error {
+		fd.QThreshold = q
+		return nil
+	}
+}
+
+// WithNMS sets the suppression method of the overlapping detections and the Soft-NMS sigma.
+func WithNMS(method string, sigma float64) Option {
+	return func(fd *Detector) error {
+		fd.NMS, fd.NMSSigma = method, sigma
+		return nil
+	}
+}
+
+// WithPreprocess sets the enhancements applied to the grayscale image before the detection.
+func WithPreprocess(spec string) Option {
+	return func(fd *Detector) error {
+		fd.Preprocess = spec
+		return nil
+	}
+}
+
+// WithIPDRange sets the plausible range of the interpupillary distance relative to the face size.
+func WithIPDRange(min, max float64) Option {
+	return func(fd *Detector) error {
+		fd.MinIPD, fd.MaxIPD = min, max
+		return nil
+	}
+}
+
+// WithLandmarkQ sets the minimum confidence of the landmark fit, under which the overlay
+// is placed relative to the face box.
+func WithLandmarkQ(q float64) Option {
+	return func(fd *Detector) error {
+		fd.LandmarkQ = q
+		return nil
+	}
+}
+
+// WithDetectScale runs the face cascades over the image downscaled by the factor,
+// while the pupils and the landmark points are localized at the full resolution.
+func WithDetectScale(scale float64) Option {
+	return func(fd *Detector) error {
+		fd.DetectScale = scale
+		return nil
+	}
+}
+
+// WithLandmarks selects the landmark points, or the point groups, localized on every face.
+func WithLandmarks(names ...string) Option {
+	return func(fd *Detector) error {
+		fd.Landmarks = names
+		return nil
+	}
+}
+
+// WithMirror enables the detection over the horizontally flipped image too.
+func WithMirror(mirror bool) Option {
+	return func(fd *Detector) error {
+		fd.Mirror = mirror
+		return nil
+	}
+}
+
+// WithBackend sets the face detection backend and its model file.
+func WithBackend(name, model string) Option {
+	return func(fd *Detector) error {
+		fd.Backend, fd.Model = name, model
+		return nil
+	}
+}
+
+// WithOverlay sets the renderer of the overlays drawn by Process.
+func WithOverlay(r Renderer) Option {
+	return func(fd *Detector) error {
+		fd.Overlay = r
+		return nil
+	}
+}
+
+// WithMask sets the overlay drawn by Process to the mask renderer using the PNG
+// image read from r as mask.
+func WithMask(r io.Reader) Option {
+	return func(fd *Detector) error {
+		mask, err := png.Decode(r)
+		if err != nil {
+			return err
+		}
+		fd.Overlay = NewMaskRendererFromImage(mask)
+		return nil
+	}
+}
+
+// NewMaskRendererFromImage returns a mask renderer using the provided image as mask.
+func NewMaskRendererFromImage(mask image.Image) *MaskRenderer {
+	mr := &MaskRenderer{mask: mask}
+	mr.once.Do(func() {})
+	return mr
+}
@@ -0,0 +1,189 @@
+package facemask
+
+import (
+	"math"
+
+	"github.com/fogleman/gg"
+)
+
+// HeadPose is the estimated 3D orientation of the head in degrees.
+// Yaw is positive when the head turns towards the image right, pitch
+// when it tilts downwards and roll when it leans clockwise.
+type HeadPose struct {
+	Yaw   float64 `json:"yaw"`
+	Pitch float64 `json:"pitch"`
+	Roll  float64 `json:"roll"`
+}
+
+// poseModel holds the 3D coordinates of the landmark points on a generic head model
+// (in millimeters, with x towards the image right, y downwards and z towards the camera).
+var poseModel = map[string][3]float64{
+	"nose_tip":        {0, 0, 0},
+	"left_eye_outer":  {-225, -170, -135},
+	"left_eye_inner":  {-80, -170, -120},
+	"right_eye_inner": {80, -170, -120},
+	"right_eye_outer": {225, -170, -135},
+	"mouth_left":      {-150, 150, -125},
+	"mouth_right":     {150, 150, -125},
+	"upper_lip":       {0, 110, -45},
+	"lower_lip":       {0, 190, -60},
+}
+
+// camera is a weak perspective (scaled orthographic) camera mapping the head model
+// to the image: p = ic + scale * [r1; r2] (X - mc).
+type camera struct {
+	r1, r2 [3]float64
+	scale  float64
+	mc     [3]float64
+	ic     [2]float64
+}
+
+// EstimatePose estimates the head pose from the landmark points. It fits a weak perspective
+// (scaled orthographic) camera to the correspondences between the generic head model and
+// the localized points in the least squares sense, which is the affine approximation
+// of the perspective-n-point problem, then decomposes the rotation into Euler angles.
+func EstimatePose(face FaceInfo) (*HeadPose, bool) {
+	cam, ok := fitCamera(face)
+	if !ok {
+		return nil, false
+	}
+	r1, r2 := cam.r1, cam.r2
+
+	return &HeadPose{
+		Yaw:   gg.Degrees(math.Asin(clamp(r1[2], -1, 1))),
+		Pitch: gg.Degrees(math.Asin(clamp(r2[2], -1, 1))),
+		Roll:  gg.Degrees(math.Atan2(r2[0], r2[1])),
+	}, true
+}
+
+// fitCamera fits the weak perspective camera to the localized landmark points.
+func fitCamera(face FaceInfo) (camera, bool) {
+	var cam camera
+	var model [][3]float64
+	var image [][2]float64
+	// The points are visited in a fixed order, so the floating point sums
+	// and the fitted camera are reproducible.
+	for _, lp := range landmarkPoints {
+		m, ok := poseModel[lp.name]
+		if !ok {
+			continue
+		}
+		p, ok := face.Landmarks[lp.name]
+		if !ok || !validPoint(p) {
+			continue
+		}
+		model = append(model, m)
+		image = append(image, [2]float64{float64(p.Col), float64(p.Row)})
+	}
+	if len(model) < 5 {
+		return cam, false
+	}
+
+	// Center both point sets.
+	mc, ic := &cam.mc, &cam.ic
+	for i := range model {
+		for k := 0; k < 3; k++ {
+			mc[k] += model[i][k] / float64(len(model))
+		}
+		for k := 0; k < 2; k++ {
+			ic[k] += image[i][k] / float64(len(image))
+		}
+	}
+	// Solve the 2x3 camera matrix: A = (x^T X) (X^T X)^-1.
+	var xtx [3][3]float64
+	var ptx [2][3]float64
+	for i := range model {
+		var X [3]float64
+		for k := 0; k < 3; k++ {
+			X[k] = model[i][k] - mc[k]
+		}
+		for r := 0; r < 3; r++ {
+			for c := 0; c < 3; c++ {
+				xtx[r][c] += X[r] * X[c]
+			}
+		}
+		for r := 0; r < 2; r++ {
+			for c := 0; c < 3; c++ {
+				ptx[r][c] += (image[i][r] - ic[r]) * X[c]
+			}
+		}
+	}
+	inv, ok := invert3(xtx)
+	if !ok {
+		return cam, false
+	}
+	var r1, r2 [3]float64
+	for c := 0; c < 3; c++ {
+		for k := 0; k < 3; k++ {
+			r1[c] += ptx[0][k] * inv[k][c]
+			r2[c] += ptx[1][k] * inv[k][c]
+		}
+	}
+	cam.scale = (math.Sqrt(dot(r1, r1)) + math.Sqrt(dot(r2, r2))) / 2
+
+	// Recover the rotation rows by normalizing and orthogonalizing the camera rows.
+	r1 = normalize(r1)
+	r2 = normalize(r2)
+	d := dot(r1, r2)
+	for k := 0; k < 3; k++ {
+		r2[k] -= d * r1[k]
+	}
+	cam.r1, cam.r2 = r1, normalize(r2)
+
+	return cam, cam.scale > 0
+}
+
+// SkipTurned wraps the renderer so the faces turned sideways by more than
+// maxYaw degrees are left untouched.
+func SkipTurned(r Renderer, maxYaw float64) Renderer {
+	return RendererFunc(func(ctx *gg.Context, face FaceInfo) error {
+		if face.Pose != nil && math.Abs(face.Pose.Yaw) > maxYaw {
+			return nil
+		}
+		return r.Render(ctx, face)
+	})
+}
+
+func invert3(m [3][3]float64) ([3][3]float64, bool) {
+	var inv [3][3]float64
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if math.Abs(det) < 1e-12 {
+		return inv, false
+	}
+	inv[0][0] = (m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det
+	inv[0][1] = (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det
+	inv[0][2] = (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det
+	inv[1][0] = (m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det
+	inv[1][1] = (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det
+	inv[1][2] = (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det
+	inv[2][0] = (m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det
+	inv[2][1] = (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det
+	inv[2][2] = (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det
+	return inv, true
+}
+
+func normalize(v [3]float64) [3]float64 {
+	l := math.Sqrt(dot(v, v))
+	if l == 0 {
+		return v
+	}
+	return [3]float64{v[0] / l, v[1] / l, v[2] / l}
+}
+
+func cross(a, b [3]float64) [3]float64 {
+	return [3]float64{
+		a[1]*b[2] - a[2]*b[1],
+		a[2]*b[0] - a[0]*b[2],
+		a[0]*b[1] - a[1]*b[0],
+	}
+}
+
+func dot(a, b [3]float64) float64 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
+
+func clamp(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, v))
+}
@@ -0,0 +1,229 @@
+package facemask
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The CLAHE parameters: the image is divided into claheTiles x claheTiles tiles
+// and the histogram bins are clipped at claheClip times their average height.
+const (
+	claheTiles = 8
+	claheClip  = 2.0
+)
+
+// preprocess applies the comma separated list of contrast enhancements to the grayscale
+// pixels used by the detection, leaving the colors of the output image untouched.
+// The supported operations are equalize, clahe, gamma=<value>, lowlight and denoise.
+func preprocess(pixels []uint8, cols, rows int, spec string) error {
+	for _, op := range strings.Split(spec, ",") {
+		op = strings.TrimSpace(op)
+		switch {
+		case op == "" || op == "none":
+		case op == "equalize":
+			equalize(pixels)
+		case op == "clahe":
+			clahe(pixels, cols, rows)
+		case op == "lowlight":
+			lowLight(pixels, cols, rows)
+		case op == "denoise":
+			denoise(pixels, cols, rows)
+		case strings.HasPrefix(op, "gamma="):
+			g, err := strconv.ParseFloat(strings.TrimPrefix(op, "gamma="), 64)
+			if err != nil || g <= 0 {
+				return fmt.Errorf("invalid gamma value in %q", op)
+			}
+			gamma(pixels, g)
+		default:
+			return fmt.Errorf("unknown preprocessing %q", op)
+		}
+	}
+	return nil
+}
+
+// equalize applies a global histogram equalization.
+func equalize(pixels []uint8) {
+	var hist [256]int
+	for _, p := range pixels {
+		hist[p]++
+	}
+	lut := equalizeLUT(hist, len(pixels))
+	for i, p := range pixels {
+		pixels[i] = lut[p]
+	}
+}
+
+// equalizeLUT returns the lookup table mapping the intensities to their cumulative distribution.
+func equalizeLUT(hist [256]int, total int) [256]uint8 {
+	var lut [256]uint8
+	if total == 0 {
+		return lut
+	}
+	var sum int
+	for i, n := range hist {
+		sum += n
+		lut[i] = uint8(255 * sum / total)
+	}
+	return lut
+}
+
+// clahe applies a contrast limited adaptive histogram equalization: the histograms are
+// equalized per tile with their bins clipped, then the tile mappings are bilinearly interpolated.
+func clahe(pixels []uint8, cols, rows int) {
+	tw := int(math.Ceil(float64(cols) / claheTiles))
+	th := int(math.Ceil(float64(rows) / claheTiles))
+	if tw < 1 || th < 1 {
+		return
+	}
+	tx, ty := (cols+tw-1)/tw, (rows+th-1)/th
+
+	luts := make([][256]uint8, tx*ty)
+	for j := 0; j < ty; j++ {
+		for i := 0; i < tx; i++ {
+			var hist [256]int
+			var total int
+			for y := j * th; y < (j+1)*th && y < rows; y++ {
+				for x := i * tw; x < (i+1)*tw && x < cols; x++ {
+					hist[pixels[y*cols+x]]++
+					total++
+				}
+			}
+			// Clip the bins and redistribute the excess evenly.
+			limit := int(claheClip * float64(total) / 256)
+			if limit < 1 {
+				limit = 1
+			}
+			var excess int
+			for k := range hist {
+				if hist[k] > limit {
+					excess += hist[k] - limit
+					hist[k] = limit
+				}
+			}
+			for k := range hist {
+				hist[k] += excess / 256
+			}
+			for k := 0; k < excess%256; k++ {
+				hist[k]++
+			}
+			luts[j*tx+i] = equalizeLUT(hist, total)
+		}
+	}
+
+	for y := 0; y < rows; y++ {
+		// Position relative to the tile centers.
+		fy := (float64(y)+0.5)/float64(th) - 0.5
+		y0 := int(math.Floor(fy))
+		wy := fy - float64(y0)
+		y1 := y0 + 1
+		y0, y1 = clampInt(y0, 0, ty-1), clampInt(y1, 0, ty-1)
+		for x := 0; x < cols; x++ {
+			fx := (float64(x)+0.5)/float64(tw) - 0.5
+			x0 := int(math.Floor(fx))
+			wx := fx - float64(x0)
+			x1 := x0 + 1
+			x0, x1 = clampInt(x0, 0, tx-1), clampInt(x1, 0, tx-1)
+
+			p := pixels[y*cols+x]
+			top := (1-wx)*float64(luts[y0*tx+x0][p]) + wx*float64(luts[y0*tx+x1][p])
+			bottom := (1-wx)*float64(luts[y1*tx+x0][p]) + wx*float64(luts[y1*tx+x1][p])
+			pixels[y*cols+x] = uint8((1-wy)*top + wy*bottom + 0.5)
+		}
+	}
+}
+
+// gamma applies a gamma correction; values above 1 brighten the dark regions.
+func gamma(pixels []uint8, g float64) {
+	var lut [256]uint8
+	for i := range lut {
+		lut[i] = uint8(255*math.Pow(float64(i)/255, 1/g) + 0.5)
+	}
+	for i, p := range pixels {
+		pixels[i] = lut[p]
+	}
+}
+
+// lowLight enhances the dark photos: it brightens the image with a gamma correction
+// adapted to its mean intensity, stretches the contrast between the 1st and the 99th
+// percentile, then removes the noise amplified by the brightening.
+func lowLight(pixels []uint8, cols, rows int) {
+	if len(pixels) == 0 {
+		return
+	}
+	var hist [256]int
+	var sum int
+	for _, p := range pixels {
+		hist[p]++
+		sum += int(p)
+	}
+	mean := float64(sum) / float64(len(pixels)) / 255
+	if mean > 0 && mean < lowLightMean {
+		gamma(pixels, clamp(math.Log(mean)/math.Log(lowLightMean), 1, 3))
+		hist = [256]int{}
+		for _, p := range pixels {
+			hist[p]++
+		}
+	}
+
+	lo, hi := percentile(hist, len(pixels), 0.01), percentile(hist, len(pixels), 0.99)
+	if hi > lo {
+		for i, p := range pixels {
+			v := (float64(p) - float64(lo)) * 255 / float64(hi-lo)
+			pixels[i] = uint8(clamp(v, 0, 255) + 0.5)
+		}
+	}
+	denoise(pixels, cols, rows)
+}
+
+// lowLightMean is the mean intensity the dark images are brightened to.
+const lowLightMean = 0.45
+
+// percentile returns the intensity below which the fraction of the pixels lies.
+func percentile(hist [256]int, total int, fraction float64) int {
+	var sum int
+	for i, n := range hist {
+		sum += n
+		if float64(sum) >= fraction*float64(total) {
+			return i
+		}
+	}
+	return 255
+}
+
+// denoise applies a 3x3 median filter, which removes the sensor noise while keeping the edges.
+func denoise(pixels []uint8, cols, rows int) {
+	src := append([]uint8(nil), pixels...)
+	var window [9]uint8
+	for y := 1; y < rows-1; y++ {
+		for x := 1; x < cols-1; x++ {
+			n := 0
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					window[n] = src[(y+dy)*cols+x+dx]
+					n++
+				}
+			}
+			// Partial insertion sort up to the median.
+			for i := 0; i <= 4; i++ {
+				for j := i + 1; j < 9; j++ {
+					if window[j] < window[i] {
+						window[i], window[j] = window[j], window[i]
+					}
+				}
+			}
+			pixels[y*cols+x] = window[4]
+		}
+	}
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,243 @@
+package facemask
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// puplocCascade is a pupil or facial landmark point localization cascade of Pigo. Pigo
+// localizes the points as the median of the runs over randomly perturbed search windows,
+// drawing the perturbations from the global random source, so the cascades are evaluated
+// here with the random source of the detector instead, which makes the seeded detectors
+// reproducible whatever the other detectors do concurrently.
+type puplocCascade struct {
+	stages    int
+	scales    float32
+	trees     int
+	treeDepth int
+	treeCodes []int8
+	treePreds []float32
+}
+
+// errTruncatedCascade is returned for the cascade files shorter than their header declares.
+var errTruncatedCascade = errors.New("truncated localization cascade")
+
+// unpackPuploc unpacks the binary localization cascade, in the format of Pigo.
+func unpackPuploc(data []byte) (*puplocCascade, error) {
+	if len(data) < 16 {
+		return nil, errTruncatedCascade
+	}
+	plc := &puplocCascade{
+		stages:    int(binary.LittleEndian.Uint32(data[0:])),
+		scales:    math.Float32frombits(binary.LittleEndian.Uint32(data[4:])),
+		trees:     int(binary.LittleEndian.Uint32(data[8:])),
+		treeDepth: int(binary.LittleEndian.Uint32(data[12:])),
+	}
+	if plc.treeDepth < 1 || plc.treeDepth > 16 {
+		return nil, fmt.Errorf("invalid localization cascade tree depth: %d", plc.treeDepth)
+	}
+	// Every tree holds the codes of its internal nodes, 4 bytes each, followed by the two
+	// predictions of each of its leaves.
+	leaves := 1 << uint(plc.treeDepth)
+	treeSize := 4*leaves - 4 + 8*leaves
+	if plc.stages < 0 || plc.trees < 0 || plc.stages*plc.trees > (len(data)-16)/treeSize {
+		return nil, errTruncatedCascade
+	}
+	pos := 16
+	for i := 0; i < plc.stages*plc.trees; i++ {
+		for _, code := range data[pos : pos+4*leaves-4] {
+			plc.treeCodes = append(plc.treeCodes, int8(code))
+		}
+		pos += 4*leaves - 4
+		for j := 0; j < 2*leaves; j++ {
+			plc.treePreds = append(plc.treePreds, math.Float32frombits(binary.LittleEndian.Uint32(data[pos:])))
+			pos += 4
+		}
+	}
+	return plc, nil
+}
+
+// readPuploc reads the localization cascade file.
+func readPuploc(path string) (*puplocCascade, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plc, err := unpackPuploc(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return plc, nil
+}
+
+// readLandmarkCascades reads the facial landmark point cascades of the directory by file name.
+func readLandmarkCascades(dir string) (map[string]*puplocCascade, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	cascades := make(map[string]*puplocCascade)
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if cascades[f.Name()], err = readPuploc(filepath.Join(dir, f.Name())); err != nil {
+			return nil, err
+		}
+	}
+	if len(cascades) == 0 {
+		return nil, fmt.Errorf("no landmark cascades in %s", dir)
+	}
+	return cascades, nil
+}
+
+// run localizes the point of the search window as the median of the runs over its random
+// perturbations. The angle rotates the search windows, and flipV mirrors them horizontally,
+// localizing the points of the right side of the face with the cascades of the left side.
+func (plc *puplocCascade) run(pl pigo.Puploc, img pigo.ImageParams, angle float64, flipV bool, rnd *rand.Rand) *pigo.Puploc {
+	if pl.Perturbs < 1 {
+		return &pigo.Puploc{}
+	}
+	if angle > 1 {
+		angle = 1
+	}
+	rows := make([]float32, pl.Perturbs)
+	cols := make([]float32, pl.Perturbs)
+	scales := make([]float32, pl.Perturbs)
+	for i := 0; i < pl.Perturbs; i++ {
+		row := float32(pl.Row) + pl.Scale*0.15*(0.5-rnd.Float32())
+		col := float32(pl.Col) + pl.Scale*0.15*(0.5-rnd.Float32())
+		scale := pl.Scale * (0.925 + 0.15*rnd.Float32())
+		if angle > 0 {
+			rows[i], cols[i], scales[i] = plc.classifyRotated(row, col, scale, angle, img, flipV)
+		} else {
+			rows[i], cols[i], scales[i] = plc.classify(row, col, scale, img, flipV)
+		}
+	}
+	median := func(values []float32) float32 {
+		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+		idx := int(math.Floor(float64(len(values))/2 + 0.5))
+		if idx >= len(values) {
+			idx = len(values) - 1
+		}
+		return values[idx]
+	}
+	return &pigo.Puploc{
+		Row:   int(median(rows)),
+		Col:   int(median(cols)),
+		Scale: median(scales),
+	}
+}
+
+// landmark localizes the facial landmark point of the cascade relative to the pupils.
+func (plc *puplocCascade) landmark(leftEye, rightEye *pigo.Puploc, img pigo.ImageParams, perturbs int, flipV bool, rnd *rand.Rand) *pigo.Puploc {
+	dr, dc := leftEye.Row-rightEye.Row, leftEye.Col-rightEye.Col
+	dist := math.Sqrt(float64(dr*dr + dc*dc))
+	start := pigo.Puploc{
+		Row:      int(float64(leftEye.Row+rightEye.Row)/2 + 0.25*dist),
+		Col:      int(float64(leftEye.Col+rightEye.Col)/2 + 0.15*dist),
+		Scale:    float32(3 * dist),
+		Perturbs: perturbs,
+	}
+	return plc.run(start, img, 0, flipV, rnd)
+}
+
+// classify runs the cascade over the search window, returning the localized point and scale.
+func (plc *puplocCascade) classify(r, c, s float32, img pigo.ImageParams, flipV bool) (float32, float32, float32) {
+	leaves := 1 << uint(plc.treeDepth)
+	var sign float32 = 1
+	if flipV {
+		sign = -1
+	}
+	root := 0
+	for i := 0; i < plc.stages; i++ {
+		var dr, dc float32
+		scale := int(math.Round(float64(s)))
+		for j := 0; j < plc.trees; j++ {
+			idx := 0
+			for k := 0; k < plc.treeDepth; k++ {
+				code := plc.treeCodes[root+4*idx:]
+				r1 := clampInt((256*int(r)+int(code[0])*scale)>>8, 0, img.Rows-1)
+				c1 := clampInt((256*int(c)+flipCode(code[1], flipV)*scale)>>8, 0, img.Cols-1)
+				r2 := clampInt((256*int(r)+int(code[2])*scale)>>8, 0, img.Rows-1)
+				c2 := clampInt((256*int(c)+flipCode(code[3], flipV)*scale)>>8, 0, img.Cols-1)
+				idx = 2*idx + 1
+				if img.Pixels[r1*img.Dim+c1] > img.Pixels[r2*img.Dim+c2] {
+					idx++
+				}
+			}
+			lut := 2 * (plc.trees*leaves*i + leaves*j + idx - (leaves - 1))
+			dr += plc.treePreds[lut]
+			dc += sign * plc.treePreds[lut+1]
+			root += 4*leaves - 4
+		}
+		r += dr * s
+		c += dc * s
+		s *= plc.scales
+	}
+	return r, c, s
+}
+
+// The rotation tables of classifyRotated, the sines and cosines of the 32 steps of the full
+// turn scaled by 256.
+var (
+	puplocCos = []float32{256, 251, 236, 212, 181, 142, 97, 49, 0, -49, -97, -142, -181, -212, -236, -251, -256, -251, -236, -212, -181, -142, -97, -49, 0, 49, 97, 142, 181, 212, 236, 251, 256}
+	puplocSin = []float32{0, 49, 97, 142, 181, 212, 236, 251, 256, 251, 236, 212, 181, 142, 97, 49, 0, -49, -97, -142, -181, -212, -236, -251, -256, -251, -236, -212, -181, -142, -97, -49, 0}
+)
+
+// classifyRotated runs the cascade over the search window rotated by the angle, a fraction
+// of the full turn.
+func (plc *puplocCascade) classifyRotated(r, c, s float32, angle float64, img pigo.ImageParams, flipV bool) (float32, float32, float32) {
+	leaves := 1 << uint(plc.treeDepth)
+	var sign float32 = 1
+	if flipV {
+		sign = -1
+	}
+	qsin := int(s * puplocSin[int(32*angle)])
+	qcos := int(s * puplocCos[int(32*angle)])
+	root := 0
+	for i := 0; i < plc.stages; i++ {
+		var dr, dc float32
+		for j := 0; j < plc.trees; j++ {
+			idx := 0
+			for k := 0; k < plc.treeDepth; k++ {
+				code := plc.treeCodes[root+4*idx:]
+				row1, col1 := int(code[0]), flipCode(code[1], flipV)
+				row2, col2 := int(code[2]), flipCode(code[3], flipV)
+				r1 := clampInt((65536*int(r)+qcos*row1-qsin*col1)>>16, 0, img.Rows-1)
+				c1 := clampInt((65536*int(c)+qsin*row1+qcos*col1)>>16, 0, img.Cols-1)
+				r2 := clampInt((65536*int(r)+qcos*row2-qsin*col2)>>16, 0, img.Rows-1)
+				c2 := clampInt((65536*int(c)+qsin*row2+qcos*col2)>>16, 0, img.Cols-1)
+				idx = 2*idx + 1
+				if img.Pixels[r1*img.Dim+c1] <= img.Pixels[r2*img.Dim+c2] {
+					idx++
+				}
+			}
+			lut := 2 * (plc.trees*leaves*i + leaves*j + idx - (leaves - 1))
+			dr += plc.treePreds[lut]
+			dc += sign * plc.treePreds[lut+1]
+			root += 4*leaves - 4
+		}
+		r += dr * s
+		c += dc * s
+		s *= plc.scales
+	}
+	return r, c, s
+}
+
+// flipCode returns the column offset of the tree node, mirrored with flipV. The offsets are
+// negated as int8, like Pigo does, so -128 stays -128.
+func flipCode(code int8, flipV bool) int {
+	if flipV {
+		return int(-code)
+	}
+	return int(code)
+}
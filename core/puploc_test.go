@@ -0,0 +1,72 @@
+package facemask
+
+import (
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSeededLocalization(t *testing.T) {
+	base := &Detector{
+		FaceCascade:  "../cascades/facefinder",
+		EyesCascade:  "../cascades/puploc",
+		FlplocDir:    "../cascades/lps",
+		MinSize:      20,
+		MaxSize:      1000,
+		ShiftFactor:  0.1,
+		ScaleFactor:  1.1,
+		IouThreshold: 0.2,
+	}
+	localize := func(seed int64) []FaceInfo {
+		fd := base.Clone()
+		fd.Seed = seed
+		faces, err := fd.DetectFaces("../testdata/face.jpg")
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		return fd.LocalizeFaces(faces)
+	}
+	want := localize(1)
+	if len(want) == 0 {
+		t.Fatal("no faces localized")
+	}
+
+	// The seeded detectors get the same points while the unseeded ones draw from their own
+	// random sources concurrently.
+	var wg sync.WaitGroup
+	got := make([][]FaceInfo, 8)
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			seed := int64(1)
+			if i%2 == 1 {
+				seed = 0
+			}
+			got[i] = localize(seed)
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < len(got); i += 2 {
+		if !reflect.DeepEqual(got[i], want) {
+			t.Errorf("run %d localized %+v, want %+v", i, got[i], want)
+		}
+	}
+}
+
+func TestUnpackPuplocTruncated(t *testing.T) {
+	data, err := ioutil.ReadFile("../cascades/puploc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unpackPuploc(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{0, 15, 16, len(data) - 1} {
+		if _, err := unpackPuploc(data[:n]); err == nil {
+			t.Errorf("the cascade truncated to %d bytes unpacked", n)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package facemask
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/fogleman/gg"
+)
+
+// QRRenderer draws a QR code beside each face encoding the URL of the template, in which
+// {index} is replaced by the index of the face in the image starting from 1 and {identity}
+// by the identity recognized by Identities, so the guests of an event can scan their own photo.
+// The faces not recognized are skipped by the templates containing {identity}.
+type QRRenderer struct {
+	Template   string
+	Identities *IdentityRenderer
+}
+
+// Render implements the Renderer interface. A single face is rendered as the first face of the image.
+func (qr *QRRenderer) Render(ctx *gg.Context, face FaceInfo) error {
+	return qr.RenderAll(ctx, []FaceInfo{face})
+}
+
+// RenderAll implements the GroupRenderer interface. Nothing is drawn without a template.
+func (qr *QRRenderer) RenderAll(ctx *gg.Context, faces []FaceInfo) error {
+	if qr.Template == "" {
+		return nil
+	}
+	// The identities are recognized on the source, before any code is drawn over the faces.
+	urls := make([]string, len(faces))
+	for i, face := range faces {
+		url := strings.Replace(qr.Template, "{index}", strconv.Itoa(i+1), -1)
+		if strings.Contains(url, "{identity}") {
+			if qr.Identities == nil {
+				continue
+			}
+			id, err := qr.Identities.Identify(ctx.Image(), face)
+			if err != nil {
+				return err
+			}
+			if id == nil {
+				continue
+			}
+			url = strings.Replace(url, "{identity}", id.Name, -1)
+		}
+		urls[i] = url
+	}
+	for i, face := range faces {
+		if urls[i] == "" {
+			continue
+		}
+		modules, err := encodeQR([]byte(urls[i]))
+		if err != nil {
+			return err
+		}
+		drawQR(ctx, face, modules)
+	}
+	return nil
+}
+
+// drawQR draws the QR code with its quiet zone over the top right corner of the face,
+// or the top left one when it doesn't fit into the image on the right. The code is half
+// the face size, but its modules are at least 2 pixels wide, so it remains scannable.
+func drawQR(ctx *gg.Context, face FaceInfo, modules [][]bool) {
+	n := len(modules) + 8 // with the quiet zone of 4 modules
+	s := float64(face.Scale)
+	m := math.Max(2, math.Round(s*0.5/float64(n)))
+	size := m * float64(n)
+
+	x := float64(face.Col) + s/2
+	if x+size > float64(ctx.Width()) {
+		x = float64(face.Col) - s/2 - size
+	}
+	x = clamp(x, 0, math.Max(0, float64(ctx.Width())-size))
+	y := clamp(float64(face.Row)-s/2, 0, math.Max(0, float64(ctx.Height())-size))
+
+	ctx.Push()
+	defer ctx.Pop()
+	ctx.SetRGB(1, 1, 1)
+	ctx.DrawRectangle(x, y, size, size)
+	ctx.Fill()
+	ctx.SetRGB(0, 0, 0)
+	for row := range modules {
+		for col, dark := range modules[row] {
+			if dark {
+				ctx.DrawRectangle(x+float64(col+4)*m, y+float64(row+4)*m, m, m)
+			}
+		}
+	}
+	ctx.Fill()
+}
+
+var errQRTooLong = errors.New("the QR code data is too long")
+
+// qrVersion holds the block structure of a QR code version at the M error correction level.
+type qrVersion struct {
+	// ec is the number of error correction codewords per block.
+	ec int
+	// blocks are the numbers of data codewords of the blocks.
+	blocks []int
+	// align are the coordinates of the alignment patterns.
+	align []int
+}
+
+// qrVersions are the versions 1 to 10 of the QR code, which encode up to 213 bytes.
+var qrVersions = []qrVersion{
+	{10, []int{16}, nil},
+	{16, []int{28}, []int{6, 18}},
+	{26, []int{44}, []int{6, 22}},
+	{18, []int{32, 32}, []int{6, 26}},
+	{24, []int{43, 43}, []int{6, 30}},
+	{16, []int{27, 27, 27, 27}, []int{6, 34}},
+	{18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	{22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	{22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	{26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+// encodeQR encodes the data in byte mode into the smallest QR code of the M error
+// correction level, returning its modules by row, true being the dark ones.
+func encodeQR(data []byte) ([][]bool, error) {
+	for i, v := range qrVersions {
+		version := i + 1
+		capacity := 0
+		for _, n := range v.blocks {
+			capacity += n
+		}
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) > 8*capacity {
+			continue
+		}
+
+		// The mode indicator, the character count, the data, the terminator and the pad codewords.
+		var bits qrBits
+		bits.append(4, 4)
+		bits.append(len(data), countBits)
+		for _, b := range data {
+			bits.append(int(b), 8)
+		}
+		bits.append(0, int(math.Min(4, float64(8*capacity-bits.n))))
+		bits.append(0, (8-bits.n%8)%8)
+		for pad := 0xec; len(bits.data) < capacity; pad ^= 0xec ^ 0x11 {
+			bits.append(pad, 8)
+		}
+		return qrMatrix(version, v, qrInterleave(v, bits.data)), nil
+	}
+	return nil, errQRTooLong
+}
+
+// qrBits is a big endian bit buffer.
+type qrBits struct {
+	data []byte
+	n    int
+}
+
+func (b *qrBits) append(v, count int) {
+	for i := count - 1; i >= 0; i-- {
+		if b.n%8 == 0 {
+			b.data = append(b.data, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			b.data[b.n/8] |= 0x80 >> uint(b.n%8)
+		}
+		b.n++
+	}
+}
+
+// qrInterleave splits the data into the blocks, computes their error correction
+// codewords and interleaves the codewords of the blocks.
+func qrInterleave(v qrVersion, data []byte) []byte {
+	gen := rsGenerator(v.ec)
+	var blocks, ecs [][]byte
+	for _, n := range v.blocks {
+		blocks = append(blocks, data[:n])
+		ecs = append(ecs, rsRemainder(data[:n], gen))
+		data = data[n:]
+	}
+	var out []byte
+	for i := 0; i < v.blocks[len(v.blocks)-1]; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < v.ec; i++ {
+		for _, ec := range ecs {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(256) with the 0x11d reducing polynomial of the QR codes.
+func gfMul(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		hi := z & 0x80
+		z <<= 1
+		if hi != 0 {
+			z ^= 0x1d
+		}
+		if y>>uint(i)&1 == 1 {
+			z ^= x
+		}
+	}
+	return z
+}
+
+// rsGenerator returns the coefficients of the Reed-Solomon generator polynomial
+// of the degree, without the leading term.
+func rsGenerator(degree int) []byte {
+	gen := make([]byte, degree)
+	gen[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range gen {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < len(gen) {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return gen
+}
+
+// rsRemainder returns the Reed-Solomon error correction codewords of the data.
+func rsRemainder(data, gen []byte) []byte {
+	rem := make([]byte, len(gen))
+	for _, b := range data {
+		factor := b ^ rem[0]
+		copy(rem, rem[1:])
+		rem[len(rem)-1] = 0
+		for i := range rem {
+			rem[i] ^= gfMul(gen[i], factor)
+		}
+	}
+	return rem
+}
+
+// qrGrid holds the modules of the QR code and marks the function pattern modules.
+type qrGrid struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+func (g *qrGrid) set(x, y int, dark bool) {
+	g.modules[y][x] = dark
+	g.function[y][x] = true
+}
+
+// qrMatrix places the function patterns and the codewords, choosing the mask with the lowest penalty.
+func qrMatrix(version int, v qrVersion, codewords []byte) [][]bool {
+	size := 17 + 4*version
+	g := &qrGrid{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for i := range g.modules {
+		g.modules[i] = make([]bool, size)
+		g.function[i] = make([]bool, size)
+	}
+
+	// The timing patterns.
+	for i := 0; i < size; i++ {
+		g.set(6, i, i%2 == 0)
+		g.set(i, 6, i%2 == 0)
+	}
+	// The finder patterns with their separators.
+	for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || y < 0 || x >= size || y >= size {
+					continue
+				}
+				d := maxInt(absInt(dx), absInt(dy))
+				g.set(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+	// The alignment patterns, except the ones overlapping the finder patterns.
+	n := len(v.align)
+	for i, y := range v.align {
+		for j, x := range v.align {
+			if i == 0 && j == 0 || i == 0 && j == n-1 || i == n-1 && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					g.set(x+dx, y+dy, maxInt(absInt(dx), absInt(dy)) != 1)
+				}
+			}
+		}
+	}
+	// Reserve the format areas, drawn with the chosen mask, and draw the version information.
+	g.drawFormat(0)
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1f25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>uint(i)&1 == 1
+			a, b := size-11+i%3, i/3
+			g.set(a, b, dark)
+			g.set(b, a, dark)
+		}
+	}
+
+	// The codewords zigzag in pairs of columns from the bottom right corner.
+	i := 0
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = size - 1 - vert
+				}
+				if !g.function[y][x] && i < len(codewords)*8 {
+					g.modules[y][x] = codewords[i>>3]>>uint(7-i&7)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+
+	best, penalty := -1, math.MaxInt32
+	for mask := 0; mask < 8; mask++ {
+		g.applyMask(mask)
+		g.drawFormat(mask)
+		if p := g.penalty(); p < penalty {
+			best, penalty = mask, p
+		}
+		g.applyMask(mask) // undo
+	}
+	g.applyMask(best)
+	g.drawFormat(best)
+	return g.modules
+}
+
+// drawFormat draws the two copies of the format information of the M level and the mask.
+func (g *qrGrid) drawFormat(mask int) {
+	data := mask // the M level is encoded as 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>uint(i)&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		g.set(8, i, bit(i))
+	}
+	g.set(8, 7, bit(6))
+	g.set(8, 8, bit(7))
+	g.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		g.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		g.set(g.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		g.set(8, g.size-15+i, bit(i))
+	}
+	g.set(8, g.size-8, true) // the dark module
+}
+
+// applyMask inverts the data modules selected by the mask pattern.
+func (g *qrGrid) applyMask(mask int) {
+	for y := 0; y < g.size; y++ {
+		for x := 0; x < g.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !g.function[y][x] {
+				g.modules[y][x] = !g.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty evaluates the mask penalty rules of the QR code specification.
+func (g *qrGrid) penalty() int {
+	at := func(x, y int, horizontal bool) bool {
+		if horizontal {
+			return g.modules[y][x]
+		}
+		return g.modules[x][y]
+	}
+	var p, dark int
+	for _, horizontal := range []bool{true, false} {
+		for y := 0; y < g.size; y++ {
+			run := 0
+			for x := 0; x < g.size; x++ {
+				// Rule 1: the runs of five or more modules of the same color.
+				if x > 0 && at(x, y, horizontal) == at(x-1, y, horizontal) {
+					run++
+					if run == 5 {
+						p += 3
+					} else if run > 5 {
+						p++
+					}
+				} else {
+					run = 1
+				}
+				// Rule 3: the finder like 1:1:3:1:1 patterns with four light modules on a side.
+				if x+11 <= g.size {
+					pattern := [11]bool{true, false, true, true, true, false, true}
+					var fwd, bwd bool = true, true
+					for k := 0; k < 11; k++ {
+						m := at(x+k, y, horizontal)
+						if m != pattern[k] {
+							fwd = false
+						}
+						if m != pattern[10-k] {
+							bwd = false
+						}
+					}
+					if fwd {
+						p += 40
+					}
+					if bwd {
+						p += 40
+					}
+				}
+			}
+		}
+	}
+	for y := 0; y < g.size; y++ {
+		for x := 0; x < g.size; x++ {
+			if g.modules[y][x] {
+				dark++
+			}
+			// Rule 2: the 2x2 blocks of the same color.
+			if x+1 < g.size && y+1 < g.size {
+				c := g.modules[y][x]
+				if c == g.modules[y][x+1] && c == g.modules[y+1][x] && c == g.modules[y+1][x+1] {
+					p += 3
+				}
+			}
+		}
+	}
+	// Rule 4: the deviation of the dark module ratio from the half.
+	total := g.size * g.size
+	k := absInt(dark*20-total*10) / total
+	return p + k*10
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,234 @@
+package facemask
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/fogleman/gg"
+)
+
+const (
+	// The size of the aligned face used for computing the descriptor.
+	alignedSize = 64
+	// The interpupillary distance and the eyes row of the aligned face.
+	alignedIPD    = 24
+	alignedEyeRow = 24
+	// The aligned face is split into lbpGrid x lbpGrid cells, each of them
+	// described by the histogram of its uniform local binary patterns.
+	lbpGrid = 4
+	lbpBins = 59
+)
+
+// lbpUniform maps the 8 bit local binary patterns to the uniform pattern bins:
+// each pattern with at most two 0-1 transitions has its own bin, the rest share the last one.
+var lbpUniform = func() [256]int {
+	var table [256]int
+	bin := 0
+	for i := 0; i < 256; i++ {
+		transitions := 0
+		for b := uint(0); b < 8; b++ {
+			if (i>>b)&1 != (i>>((b+1)%8))&1 {
+				transitions++
+			}
+		}
+		if transitions <= 2 {
+			table[i] = bin
+			bin++
+		} else {
+			table[i] = lbpBins - 1
+		}
+	}
+	return table
+}()
+
+// Embedder computes a face descriptor, used to recognize the same person across images.
+type Embedder interface {
+	Embed(img image.Image, face FaceInfo) ([]float64, error)
+}
+
+// LBPEmbedder describes the face with the local binary pattern histograms of the face
+// aligned by the pupils. It is the classic LBPH face recognition method, which requires
+// no trained model and works reasonably well on frontal faces.
+type LBPEmbedder struct{}
+
+// Embed implements the Embedder interface.
+func (LBPEmbedder) Embed(img image.Image, face FaceInfo) ([]float64, error) {
+	aligned := alignFace(img, face)
+
+	cell := (alignedSize - 2) / lbpGrid
+	desc := make([]float64, lbpGrid*lbpGrid*lbpBins)
+	for y := 1; y < alignedSize-1; y++ {
+		for x := 1; x < alignedSize-1; x++ {
+			center := aligned[y*alignedSize+x]
+			var code int
+			for i, n := range [8][2]int{{-1, -1}, {0, -1}, {1, -1}, {1, 0}, {1, 1}, {0, 1}, {-1, 1}, {-1, 0}} {
+				if aligned[(y+n[1])*alignedSize+x+n[0]] >= center {
+					code |= 1 << uint(i)
+				}
+			}
+			cx, cy := (x-1)/cell, (y-1)/cell
+			if cx >= lbpGrid || cy >= lbpGrid {
+				continue
+			}
+			desc[(cy*lbpGrid+cx)*lbpBins+lbpUniform[code]]++
+		}
+	}
+	// Normalize the cell histograms.
+	for c := 0; c < lbpGrid*lbpGrid; c++ {
+		hist := desc[c*lbpBins : (c+1)*lbpBins]
+		var sum float64
+		for _, v := range hist {
+			sum += v
+		}
+		if sum > 0 {
+			for i := range hist {
+				hist[i] /= sum
+			}
+		}
+	}
+	return desc, nil
+}
+
+// Similarity returns the similarity of two face descriptors between 0 and 1,
+// computed as the histogram intersection of the normalized cell histograms.
+func Similarity(a, b []float64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var sum float64
+	for i := range a {
+		sum += math.Min(a[i], b[i])
+	}
+	return sum / float64(len(a)/lbpBins)
+}
+
+// Reference detects the largest face of the provided image and returns its descriptor.
+func (fd *Detector) Reference(source string, e Embedder) ([]float64, error) {
+	faces, err := fd.DetectFaces(source)
+	if err != nil {
+		return nil, err
+	}
+	infos := fd.LocalizeFaces(faces)
+	if len(infos) == 0 {
+		return nil, errors.New("no face found on the reference image")
+	}
+	largest := infos[0]
+	for _, face := range infos[1:] {
+		if face.Scale > largest.Scale {
+			largest = face
+		}
+	}
+	return e.Embed(fd.ctx.Image(), largest)
+}
+
+// MatchFaces wraps the renderer so only the faces matching one of the reference
+// descriptors are rendered, or the ones not matching any of them when invert is true.
+func MatchFaces(r Renderer, e Embedder, refs [][]float64, threshold float64, invert bool) Renderer {
+	return RendererFunc(func(ctx *gg.Context, face FaceInfo) error {
+		desc, err := e.Embed(ctx.Image(), face)
+		if err != nil {
+			return err
+		}
+		matched := false
+		for _, ref := range refs {
+			if Similarity(desc, ref) >= threshold {
+				matched = true
+				break
+			}
+		}
+		if matched == invert {
+			return nil
+		}
+		return r.Render(ctx, face)
+	})
+}
+
+// alignFace returns the grayscale pixels of the face rotated and scaled
+// so that the pupils are on the same row at a fixed distance.
+func alignFace(img image.Image, face FaceInfo) []float64 {
+	lx, ly, rx, ry := eyePoints(face)
+	cx, cy := (lx+rx)/2, (ly+ry)/2
+	angle := math.Atan2(ry-ly, rx-lx)
+	scale := math.Hypot(rx-lx, ry-ly) / alignedIPD
+	sin, cos := math.Sincos(angle)
+
+	bounds := img.Bounds()
+	pixels := make([]float64, alignedSize*alignedSize)
+	for v := 0; v < alignedSize; v++ {
+		for u := 0; u < alignedSize; u++ {
+			du, dv := float64(u-alignedSize/2)*scale, float64(v-alignedEyeRow)*scale
+			x := int(cx + du*cos - dv*sin)
+			y := int(cy + du*sin + dv*cos)
+			if !(image.Point{x, y}).In(bounds) {
+				continue
+			}
+			pixels[v*alignedSize+u] = float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+		}
+	}
+	return pixels
+}
+
+// Identity associates a recognized person with the renderer used for their face.
+type Identity struct {
+	Name       string
+	Descriptor []float64
+	Renderer   Renderer
+}
+
+// IdentityRenderer renders each face with the renderer of the best matching identity.
+// The faces not matching any of the identities are rendered with the Fallback renderer,
+// or left untouched if it is nil.
+type IdentityRenderer struct {
+	Embedder   Embedder
+	Identities []Identity
+	Threshold  float64
+	Fallback   Renderer
+}
+
+// Render implements the Renderer interface.
+func (ir *IdentityRenderer) Render(ctx *gg.Context, face FaceInfo) error {
+	id, err := ir.Identify(ctx.Image(), face)
+	if err != nil {
+		return err
+	}
+	best := ir.Fallback
+	if id != nil {
+		best = id.Renderer
+	}
+	if best == nil {
+		return nil
+	}
+	return best.Render(ctx, face)
+}
+
+// Identify returns the identity best matching the face, or nil if none of them matches.
+func (ir *IdentityRenderer) Identify(img image.Image, face FaceInfo) (*Identity, error) {
+	desc, err := ir.Embedder.Embed(img, face)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		best  *Identity
+		score = ir.Threshold
+	)
+	for i, id := range ir.Identities {
+		if sim := Similarity(desc, id.Descriptor); sim >= score {
+			best, score = &ir.Identities[i], sim
+		}
+	}
+	return best, nil
+}
+
+// eyePoints returns the pupil coordinates of the face. When the pupils
+// were not localized it falls back to their typical position relative to the face box.
+func eyePoints(face FaceInfo) (lx, ly, rx, ry float64) {
+	if validPoint(face.LeftEye) && validPoint(face.RightEye) {
+		return float64(face.LeftEye.Col), float64(face.LeftEye.Row),
+			float64(face.RightEye.Col), float64(face.RightEye.Row)
+	}
+	s := float64(face.Scale)
+	return float64(face.Col) - 0.175*s, float64(face.Row) - 0.075*s,
+		float64(face.Col) + 0.185*s, float64(face.Row) - 0.075*s
+}
@@ -0,0 +1,77 @@
+package facemask
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	// referenceLuminance is the luminance of the evenly lit skin, on which the masks
+	// are drawn as they are. The masks are darkened on the faces in a dimmer light.
+	referenceLuminance = 0.6
+	// tintStrength is how much of the color cast of the light is applied to the mask.
+	tintStrength = 0.5
+)
+
+// faceLighting samples the lighting of the face from the cheeks, below the pupils, and
+// returns the brightness factor and the color cast of the light applied to the mask.
+// The cheeks are sampled rather than the whole face, since the eyes, the hair and the
+// beard are darker than the light falling onto the face.
+func faceLighting(img image.Image, face FaceInfo) (gain float64, tint [3]float64, ok bool) {
+	lx, ly, rx, ry := eyePoints(face)
+	ipd := math.Max(1, math.Hypot(rx-lx, ry-ly))
+	radius := int(math.Max(1, ipd*0.15))
+
+	var sum [3]float64
+	var n int
+	for _, c := range [][2]float64{{lx, ly + 0.6*ipd}, {rx, ry + 0.6*ipd}} {
+		cx, cy := int(c[0]), int(c[1])
+		r := image.Rect(cx-radius, cy-radius, cx+radius, cy+radius).Intersect(img.Bounds())
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				cr, cg, cb, _ := img.At(x, y).RGBA()
+				sum[0] += float64(cr) / 0xffff
+				sum[1] += float64(cg) / 0xffff
+				sum[2] += float64(cb) / 0xffff
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return 1, [3]float64{1, 1, 1}, false
+	}
+	for i := range sum {
+		sum[i] /= float64(n)
+	}
+	lum := 0.299*sum[0] + 0.587*sum[1] + 0.114*sum[2]
+	if lum <= 0 {
+		return 1, [3]float64{1, 1, 1}, false
+	}
+	// The skin is warmer than the light, so the color cast is measured relative to
+	// the average skin tone rather than to a neutral gray.
+	skin := [3]float64{1.15, 0.98, 0.82}
+	for i := range tint {
+		tint[i] = 1 + (sum[i]/lum/skin[i]-1)*tintStrength
+	}
+	return clamp(lum/referenceLuminance, 0.35, 1), tint, true
+}
+
+// relight adjusts the brightness and the tint of the mask to the lighting of the face,
+// so a bright mask doesn't glow on the faces in a dim light.
+func relight(mask *image.NRGBA, gain float64, tint [3]float64) *image.NRGBA {
+	dst := image.NewNRGBA(mask.Bounds())
+	copy(dst.Pix, mask.Pix)
+	var lut [3][256]uint8
+	for c := 0; c < 3; c++ {
+		f := gain * tint[c]
+		for v := 0; v < 256; v++ {
+			lut[c][v] = uint8(clamp(float64(v)*f, 0, 255))
+		}
+	}
+	for i := 0; i < len(dst.Pix); i += 4 {
+		dst.Pix[i] = lut[0][dst.Pix[i]]
+		dst.Pix[i+1] = lut[1][dst.Pix[i+1]]
+		dst.Pix[i+2] = lut[2][dst.Pix[i+2]]
+	}
+	return dst
+}
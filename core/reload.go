@@ -0,0 +1,108 @@
+package facemask
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fogleman/gg"
+)
+
+// DefaultReloadInterval is the default interval of checking the mask files for changes.
+const DefaultReloadInterval = 2 * time.Second
+
+// ReloadRenderer renders with the renderer loaded from the mask files, reloading it when
+// the files change, so the long running processes pick up the new masks without a restart.
+// The files are checked on rendering, at most once per Interval. In case the reload fails
+// the previous renderer is kept, until the files change again.
+type ReloadRenderer struct {
+	// Path is the mask image, the mask pack directory or the manifest file.
+	Path string
+	// Load loads the renderer from the mask files.
+	Load func() (Renderer, error)
+	// Interval is the minimum interval between the checks, DefaultReloadInterval if zero.
+	Interval time.Duration
+	// OnReload is called after every reload with its error, if it's not nil.
+	OnReload func(err error)
+
+	mu      sync.Mutex
+	current Renderer
+	stamp   string
+	checked time.Time
+}
+
+// NewReloadRenderer returns a renderer rendering with the renderer already loaded from the
+// mask files, and reloading it with load on change.
+func NewReloadRenderer(path string, current Renderer, load func() (Renderer, error)) (*ReloadRenderer, error) {
+	stamp, err := filesStamp(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ReloadRenderer{Path: path, Load: load, current: current, stamp: stamp, checked: time.Now()}, nil
+}
+
+// Render implements the Renderer interface.
+func (rr *ReloadRenderer) Render(ctx *gg.Context, face FaceInfo) error {
+	return rr.renderer().Render(ctx, face)
+}
+
+// renderer returns the current renderer, reloading it first when the files have changed.
+func (rr *ReloadRenderer) renderer() Renderer {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	interval := rr.Interval
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	if time.Since(rr.checked) < interval {
+		return rr.current
+	}
+	rr.checked = time.Now()
+	// The missing files, e.g. while a pack is being replaced, are reported once.
+	stamp, err := filesStamp(rr.Path)
+	if stamp == rr.stamp {
+		return rr.current
+	}
+	rr.stamp = stamp
+	if err == nil {
+		var r Renderer
+		if r, err = rr.Load(); err == nil {
+			rr.current = r
+		}
+	}
+	if rr.OnReload != nil {
+		rr.OnReload(err)
+	}
+	return rr.current
+}
+
+// filesStamp summarizes the names, sizes and modification times of the mask files:
+// the mask image, or all the files of the mask pack directory, which for a manifest
+// file is the directory containing it.
+func filesStamp(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() && filepath.Ext(path) != ".json" {
+		return fmt.Sprintf("%d %d", fi.Size(), fi.ModTime().UnixNano()), nil
+	}
+	dir := path
+	if !fi.IsDir() {
+		dir = filepath.Dir(path)
+	}
+	var stamp []byte
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			stamp = append(stamp, fmt.Sprintf("%s %d %d\n", p, fi.Size(), fi.ModTime().UnixNano())...)
+		}
+		return nil
+	})
+	return string(stamp), err
+}
@@ -0,0 +1,105 @@
+package facemask
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	pigo "github.com/esimov/pigo/core"
+	"github.com/fogleman/gg"
+)
+
+// FaceInfo holds the detection results of a face together with
+// the localized pupils and the mouth corner landmark points.
+type FaceInfo struct {
+	pigo.Detection
+	LeftEye    *pigo.Puploc
+	RightEye   *pigo.Puploc
+	MouthLeft  *pigo.Puploc
+	MouthRight *pigo.Puploc
+	// Landmarks holds all the facial landmark points localized by the lps cascades by name.
+	Landmarks map[string]*pigo.Puploc
+	// Pose is the estimated head pose, nil when it could not be estimated.
+	Pose *HeadPose
+	// Occluded is set when the landmark points were not reliable, in which case
+	// the mouth corners are placed relative to the face box.
+	Occluded bool
+	// Confidence holds the confidence (0..1) of the pupils and of the landmark points by name,
+	// the pupils being left_eye and right_eye. It's nil unless the detector estimates it.
+	Confidence map[string]float64
+	// LandmarkQ is the confidence of the landmark fit: the lowest confidence of the
+	// pupils and the mouth corners.
+	LandmarkQ float64
+}
+
+// Renderer is the interface implemented by the face overlays.
+// Render is called once for every detected face, with the drawing context
+// containing the source image and the overlays rendered over the previous faces.
+type Renderer interface {
+	Render(ctx *gg.Context, face FaceInfo) error
+}
+
+// RendererFunc is an adapter to allow the use of ordinary functions as renderers.
+type RendererFunc func(ctx *gg.Context, face FaceInfo) error
+
+// Render calls f(ctx, face).
+func (f RendererFunc) Render(ctx *gg.Context, face FaceInfo) error {
+	return f(ctx, face)
+}
+
+var (
+	renderersMu sync.RWMutex
+	renderers   = make(map[string]Renderer)
+)
+
+func init() {
+	Register("mask", NewMaskRenderer(DefaultMask))
+	Register("mask3d", NewMask3DRenderer(DefaultMask))
+	Register("blur", &BlurRenderer{Sigma: 8})
+	Register("pixelate", &PixelateRenderer{BlockSize: 12})
+	Register("sunglasses", &SunglassesRenderer{})
+	Register("badge", &BadgeRenderer{Classifier: &SmileClassifier{WidthRatio: defaultSmileRatio}})
+	Register("swap", &SwapRenderer{Feather: 0.15})
+	Register("mesh", &MeshRenderer{})
+	Register("emoji", &EmojiRenderer{Classifier: &SmileClassifier{WidthRatio: defaultSmileRatio}})
+	Register("bubble", &BubbleRenderer{Text: DefaultBubbleText})
+	Register("qr", &QRRenderer{})
+}
+
+// Register makes a renderer available under the provided name.
+// Registering a renderer with an already existing name replaces the previous one,
+// this way the built-in renderers can also be customized.
+func Register(name string, r Renderer) {
+	renderersMu.Lock()
+	defer renderersMu.Unlock()
+
+	if r == nil {
+		panic("facemask: Register renderer is nil")
+	}
+	renderers[name] = r
+}
+
+// Lookup returns the renderer registered under the provided name.
+func Lookup(name string) (Renderer, error) {
+	renderersMu.RLock()
+	defer renderersMu.RUnlock()
+
+	r, ok := renderers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown renderer %q", name)
+	}
+	return r, nil
+}
+
+// Renderers returns the sorted list of the registered renderer names.
+func Renderers() []string {
+	renderersMu.RLock()
+	defer renderersMu.RUnlock()
+
+	names := make([]string, 0, len(renderers))
+	for name := range renderers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
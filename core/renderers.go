@@ -0,0 +1,417 @@
+package facemask
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/fogleman/gg"
+)
+
+// DefaultMask is the mask asset used by the built-in mask renderer.
+const DefaultMask = "assets/facemask.png"
+
+// MaskRenderer overlays a mask image over the lower part of the face,
+// aligned to the mouth corner landmark points.
+type MaskRenderer struct {
+	Source string
+	// ClipSkin clips the mask to the face silhouette found by a skin color model,
+	// so it doesn't overhang onto the hair or the background on narrow faces.
+	ClipSkin bool
+	// WarpJaw deforms the mask so its bottom edge follows the estimated jaw line
+	// instead of the rigid resize of the mask image.
+	WarpJaw bool
+	// GlassesOffset lowers the mask by this fraction of its height when the face
+	// wears eyeglasses, so the mask doesn't overlap them. Zero disables the glasses detection.
+	GlassesOffset float64
+	// Anchor places the mask fitted into the named anchor region of the face instead,
+	// e.g. a sticker on the forehead. The jaw warping and the glasses offset apply
+	// only to the default placement.
+	Anchor string
+	// Relight adjusts the brightness and the tint of the mask to the lighting of the face,
+	// sampled from the cheeks.
+	Relight bool
+	// Feather softens the alpha edge of the mask over this many pixels. Zero keeps the hard edge.
+	Feather int
+	// Opacity makes the mask translucent, between 0 and 1. Zero keeps the mask as it is.
+	Opacity float64
+	// Jitter perturbs the placement of the mask randomly on every face. Nil disables it.
+	Jitter *Jitter
+	// Key knocks out the solid background of the mask image. Nil keeps the mask as it is.
+	Key *ChromaKey
+	// Compositor resizes, rotates and blends the mask. Nil uses the CPUCompositor.
+	Compositor Compositor
+
+	once sync.Once
+	mask image.Image
+	// patch is set for the nine-patch masks, whose width follows the width of the face.
+	patch *ninePatch
+	err   error
+}
+
+// NewMaskRenderer returns a mask renderer using the provided PNG file as mask.
+// The mask image is loaded at the first rendering. The masks named *.9.png are
+// nine-patch images, whose stretchable regions are stretched to the width of the face.
+func NewMaskRenderer(source string) *MaskRenderer {
+	return &MaskRenderer{Source: source}
+}
+
+// MaskTransform describes the placement of the mask overlay: the mask image is resized
+// to the size of Rect, rotated by Angle degrees counterclockwise and drawn at the top left corner of Rect.
+type MaskTransform struct {
+	Rect  image.Rectangle `json:"rect"`
+	Angle float64         `json:"angle"`
+}
+
+// ParseTransforms parses the JSON array of the mask placements, like the ones of the faces
+// reported by Faces, rejecting more than max placements.
+func ParseTransforms(data []byte, max int) ([]MaskTransform, error) {
+	var transforms []MaskTransform
+	if err := json.Unmarshal(data, &transforms); err != nil {
+		return nil, err
+	}
+	if len(transforms) > max {
+		return nil, fmt.Errorf("more than %d transforms", max)
+	}
+	return transforms, nil
+}
+
+// CheckTransforms rejects the empty placements and the ones larger than twice the larger
+// side of the image of the bounds, so the untrusted placements can't exhaust the memory
+// with the resized masks.
+func CheckTransforms(transforms []MaskTransform, bounds image.Rectangle) error {
+	limit := 2 * bounds.Dx()
+	if bounds.Dy() > bounds.Dx() {
+		limit = 2 * bounds.Dy()
+	}
+	for i, t := range transforms {
+		if t.Rect.Empty() || t.Rect.Dx() > limit || t.Rect.Dy() > limit {
+			return fmt.Errorf("invalid transform %d: %v", i, t.Rect)
+		}
+	}
+	return nil
+}
+
+// Transform computes the placement of the mask over the face of the image.
+func (mr *MaskRenderer) Transform(img image.Image, face FaceInfo) (MaskTransform, error) {
+	t, err := mr.transform(img, face)
+	if err != nil || mr.Jitter == nil {
+		return t, err
+	}
+	return mr.Jitter.apply(t, face), nil
+}
+
+// load loads the mask image at the first use.
+func (mr *MaskRenderer) load() error {
+	mr.once.Do(func() {
+		mr.mask, mr.patch, mr.err = loadMask(mr.Source)
+		if mr.err == nil && mr.Key != nil {
+			keyed := mr.Key.Apply(mr.mask)
+			if mr.patch != nil {
+				mr.patch.img = keyed
+			}
+			mr.mask = keyed
+		}
+	})
+	return mr.err
+}
+
+// transform computes the placement of the mask before the jitter.
+func (mr *MaskRenderer) transform(img image.Image, face FaceInfo) (MaskTransform, error) {
+	if err := mr.load(); err != nil {
+		return MaskTransform{}, err
+	}
+	if mr.Anchor != "" {
+		return mr.anchorTransform(face)
+	}
+	flp1, flp2 := face.MouthLeft, face.MouthRight
+
+	// Calculate the lean angle between the two mouth points.
+	angle := 1 - (math.Atan2(float64(flp2.Col-flp1.Col), float64(flp2.Row-flp1.Row)) * 180 / math.Pi / 90)
+	dx, dy := mr.mask.Bounds().Dx(), mr.mask.Bounds().Dy()
+
+	imgScale := float64(face.Scale) / float64(dy)
+	if dx > dy {
+		imgScale = float64(face.Scale) / float64(dx)
+	}
+	width, height := float64(dx)*imgScale*0.75, float64(dy)*imgScale*0.75
+	if mr.patch != nil {
+		lx, ly, rx, ry := eyePoints(face)
+		width = math.Hypot(rx-lx, ry-ly) * faceWidthRatio
+	}
+	tx := face.Col - int(width/2)
+	ty := flp1.Row + (flp1.Row-flp2.Row)/2 - int(height*0.4)
+	if mr.GlassesOffset > 0 && HasGlasses(img, face) {
+		ty += int(height * mr.GlassesOffset)
+	}
+	return MaskTransform{
+		Rect:  image.Rect(tx, ty, tx+int(width), ty+int(height)),
+		Angle: angle,
+	}, nil
+}
+
+// anchorTransform fits the mask into the anchor region of the face, keeping its aspect ratio.
+func (mr *MaskRenderer) anchorTransform(face FaceInfo) (MaskTransform, error) {
+	a, err := face.Anchor(mr.Anchor)
+	if err != nil {
+		return MaskTransform{}, err
+	}
+	dx, dy := float64(mr.mask.Bounds().Dx()), float64(mr.mask.Bounds().Dy())
+	scale := math.Min(float64(a.Rect.Dx())/dx, float64(a.Rect.Dy())/dy)
+	width, height := int(dx*scale), int(dy*scale)
+	tx, ty := a.Center.X-width/2, a.Center.Y-height/2
+	return MaskTransform{
+		Rect:  image.Rect(tx, ty, tx+width, ty+height),
+		Angle: a.Angle,
+	}, nil
+}
+
+// Render implements the Renderer interface.
+func (mr *MaskRenderer) Render(ctx *gg.Context, face FaceInfo) error {
+	t, err := mr.Transform(ctx.Image(), face)
+	if err != nil {
+		return err
+	}
+	tx, ty := t.Rect.Min.X, t.Rect.Min.Y
+	width, height := float64(t.Rect.Dx()), float64(t.Rect.Dy())
+	warp := mr.WarpJaw && mr.Anchor == ""
+	translucent := mr.Opacity > 0 && mr.Opacity < 1
+
+	// The mask is resized ahead of the compositor only when its pixels are adjusted.
+	var resized *image.NRGBA
+	if mr.patch != nil && mr.Anchor == "" {
+		resized = mr.patch.resize(int(width), int(height))
+	} else if warp || mr.Relight || mr.ClipSkin || mr.Feather > 0 || translucent {
+		resized = imaging.Resize(mr.mask, int(width), int(height), imaging.Lanczos)
+	}
+	if warp {
+		if _, chinY, ok := estimateChin(face); ok {
+			// The mask bottom reaches slightly below the chin, while at the jaw
+			// corners it keeps the original mask height.
+			centerBottom := chinY - float64(ty) + float64(face.Scale)*0.03
+			resized = warpToJaw(resized, centerBottom, height, float64(face.Scale)*jawRatio)
+		}
+	}
+	if mr.Relight {
+		if gain, tint, ok := faceLighting(ctx.Image(), face); ok {
+			resized = relight(resized, gain, tint)
+		}
+	}
+	if translucent {
+		resized = fadeAlpha(resized, mr.Opacity)
+	}
+	compositor := mr.Compositor
+	if compositor == nil {
+		compositor = CPUCompositor{}
+	}
+	if !mr.ClipSkin && mr.Feather == 0 {
+		if resized != nil {
+			return compositor.Composite(ctx, resized, t)
+		}
+		return compositor.Composite(ctx, mr.mask, t)
+	}
+	// The skin clipping and the feathering apply to the rotated mask, which is only blended.
+	aligned := imaging.Rotate(resized, t.Angle, color.Transparent)
+	if mr.ClipSkin {
+		aligned = clipToSkin(ctx.Image(), aligned, tx, ty)
+	}
+	if mr.Feather > 0 {
+		aligned = featherAlpha(aligned, mr.Feather)
+	}
+	return compositor.Composite(ctx, aligned, MaskTransform{Rect: aligned.Bounds().Add(t.Rect.Min)})
+}
+
+// RenderTransform draws the mask at the provided placement instead of the one computed from
+// the landmark points, e.g. a placement adjusted by the user in an editor. The opacity, the
+// feathering and the nine-patch stretching apply, the adjustments to the face don't.
+func (mr *MaskRenderer) RenderTransform(ctx *gg.Context, t MaskTransform) error {
+	if err := mr.load(); err != nil {
+		return err
+	}
+	compositor := mr.Compositor
+	if compositor == nil {
+		compositor = CPUCompositor{}
+	}
+	translucent := mr.Opacity > 0 && mr.Opacity < 1
+	var resized *image.NRGBA
+	if mr.patch != nil {
+		resized = mr.patch.resize(t.Rect.Dx(), t.Rect.Dy())
+	} else if translucent || mr.Feather > 0 {
+		resized = imaging.Resize(mr.mask, t.Rect.Dx(), t.Rect.Dy(), imaging.Lanczos)
+	}
+	if resized == nil {
+		return compositor.Composite(ctx, mr.mask, t)
+	}
+	if translucent {
+		resized = fadeAlpha(resized, mr.Opacity)
+	}
+	if mr.Feather == 0 {
+		return compositor.Composite(ctx, resized, t)
+	}
+	aligned := featherAlpha(imaging.Rotate(resized, t.Angle, color.Transparent), mr.Feather)
+	return compositor.Composite(ctx, aligned, MaskTransform{Rect: aligned.Bounds().Add(t.Rect.Min)})
+}
+
+// BlurRenderer anonymizes the face by applying a gaussian blur over the face region.
+type BlurRenderer struct {
+	Sigma float64
+}
+
+// Render implements the Renderer interface.
+func (br *BlurRenderer) Render(ctx *gg.Context, face FaceInfo) error {
+	rect := faceRect(ctx, face)
+	blurred := imaging.Blur(imaging.Crop(ctx.Image(), rect), br.Sigma)
+	drawClipped(ctx, blurred, rect)
+
+	return nil
+}
+
+// PixelateRenderer anonymizes the face by pixelating the face region.
+type PixelateRenderer struct {
+	BlockSize int
+}
+
+// Render implements the Renderer interface.
+func (pr *PixelateRenderer) Render(ctx *gg.Context, face FaceInfo) error {
+	rect := faceRect(ctx, face)
+	blockSize := pr.BlockSize
+	if blockSize < 1 {
+		blockSize = 1
+	}
+	cols := int(math.Max(1, float64(rect.Dx()/blockSize)))
+	rows := int(math.Max(1, float64(rect.Dy()/blockSize)))
+
+	small := imaging.Resize(imaging.Crop(ctx.Image(), rect), cols, rows, imaging.Box)
+	pixelated := imaging.Resize(small, rect.Dx(), rect.Dy(), imaging.NearestNeighbor)
+	drawClipped(ctx, pixelated, rect)
+
+	return nil
+}
+
+// SunglassesRenderer draws a pair of sunglasses over the localized pupils.
+type SunglassesRenderer struct{}
+
+// Render implements the Renderer interface.
+func (sr *SunglassesRenderer) Render(ctx *gg.Context, face FaceInfo) error {
+	le, re := face.LeftEye, face.RightEye
+	if le == nil || re == nil || le.Row < 0 || re.Row < 0 {
+		return nil
+	}
+	lx, ly := float64(le.Col), float64(le.Row)
+	rx, ry := float64(re.Col), float64(re.Row)
+
+	dist := math.Hypot(rx-lx, ry-ly)
+	angle := math.Atan2(ry-ly, rx-lx)
+	lensW, lensH := dist*0.45, dist*0.3
+
+	ctx.Push()
+	ctx.RotateAbout(angle, (lx+rx)/2, (ly+ry)/2)
+	for _, x := range []float64{-dist / 2, dist / 2} {
+		ctx.DrawEllipse((lx+rx)/2+x, (ly+ry)/2, lensW, lensH)
+	}
+	ctx.SetRGBA(0.05, 0.05, 0.05, 0.9)
+	ctx.FillPreserve()
+	ctx.SetRGB(0, 0, 0)
+	ctx.SetLineWidth(math.Max(1, dist*0.05))
+	ctx.Stroke()
+
+	ctx.DrawLine((lx+rx)/2-dist/2+lensW, (ly+ry)/2, (lx+rx)/2+dist/2-lensW, (ly+ry)/2)
+	ctx.Stroke()
+	ctx.Pop()
+
+	return nil
+}
+
+// loadPNG decodes the PNG image file.
+func loadPNG(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+// loadMask loads the mask image, which is a nine-patch image in case its name ends in .9.png.
+func loadMask(path string) (image.Image, *ninePatch, error) {
+	if !isNinePatch(path) {
+		img, err := loadPNG(path)
+		return img, nil, err
+	}
+	np, err := loadNinePatch(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return np.img, np, nil
+}
+
+// faceRect returns the face bounding box limited to the drawing context boundaries.
+func faceRect(ctx *gg.Context, face FaceInfo) image.Rectangle {
+	r := face.Scale / 2
+	rect := image.Rect(face.Col-r, face.Row-r, face.Col+r, face.Row+r)
+	return rect.Intersect(image.Rect(0, 0, ctx.Width(), ctx.Height()))
+}
+
+// drawClipped draws the image over the region defined by rect, clipped by an ellipse.
+// The image is composited directly into the context image when it's possible, since
+// the gg clipping allocates a mask of the whole image and draws through a bilinear
+// transformation, which is wasted work for the pixel only overlays. Inside the ellipse
+// the image replaces the region rather than being drawn over it, so on the sources with
+// transparency the original pixels don't show through the translucent pixels of the image,
+// and the two are blended over the antialiased edge only.
+func drawClipped(ctx *gg.Context, img image.Image, rect image.Rectangle) {
+	if dst, ok := ctx.Image().(*image.RGBA); ok {
+		src := image.NewRGBA(rect)
+		draw.Draw(src, rect, img, img.Bounds().Min, draw.Src)
+		mask, r := ellipseMask(rect), rect.Intersect(dst.Rect)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				m := uint32(mask.At(x, y).(color.Alpha).A)
+				if m == 0 {
+					continue
+				}
+				i, j := dst.PixOffset(x, y), src.PixOffset(x, y)
+				for k := 0; k < 4; k++ {
+					dst.Pix[i+k] = uint8((uint32(src.Pix[j+k])*m + uint32(dst.Pix[i+k])*(255-m) + 127) / 255)
+				}
+			}
+		}
+		return
+	}
+	cx := float64(rect.Min.X+rect.Max.X) / 2
+	cy := float64(rect.Min.Y+rect.Max.Y) / 2
+
+	ctx.Push()
+	ctx.DrawEllipse(cx, cy, float64(rect.Dx())/2, float64(rect.Dy())/2)
+	ctx.Clip()
+	ctx.DrawImage(img, rect.Min.X, rect.Min.Y)
+	ctx.ResetClip()
+	ctx.Pop()
+}
+
+// ellipseMask is the alpha mask of the ellipse inscribed in the rectangle,
+// with an antialiased edge.
+type ellipseMask image.Rectangle
+
+func (m ellipseMask) ColorModel() color.Model { return color.AlphaModel }
+
+func (m ellipseMask) Bounds() image.Rectangle { return image.Rectangle(m) }
+
+func (m ellipseMask) At(x, y int) color.Color {
+	rx, ry := float64(m.Max.X-m.Min.X)/2, float64(m.Max.Y-m.Min.Y)/2
+	if rx <= 0 || ry <= 0 {
+		return color.Alpha{}
+	}
+	dx := (float64(x) + 0.5 - float64(m.Min.X) - rx) / rx
+	dy := (float64(y) + 0.5 - float64(m.Min.Y) - ry) / ry
+	// The distance from the edge in pixels, approximately.
+	d := (1 - math.Hypot(dx, dy)) * math.Min(rx, ry)
+	return color.Alpha{A: uint8(clamp(d+0.5, 0, 1) * 255)}
+}
@@ -0,0 +1,99 @@
+package facemask
+
+import (
+	"encoding/json"
+	"io"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// Point is a landmark point in image coordinates.
+type Point struct {
+	Row int `json:"row"`
+	Col int `json:"col"`
+}
+
+// FaceReport is the JSON representation of a processed face.
+type FaceReport struct {
+	Row        int       `json:"row"`
+	Col        int       `json:"col"`
+	Scale      int       `json:"scale"`
+	Score      float32   `json:"score"`
+	LeftEye    *Point    `json:"left_eye,omitempty"`
+	RightEye   *Point    `json:"right_eye,omitempty"`
+	MouthLeft  *Point    `json:"mouth_left,omitempty"`
+	MouthRight *Point    `json:"mouth_right,omitempty"`
+	Occluded   bool      `json:"occluded"`
+	Pose       *HeadPose `json:"pose,omitempty"`
+	// LandmarkQ and Confidence are the confidence of the landmark fit and of the single
+	// points by name, reported when the detector estimates them.
+	LandmarkQ  *float64           `json:"landmark_q,omitempty"`
+	Confidence map[string]float64 `json:"confidence,omitempty"`
+	// Landmarks holds all the localized landmark points by name.
+	Landmarks map[string]Point `json:"landmarks,omitempty"`
+	// Landmarks68 holds the landmark points in the 68 point dlib indexing,
+	// with null for the points not provided by the landmark cascades.
+	Landmarks68 []*Point `json:"landmarks68,omitempty"`
+}
+
+// Report is the JSON report of a processed image.
+type Report struct {
+	Source string       `json:"source"`
+	Faces  []FaceReport `json:"faces"`
+}
+
+// NewReport creates the report of the faces found on the source image.
+func NewReport(source string, faces []FaceInfo) Report {
+	report := Report{Source: source, Faces: make([]FaceReport, 0, len(faces))}
+	for _, face := range faces {
+		landmarks := make(map[string]Point, len(face.Landmarks))
+		for name, p := range face.Landmarks {
+			if validPoint(p) {
+				landmarks[name] = Point{Row: p.Row, Col: p.Col}
+			}
+		}
+		var landmarks68 []*Point
+		if len(landmarks) > 0 {
+			landmarks68 = make([]*Point, 0, Landmarks68)
+			for _, p := range face.Landmarks68() {
+				landmarks68 = append(landmarks68, reportPoint(p))
+			}
+		}
+		var landmarkQ *float64
+		if face.Confidence != nil {
+			q := face.LandmarkQ
+			landmarkQ = &q
+		}
+		report.Faces = append(report.Faces, FaceReport{
+			Row:         face.Row,
+			Col:         face.Col,
+			Scale:       face.Scale,
+			Score:       face.Q,
+			LeftEye:     reportPoint(face.LeftEye),
+			RightEye:    reportPoint(face.RightEye),
+			MouthLeft:   reportPoint(face.MouthLeft),
+			MouthRight:  reportPoint(face.MouthRight),
+			Occluded:    face.Occluded,
+			Pose:        face.Pose,
+			Landmarks:   landmarks,
+			Landmarks68: landmarks68,
+			LandmarkQ:   landmarkQ,
+			Confidence:  face.Confidence,
+		})
+	}
+	return report
+}
+
+// WriteReports encodes the reports as indented JSON.
+func WriteReports(w io.Writer, reports []Report) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(reports)
+}
+
+func reportPoint(p *pigo.Puploc) *Point {
+	if !validPoint(p) {
+		return nil
+	}
+	return &Point{Row: p.Row, Col: p.Col}
+}
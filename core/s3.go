@@ -0,0 +1,192 @@
+package facemask
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the hash of the empty payload of the GET requests, signed by SigV4.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Source is the object of an S3 bucket, or of an S3 compatible store like MinIO, downloaded
+// with a GET request signed by AWS Signature Version 4. Without the credentials the request
+// is anonymous, for the public buckets.
+type S3Source struct {
+	Bucket string
+	Key    string
+	// Region is the region of the bucket, us-east-1 when empty.
+	Region string
+	// Endpoint is the URL of an S3 compatible store, addressing the buckets by their path.
+	// The buckets of AWS are addressed by their virtual host when empty.
+	Endpoint     string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// Client is the client of the download, a client with a one minute timeout when nil.
+	Client *http.Client
+}
+
+// NewS3Source returns the source of the s3://bucket/key URI, with the credentials, the region
+// and the endpoint of the standard AWS environment variables: AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION (or AWS_DEFAULT_REGION) and
+// AWS_ENDPOINT_URL_S3 (or AWS_ENDPOINT_URL).
+func NewS3Source(uri string) (*S3Source, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Scheme != "s3" || u.Host == "" || key == "" {
+		return nil, fmt.Errorf("invalid S3 URI %q, expected s3://bucket/key", uri)
+	}
+	env := func(names ...string) string {
+		for _, name := range names {
+			if v := os.Getenv(name); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	return &S3Source{
+		Bucket:       u.Host,
+		Key:          key,
+		Region:       env("AWS_REGION", "AWS_DEFAULT_REGION"),
+		Endpoint:     env("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"),
+		AccessKey:    env("AWS_ACCESS_KEY_ID"),
+		SecretKey:    env("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: env("AWS_SESSION_TOKEN"),
+	}, nil
+}
+
+// Name returns the s3:// URI of the object.
+func (s *S3Source) Name() string { return "s3://" + s.Bucket + "/" + s.Key }
+
+// Open starts the download of the object, failing on the responses other than 2xx.
+func (s *S3Source) Open() (io.ReadCloser, error) {
+	req, err := s.request(http.MethodGet, nil, "", time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return s.do(req)
+}
+
+// do sends the request of the object, failing on the responses other than 2xx.
+func (s *S3Source) do(req *http.Request) (io.ReadCloser, error) {
+	client := s.Client
+	if client == nil {
+		client = sourceClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, errors.New(resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// request returns the signed request of the object at the time, with the payload of the
+// content type.
+func (s *S3Source) request(method string, payload []byte, contentType string, now time.Time) (*http.Request, error) {
+	key := s3Escape(s.Key)
+	rawurl := "https://" + s.Bucket + ".s3.amazonaws.com/" + key
+	if s.Endpoint != "" {
+		rawurl = strings.TrimSuffix(s.Endpoint, "/") + "/" + s.Bucket + "/" + key
+	}
+	req, err := http.NewRequest(method, rawurl, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if s.AccessKey != "" {
+		hash := emptySHA256
+		if len(payload) > 0 {
+			sum := sha256.Sum256(payload)
+			hash = hex.EncodeToString(sum[:])
+		}
+		s.sign(req, hash, now)
+	}
+	return req, nil
+}
+
+// sign adds the AWS Signature Version 4 of the request to its Authorization header, signing
+// the host and all the headers set on it, and the payload by its hash.
+func (s *S3Source) sign(req *http.Request, payloadHash string, now time.Time) {
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	now = now.UTC()
+	date, stamp := now.Format("20060102"), now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	request := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonical.String(), signed, payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// s3Escape escapes the object key as required by the signature, every byte but the
+// unreserved characters and the slashes.
+func s3Escape(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the data with the key.
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,261 @@
+package facemask
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OutputSink is a destination of the processed images. The results are written to the sinks
+// rather than encoded by the compositor, so the new destinations are added by implementing
+// the interface, and a result is written to several destinations at once by MultiSink.
+type OutputSink interface {
+	// Name identifies the sink in the errors.
+	Name() string
+	// Write writes the result of the image, with the report of its faces.
+	Write(r *Result, report Report) error
+}
+
+// Encode encodes the image to w in the format, preserving the color profile of the source.
+func (r *Result) Encode(w io.Writer, format Format) error {
+	return encodeICC(w, r.img, format, r.profile)
+}
+
+// Image returns the image of the result.
+func (r *Result) Image() image.Image {
+	return r.img
+}
+
+// bytes returns the image encoded in the format.
+func (r *Result) bytes(format Format) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := r.Encode(&buf, format); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// FileSink is the image file of the path, encoded in the format of its extension.
+type FileSink string
+
+// Name returns the path of the file.
+func (s FileSink) Name() string { return string(s) }
+
+// Write encodes the image into the file.
+func (s FileSink) Write(r *Result, _ Report) error {
+	if _, ok := FormatFromExt(string(s)); !ok {
+		return fmt.Errorf("output file type not supported: %v", filepath.Ext(string(s)))
+	}
+	return r.Save(string(s))
+}
+
+// ThumbnailSink is the image file of the path, holding a copy of the image downscaled to
+// fit into a square of the size.
+type ThumbnailSink struct {
+	Path string
+	Size int
+}
+
+// Name returns the path of the thumbnail.
+func (s ThumbnailSink) Name() string { return s.Path }
+
+// Write encodes the thumbnail into the file, creating its directory.
+func (s ThumbnailSink) Write(r *Result, _ Report) error {
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return err
+	}
+	return r.SaveThumbnail(s.Path, s.Size)
+}
+
+// ReportSink is the JSON file of the path, holding the report of the faces of the image.
+type ReportSink string
+
+// Name returns the path of the report.
+func (s ReportSink) Name() string { return string(s) }
+
+// Write writes the report as indented JSON.
+func (s ReportSink) Write(_ *Result, report Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(string(s), append(data, '\n'), 0644)
+}
+
+// WriterSink encodes the images to the writer, e.g. the standard output or a pipe. The
+// JPEG images written one after the other form an MJPEG stream, which ffmpeg can publish
+// to a virtual camera.
+type WriterSink struct {
+	Label  string
+	Writer io.Writer
+	Format Format
+}
+
+// Name returns the label of the writer.
+func (s WriterSink) Name() string { return s.Label }
+
+// Write encodes the image to the writer.
+func (s WriterSink) Write(r *Result, _ Report) error {
+	return r.Encode(s.Writer, s.Format)
+}
+
+// ResponseSink writes the image as the response of an HTTP request, with the number of
+// the faces in the X-Faces header.
+type ResponseSink struct {
+	Writer http.ResponseWriter
+	Format Format
+}
+
+// Name returns the name of the sink.
+func (s ResponseSink) Name() string { return "response" }
+
+// Write encodes the image and writes the response.
+func (s ResponseSink) Write(r *Result, report Report) error {
+	data, err := r.bytes(s.Format)
+	if err != nil {
+		return err
+	}
+	s.Writer.Header().Set("Content-Type", "image/"+s.Format.String())
+	s.Writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	s.Writer.Header().Set("X-Faces", strconv.Itoa(len(report.Faces)))
+	_, err = s.Writer.Write(data)
+	return err
+}
+
+// URLSink uploads the images with PUT to the http(s) URL, like a presigned URL of an object
+// store, encoded in the format of the extension of the URL path.
+type URLSink struct {
+	URL string
+	// Client is the client of the upload, a client with a one minute timeout when nil.
+	Client *http.Client
+}
+
+// Name returns the URL.
+func (s URLSink) Name() string { return s.URL }
+
+// Write uploads the image, failing on the responses other than 2xx.
+func (s URLSink) Write(r *Result, _ Report) error {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return err
+	}
+	// The format follows the path, without the query of the presigned URLs.
+	format, ok := FormatFromExt(u.Path)
+	if !ok {
+		return fmt.Errorf("output file type not supported: %v", path.Ext(u.Path))
+	}
+	data, err := r.bytes(format)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, s.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "image/"+format.String())
+	client := s.Client
+	if client == nil {
+		client = sourceClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// S3Sink uploads the images to the object of an S3 bucket, or of an S3 compatible store,
+// encoded in the format of the extension of the key. The object is addressed and the
+// requests signed like the ones of S3Source.
+type S3Sink struct {
+	Object *S3Source
+}
+
+// NewS3Sink returns the sink of the s3://bucket/key URI, configured by the AWS environment
+// variables like NewS3Source.
+func NewS3Sink(uri string) (*S3Sink, error) {
+	object, err := NewS3Source(uri)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Sink{Object: object}, nil
+}
+
+// Name returns the s3:// URI of the object.
+func (s *S3Sink) Name() string { return s.Object.Name() }
+
+// Write uploads the image with PUT, failing on the responses other than 2xx.
+func (s *S3Sink) Write(r *Result, _ Report) error {
+	format, ok := FormatFromExt(s.Object.Key)
+	if !ok {
+		return fmt.Errorf("output file type not supported: %v", path.Ext(s.Object.Key))
+	}
+	data, err := r.bytes(format)
+	if err != nil {
+		return err
+	}
+	req, err := s.Object.request(http.MethodPut, data, "image/"+format.String(), time.Now())
+	if err != nil {
+		return err
+	}
+	body, err := s.Object.do(req)
+	if err != nil {
+		return err
+	}
+	return body.Close()
+}
+
+// MultiSink writes the result to all of its sinks, e.g. the output image, its thumbnail and
+// its report. All the sinks are written even if some of them fail.
+type MultiSink []OutputSink
+
+// Name returns the names of the sinks.
+func (s MultiSink) Name() string {
+	var buf bytes.Buffer
+	for i, sink := range s {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(sink.Name())
+	}
+	return buf.String()
+}
+
+// Write writes the result to every sink, returning the error of the first failed one.
+func (s MultiSink) Write(r *Result, report Report) error {
+	var first error
+	for _, sink := range s {
+		if err := sink.Write(r, report); err != nil && first == nil {
+			first = fmt.Errorf("%s: %v", sink.Name(), err)
+		}
+	}
+	return first
+}
+
+// OpenSink returns the sink of the name: the object of an s3://bucket/key URI, the http(s)
+// URL uploaded with PUT, or the image file otherwise.
+func OpenSink(name string) (OutputSink, error) {
+	switch {
+	case strings.HasPrefix(name, "s3://"):
+		return NewS3Sink(name)
+	case strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://"):
+		return URLSink{URL: name}, nil
+	}
+	return FileSink(filepath.Clean(name)), nil
+}
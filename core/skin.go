@@ -0,0 +1,79 @@
+package facemask
+
+import (
+	"image"
+	"image/color"
+)
+
+// isSkin reports whether the color falls within the common skin chrominance
+// bounds of the YCbCr color space.
+func isSkin(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	_, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+	return cb >= 77 && cb <= 127 && cr >= 133 && cr <= 173
+}
+
+// clipToSkin clips the overlay positioned at x, y over the background to the face silhouette.
+// For every row of the overlay the horizontal span between the leftmost and rightmost
+// skin colored background pixels is kept. The spans are used instead of the per pixel
+// skin decision, so the non skin colored facial features (lips, nostrils) don't punch holes into the overlay.
+func clipToSkin(bg image.Image, overlay *image.NRGBA, x, y int) *image.NRGBA {
+	w, h := overlay.Bounds().Dx(), overlay.Bounds().Dy()
+	if w == 0 || h == 0 {
+		return overlay
+	}
+	left, right := make([]int, h), make([]int, h)
+	found := false
+	for row := 0; row < h; row++ {
+		left[row], right[row] = -1, -1
+		for col := 0; col < w; col++ {
+			p := image.Pt(x+col, y+row)
+			if !p.In(bg.Bounds()) || !isSkin(bg.At(p.X, p.Y)) {
+				continue
+			}
+			if left[row] < 0 {
+				left[row] = col
+			}
+			right[row] = col
+		}
+		if left[row] >= 0 {
+			found = true
+		}
+	}
+	// Without any skin pixel the skin model doesn't fit the lighting, leave the overlay untouched.
+	if !found {
+		return overlay
+	}
+	// The rows without skin pixels inherit the span of the closest row above or below.
+	for row := 1; row < h; row++ {
+		if left[row] < 0 && left[row-1] >= 0 {
+			left[row], right[row] = left[row-1], right[row-1]
+		}
+	}
+	for row := h - 2; row >= 0; row-- {
+		if left[row] < 0 && left[row+1] >= 0 {
+			left[row], right[row] = left[row+1], right[row+1]
+		}
+	}
+
+	// Smooth the spans with a moving average and extend them with a small margin.
+	const radius = 3
+	margin := w / 50
+	clipped := image.NewNRGBA(overlay.Bounds())
+	copy(clipped.Pix, overlay.Pix)
+	for row := 0; row < h; row++ {
+		var l, r, n int
+		for i := row - radius; i <= row+radius; i++ {
+			if i >= 0 && i < h {
+				l, r, n = l+left[i], r+right[i], n+1
+			}
+		}
+		l, r = l/n-margin, r/n+margin
+		for col := 0; col < w; col++ {
+			if col < l || col > r {
+				clipped.Pix[row*clipped.Stride+col*4+3] = 0
+			}
+		}
+	}
+	return clipped
+}
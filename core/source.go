@@ -0,0 +1,198 @@
+package facemask
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// ImageSource provides the encoded image processed by the detector. The command line modes
+// and the server load their images through the sources, so they share the size limits, the
+// format sniffing and the Exif orientation.
+type ImageSource interface {
+	// Name identifies the source in the reports and the errors.
+	Name() string
+	// Open returns the encoded image. The caller closes it.
+	Open() (io.ReadCloser, error)
+}
+
+// FileSource is the image file of the path.
+type FileSource string
+
+// Name returns the path of the file.
+func (s FileSource) Name() string { return string(s) }
+
+// Open opens the file.
+func (s FileSource) Open() (io.ReadCloser, error) { return os.Open(string(s)) }
+
+// BytesSource is the encoded image held in memory.
+type BytesSource struct {
+	Label string
+	Data  []byte
+}
+
+// Name returns the label of the image.
+func (s BytesSource) Name() string { return s.Label }
+
+// Open returns a reader of the data.
+func (s BytesSource) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(s.Data)), nil
+}
+
+// ReaderSource is the encoded image read once from a stream, like the body of a request.
+type ReaderSource struct {
+	Label  string
+	Reader io.Reader
+}
+
+// Name returns the label of the stream.
+func (s ReaderSource) Name() string { return s.Label }
+
+// Open returns the stream.
+func (s ReaderSource) Open() (io.ReadCloser, error) { return ioutil.NopCloser(s.Reader), nil }
+
+// sourceClient downloads the images of the URL sources without their own client.
+var sourceClient = &http.Client{Timeout: time.Minute}
+
+// URLSource is the image downloaded with GET from the http(s) URL, like a presigned URL of
+// an object store.
+type URLSource struct {
+	URL string
+	// Client is the client of the download, a client with a one minute timeout when nil.
+	Client *http.Client
+}
+
+// Name returns the URL.
+func (s URLSource) Name() string { return s.URL }
+
+// Open starts the download, failing on the responses other than 2xx.
+func (s URLSource) Open() (io.ReadCloser, error) {
+	client := s.Client
+	if client == nil {
+		client = sourceClient
+	}
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, errors.New(resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// FrameSource is a frame already decoded, like a frame of a camera or of a video stream.
+// The detector processes the frame itself, while Open encodes it as PNG for the consumers
+// of the encoded images.
+type FrameSource struct {
+	Label string
+	Frame image.Image
+}
+
+// Name returns the label of the frame.
+func (s FrameSource) Name() string { return s.Label }
+
+// Open encodes the frame as PNG.
+func (s FrameSource) Open() (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, s.Frame); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(&buf), nil
+}
+
+// OpenSource returns the source of the name: the object of an s3://bucket/key URI, the image
+// of an http(s) URL, or the image file otherwise.
+func OpenSource(name string) (ImageSource, error) {
+	switch {
+	case strings.HasPrefix(name, "s3://"):
+		return NewS3Source(name)
+	case strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://"):
+		return URLSource{URL: name}, nil
+	}
+	return FileSource(filepath.Clean(name)), nil
+}
+
+// IsRemote reports whether the name is the URL of a remote source opened by OpenSource.
+func IsRemote(name string) bool {
+	return strings.HasPrefix(name, "s3://") || strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// SourceLimits bound the images read from the sources, so the untrusted ones can't exhaust
+// the memory. The zero values don't limit the images.
+type SourceLimits struct {
+	// MaxSize is the maximum size of the encoded image in bytes.
+	MaxSize int64
+	// MaxPixels is the maximum number of the pixels of the image, checked before decoding it.
+	MaxPixels int
+}
+
+// SourceError is the error of an image rejected by ReadSource, either for exceeding the
+// limits or for its unsupported format.
+type SourceError struct {
+	// TooLarge reports whether the image exceeds the limits.
+	TooLarge bool
+	Err      error
+}
+
+func (e *SourceError) Error() string { return e.Err.Error() }
+
+func (e *SourceError) Unwrap() error { return e.Err }
+
+// ReadSource reads the encoded image of the source, returning it with its sniffed format.
+// The images exceeding the limits and the unsupported formats are rejected with a
+// *SourceError before they're decoded.
+func ReadSource(src ImageSource, limits SourceLimits) ([]byte, string, error) {
+	rc, err := src.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+
+	var r io.Reader = rc
+	if limits.MaxSize > 0 {
+		r = io.LimitReader(rc, limits.MaxSize+1)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if limits.MaxSize > 0 && int64(len(data)) > limits.MaxSize {
+		return nil, "", &SourceError{TooLarge: true, Err: fmt.Errorf("the image exceeds %d MB", limits.MaxSize>>20)}
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", &SourceError{Err: fmt.Errorf("unsupported image: %v", err)}
+	}
+	if limits.MaxPixels > 0 && cfg.Width*cfg.Height > limits.MaxPixels {
+		return nil, "", &SourceError{TooLarge: true, Err: fmt.Errorf("the image exceeds %d megapixels", limits.MaxPixels/1000000)}
+	}
+	return data, format, nil
+}
+
+// DetectSource loads the image of the source within the Limits of the detector and runs
+// the detection algorithm over it. The frames are processed without encoding them.
+func (fd *Detector) DetectSource(src ImageSource) ([]pigo.Detection, error) {
+	if frame, ok := src.(FrameSource); ok {
+		return fd.DetectImage(frame.Frame)
+	}
+	start := time.Now()
+	data, _, err := ReadSource(src, fd.Limits)
+	if err != nil {
+		fd.stage(StageDecode, start, err)
+		return nil, err
+	}
+	return fd.DetectReader(bytes.NewReader(data))
+}
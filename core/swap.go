@@ -0,0 +1,114 @@
+package facemask
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/fogleman/gg"
+)
+
+// GroupRenderer is implemented by the renderers which need all the faces of
+// the image at once, like the face swap. When a renderer implements it,
+// RenderAll is called instead of calling Render for every face.
+type GroupRenderer interface {
+	Renderer
+	RenderAll(ctx *gg.Context, faces []FaceInfo) error
+}
+
+// SwapRenderer exchanges the content of the pairs of faces: the first face with
+// the second one, the third with the fourth and so on. The faces are aligned
+// by the pupils and blended into the target face with a feathered elliptical edge.
+type SwapRenderer struct {
+	// Feather is the width of the blended edge relative to the face size.
+	Feather float64
+}
+
+// Render implements the Renderer interface. A single face has nothing to be swapped with.
+func (sr *SwapRenderer) Render(ctx *gg.Context, face FaceInfo) error {
+	return nil
+}
+
+// RenderAll implements the GroupRenderer interface.
+func (sr *SwapRenderer) RenderAll(ctx *gg.Context, faces []FaceInfo) error {
+	// Sample from a copy of the source, so the swapped faces don't feed into each other.
+	src := image.NewRGBA(ctx.Image().Bounds())
+	draw.Draw(src, src.Bounds(), ctx.Image(), src.Bounds().Min, draw.Src)
+
+	for i := 0; i+1 < len(faces); i += 2 {
+		a, b := faces[i], faces[i+1]
+		pa := sr.warpFace(src, b, a)
+		pb := sr.warpFace(src, a, b)
+		ctx.DrawImage(pa, pa.Bounds().Min.X, pa.Bounds().Min.Y)
+		ctx.DrawImage(pb, pb.Bounds().Min.X, pb.Bounds().Min.Y)
+	}
+	return nil
+}
+
+// warpFace returns the content of the from face transformed onto the to face geometry,
+// as an image positioned over the to face with the alpha channel fading towards the edges.
+func (sr *SwapRenderer) warpFace(src *image.RGBA, from, to FaceInfo) *image.NRGBA {
+	flx, fly, frx, fry := eyePoints(from)
+	tlx, tly, trx, try := eyePoints(to)
+
+	fcx, fcy := (flx+frx)/2, (fly+fry)/2
+	tcx, tcy := (tlx+trx)/2, (tly+try)/2
+	scale := math.Hypot(frx-flx, fry-fly) / math.Max(1, math.Hypot(trx-tlx, try-tly))
+	angle := math.Atan2(fry-fly, frx-flx) - math.Atan2(try-tly, trx-tlx)
+	sin, cos := math.Sincos(angle)
+
+	s := float64(to.Scale)
+	rx, ry := s*0.4, s*0.5
+	rect := image.Rect(
+		to.Col-int(rx), to.Row-int(ry),
+		to.Col+int(rx), to.Row+int(ry),
+	).Intersect(src.Bounds())
+
+	feather := sr.Feather
+	if feather <= 0 {
+		feather = 0.15
+	}
+	patch := image.NewNRGBA(rect)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			// Normalized elliptical radius, the alpha fades out over the feather width.
+			nx, ny := (float64(x)-float64(to.Col))/rx, (float64(y)-float64(to.Row))/ry
+			alpha := (1 - math.Hypot(nx, ny)) / feather
+			if alpha <= 0 {
+				continue
+			}
+			alpha = math.Min(1, alpha)
+
+			dx, dy := (float64(x)-tcx)*scale, (float64(y)-tcy)*scale
+			sx := fcx + dx*cos - dy*sin
+			sy := fcy + dx*sin + dy*cos
+			c, ok := bilinear(src, sx, sy)
+			if !ok {
+				continue
+			}
+			c.A = uint8(alpha * 255)
+			patch.SetNRGBA(x, y, c)
+		}
+	}
+	return patch
+}
+
+// bilinear samples the image at a fractional position using bilinear interpolation.
+func bilinear(img *image.RGBA, x, y float64) (color.NRGBA, bool) {
+	b := img.Bounds()
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	if x0 < b.Min.X || y0 < b.Min.Y || x0+1 >= b.Max.X || y0+1 >= b.Max.Y {
+		return color.NRGBA{}, false
+	}
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	var out [3]float64
+	for i, w := range [4]float64{(1 - fx) * (1 - fy), fx * (1 - fy), (1 - fx) * fy, fx * fy} {
+		off := img.PixOffset(x0+i%2, y0+i/2)
+		for c := 0; c < 3; c++ {
+			out[c] += w * float64(img.Pix[off+c])
+		}
+	}
+	return color.NRGBA{R: uint8(out[0]), G: uint8(out[1]), B: uint8(out[2]), A: 255}, true
+}
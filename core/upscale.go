@@ -0,0 +1,64 @@
+package facemask
+
+import (
+	"math"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// upscaleTarget is the face size in pixels the small faces are upscaled to.
+const upscaleTarget = 128
+
+// upscaleRegion crops the region around the face from the grayscale image and upscales it
+// with bilinear interpolation, so the face becomes target pixels wide. It returns the upscaled
+// image, the face detection in its coordinates and the function mapping the points back.
+func upscaleRegion(params pigo.ImageParams, face pigo.Detection, target int) (pigo.ImageParams, pigo.Detection, func(*pigo.Puploc) *pigo.Puploc) {
+	k := float64(target) / float64(face.Scale)
+
+	// The region is twice the face size, so the landmark cascades have enough context.
+	x0 := clampInt(face.Col-face.Scale, 0, params.Cols-1)
+	y0 := clampInt(face.Row-face.Scale, 0, params.Rows-1)
+	x1 := clampInt(face.Col+face.Scale, x0+1, params.Cols)
+	y1 := clampInt(face.Row+face.Scale, y0+1, params.Rows)
+
+	cols := int(math.Ceil(float64(x1-x0) * k))
+	rows := int(math.Ceil(float64(y1-y0) * k))
+	pixels := make([]uint8, cols*rows)
+	for y := 0; y < rows; y++ {
+		sy := clamp((float64(y)+0.5)/k-0.5, 0, float64(y1-y0-1))
+		iy := int(sy)
+		fy := sy - float64(iy)
+		iy1 := clampInt(iy+1, 0, y1-y0-1)
+		for x := 0; x < cols; x++ {
+			sx := clamp((float64(x)+0.5)/k-0.5, 0, float64(x1-x0-1))
+			ix := int(sx)
+			fx := sx - float64(ix)
+			ix1 := clampInt(ix+1, 0, x1-x0-1)
+
+			at := func(r, c int) float64 {
+				return float64(params.Pixels[(y0+r)*params.Dim+x0+c])
+			}
+			v := (1-fy)*((1-fx)*at(iy, ix)+fx*at(iy, ix1)) + fy*((1-fx)*at(iy1, ix)+fx*at(iy1, ix1))
+			pixels[y*cols+x] = uint8(v + 0.5)
+		}
+	}
+
+	scaled := pigo.Detection{
+		Row:   int(float64(face.Row-y0) * k),
+		Col:   int(float64(face.Col-x0) * k),
+		Scale: target,
+		Q:     face.Q,
+	}
+	unscale := func(p *pigo.Puploc) *pigo.Puploc {
+		if !validPoint(p) {
+			return p
+		}
+		return &pigo.Puploc{
+			Row:      y0 + int(float64(p.Row)/k+0.5),
+			Col:      x0 + int(float64(p.Col)/k+0.5),
+			Scale:    p.Scale / float32(k),
+			Perturbs: p.Perturbs,
+		}
+	}
+	return pigo.ImageParams{Pixels: pixels, Rows: rows, Cols: cols, Dim: cols}, scaled, unscale
+}
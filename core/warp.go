@@ -0,0 +1,59 @@
+package facemask
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	// chinRatio estimates the chin position from the mouth center: the chin is below
+	// the mouth by this fraction of the eyes to mouth distance.
+	chinRatio = 0.65
+	// jawRatio is the estimated half width of the jaw relative to the face size.
+	jawRatio = 0.4
+)
+
+// estimateChin returns the estimated chin position of the face. The landmark cascades
+// provide no chin point, so it is extrapolated from the pupils and the mouth corners.
+func estimateChin(face FaceInfo) (float64, float64, bool) {
+	if !validPoint(face.MouthLeft) || !validPoint(face.MouthRight) {
+		return 0, 0, false
+	}
+	lx, ly, rx, ry := eyePoints(face)
+	ex, ey := (lx+rx)/2, (ly+ry)/2
+	mx := float64(face.MouthLeft.Col+face.MouthRight.Col) / 2
+	my := float64(face.MouthLeft.Row+face.MouthRight.Row) / 2
+
+	return mx + (mx-ex)*chinRatio, my + (my-ey)*chinRatio, true
+}
+
+// warpToJaw deforms the mask so its bottom edge follows the jaw line: the columns
+// within the jaw are stretched or squeezed vertically, so the bottom of the mask
+// follows a parabola reaching centerBottom under the chin and edgeBottom at the jaw corners.
+// The columns outside of the jaw keep the edgeBottom height.
+func warpToJaw(mask *image.NRGBA, centerBottom, edgeBottom, jawHalfWidth float64) *image.NRGBA {
+	w, h := mask.Bounds().Dx(), mask.Bounds().Dy()
+	if w == 0 || h == 0 || centerBottom <= 0 || edgeBottom <= 0 || jawHalfWidth <= 0 {
+		return mask
+	}
+	outH := int(math.Ceil(math.Max(centerBottom, edgeBottom)))
+	dst := image.NewNRGBA(image.Rect(0, 0, w, outH))
+
+	for x := 0; x < w; x++ {
+		d := math.Min(1, math.Abs(float64(x)-float64(w)/2)/jawHalfWidth)
+		bottom := centerBottom - (centerBottom-edgeBottom)*d*d
+		if bottom < 1 {
+			continue
+		}
+		for y := 0; y < outH && float64(y) < bottom; y++ {
+			v := int(float64(y) * float64(h) / bottom)
+			if v >= h {
+				v = h - 1
+			}
+			si := mask.PixOffset(mask.Bounds().Min.X+x, mask.Bounds().Min.Y+v)
+			di := dst.PixOffset(x, y)
+			copy(dst.Pix[di:di+4], mask.Pix[si:si+4])
+		}
+	}
+	return dst
+}
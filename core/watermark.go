@@ -0,0 +1,75 @@
+package facemask
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+
+	"github.com/disintegration/imaging"
+)
+
+// WatermarkPositions are the corners of the image, or its center, where the watermark can be placed.
+var WatermarkPositions = []string{"tl", "tr", "bl", "br", "c"}
+
+// Watermark is an image, like a logo, stamped over the processed images.
+type Watermark struct {
+	Image image.Image
+	// Position is one of WatermarkPositions.
+	Position string
+	// Opacity of the watermark between 0 and 1.
+	Opacity float64
+}
+
+// NewWatermark loads the watermark image from the PNG or JPEG file.
+func NewWatermark(path, position string, opacity float64) (*Watermark, error) {
+	switch position {
+	case "tl", "tr", "bl", "br", "c":
+	default:
+		return nil, fmt.Errorf("unknown watermark position %q (available: %v)", position, WatermarkPositions)
+	}
+	if opacity <= 0 || opacity > 1 {
+		return nil, fmt.Errorf("the watermark opacity must be between 0 and 1: %v", opacity)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding the watermark: %v", err)
+	}
+	return &Watermark{Image: img, Position: position, Opacity: opacity}, nil
+}
+
+// Draw stamps the watermark over the image. The watermark keeps its own size, unless it's
+// wider than a quarter of the image, in which case it's downscaled to that width. It's kept
+// off the image edges by a margin of 2% of the smaller image side.
+func (wm *Watermark) Draw(dst draw.Image) {
+	b := dst.Bounds()
+	logo := wm.Image
+	if maxW := b.Dx() / 4; logo.Bounds().Dx() > maxW && maxW > 0 {
+		logo = imaging.Resize(logo, maxW, 0, imaging.Lanczos)
+	}
+	size := logo.Bounds().Size()
+	margin := int(math.Round(math.Min(float64(b.Dx()), float64(b.Dy())) * 0.02))
+
+	x, y := b.Min.X+margin, b.Min.Y+margin
+	switch wm.Position {
+	case "tr", "br":
+		x = b.Max.X - margin - size.X
+	case "c":
+		x = b.Min.X + (b.Dx()-size.X)/2
+	}
+	switch wm.Position {
+	case "bl", "br":
+		y = b.Max.Y - margin - size.Y
+	case "c":
+		y = b.Min.Y + (b.Dy()-size.Y)/2
+	}
+	alpha := image.NewUniform(color.Alpha{A: uint8(wm.Opacity*255 + 0.5)})
+	draw.DrawMask(dst, image.Rectangle{image.Pt(x, y), image.Pt(x, y).Add(size)}, logo, logo.Bounds().Min, alpha, image.Point{}, draw.Over)
+}
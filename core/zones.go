@@ -0,0 +1,129 @@
+package facemask
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+
+	"github.com/disintegration/imaging"
+	"github.com/fogleman/gg"
+)
+
+// defaultZoneSigma is the blur strength of the privacy zones, strong enough to hide
+// the people and the text in them.
+const defaultZoneSigma = 20
+
+// Zone is a privacy zone of the frames, a polygon in pixel coordinates.
+type Zone struct {
+	Name   string       `json:"name"`
+	Points [][2]float64 `json:"points"`
+
+	// mask is the rasterized polygon, in the image coordinates.
+	mask *image.Alpha
+}
+
+// PrivacyZones are the regions of the frames which are always blurred, whether or not
+// faces are detected in them, like the windows of the neighbouring buildings in the
+// view of a public space camera.
+type PrivacyZones struct {
+	Zones []Zone `json:"zones"`
+	// Sigma is the blur strength. Zero means the default of 20.
+	Sigma float64 `json:"sigma,omitempty"`
+}
+
+// LoadPrivacyZones reads the privacy zones from the JSON file of the form
+// {"zones": [{"name": "window", "points": [[x, y], ...]}, ...]}.
+func LoadPrivacyZones(path string) (*PrivacyZones, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pz := new(PrivacyZones)
+	if err := json.NewDecoder(f).Decode(pz); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(pz.Zones) == 0 {
+		return nil, fmt.Errorf("%s: no privacy zones defined", path)
+	}
+	if pz.Sigma < 0 {
+		return nil, fmt.Errorf("%s: invalid blur strength: %v", path, pz.Sigma)
+	}
+	for i := range pz.Zones {
+		if len(pz.Zones[i].Points) < 3 {
+			return nil, fmt.Errorf("%s: zone %d: a polygon needs at least 3 points", path, i)
+		}
+		pz.Zones[i].mask = polygonMask(pz.Zones[i].Points)
+	}
+	if pz.Sigma == 0 {
+		pz.Sigma = defaultZoneSigma
+	}
+	return pz, nil
+}
+
+// Contains reports whether the point is inside the zone.
+func (z *Zone) Contains(x, y int) bool {
+	if z.mask == nil {
+		z.mask = polygonMask(z.Points)
+	}
+	return z.mask.AlphaAt(x, y).A >= 0x80
+}
+
+// Draw blurs the zones of the image. The image is blurred a bit beyond the zones,
+// so their edges are blurred with the surrounding pixels rather than with the black.
+func (pz *PrivacyZones) Draw(dst draw.Image) {
+	sigma := pz.Sigma
+	if sigma == 0 {
+		sigma = defaultZoneSigma
+	}
+	pad := int(math.Ceil(3 * sigma))
+	for i := range pz.Zones {
+		z := &pz.Zones[i]
+		if z.mask == nil {
+			z.mask = polygonMask(z.Points)
+		}
+		rect := z.mask.Bounds().Intersect(dst.Bounds())
+		if rect.Empty() {
+			continue
+		}
+		region := rect.Inset(-pad).Intersect(dst.Bounds())
+		blurred := imaging.Blur(imaging.Crop(dst, region), sigma)
+		draw.DrawMask(dst, rect, blurred, rect.Min.Sub(region.Min), z.mask, rect.Min, draw.Over)
+	}
+}
+
+// polygonMask rasterizes the polygon into an antialiased alpha mask covering its bounding box.
+func polygonMask(points [][2]float64) *image.Alpha {
+	min := image.Pt(math.MaxInt32, math.MaxInt32)
+	max := image.Pt(math.MinInt32, math.MinInt32)
+	for _, p := range points {
+		x, y := int(math.Floor(p[0])), int(math.Floor(p[1]))
+		if x < min.X {
+			min.X = x
+		}
+		if y < min.Y {
+			min.Y = y
+		}
+		max.X, max.Y = maxInt(max.X, x+1), maxInt(max.Y, y+1)
+	}
+	bounds := image.Rectangle{min, max}
+	ctx := gg.NewContext(bounds.Dx(), bounds.Dy())
+	for _, p := range points {
+		ctx.LineTo(p[0]-float64(min.X), p[1]-float64(min.Y))
+	}
+	ctx.ClosePath()
+	ctx.SetColor(color.White)
+	ctx.Fill()
+
+	mask := image.NewAlpha(bounds)
+	rgba := ctx.Image().(*image.RGBA)
+	for i := range mask.Pix {
+		mask.Pix[i] = rgba.Pix[4*i+3]
+	}
+	return mask
+}
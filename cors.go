@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsMaxAge is the time the browsers cache the answers of the preflight requests.
+const corsMaxAge = 10 * time.Minute
+
+// corsHeaders are the response headers exposed to the browser clients: the number of the
+// faces, the cache validators and the headers of the resumable uploads.
+var corsHeaders = []string{
+	"X-Faces", "X-Request-ID", "ETag", "Location", "Upload-Offset", "Upload-Length",
+	"Upload-Expires", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size",
+}
+
+// cors allows the browser clients of the -cors-origins origins to call the server directly,
+// answering their preflight requests. The origin * allows any origin.
+func (s *server) cors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(s.origins) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowed := s.allowedOrigin(origin)
+		if allowed == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsHeaders, ", "))
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PATCH, DELETE, OPTIONS")
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// allowedOrigin returns the allowed origin of the response to the origin, * when any origin
+// is allowed, or an empty string if the origin is not one of the -cors-origins.
+func (s *server) allowedOrigin(origin string) string {
+	for _, o := range s.origins {
+		switch {
+		case o == "*":
+			return o
+		case strings.EqualFold(o, origin):
+			return origin
+		}
+	}
+	return ""
+}
@@ -0,0 +1,49 @@
+package main
+
+import "sync"
+
+// encoder encodes the outputs of the batch mode on background workers, so the encoding
+// of an image overlaps with the detection of the next ones. Every pending output holds
+// a fully decoded image in memory, so the number of images in flight is bounded: when
+// all the workers are busy, submit blocks until one of them is done.
+type encoder struct {
+	jobs chan func()
+	wg   sync.WaitGroup
+}
+
+// newEncoder starts the encoder workers. Without workers it returns nil,
+// and the outputs are encoded synchronously.
+func newEncoder(workers int) *encoder {
+	if workers <= 0 {
+		return nil
+	}
+	e := &encoder{jobs: make(chan func())}
+	e.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer e.wg.Done()
+			for job := range e.jobs {
+				job()
+			}
+		}()
+	}
+	return e
+}
+
+// submit runs the job on the first idle worker, or right away on a nil encoder.
+func (e *encoder) submit(job func()) {
+	if e == nil {
+		job()
+		return
+	}
+	e.jobs <- job
+}
+
+// wait waits for the submitted jobs to complete and stops the workers.
+func (e *encoder) wait() {
+	if e == nil {
+		return
+	}
+	close(e.jobs)
+	e.wg.Wait()
+}
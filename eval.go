@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// evalCommand compares the detections with the ground truth face boxes of a sample set
+// and prints the precision, the recall and the average IoU of the detector.
+func evalCommand(args []string) {
+	fs := flag.NewFlagSet("eval", flag.ExitOnError)
+	flags := evalFlags(fs)
+	fd := flags.fd
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: facemask eval -in samples/ -truth annotations.json\n\n")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	defer fd.Close()
+
+	if len(*flags.source) == 0 || len(*flags.truth) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	boxes, err := facemask.LoadTruth(*flags.truth)
+	if err != nil {
+		log.Fatalf("Error loading the ground truth: %v", err)
+	}
+	files := make([]string, 0, len(boxes))
+	for file := range boxes {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var total facemask.Evaluation
+	for _, file := range files {
+		faces, err := fd.DetectFaces(filepath.Join(*flags.source, file))
+		if err != nil {
+			log.Fatalf("Detection error: %v", err)
+		}
+		var eval facemask.Evaluation
+		eval.Add(qualityFilter(faces, fd.QThreshold), boxes[file], *flags.matchAt)
+		if *flags.verbose {
+			fmt.Printf("%s: tp %d, fp %d, fn %d, iou %.3f\n",
+				file, eval.TruePositives, eval.FalsePositives, eval.FalseNegatives, eval.MeanIoU())
+		}
+		total.TruePositives += eval.TruePositives
+		total.FalsePositives += eval.FalsePositives
+		total.FalseNegatives += eval.FalseNegatives
+		total.IoUSum += eval.IoUSum
+	}
+
+	fmt.Printf("images: %d\nfaces: %d\ndetections: %d\n", len(files),
+		total.TruePositives+total.FalseNegatives, total.TruePositives+total.FalsePositives)
+	fmt.Printf("precision: %.3f\nrecall: %.3f\nf1: %.3f\naverage iou: %.3f\n",
+		total.Precision(), total.Recall(), total.F1(), total.MeanIoU())
+}
+
+// evalSettings are the settings of the flags of the eval command.
+type evalSettings struct {
+	source  *string
+	truth   *string
+	matchAt *float64
+	verbose *bool
+	fd      *facemask.Detector
+}
+
+// evalFlags defines the flags of the eval command.
+func evalFlags(fs *flag.FlagSet) *evalSettings {
+	return &evalSettings{
+		source:  fs.String("in", "", "Directory of the sample images"),
+		truth:   fs.String("truth", "", "Ground truth face boxes (JSON, COCO or CSV)"),
+		matchAt: fs.Float64("match-iou", 0.5, "Minimum IoU of a detection matching a ground truth box"),
+		verbose: fs.Bool("v", false, "Print the results of every image"),
+		fd:      detectorFlags(fs),
+	}
+}
@@ -1,9 +1,13 @@
 module github.com/esimov/facemask
 
-go 1.13
+go 1.18
 
 require (
 	github.com/disintegration/imaging v1.6.2
 	github.com/esimov/pigo v1.4.3
 	github.com/fogleman/gg v1.3.0
+	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.6
+	golang.org/x/image v0.0.0-20191009234506-e7c1f5e7dbb8
 )
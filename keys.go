@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// readKeys reads the keys pressed in the controlling terminal, which remains free while the
+// standard input carries the stream. The terminal is switched with stty to the unbuffered
+// mode without echo, so the keys are delivered without Enter; the returned function restores
+// it, which also happens on an interrupt. The keys pressed faster than consumed are dropped.
+func readKeys() (<-chan byte, func(), error) {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return nil, nil, err
+	}
+	saved, err := stty(tty, "-g")
+	if err != nil {
+		tty.Close()
+		return nil, nil, err
+	}
+	if _, err := stty(tty, "cbreak", "-echo"); err != nil {
+		tty.Close()
+		return nil, nil, err
+	}
+	restore := func() {
+		stty(tty, strings.TrimSpace(saved))
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		restore()
+		os.Exit(1)
+	}()
+
+	keys := make(chan byte, 16)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := tty.Read(buf); err != nil {
+				close(keys)
+				return
+			}
+			select {
+			case keys <- buf[0]:
+			default:
+			}
+		}
+	}()
+	return keys, restore, nil
+}
+
+// stty runs stty over the terminal and returns its output.
+func stty(tty *os.File, args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = tty
+	out, err := cmd.Output()
+	return string(out), err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ledgerFile is the state file of the batch runs, written into the output directory.
+const ledgerFile = ".facemask-state.json"
+
+// ledger records the processed and the failed files of a batch run, so an interrupted
+// run can be resumed without processing the completed files again.
+type ledger struct {
+	path string
+
+	Done   map[string]ledgerEntry `json:"done"`
+	Failed map[string]string      `json:"failed"`
+}
+
+// ledgerEntry is a successfully processed source file.
+type ledgerEntry struct {
+	Output  string    `json:"output"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// openLedger reads the ledger of the output directory. A missing ledger is an empty one.
+func openLedger(dir string) (*ledger, error) {
+	l := &ledger{
+		path:   filepath.Join(dir, ledgerFile),
+		Done:   make(map[string]ledgerEntry),
+		Failed: make(map[string]string),
+	}
+	data, err := ioutil.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, err
+	}
+	if l.Done == nil {
+		l.Done = make(map[string]ledgerEntry)
+	}
+	if l.Failed == nil {
+		l.Failed = make(map[string]string)
+	}
+	return l, nil
+}
+
+// completed reports whether the source file has been processed already and
+// it hasn't been modified since.
+func (l *ledger) completed(source string) bool {
+	entry, ok := l.Done[source]
+	if !ok {
+		return false
+	}
+	fi, err := os.Stat(source)
+	return err == nil && fi.ModTime().Equal(entry.ModTime)
+}
+
+// record stores the outcome of processing the source file and saves the ledger.
+func (l *ledger) record(source, output string, procErr error) error {
+	if procErr != nil {
+		delete(l.Done, source)
+		l.Failed[source] = procErr.Error()
+	} else {
+		fi, err := os.Stat(source)
+		if err != nil {
+			return err
+		}
+		delete(l.Failed, source)
+		l.Done[source] = ledgerEntry{Output: output, ModTime: fi.ModTime()}
+	}
+	return l.save()
+}
+
+// save writes the ledger atomically, so it's not corrupted when the run is interrupted.
+func (l *ledger) save() error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
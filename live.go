@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	facemask "github.com/esimov/facemask/core"
+	"github.com/fogleman/gg"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gomono"
+)
+
+// snapshots saves the masked frames of the stream into a directory, numbered in order
+// after the snapshots already there.
+type snapshots struct {
+	dir  string
+	next int
+}
+
+// save encodes the last frame of the detector as the next snapshot and returns its path.
+func (s *snapshots) save(fd *facemask.Detector) (string, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return "", err
+	}
+	for {
+		s.next++
+		path := filepath.Join(s.dir, fmt.Sprintf("snapshot-%04d.jpg", s.next))
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := fd.Save(path); err != nil {
+				return "", fmt.Errorf("error saving the snapshot: %v", err)
+			}
+			return path, nil
+		}
+	}
+}
+
+// switchRenderer renders with the selected one of the masks, switched from the keyboard.
+type switchRenderer struct {
+	masks    []facemask.Renderer
+	names    []string
+	selected int32
+}
+
+// Render implements the facemask.Renderer interface.
+func (sr *switchRenderer) Render(ctx *gg.Context, face facemask.FaceInfo) error {
+	return sr.masks[atomic.LoadInt32(&sr.selected)].Render(ctx, face)
+}
+
+// selectMask selects the mask by its index, reporting whether it exists.
+func (sr *switchRenderer) selectMask(i int) bool {
+	if i < 0 || i >= len(sr.masks) {
+		return false
+	}
+	atomic.StoreInt32(&sr.selected, int32(i))
+	return true
+}
+
+// name returns the name of the selected mask.
+func (sr *switchRenderer) name() string {
+	return sr.names[atomic.LoadInt32(&sr.selected)]
+}
+
+// liveControls are the interactive controls of the stream mode, e.g. of a webcam stream:
+// the keys pressed in the terminal, the blink trigger and the stats overlay, along with
+// the face count analytics and the detection events. The space key
+// takes a snapshot of the masked frame, after a countdown drawn over the frames if set,
+// the number keys select the mask, 1 being the -mask image and the next ones the -masks
+// images, and the s key shows or hides the stats.
+type liveControls struct {
+	keys      <-chan byte
+	countdown time.Duration
+	masks     *switchRenderer
+	blink     *blinkTrigger
+	snapshots *snapshots
+	analytics *faceAnalytics
+	// events records the frames where the number of faces changes.
+	events *eventSink
+	faces  int
+
+	// stats are measured when not nil, and drawn over the frames while showStats is set.
+	stats     *frameStats
+	showStats bool
+	// mask is the name of the overlay shown by the stats, unless the masks are switched.
+	mask string
+
+	// capture is the time of the requested snapshot, zero when none is pending.
+	capture   time.Time
+	font      *truetype.Font
+	statsFont *truetype.Font
+}
+
+// frameStats returns the stats of the stream, nil if they are not measured.
+func (lc *liveControls) frameStats() *frameStats {
+	if lc == nil {
+		return nil
+	}
+	return lc.stats
+}
+
+// update handles the keys pressed since the previous frame, the snapshots and the overlays
+// of the frame, which has been rendered already, before it's encoded.
+func (lc *liveControls) update(fd *facemask.Detector, frame int, infos []facemask.FaceInfo) error {
+	for pending := true; pending && lc.keys != nil; {
+		select {
+		case key, ok := <-lc.keys:
+			if !ok {
+				lc.keys = nil
+				break
+			}
+			lc.press(key)
+		default:
+			pending = false
+		}
+	}
+	if lc.events != nil && (frame == 0 || len(infos) != lc.faces) {
+		if err := lc.events.record(facemask.NewReport(streamSource, infos), frame, ""); err != nil {
+			return err
+		}
+	}
+	lc.faces = len(infos)
+	if lc.analytics != nil {
+		if err := lc.analytics.add(infos); err != nil {
+			return err
+		}
+	}
+	if lc.blink != nil {
+		if err := lc.blink.update(fd, frame, infos); err != nil {
+			return err
+		}
+	}
+	// The snapshot is taken before the overlays are drawn, so they are not on the snapshot.
+	if !lc.capture.IsZero() && !time.Now().Before(lc.capture) {
+		lc.capture = time.Time{}
+		path, err := lc.snapshots.save(fd)
+		if err != nil {
+			return err
+		}
+		log.Printf("Snapshot at frame %d: %s", frame, path)
+	}
+	if !lc.capture.IsZero() {
+		if lc.font == nil {
+			f, err := truetype.Parse(gobold.TTF)
+			if err != nil {
+				return err
+			}
+			lc.font = f
+		}
+		drawCountdown(fd.Canvas(), lc.font, int(math.Ceil(time.Until(lc.capture).Seconds())))
+	}
+	if lc.stats != nil && lc.showStats {
+		if lc.statsFont == nil {
+			f, err := truetype.Parse(gomono.TTF)
+			if err != nil {
+				return err
+			}
+			lc.statsFont = f
+		}
+		mask := lc.mask
+		if lc.masks != nil {
+			mask = lc.masks.name()
+		}
+		lc.stats.draw(fd.Canvas(), lc.statsFont, len(infos), mask)
+	}
+	return nil
+}
+
+// press handles the key press.
+func (lc *liveControls) press(key byte) {
+	switch {
+	case key == ' ':
+		if lc.capture.IsZero() {
+			lc.capture = time.Now().Add(lc.countdown)
+		}
+	case key == 's':
+		lc.showStats = !lc.showStats
+	case key >= '1' && key <= '9':
+		if lc.masks != nil && lc.masks.selectMask(int(key-'1')) {
+			log.Printf("Selected the mask %s", lc.masks.name())
+		}
+	}
+}
+
+// drawCountdown draws the remaining seconds of the countdown in the middle of the frame.
+func drawCountdown(ctx *gg.Context, f *truetype.Font, seconds int) {
+	size := float64(ctx.Height()) / 3
+	ctx.Push()
+	defer ctx.Pop()
+
+	ctx.SetFontFace(truetype.NewFace(f, &truetype.Options{Size: size}))
+	text := strconv.Itoa(seconds)
+	x, y := float64(ctx.Width())/2, float64(ctx.Height())/2
+	ctx.SetColor(color.NRGBA{A: 160})
+	ctx.DrawStringAnchored(text, x+size/30, y+size/30, 0.5, 0.35)
+	ctx.SetColor(color.White)
+	ctx.DrawStringAnchored(text, x, y, 0.5, 0.35)
+}
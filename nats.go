@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsPort is the default port of the NATS servers.
+const natsPort = "4222"
+
+// natsMaxBackoff is the longest wait between the reconnection attempts.
+const natsMaxBackoff = 30 * time.Second
+
+// natsMaxPending is the number of the received messages queued for next. Once it's reached,
+// the connection isn't read until next takes a message, so the server keeps the rest.
+const natsMaxPending = 16
+
+// errNATSClosed is returned by the connections closed by the client.
+var errNATSClosed = errors.New("NATS connection closed")
+
+// natsConn is a minimal client of the NATS core protocol, a line based text protocol,
+// implementing the subscriptions with queue groups and the publishing, which is all
+// the worker mode needs. A goroutine reads the connection, answering the pings of the
+// server and queueing up to natsMaxPending messages, so the connection stays alive while
+// the messages are processed. The lost connections are reestablished and their
+// subscriptions renewed.
+type natsConn struct {
+	url *url.URL
+	// mu serializes the writes and guards the connection and the subscriptions.
+	mu   sync.Mutex
+	conn net.Conn
+	subs []string
+	// msgs queues the received messages. stopped is closed once the reader stops, with err.
+	msgs    chan natsMsg
+	err     error
+	stopped chan struct{}
+	done    chan struct{}
+}
+
+// natsMsg is a message received on a subscription.
+type natsMsg struct {
+	Subject string
+	Reply   string
+	Data    []byte
+}
+
+// natsInfo is the part of the INFO of the server the client needs.
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+// dialNATS connects to the NATS server of the URL, nats://[user:password@|token@]host[:port].
+// The tls:// URLs connect with TLS, which the nats:// ones also use when the server requires it.
+func dialNATS(rawurl string) (*natsConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("unsupported broker %q (available: nats, tls, redis)", u.Scheme)
+	}
+	nc := &natsConn{
+		url:     u,
+		msgs:    make(chan natsMsg, natsMaxPending),
+		stopped: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	r, err := nc.connect()
+	if err != nil {
+		return nil, err
+	}
+	go nc.read(r)
+	return nc, nil
+}
+
+// connect establishes the connection, renewing the subscriptions, and returns its reader.
+func (nc *natsConn) connect() (*bufio.Reader, error) {
+	host := nc.url.Host
+	if nc.url.Port() == "" {
+		host = net.JoinHostPort(nc.url.Hostname(), natsPort)
+	}
+	conn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+
+	// The server greets with its INFO, upgrading the connection to TLS when either side
+	// requires it, then the client sends its CONNECT and a PING, whose PONG confirms that
+	// the connection is accepted.
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	line, err := natsReadLine(r)
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected NATS greeting: %q %v", line, err)
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("invalid NATS greeting: %v", err)
+	}
+	secure := info.TLSRequired || nc.url.Scheme == "tls"
+	if secure {
+		tc := tls.Client(conn, &tls.Config{ServerName: nc.url.Hostname()})
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn, r = tc, bufio.NewReader(tc)
+	}
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "facemask", "lang": "go", "tls_required": secure}
+	if u := nc.url.User; u != nil {
+		if pass, ok := u.Password(); ok {
+			options["user"], options["pass"] = u.Username(), pass
+		} else {
+			options["auth_token"] = u.Username()
+		}
+	}
+	data, err := json.Marshal(options)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := io.WriteString(conn, "CONNECT "+string(data)+"\r\nPING\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for {
+		line, err := natsReadLine(r)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, fmt.Errorf("NATS: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		if line == "PONG" {
+			break
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	for _, sub := range nc.subs {
+		if _, err := io.WriteString(conn, sub); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	select {
+	case <-nc.done:
+		conn.Close()
+		return nil, errNATSClosed
+	default:
+	}
+	nc.conn = conn
+	return r, nil
+}
+
+// read reads the connection until it's closed, reconnecting with a growing backoff when
+// it's lost.
+func (nc *natsConn) read(r *bufio.Reader) {
+	for {
+		err := nc.readMessages(r)
+		for backoff := time.Second; ; backoff *= 2 {
+			select {
+			case <-nc.done:
+				nc.stop(errNATSClosed)
+				return
+			default:
+			}
+			log.Printf("NATS connection lost: %v, reconnecting in %v", err, backoff)
+			select {
+			case <-nc.done:
+				nc.stop(errNATSClosed)
+				return
+			case <-time.After(backoff):
+			}
+			if r, err = nc.connect(); err == nil {
+				log.Printf("NATS connection reestablished")
+				break
+			}
+			if backoff > natsMaxBackoff/2 {
+				backoff = natsMaxBackoff / 2
+			}
+		}
+	}
+}
+
+// readMessages queues the messages of the subscriptions, answering the pings of the server
+// meanwhile, until the connection fails.
+func (nc *natsConn) readMessages(r *bufio.Reader) error {
+	for {
+		line, err := natsReadLine(r)
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PING":
+			if err := nc.write("PONG\r\n"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			// The fatal errors are followed by the server closing the connection.
+			log.Printf("NATS: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <size>
+			fields := strings.Fields(line)
+			if len(fields) != 4 && len(fields) != 5 {
+				return fmt.Errorf("invalid NATS message: %q", line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 {
+				return fmt.Errorf("invalid NATS message: %q", line)
+			}
+			msg := natsMsg{Subject: fields[1], Data: make([]byte, size+2)}
+			if len(fields) == 5 {
+				msg.Reply = fields[3]
+			}
+			if _, err := io.ReadFull(r, msg.Data); err != nil {
+				return err
+			}
+			msg.Data = msg.Data[:size]
+
+			select {
+			case nc.msgs <- msg:
+			case <-nc.done:
+				return errNATSClosed
+			}
+		}
+		// The +OK, the PONG and the INFO updates are ignored.
+	}
+}
+
+// stop records the error the reader stopped with.
+func (nc *natsConn) stop(err error) {
+	nc.err = err
+	close(nc.stopped)
+}
+
+// subscribe subscribes to the subject. The messages of a subject are distributed among the
+// subscribers of the same queue group, each message being delivered to one of them only.
+func (nc *natsConn) subscribe(subject, queue string, sid int) error {
+	sub := fmt.Sprintf("SUB %s %d\r\n", subject, sid)
+	if queue != "" {
+		sub = fmt.Sprintf("SUB %s %s %d\r\n", subject, queue, sid)
+	}
+	nc.mu.Lock()
+	nc.subs = append(nc.subs, sub)
+	nc.mu.Unlock()
+	return nc.write(sub)
+}
+
+// publish publishes the data to the subject.
+func (nc *natsConn) publish(subject string, data []byte) error {
+	return nc.write(fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(data), data))
+}
+
+// next returns the next message of the subscriptions, waiting for it while the connection
+// is reestablished. It only fails once the connection is closed.
+func (nc *natsConn) next() (natsMsg, error) {
+	select {
+	case msg := <-nc.msgs:
+		return msg, nil
+	case <-nc.stopped:
+		return natsMsg{}, nc.err
+	}
+}
+
+// natsReadLine reads the next protocol line, without the line ending.
+func natsReadLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			return "", errors.New("NATS connection closed by the server")
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (nc *natsConn) write(s string) error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	_, err := io.WriteString(nc.conn, s)
+	return err
+}
+
+// Close closes the connection.
+func (nc *natsConn) Close() error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	select {
+	case <-nc.done:
+		return nil
+	default:
+	}
+	close(nc.done)
+	return nc.conn.Close()
+}
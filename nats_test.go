@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// natsServer is a fake NATS server accepting the connections of the client under test.
+type natsServer struct {
+	t     *testing.T
+	ln    net.Listener
+	conns chan *natsPeer
+}
+
+// natsPeer is the server side of a client connection.
+type natsPeer struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newNATSServer(t *testing.T) *natsServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &natsServer{t: t, ln: ln, conns: make(chan *natsPeer, 4)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.conns <- &natsPeer{t: t, conn: conn, r: bufio.NewReader(conn)}
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *natsServer) url() string {
+	return "nats://" + s.ln.Addr().String()
+}
+
+// accept takes the next connection, greeting the client and accepting its CONNECT.
+func (s *natsServer) accept() *natsPeer {
+	s.t.Helper()
+	select {
+	case p := <-s.conns:
+		p.conn.SetDeadline(time.Now().Add(5 * time.Second))
+		p.send("INFO {\"server_id\":\"test\",\"max_payload\":1048576}\r\n")
+		if line := p.line(); !strings.HasPrefix(line, "CONNECT {") {
+			s.t.Fatalf("got %q, want the CONNECT", line)
+		}
+		p.expect("PING")
+		p.send("PONG\r\n")
+		return p
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("no connection")
+	}
+	return nil
+}
+
+func (p *natsPeer) send(s string) {
+	p.t.Helper()
+	if _, err := p.conn.Write([]byte(s)); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *natsPeer) line() string {
+	p.t.Helper()
+	line, err := p.r.ReadString('\n')
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+func (p *natsPeer) expect(want string) {
+	p.t.Helper()
+	if got := p.line(); got != want {
+		p.t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// dialTestNATS connects to the fake server, subscribing to images.in.
+func dialTestNATS(t *testing.T, s *natsServer) (*natsConn, *natsPeer) {
+	t.Helper()
+	type dialed struct {
+		nc  *natsConn
+		err error
+	}
+	done := make(chan dialed)
+	go func() {
+		nc, err := dialNATS(s.url())
+		done <- dialed{nc, err}
+	}()
+	p := s.accept()
+	d := <-done
+	if d.err != nil {
+		t.Fatal(d.err)
+	}
+	t.Cleanup(func() { d.nc.Close() })
+	if err := d.nc.subscribe("images.in", "facemask", 1); err != nil {
+		t.Fatal(err)
+	}
+	p.expect("SUB images.in facemask 1")
+	return d.nc, p
+}
+
+// nextMsg returns the next message, failing the test if none arrives in time.
+func nextMsg(t *testing.T, nc *natsConn) natsMsg {
+	t.Helper()
+	type received struct {
+		msg natsMsg
+		err error
+	}
+	done := make(chan received, 1)
+	go func() {
+		msg, err := nc.next()
+		done <- received{msg, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		return r.msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message")
+	}
+	return natsMsg{}
+}
+
+func TestNATSMessages(t *testing.T) {
+	nc, p := dialTestNATS(t, newNATSServer(t))
+
+	// The payloads are framed by their size, so they can hold line endings, and the
+	// messages can be split anywhere by the network.
+	p.send("MSG images.in 1 _INBOX.1 7\r\nab\r\ncde\r\n+OK\r\nMSG images.in 1 ")
+	p.send("3\r\nxyz\r\n")
+	if msg := nextMsg(t, nc); msg.Subject != "images.in" || msg.Reply != "_INBOX.1" || string(msg.Data) != "ab\r\ncde" {
+		t.Errorf("got %+v", msg)
+	}
+	if msg := nextMsg(t, nc); msg.Reply != "" || string(msg.Data) != "xyz" {
+		t.Errorf("got %+v", msg)
+	}
+
+	p.send("PING\r\n")
+	p.expect("PONG")
+
+	if err := nc.publish("images.out", []byte("done\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	p.expect("PUB images.out 6")
+	p.expect("done")
+	p.expect("")
+}
+
+func TestNATSInvalidMessage(t *testing.T) {
+	s := newNATSServer(t)
+	nc, p := dialTestNATS(t, s)
+
+	// The invalid frames drop the connection, which is reestablished.
+	p.send("MSG images.in 1 x\r\n")
+	p = s.accept()
+	p.expect("SUB images.in facemask 1")
+	p.send("MSG images.in 1 2\r\nok\r\n")
+	if msg := nextMsg(t, nc); string(msg.Data) != "ok" {
+		t.Errorf("got %+v", msg)
+	}
+}
+
+func TestNATSReconnect(t *testing.T) {
+	s := newNATSServer(t)
+	nc, p := dialTestNATS(t, s)
+
+	p.conn.Close()
+	p = s.accept()
+	p.expect("SUB images.in facemask 1")
+	p.send("MSG images.in 1 5\r\nagain\r\n")
+	if msg := nextMsg(t, nc); string(msg.Data) != "again" {
+		t.Errorf("got %+v", msg)
+	}
+
+	nc.Close()
+	if _, err := nc.next(); err != errNATSClosed {
+		t.Errorf("got %v, want %v", err, errNATSClosed)
+	}
+}
+
+func TestNATSPendingLimit(t *testing.T) {
+	nc, p := dialTestNATS(t, newNATSServer(t))
+
+	// Two messages over the limit: the first one waits for room in the queue, and the
+	// second one and the ping aren't read meanwhile.
+	for i := 0; i < natsMaxPending+2; i++ {
+		p.send("MSG images.in 1 1\r\nx\r\n")
+	}
+	p.send("PING\r\n")
+
+	p.conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if line, err := p.r.ReadString('\n'); err == nil {
+		t.Fatalf("got %q while the queue is full", line)
+	}
+	p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 3; i++ {
+		nextMsg(t, nc)
+	}
+	p.expect("PONG")
+	if n := len(nc.msgs); n != natsMaxPending-1 {
+		t.Errorf("%d messages queued, want %d", n, natsMaxPending-1)
+	}
+}
+
+func TestNATSConnectError(t *testing.T) {
+	s := newNATSServer(t)
+	done := make(chan error)
+	go func() {
+		_, err := dialNATS(strings.Replace(s.url(), "nats://", "nats://user:secret@", 1))
+		done <- err
+	}()
+	p := <-s.conns
+	p.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	p.send("INFO {}\r\n")
+	if line := p.line(); !strings.Contains(line, `"user":"user"`) || !strings.Contains(line, `"pass":"secret"`) {
+		t.Errorf("got %q, want the credentials", line)
+	}
+	p.expect("PING")
+	p.send("-ERR 'Authorization Violation'\r\n")
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Errorf("got %v, want the authorization error", err)
+	}
+}
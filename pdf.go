@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// pdfQuality is the JPEG quality of the page images of the PDF output.
+const pdfQuality = 90
+
+// isPDF reports whether the file is a PDF document, based on its extension.
+func isPDF(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == ".pdf"
+}
+
+// processPDF rasterizes the pages of the PDF document, masks the faces on every page
+// and writes the pages into a new PDF document at the resolved output path. The output
+// contains only the page images, so neither the text nor the original photos of the
+// document survive the redaction. The reports of the pages are returned.
+func processPDF(fd *facemask.Detector, renderer facemask.Renderer, source string, out output, dpi int) ([]facemask.Report, string, error) {
+	dir, err := ioutil.TempDir("", "facemask")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.RemoveAll(dir)
+
+	pages, err := rasterizePDF(source, dir, dpi)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The document is written into a temporary file first, since the output path
+	// may depend on the number of faces found on all the pages.
+	tmp, err := os.Create(filepath.Join(dir, "out.pdf"))
+	if err != nil {
+		return nil, "", err
+	}
+	defer tmp.Close()
+
+	var (
+		reports []facemask.Report
+		faces   int
+	)
+	pw := newPDFWriter(tmp)
+	for i, page := range pages {
+		dets, err := fd.DetectFaces(page)
+		if err != nil {
+			return nil, "", fmt.Errorf("page %d: detection error: %v", i+1, err)
+		}
+		infos := fd.LocalizeFaces(dets)
+		if err := fd.Render(infos, renderer); err != nil {
+			return nil, "", fmt.Errorf("page %d: error rendering the overlays: %v", i+1, err)
+		}
+		if err := pw.addPage(fd.Image(), dpi); err != nil {
+			return nil, "", err
+		}
+		reports = append(reports, facemask.NewReport(fmt.Sprintf("%s#page=%d", source, i+1), infos))
+		faces += len(infos)
+	}
+	if err := pw.close(); err != nil {
+		return nil, "", err
+	}
+
+	destination, err := out.resolve(source, faces)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := copyOutput(destination, tmp); err != nil {
+		return nil, "", fmt.Errorf("error creating the document output: %v", err)
+	}
+	return reports, destination, nil
+}
+
+// rasterizePDF renders the pages of the PDF document as PNG images into the directory
+// with pdftoppm of the Poppler utilities, returning the page images in page order.
+func rasterizePDF(source, dir string, dpi int) ([]string, error) {
+	cmd := exec.Command("pdftoppm", "-r", strconv.Itoa(dpi), "-png", source, filepath.Join(dir, "page"))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.Error); ok {
+			return nil, fmt.Errorf("rasterizing the PDF pages requires pdftoppm (poppler-utils): %v", err)
+		}
+		return nil, fmt.Errorf("error rasterizing the PDF pages: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	// The page numbers are zero padded to the same width, so the names sort in page order.
+	pages, err := filepath.Glob(filepath.Join(dir, "page-*.png"))
+	if err != nil {
+		return nil, err
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("the PDF document has no pages")
+	}
+	sort.Strings(pages)
+	return pages, nil
+}
+
+// pdfWriter writes a PDF document made of full page JPEG images. The pages are written
+// as soon as they are added, so only the object offsets are kept in memory.
+type pdfWriter struct {
+	w       *bufio.Writer
+	n       int64
+	offsets []int64
+	pages   []int
+	err     error
+}
+
+// The catalog and the page tree are the first two objects, written at the end.
+const (
+	pdfCatalog = 1
+	pdfPages   = 2
+)
+
+func newPDFWriter(w io.Writer) *pdfWriter {
+	pw := &pdfWriter{w: bufio.NewWriter(w), offsets: make([]int64, 2)}
+	// The binary comment marks the file as binary for the transfer tools.
+	pw.printf("%%PDF-1.4\n%%\xe2\xe3\xcf\xd3\n")
+	return pw
+}
+
+func (pw *pdfWriter) printf(format string, args ...interface{}) {
+	if pw.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(pw.w, format, args...)
+	pw.n += int64(n)
+	pw.err = err
+}
+
+func (pw *pdfWriter) write(data []byte) {
+	if pw.err != nil {
+		return
+	}
+	n, err := pw.w.Write(data)
+	pw.n += int64(n)
+	pw.err = err
+}
+
+// object starts the object with the number, or with the next free number when it's zero.
+func (pw *pdfWriter) object(num int) int {
+	if num == 0 {
+		pw.offsets = append(pw.offsets, 0)
+		num = len(pw.offsets)
+	}
+	pw.offsets[num-1] = pw.n
+	pw.printf("%d 0 obj\n", num)
+	return num
+}
+
+// addPage adds the image as a page sized by the image resolution in dots per inch.
+func (pw *pdfWriter) addPage(img image.Image, dpi int) error {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: pdfQuality}); err != nil {
+		return err
+	}
+	b := img.Bounds()
+	width := float64(b.Dx()) * 72 / float64(dpi)
+	height := float64(b.Dy()) * 72 / float64(dpi)
+
+	im := pw.object(0)
+	pw.printf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>\nstream\n",
+		b.Dx(), b.Dy(), buf.Len())
+	pw.write(buf.Bytes())
+	pw.printf("\nendstream\nendobj\n")
+
+	content := fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q", width, height)
+	cs := pw.object(0)
+	pw.printf("<< /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(content), content)
+
+	page := pw.object(0)
+	pw.printf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>\nendobj\n",
+		pdfPages, width, height, im, cs)
+	pw.pages = append(pw.pages, page)
+	return pw.err
+}
+
+// close writes the page tree, the catalog and the cross-reference table.
+func (pw *pdfWriter) close() error {
+	pw.object(pdfPages)
+	kids := make([]string, len(pw.pages))
+	for i, page := range pw.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", page)
+	}
+	pw.printf("<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(kids, " "), len(pw.pages))
+	pw.object(pdfCatalog)
+	pw.printf("<< /Type /Catalog /Pages %d 0 R >>\nendobj\n", pdfPages)
+
+	xref := pw.n
+	pw.printf("xref\n0 %d\n0000000000 65535 f \n", len(pw.offsets)+1)
+	for _, off := range pw.offsets {
+		pw.printf("%010d 00000 n \n", off)
+	}
+	pw.printf("trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(pw.offsets)+1, pdfCatalog, xref)
+	if pw.err != nil {
+		return pw.err
+	}
+	return pw.w.Flush()
+}
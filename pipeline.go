@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// maxTransforms is the largest number of the mask placements composited over an image.
+const maxTransforms = 1000
+
+// detectResult is the response of the /detect endpoint.
+type detectResult struct {
+	Width  int             `json:"width"`
+	Height int             `json:"height"`
+	Faces  []facemask.Face `json:"faces"`
+}
+
+// handleDetect returns the faces of the posted image as JSON, with their landmark points and
+// the placement of the mask, without rendering the overlays. Together with /composite it
+// splits the pipeline, so the clients can adjust the placements in an editor before compositing.
+func (s *server) handleDetect(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, cfgErr := s.requestConfig(r.URL.Query())
+	rec, fail := s.newRecord(w, r, start, cfg)
+	defer s.writeRecord(rec, start)
+	if cfgErr != nil {
+		fail(http.StatusBadRequest, cfgErr)
+		return
+	}
+	data, status, err := s.readImage(w, r)
+	if data != nil {
+		sum := sha256.Sum256(data)
+		rec.Source, rec.Size = hex.EncodeToString(sum[:]), len(data)
+	}
+	if err != nil {
+		fail(status, err)
+		return
+	}
+
+	sp := spanFrom(r.Context())
+	pd := s.detector(cfg)
+	defer func() { s.detectors <- pd }()
+	fd := pd.fd
+	fd.Hooks.OnStage = sp.stageHook()
+
+	dets, err := fd.DetectReader(bytes.NewReader(data))
+	if err != nil {
+		fail(http.StatusUnprocessableEntity, fmt.Errorf("detection error: %v", err))
+		return
+	}
+	// The mask placements are computed for the mask renderer of the configuration.
+	fd.Overlay = cfg.renderer
+	faces, err := fd.Faces(fd.LocalizeFaces(dets))
+	if err != nil {
+		fail(http.StatusInternalServerError, fmt.Errorf("error placing the masks: %v", err))
+		return
+	}
+	rec.Faces = len(faces)
+	bounds := fd.Image().Bounds()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Faces", strconv.Itoa(len(faces)))
+	sp.setAttr(intAttr("facemask.faces", len(faces)))
+	json.NewEncoder(w).Encode(detectResult{Width: bounds.Dx(), Height: bounds.Dy(), Faces: faces})
+	log.Printf("%s %s %s %s: %d faces in %v", rec.RequestID, rec.Client, r.Method, r.URL.Path, len(faces), time.Since(start).Round(time.Millisecond))
+}
+
+// handleComposite draws the mask at the placements provided by the client over the image,
+// posted as multipart/form-data with the image in the image field and the JSON array of the
+// mask placements, in the format of /detect, in the transforms field. The result is in the
+// format of the upload for the PNG images and JPEG otherwise.
+func (s *server) handleComposite(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, cfgErr := s.requestConfig(r.URL.Query())
+	rec, fail := s.newRecord(w, r, start, cfg)
+	defer s.writeRecord(rec, start)
+	if cfgErr != nil {
+		fail(http.StatusBadRequest, cfgErr)
+		return
+	}
+	mr, ok := cfg.renderer.(*facemask.MaskRenderer)
+	if !ok {
+		fail(http.StatusBadRequest, errors.New("compositing requires the mask mode with a single mask image"))
+		return
+	}
+	data, transforms, status, err := s.readComposite(w, r)
+	if data != nil {
+		sum := sha256.Sum256(data)
+		rec.Source, rec.Size = hex.EncodeToString(sum[:]), len(data)
+	}
+	if err != nil {
+		fail(status, err)
+		return
+	}
+
+	sp := spanFrom(r.Context())
+	pd := s.detector(cfg)
+	defer func() { s.detectors <- pd }()
+	fd := pd.fd
+	fd.Hooks.OnStage = sp.stageHook()
+
+	if err := fd.LoadReader(bytes.NewReader(data)); err != nil {
+		fail(http.StatusUnprocessableEntity, fmt.Errorf("error decoding the image: %v", err))
+		return
+	}
+	if err := facemask.CheckTransforms(transforms, fd.Image().Bounds()); err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	rec.Faces = len(transforms)
+	compositeStart := time.Now()
+	for _, t := range transforms {
+		if err = mr.RenderTransform(fd.Canvas(), t); err != nil {
+			break
+		}
+	}
+	if fd.Hooks.OnStage != nil {
+		fd.Hooks.OnStage(facemask.StageComposite, compositeStart, err)
+	}
+	if err != nil {
+		fail(http.StatusInternalServerError, fmt.Errorf("error rendering the overlays: %v", err))
+		return
+	}
+
+	format := imageFormat(data)
+	var buf bytes.Buffer
+	if err := fd.OverlayTo(&buf, format); err != nil {
+		fail(http.StatusInternalServerError, fmt.Errorf("error encoding the image: %v", err))
+		return
+	}
+	s.audit.addThumbnail(rec, fd.Image())
+	w.Header().Set("Content-Type", "image/"+format.String())
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("X-Faces", strconv.Itoa(len(transforms)))
+	sp.setAttr(intAttr("facemask.faces", len(transforms)))
+	w.Write(buf.Bytes())
+	log.Printf("%s %s %s %s: %d masks in %v", rec.RequestID, rec.Client, r.Method, r.URL.Path, len(transforms), time.Since(start).Round(time.Millisecond))
+}
+
+// readComposite reads the image and the mask placements of the multipart form, rejecting the
+// too large uploads and images, and the unsupported formats, with the status of the response.
+func (s *server) readComposite(w http.ResponseWriter, r *http.Request) ([]byte, []facemask.MaskTransform, int, error) {
+	// The form can hold the placements besides the image.
+	limit := s.maxSize + 1<<20
+	if r.ContentLength > limit {
+		return nil, nil, http.StatusRequestEntityTooLarge, fmt.Errorf("the image exceeds %d MB", s.maxSize>>20)
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		return nil, nil, http.StatusBadRequest, fmt.Errorf("invalid form: %v", err)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	f, _, err := r.FormFile("image")
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, fmt.Errorf("missing image: %v", err)
+	}
+	defer f.Close()
+	data, status, err := s.readSource(facemask.ReaderSource{Label: "image", Reader: f}, s.maxSize)
+	if err != nil {
+		return nil, nil, status, err
+	}
+	transforms, err := facemask.ParseTransforms([]byte(r.PostFormValue("transforms")), maxTransforms)
+	if err != nil {
+		return data, nil, http.StatusBadRequest, fmt.Errorf("invalid transforms: %v", err)
+	}
+	return data, transforms, http.StatusOK, nil
+}
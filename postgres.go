@@ -0,0 +1,7 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+// The PostgreSQL driver of the -events database.
+import _ "github.com/lib/pq"
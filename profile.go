@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// startProfiling starts the CPU profiling and the execution tracing when their output
+// files are provided. The returned function stops them and writes the heap profile.
+func startProfiling(cpuProfile, memProfile, traceFile string) func() {
+	var stops []func()
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			log.Fatalf("Error creating the CPU profile: %v", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			log.Fatalf("Error starting the CPU profile: %v", err)
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		})
+	}
+	if traceFile != "" {
+		f, err := os.Create(traceFile)
+		if err != nil {
+			log.Fatalf("Error creating the trace file: %v", err)
+		}
+		if err := trace.Start(f); err != nil {
+			log.Fatalf("Error starting the trace: %v", err)
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			f.Close()
+		})
+	}
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+		if memProfile == "" {
+			return
+		}
+		f, err := os.Create(memProfile)
+		if err != nil {
+			log.Fatalf("Error creating the memory profile: %v", err)
+		}
+		defer f.Close()
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			log.Fatalf("Error writing the memory profile: %v", err)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// queueBatch is the number of the jobs pushed to Redis at once.
+const queueBatch = 100
+
+// queueCommand distributes the images of a directory among the Redis workers: it pushes a
+// job per image to the Redis list consumed by the workers, then collects their results and
+// aggregates the progress. The source and the output directories have to be shared by the
+// workers, which are started with them as their -in and -out directories: the jobs give the
+// paths relative to them.
+func queueCommand(args []string) {
+	fs := flag.NewFlagSet("queue", flag.ExitOnError)
+	flags := queueFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: facemask queue -redis redis://localhost:6379 -in photos/ -out masked/\n\n")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if len(*flags.source) == 0 || len(*flags.destination) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	root, err := filepath.Abs(*flags.source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dir, err := filepath.Abs(*flags.destination)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sources, err := listImages(root, *flags.recursive, splitPatterns(*flags.include), splitPatterns(*flags.exclude))
+	if err != nil {
+		log.Fatalf("Error reading the source directory: %v", err)
+	}
+	if len(sources) == 0 {
+		log.Fatal("No images found in the source directory")
+	}
+
+	rc, err := dialRedis(*flags.redisURL)
+	if err != nil {
+		log.Fatalf("Error connecting to Redis: %v", err)
+	}
+	defer rc.Close()
+
+	// The results of the run are pushed by the workers to a list of its own.
+	results := fmt.Sprintf("facemask:results:%d", time.Now().UnixNano())
+	out := output{template: defaultOutTemplate, dir: dir, root: root}
+	jobs := make([]string, len(sources))
+	for i, src := range sources {
+		dest, err := out.resolve(src, 0)
+		if err != nil {
+			log.Fatalf("%s: %v", src, err)
+		}
+		// The workers resolve the paths in their own -in and -out directories.
+		job := workerJob{ID: strconv.Itoa(i), Source: relPath(root, src), Output: relPath(dir, dest), Reply: results}
+		data, err := json.Marshal(job)
+		if err != nil {
+			log.Fatal(err)
+		}
+		jobs[i] = string(data)
+		if (i+1)%queueBatch == 0 || i == len(sources)-1 {
+			if err := rc.push(*flags.list, jobs[i/queueBatch*queueBatch:i+1]...); err != nil {
+				log.Fatalf("Error queueing the jobs: %v", err)
+			}
+		}
+	}
+
+	// The results are collected by the job ID, so the report keeps the order of the files,
+	// and the jobs requeued after their worker was presumed dead are counted once. While no
+	// result comes, the jobs of the dead workers are requeued.
+	start, last := time.Now(), time.Now()
+	var (
+		received  = make([]bool, len(sources))
+		completed = make([]*facemask.Report, len(sources))
+		reports   []facemask.Report
+		failures  []batchError
+		faces     int
+		done      int
+	)
+	for done < len(sources) {
+		fmt.Fprintf(os.Stderr, "\rProcessed %d/%d files, %d failed", done, len(sources), len(failures))
+		data, err := rc.pop(results, redisPoll)
+		if err == errRedisNil {
+			if _, err := rc.requeue(*flags.list); err != nil {
+				log.Fatalf("\nError requeueing the expired jobs: %v", err)
+			}
+			if *flags.timeout > 0 && time.Since(last) > *flags.timeout {
+				break
+			}
+			continue
+		}
+		if err != nil {
+			log.Fatalf("\nError receiving the results: %v", err)
+		}
+		last = time.Now()
+		var result workerResult
+		if err := json.Unmarshal([]byte(data), &result); err != nil {
+			log.Fatalf("\nInvalid result: %v", err)
+		}
+		i, err := strconv.Atoi(result.ID)
+		if err != nil || i < 0 || i >= len(sources) || received[i] {
+			continue
+		}
+		received[i] = true
+		done++
+		result.Source = sources[i]
+		if result.Error != "" {
+			failures = append(failures, batchError{Source: result.Source, Error: result.Error})
+			continue
+		}
+		completed[i] = &facemask.Report{Source: result.Source, Faces: result.Faces}
+		faces += len(result.Faces)
+	}
+	fmt.Fprintf(os.Stderr, "\rProcessed %d/%d files, %d failed\n", done, len(sources), len(failures))
+
+	// The jobs without a result are withdrawn from the queue, unless a worker has them already.
+	for i, ok := range received {
+		if ok {
+			continue
+		}
+		if _, err := rc.do("LREM", *flags.list, "0", jobs[i]); err != nil {
+			log.Printf("Error withdrawing the job of %s: %v", sources[i], err)
+		}
+		failures = append(failures, batchError{Source: sources[i], Error: fmt.Sprintf("no result from the workers in %v", *flags.timeout)})
+	}
+	for _, r := range completed {
+		if r != nil {
+			reports = append(reports, *r)
+		}
+	}
+	// The results of the jobs still leased by the workers may be pushed later, which the
+	// workers expire with the list.
+	if _, err := rc.do("DEL", results); err != nil {
+		log.Printf("Error removing the results list %s: %v", results, err)
+	}
+
+	if *flags.reportFile != "" {
+		if err := writeReport(*flags.reportFile, reports); err != nil {
+			log.Fatalf("Error writing the report: %v", err)
+		}
+	}
+	if *flags.errorReport != "" {
+		if err := writeErrorReport(*flags.errorReport, failures); err != nil {
+			log.Fatalf("Error writing the error report: %v", err)
+		}
+	}
+	fmt.Printf("Done in: \x1b[92m%.2fs\x1b[0m, %d faces\n", time.Since(start).Seconds(), faces)
+	for _, f := range failures {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", f.Source, f.Error)
+	}
+	if len(failures) > 0 {
+		os.Exit(1)
+	}
+}
+
+// queueSettings are the settings of the flags of the queue command.
+type queueSettings struct {
+	redisURL    *string
+	list        *string
+	source      *string
+	destination *string
+	recursive   *bool
+	include     *string
+	exclude     *string
+	reportFile  *string
+	errorReport *string
+	timeout     *time.Duration
+}
+
+// queueFlags defines the flags of the queue command.
+func queueFlags(fs *flag.FlagSet) *queueSettings {
+	return &queueSettings{
+		redisURL:    fs.String("redis", "redis://localhost:6379", "Redis URL, redis://[:password@]host[:port][/db]"),
+		list:        fs.String("queue", "images.in", "Redis list of the jobs, the -subject of the workers"),
+		source:      fs.String("in", "", "Source directory of images, the -in directory of the workers"),
+		destination: fs.String("out", "", "Output directory, the -out directory of the workers"),
+		recursive:   fs.Bool("recursive", false, "Process the subdirectories of the source directory too"),
+		include:     fs.String("include", "", "Comma separated file patterns processed, e.g. *.jpg,*.png"),
+		exclude:     fs.String("exclude", "", "Comma separated file patterns skipped, e.g. **/thumbs/**"),
+		reportFile:  fs.String("report", "", "JSON report of the processed faces"),
+		errorReport: fs.String("error-report", "", "JSON report of the failed files"),
+		timeout:     fs.Duration("timeout", 10*time.Minute, "Longest wait for the next result of the workers, after which the missing files are reported as failed"),
+	}
+}
+
+// relPath returns the path of the file relative to the directory, with forward slashes, so
+// the workers running on the other systems can resolve it too.
+func relPath(dir, file string) string {
+	rel, err := filepath.Rel(dir, file)
+	if err != nil {
+		return file
+	}
+	return filepath.ToSlash(rel)
+}
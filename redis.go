@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisPort is the default port of the Redis servers.
+const redisPort = "6379"
+
+// redisLeaseGrace is the lease of the jobs taken by a worker which died before leasing them.
+const redisLeaseGrace = time.Minute
+
+// redisConn is a minimal client of the Redis protocol (RESP), sending the commands
+// one at a time, which is all the job queue needs. TLS is not supported.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// errRedisNil is the reply of the missing keys and of the timed out blocking commands.
+var errRedisNil = errors.New("redis: nil")
+
+// dialRedis connects to the Redis server of the URL, redis://[[user]:password@]host[:port][/db].
+func dialRedis(rawurl string) (*redisConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported Redis URL %q", rawurl)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), redisPort)
+	}
+	conn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if u.User != nil {
+		args := []string{"AUTH"}
+		if pass, ok := u.User.Password(); ok {
+			if u.User.Username() != "" {
+				args = append(args, u.User.Username())
+			}
+			args = append(args, pass)
+		} else {
+			args = append(args, u.User.Username())
+		}
+		if _, err := rc.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err := rc.do("SELECT", db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do sends the command and returns its reply: a string, an integer, or a slice of the replies.
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return rc.reply()
+}
+
+// reply reads the next reply.
+func (rc *redisConn) reply() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid reply %q", line)
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid reply %q", line)
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = rc.reply(); err != nil && err != errRedisNil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: invalid reply %q", line)
+}
+
+// pop removes and returns the first item of the list, blocking until there's one or the
+// timeout elapses, which returns errRedisNil.
+func (rc *redisConn) pop(key string, timeout time.Duration) (string, error) {
+	r, err := rc.do("BLPOP", key, redisSeconds(timeout))
+	if err != nil {
+		return "", err
+	}
+	items, ok := r.([]interface{})
+	if !ok || len(items) != 2 {
+		return "", fmt.Errorf("redis: unexpected BLPOP reply %v", r)
+	}
+	item, _ := items[1].(string)
+	return item, nil
+}
+
+// take moves the first job of the list into the processing list of the jobs, leasing it for
+// the visibility timeout, and returns it. It blocks until there's a job or the wait elapses,
+// which returns errRedisNil. The job stays in the processing list until it's acknowledged
+// by ack, so the jobs of the dead workers are requeued once their lease expires.
+func (rc *redisConn) take(key string, visibility, wait time.Duration) (string, error) {
+	r, err := rc.do("BLMOVE", key, redisProcessing(key), "LEFT", "RIGHT", redisSeconds(wait))
+	if err != nil {
+		return "", err
+	}
+	job, ok := r.(string)
+	if !ok {
+		return "", fmt.Errorf("redis: unexpected BLMOVE reply %v", r)
+	}
+	deadline := time.Now().Add(visibility).Unix()
+	_, err = rc.do("HSET", redisLeases(key), job, strconv.FormatInt(deadline, 10))
+	return job, err
+}
+
+// ack removes the processed job from the processing list of the jobs.
+func (rc *redisConn) ack(key, job string) error {
+	if _, err := rc.do("LREM", redisProcessing(key), "1", job); err != nil {
+		return err
+	}
+	_, err := rc.do("HDEL", redisLeases(key), job)
+	return err
+}
+
+// requeue moves the jobs of the processing list whose lease has expired back to the front
+// of the list, and returns their number. The jobs taken by a worker which died before
+// leasing them are leased for redisLeaseGrace first.
+func (rc *redisConn) requeue(key string) (int, error) {
+	r, err := rc.do("LRANGE", redisProcessing(key), "0", "-1")
+	if err != nil {
+		return 0, err
+	}
+	items, _ := r.([]interface{})
+	now, n := time.Now(), 0
+	for _, item := range items {
+		job, _ := item.(string)
+		r, err := rc.do("HGET", redisLeases(key), job)
+		if err == errRedisNil {
+			deadline := now.Add(redisLeaseGrace).Unix()
+			if _, err := rc.do("HSETNX", redisLeases(key), job, strconv.FormatInt(deadline, 10)); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		lease, _ := r.(string)
+		deadline, _ := strconv.ParseInt(lease, 10, 64)
+		if now.Unix() < deadline {
+			continue
+		}
+		// Only the requeue removing the job pushes it back, whoever else requeues concurrently.
+		r, err = rc.do("LREM", redisProcessing(key), "1", job)
+		if err != nil {
+			return n, err
+		}
+		if removed, _ := r.(int64); removed == 0 {
+			continue
+		}
+		if _, err := rc.do("HDEL", redisLeases(key), job); err != nil {
+			return n, err
+		}
+		if _, err := rc.do("LPUSH", key, job); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// redisProcessing and redisLeases are the keys of the processing list of the jobs of the
+// list and of the hash of their lease deadlines, in Unix seconds.
+func redisProcessing(key string) string { return key + ":processing" }
+func redisLeases(key string) string     { return key + ":leases" }
+
+// redisSeconds formats the timeout of the blocking commands, in seconds.
+func redisSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// push appends the items to the list.
+func (rc *redisConn) push(key string, items ...string) error {
+	_, err := rc.do(append([]string{"RPUSH", key}, items...)...)
+	return err
+}
+
+// expire sets the time to live of the key, rounded down to seconds.
+func (rc *redisConn) expire(key string, ttl time.Duration) error {
+	_, err := rc.do("EXPIRE", key, strconv.FormatInt(int64(ttl/time.Second), 10))
+	return err
+}
+
+// Close closes the connection.
+func (rc *redisConn) Close() error {
+	return rc.conn.Close()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRedisReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  interface{}
+		err   string
+	}{
+		{name: "status", reply: "+OK\r\n", want: "OK"},
+		{name: "integer", reply: ":-42\r\n", want: int64(-42)},
+		{name: "bulk", reply: "$7\r\nab\r\ncde\r\n", want: "ab\r\ncde"},
+		{name: "empty bulk", reply: "$0\r\n\r\n", want: ""},
+		{name: "nil bulk", reply: "$-1\r\n", err: errRedisNil.Error()},
+		{name: "array", reply: "*3\r\n$1\r\na\r\n:1\r\n$-1\r\n", want: []interface{}{"a", int64(1), nil}},
+		{name: "nested array", reply: "*1\r\n*1\r\n+x\r\n", want: []interface{}{[]interface{}{"x"}}},
+		{name: "nil array", reply: "*-1\r\n", err: errRedisNil.Error()},
+		{name: "error", reply: "-WRONGTYPE Operation against a key\r\n", err: "redis: WRONGTYPE Operation against a key"},
+		{name: "invalid", reply: "?\r\n", err: `redis: invalid reply "?"`},
+		{name: "invalid size", reply: "$x\r\n", err: `redis: invalid reply "$x"`},
+		{name: "truncated bulk", reply: "$5\r\nab", err: "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := &redisConn{r: bufio.NewReader(strings.NewReader(tt.reply))}
+			got, err := rc.reply()
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got %v, %v, want the error %q", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// redisServer is a fake Redis server answering the commands of a single connection with
+// the replies of the handler.
+func redisServer(t *testing.T, handle func(cmd []string) string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			cmd, err := readRedisCommand(r)
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(handle(cmd)))
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// readRedisCommand reads a command, an array of bulk strings.
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	rc := &redisConn{r: r}
+	reply, err := rc.reply()
+	if err != nil {
+		return nil, err
+	}
+	items, _ := reply.([]interface{})
+	cmd := make([]string, len(items))
+	for i, item := range items {
+		cmd[i], _ = item.(string)
+	}
+	return cmd, nil
+}
+
+func TestRedisCommands(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got [][]string
+	)
+	addr := redisServer(t, func(cmd []string) string {
+		mu.Lock()
+		got = append(got, cmd)
+		mu.Unlock()
+		switch cmd[0] {
+		case "BLMOVE":
+			return "$6\r\njob\r\n1\r\n"
+		case "HSET", "RPUSH", "EXPIRE":
+			return ":1\r\n"
+		case "BLPOP":
+			return "*-1\r\n"
+		}
+		return "+OK\r\n"
+	})
+	rc, err := dialRedis("redis://:secret@" + addr + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	job, err := rc.take("images.in", 0, 0)
+	if err != nil || job != "job\r\n1" {
+		t.Errorf("took %q, %v", job, err)
+	}
+	if err := rc.push("images.out", "a b", ""); err != nil {
+		t.Error(err)
+	}
+	if err := rc.expire("images.out", 90*time.Minute+time.Millisecond); err != nil {
+		t.Error(err)
+	}
+	if _, err := rc.pop("images.out", 1500*time.Millisecond); err != errRedisNil {
+		t.Errorf("got %v, want %v", err, errRedisNil)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 7 {
+		t.Fatalf("sent %q", got)
+	}
+	want := [][]string{
+		{"AUTH", "secret"},
+		{"SELECT", "2"},
+		{"BLMOVE", "images.in", "images.in:processing", "LEFT", "RIGHT", "0"},
+		{"HSET", "images.in:leases", "job\r\n1", got[3][3]},
+		{"RPUSH", "images.out", "a b", ""},
+		{"EXPIRE", "images.out", "5400"},
+		{"BLPOP", "images.out", "1.5"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	if _, err := strconv.ParseInt(got[3][3], 10, 64); err != nil {
+		t.Errorf("invalid lease deadline %q", got[3][3])
+	}
+}
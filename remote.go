@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// maxPackSize is the maximum size of the downloaded mask packs and of their extracted files.
+const maxPackSize = 64 << 20
+
+// packClient downloads the remote mask packs.
+var packClient = &http.Client{Timeout: time.Minute}
+
+// isRemoteMask reports whether the mask path is the URL of a remote mask pack.
+func isRemoteMask(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// fetchMaskPack downloads the zip archive of the mask pack, verifies its SHA-256 checksum and
+// extracts it into the user cache directory, returning the directory of the manifest. When the
+// checksum is not provided, it's read from the <url>.sha256 file published next to the pack.
+// The packs are cached by their checksum, so a pack is downloaded only once.
+func fetchMaskPack(url, checksum string) (string, error) {
+	if checksum == "" {
+		var err error
+		if checksum, err = fetchChecksum(url + ".sha256"); err != nil {
+			return "", fmt.Errorf("the checksum of the mask pack is required, provide it with -mask-sha256: %v", err)
+		}
+	}
+	checksum = strings.ToLower(strings.TrimSpace(checksum))
+	if b, err := hex.DecodeString(checksum); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 checksum: %v", checksum)
+	}
+
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	packs := filepath.Join(cache, "facemask", "packs")
+	dir := filepath.Join(packs, checksum)
+	if _, err := os.Stat(dir); err == nil {
+		return packRoot(dir)
+	}
+	if err := os.MkdirAll(packs, 0755); err != nil {
+		return "", err
+	}
+
+	archive, err := ioutil.TempFile(packs, "download")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	resp, err := packClient.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error downloading the mask pack: %s", resp.Status)
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(archive, h), io.LimitReader(resp.Body, maxPackSize+1))
+	if err != nil {
+		return "", err
+	}
+	if n > maxPackSize {
+		return "", fmt.Errorf("the mask pack exceeds %d MB", maxPackSize>>20)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != checksum {
+		return "", fmt.Errorf("checksum mismatch of the mask pack: expected %s, got %s", checksum, sum)
+	}
+
+	// The pack is extracted next to its final location, then moved in place,
+	// so an interrupted extraction doesn't leave an incomplete pack in the cache.
+	tmp, err := ioutil.TempDir(packs, "extract")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if err := extractZip(archive.Name(), tmp); err != nil {
+		return "", fmt.Errorf("error extracting the mask pack: %v", err)
+	}
+	if _, err := packRoot(tmp); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		// Another process may have cached the same pack meanwhile.
+		if _, serr := os.Stat(dir); serr != nil {
+			return "", err
+		}
+	}
+	return packRoot(dir)
+}
+
+// fetchChecksum downloads the checksum file, in the format of sha256sum: the hex digest
+// optionally followed by the file name.
+func fetchChecksum(url string) (string, error) {
+	resp, err := packClient.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("%s: empty checksum file", url)
+	}
+	return fields[0], nil
+}
+
+// extractZip extracts the regular files of the zip archive into the directory.
+// The entries pointing outside of the directory are rejected.
+func extractZip(path, dir string) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var total uint64
+	for _, f := range r.File {
+		dst := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if !strings.HasPrefix(dst, filepath.Clean(dir)+string(filepath.Separator)) {
+			return fmt.Errorf("invalid file name: %s", f.Name)
+		}
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if total += f.UncompressedSize64; total > maxPackSize {
+			return fmt.Errorf("the extracted mask pack exceeds %d MB", maxPackSize>>20)
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := extractFile(f, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractFile writes the content of the zip archive file into dst.
+func extractFile(f *zip.File, dst string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, io.LimitReader(rc, int64(f.UncompressedSize64))); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// packRoot returns the directory of the manifest of the extracted mask pack: the pack
+// directory itself, or its single subdirectory in case the archive wraps the pack in one.
+func packRoot(dir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, facemask.ManifestFile)); err == nil {
+		return dir, nil
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		sub := filepath.Join(dir, entries[0].Name())
+		if _, err := os.Stat(filepath.Join(sub, facemask.ManifestFile)); err == nil {
+			return sub, nil
+		}
+	}
+	return "", errors.New("the mask pack contains no " + facemask.ManifestFile)
+}
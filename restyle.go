@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// restyleCommand renders the overlays over the faces cached by a previous run with -cache,
+// over a whole directory, without running the detection again: only the compositing and
+// the encoding are performed, so trying out another mask or overlay mode is fast.
+func restyleCommand(args []string) {
+	fs := flag.NewFlagSet("restyle", flag.ExitOnError)
+	flags := restyleFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: facemask restyle -in photos/ -out restyled/ -cache .facemask-cache -mask new.png\n\n")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if len(*flags.source) == 0 || len(*flags.dest) == 0 || len(*flags.cacheDir) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if _, err := os.Stat(*flags.cacheDir); err != nil {
+		log.Fatalf("Error opening the detection cache: %v", err)
+	}
+	fd, err := facemask.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fd.Cache = &facemask.DetectionCache{Dir: *flags.cacheDir}
+
+	mr, err := maskRenderer(*flags.maskFile, maskOptions{clipSkin: *flags.clipSkin, relight: *flags.relight, feather: *flags.feather})
+	if err != nil {
+		log.Fatalf("Error loading the mask: %v", err)
+	}
+	facemask.Register("mask", mr)
+	if !isMaskPack(*flags.maskFile) {
+		facemask.Register("mask3d", facemask.NewMask3DRenderer(*flags.maskFile))
+	}
+	renderer, err := facemask.Lookup(*flags.mode)
+	if err != nil {
+		log.Fatalf("Overlay mode not supported: %v", err)
+	}
+
+	sources := []string{*flags.source}
+	out := output{path: *flags.dest}
+	if fi, err := os.Stat(*flags.source); err == nil && fi.IsDir() {
+		if sources, err = listImages(*flags.source, *flags.recursive, nil, nil); err != nil {
+			log.Fatalf("Error reading the source directory: %v", err)
+		}
+		out = output{template: defaultOutTemplate, dir: *flags.dest, root: *flags.source}
+	} else if !outputSupported(*flags.source, *flags.dest) {
+		log.Fatalf("Output file type not supported: %v", *flags.dest)
+	}
+
+	start := time.Now()
+	var restyled, failed int
+	for _, src := range sources {
+		if err := restyleImage(fd, renderer, src, out); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", src, err)
+			failed++
+			continue
+		}
+		restyled++
+	}
+	fmt.Printf("Restyled %d images in %.2fs\n", restyled, time.Since(start).Seconds())
+	if failed > 0 {
+		log.Fatalf("%d images failed", failed)
+	}
+}
+
+// restyleSettings are the settings of the flags of the restyle command.
+type restyleSettings struct {
+	source    *string
+	dest      *string
+	cacheDir  *string
+	recursive *bool
+	maskFile  *string
+	mode      *string
+	clipSkin  *bool
+	relight   *bool
+	feather   *int
+}
+
+// restyleFlags defines the flags of the restyle command.
+func restyleFlags(fs *flag.FlagSet) *restyleSettings {
+	return &restyleSettings{
+		source:    fs.String("in", "", "Source image or directory of images"),
+		dest:      fs.String("out", "", "Destination image, or the output directory if the source is a directory"),
+		cacheDir:  fs.String("cache", "", "Directory of the detection cache written by the -cache flag"),
+		recursive: fs.Bool("recursive", false, "Process the subdirectories of the source directory too"),
+		maskFile:  fs.String("mask", facemask.DefaultMask, "Mask image, mask pack directory or manifest file"),
+		mode:      fs.String("mode", "mask", "Overlay mode: "+strings.Join(facemask.Renderers(), ", ")),
+		clipSkin:  fs.Bool("clip-skin", false, "Clip the mask to the face silhouette found by a skin color model"),
+		relight:   fs.Bool("relight", false, "Adjust the brightness and the tint of the mask to the lighting of the face"),
+		feather:   fs.Int("feather", 0, "Soften the alpha edge of the mask by this many pixels"),
+	}
+}
+
+// restyleImage renders the overlays over the cached faces of the source image and writes the result.
+func restyleImage(fd *facemask.Detector, renderer facemask.Renderer, source string, out output) error {
+	infos, err := fd.LoadCached(source)
+	if err != nil {
+		return err
+	}
+	if err := fd.Render(infos, renderer); err != nil {
+		return fmt.Errorf("error rendering the overlays: %v", err)
+	}
+	destination, err := out.resolve(source, len(infos))
+	if err != nil {
+		return err
+	}
+	return fd.Save(destination)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// rosterEntry maps an identity to its reference photo and mask asset.
+type rosterEntry struct {
+	name      string
+	reference string
+	mask      string
+}
+
+// readRoster parses the roster file, which maps the identities to mask assets:
+//
+//	# name -> mask
+//	alice -> masks/cat.png
+//	bob   -> masks/dog.png
+//
+// The reference photo of each identity is looked up in the refs directory
+// (defaulting to the roster file's directory) as <name>.jpg, <name>.jpeg or <name>.png.
+// Relative mask paths are resolved against the roster file's directory.
+func readRoster(path, refs string) ([]rosterEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	base := filepath.Dir(path)
+	if refs == "" {
+		refs = base
+	}
+	resolve := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(base, p)
+	}
+
+	var (
+		entries []rosterEntry
+		line    int
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, "->", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"name -> mask\"", path, line)
+		}
+		name, mask := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		var reference string
+		for _, ext := range []string{".jpg", ".jpeg", ".png"} {
+			candidate := filepath.Join(refs, name+ext)
+			if _, err := os.Stat(candidate); err == nil {
+				reference = candidate
+				break
+			}
+		}
+		if reference == "" {
+			return nil, fmt.Errorf("%s:%d: no reference photo found for %q in %s", path, line, name, refs)
+		}
+		entries = append(entries, rosterEntry{name: name, reference: reference, mask: resolve(mask)})
+	}
+	return entries, scanner.Err()
+}
+
+// rosterRenderer creates the renderer assigning each recognized person
+// the mask of the roster. The unrecognized faces are rendered with the fallback renderer.
+func rosterRenderer(fd *facemask.Detector, entries []rosterEntry, threshold float64, fallback facemask.Renderer) (facemask.Renderer, error) {
+	embedder := facemask.LBPEmbedder{}
+	ir := &facemask.IdentityRenderer{
+		Embedder:  embedder,
+		Threshold: threshold,
+		Fallback:  fallback,
+	}
+	for _, e := range entries {
+		desc, err := fd.Reference(e.reference, embedder)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", e.name, err)
+		}
+		ir.Identities = append(ir.Identities, facemask.Identity{
+			Name:       e.name,
+			Descriptor: desc,
+			Renderer:   facemask.NewMaskRenderer(e.mask),
+		})
+	}
+	return ir, nil
+}
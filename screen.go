@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// screenSource is the source name capturing the screen.
+const screenSource = "screen"
+
+// captureScreen captures the screen into the screen.png image of a new temporary
+// directory, cropped to the region in the x,y,w,h format when it's not empty.
+// The caller removes the directory.
+func captureScreen(region string) (string, error) {
+	var rect image.Rectangle
+	if region != "" {
+		var err error
+		if rect, err = parseRegion(region); err != nil {
+			return "", err
+		}
+	}
+	dir, err := ioutil.TempDir("", "facemask")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, screenSource+".png")
+	cmd, err := screenshotCommand(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("error capturing the screen: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if region != "" {
+		if err := cropPNG(path, rect); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// screenshotCommand returns the command of the platform capturing the whole screen into the PNG file:
+// screencapture on macOS, PowerShell on Windows and grim (Wayland), import (ImageMagick) or
+// gnome-screenshot on the other systems, whichever is available first.
+func screenshotCommand(path string) (*exec.Cmd, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("screencapture", "-x", "-t", "png", path), nil
+	case "windows":
+		script := `Add-Type -AssemblyName System.Windows.Forms,System.Drawing
+$b = [System.Windows.Forms.SystemInformation]::VirtualScreen
+$bmp = New-Object System.Drawing.Bitmap $b.Width, $b.Height
+$g = [System.Drawing.Graphics]::FromImage($bmp)
+$g.CopyFromScreen($b.Left, $b.Top, 0, 0, $bmp.Size)
+$bmp.Save('` + strings.Replace(path, "'", "''", -1) + `', [System.Drawing.Imaging.ImageFormat]::Png)`
+		return exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script), nil
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		if _, err := exec.LookPath("grim"); err == nil {
+			return exec.Command("grim", path), nil
+		}
+	}
+	if _, err := exec.LookPath("import"); err == nil {
+		return exec.Command("import", "-window", "root", path), nil
+	}
+	if _, err := exec.LookPath("gnome-screenshot"); err == nil {
+		return exec.Command("gnome-screenshot", "-f", path), nil
+	}
+	return nil, errors.New("capturing the screen requires grim, import (ImageMagick) or gnome-screenshot")
+}
+
+// parseRegion parses the screen region in the x,y,w,h format.
+func parseRegion(s string) (image.Rectangle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("invalid region, expected x,y,w,h: %v", s)
+	}
+	var v [4]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || n < 0 || i >= 2 && n == 0 {
+			return image.Rectangle{}, fmt.Errorf("invalid region, expected x,y,w,h: %v", s)
+		}
+		v[i] = n
+	}
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
+
+// cropPNG crops the PNG image file to the region.
+func cropPNG(path string, rect image.Rectangle) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	img, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	rect = rect.Add(img.Bounds().Min).Intersect(img.Bounds())
+	if rect.Empty() {
+		return fmt.Errorf("the region is outside of the screen of %dx%d pixels", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(out, imaging.Crop(img, rect)); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// selftestCase is a golden image case of the selftest command: the source image, relative
+// to the case directory, processed with the command line arguments.
+type selftestCase struct {
+	Name string   `json:"name"`
+	In   string   `json:"in"`
+	Args []string `json:"args"`
+}
+
+// selftestCommand runs the golden image cases of a directory and compares their outputs with
+// the golden images within a perceptual tolerance, so the changes of the placement math
+// and of the compositing don't regress the outputs silently. The cases are listed in the
+// cases.json file of the directory, and their golden images are the PNG images of its
+// golden subdirectory, named by the cases.
+func selftestCommand(args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	flags := selftestFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: facemask selftest -dir testdata [-update]\n\n")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if *flags.minSSIM < 0 || *flags.minSSIM > 1 || *flags.maxDelta < 0 || *flags.maxChanged < 0 || *flags.maxChanged > 1 {
+		log.Fatal("Invalid tolerance")
+	}
+	tol := facemask.Tolerance{MinSSIM: *flags.minSSIM, MaxDelta: *flags.maxDelta, MaxChanged: *flags.maxChanged}
+	failed, err := runSelftest(*flags.dir, tol, *flags.update, *flags.diffDir, *flags.verbose)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// selftestSettings are the settings of the flags of the selftest command.
+type selftestSettings struct {
+	dir        *string
+	update     *bool
+	diffDir    *string
+	minSSIM    *float64
+	maxDelta   *int
+	maxChanged *float64
+	verbose    *bool
+}
+
+// selftestFlags defines the flags of the selftest command.
+func selftestFlags(fs *flag.FlagSet) *selftestSettings {
+	return &selftestSettings{
+		dir:        fs.String("dir", "testdata", "Directory of the cases.json file and of the golden images"),
+		update:     fs.Bool("update", false, "Write the outputs as the new golden images instead of comparing them"),
+		diffDir:    fs.String("diff", "", "Directory of the outputs and the difference images of the failed cases"),
+		minSSIM:    fs.Float64("min-ssim", facemask.DefaultTolerance.MinSSIM, "Minimum structural similarity of an output to its golden image"),
+		maxDelta:   fs.Int("max-delta", facemask.DefaultTolerance.MaxDelta, "Largest channel difference of a pixel still counted as unchanged"),
+		maxChanged: fs.Float64("max-changed", facemask.DefaultTolerance.MaxChanged, "Maximum fraction of the changed pixels"),
+		verbose:    fs.Bool("v", false, "Print the output of the failed runs"),
+	}
+}
+
+// runSelftest runs the cases of the directory, printing their results, and returns the number
+// of the failed cases, or the error which stopped the run.
+func runSelftest(dir string, tol facemask.Tolerance, update bool, diffDir string, verbose bool) (int, error) {
+	cases, err := loadSelftestCases(dir)
+	if err != nil {
+		return 0, err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempDir("", "facemask")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmp)
+
+	failed := 0
+	for _, c := range cases {
+		golden := filepath.Join(dir, "golden", c.Name+".png")
+		out := filepath.Join(tmp, c.Name+".png")
+		if output, err := runSelftestCase(exe, dir, c, out); err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %v\n", c.Name, err)
+			if verbose {
+				os.Stdout.Write(output)
+			}
+			continue
+		}
+		got, err := facemask.ReadGolden(out)
+		if err != nil {
+			return failed, fmt.Errorf("error reading the output of %s: %v", c.Name, err)
+		}
+		if update {
+			if err := facemask.WriteGolden(golden, got); err != nil {
+				return failed, fmt.Errorf("error writing the golden image: %v", err)
+			}
+			fmt.Printf("wrote %s\n", golden)
+			continue
+		}
+		want, err := facemask.ReadGolden(golden)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: missing golden image, run with -update: %v\n", c.Name, err)
+			continue
+		}
+		diff, err := facemask.CompareImages(got, want, tol)
+		if err == nil {
+			fmt.Printf("ok    %s: %v\n", c.Name, diff)
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL  %s: %v\n", c.Name, err)
+		if diffDir != "" {
+			if err := facemask.WriteGolden(filepath.Join(diffDir, c.Name+".png"), got); err != nil {
+				return failed, fmt.Errorf("error writing the output: %v", err)
+			}
+			if err := facemask.WriteGolden(filepath.Join(diffDir, c.Name+".diff.png"), facemask.DiffImage(got, want, tol)); err != nil {
+				return failed, fmt.Errorf("error writing the difference image: %v", err)
+			}
+		}
+	}
+	if !update {
+		fmt.Printf("%d passed, %d failed\n", len(cases)-failed, failed)
+	}
+	return failed, nil
+}
+
+// loadSelftestCases reads the cases of the cases.json file of the directory.
+func loadSelftestCases(dir string) ([]selftestCase, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "cases.json"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading the cases: %v", err)
+	}
+	var cases []selftestCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		return nil, fmt.Errorf("error reading the cases: %v", err)
+	}
+	for _, c := range cases {
+		if c.Name == "" || c.In == "" || filepath.Base(c.Name) != c.Name {
+			return nil, fmt.Errorf("invalid case %q: the cases require a file name and a source", c.Name)
+		}
+	}
+	return cases, nil
+}
+
+// runSelftestCase processes the source of the case into the PNG output by running the
+// executable, returning its combined output.
+func runSelftestCase(exe, dir string, c selftestCase, out string) ([]byte, error) {
+	// The outputs are deterministic, so only the intended changes differ from the golden images.
+	run := append([]string{"-in", filepath.Join(dir, c.In), "-out", out, "-deterministic"}, c.Args...)
+	return exec.Command(exe, run...).CombinedOutput()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// selftestEnv makes the test binary run the mask command, so the golden image cases run it
+// like the selftest command runs its own executable.
+const selftestEnv = "FACEMASK_SELFTEST_MASK"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(selftestEnv) != "" {
+		maskCommand(os.Args[1:])
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// TestGolden runs the cases of testdata/cases.json and compares their outputs with the golden
+// images. FACEMASK_UPDATE_GOLDEN=1 writes the new golden images after an intended change.
+func TestGolden(t *testing.T) {
+	cases, err := loadSelftestCases("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(selftestEnv, "1")
+	defer os.Unsetenv(selftestEnv)
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), c.Name+".png")
+			if output, err := runSelftestCase(exe, "testdata", c, out); err != nil {
+				t.Fatalf("%v\n%s", err, output)
+			}
+			got, err := facemask.ReadGolden(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			facemask.CheckGolden(t, got, filepath.Join("testdata", "golden", c.Name+".png"), facemask.DefaultTolerance)
+		})
+	}
+}
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// serveCommand serves the anonymization over HTTP: the images posted to /mask are returned
+// with the overlays rendered over the faces. The cascades and the default mask are embedded
+// into the binary, so the server runs from a scratch container and can be exposed directly,
+// terminating TLS itself.
+func serveCommand(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags := serveFlags(fs)
+	fd := flags.fd
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: facemask serve -addr :8080 -tls-cert cert.pem -tls-key key.pem\n\n")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+
+	if (*flags.tlsCert == "") != (*flags.tlsKey == "") {
+		log.Fatal("Both the -tls-cert and the -tls-key files are required")
+	}
+	if *flags.maxSize <= 0 || *flags.maxPixels <= 0 || *flags.maxUpload <= 0 || *flags.uploadMax < 0 || *flags.perClient < 0 {
+		log.Fatal("The size limits must be positive")
+	}
+	if *flags.uploadExp <= 0 {
+		log.Fatal("The expiry of the uploads must be positive")
+	}
+	if *flags.workers < 1 {
+		log.Fatal("The number of the workers must be at least 1")
+	}
+	if err := checkRequestOptions(flags.options, *flags.maskDir); err != nil {
+		log.Fatal(err)
+	}
+	conf, err := loadConfig(fs.Lookup("config").Value.String())
+	if err != nil {
+		log.Fatalf("Error loading the configuration file: %v", err)
+	}
+	trusted, err := parseNetworks(flags.proxies)
+	if err != nil {
+		log.Fatalf("Invalid trusted proxy: %v", err)
+	}
+	tr, err := newTracer()
+	if err != nil {
+		log.Fatalf("Error configuring the tracing: %v", err)
+	}
+	var al *auditLog
+	if *flags.audit != "" {
+		if al, err = openAuditLog(*flags.audit, *flags.auditThumb); err != nil {
+			log.Fatalf("Error opening the audit log: %v", err)
+		}
+		defer al.Close()
+	}
+
+	assets, err := embeddedAssets(fd.FaceCascade, fd.EyesCascade, fd.FlplocDir, *flags.maskFile)
+	if err != nil {
+		log.Fatalf("Error extracting the embedded assets: %v", err)
+	}
+	tempUploads := *flags.uploadDir == ""
+	if tempUploads {
+		if *flags.uploadDir, err = ioutil.TempDir("", "facemask-uploads"); err != nil {
+			log.Fatalf("Error creating the upload directory: %v", err)
+		}
+	}
+	cleanup := func() {
+		if assets != "" {
+			os.RemoveAll(assets)
+		}
+		if tempUploads {
+			os.RemoveAll(*flags.uploadDir)
+		}
+	}
+	defer cleanup()
+	ups, err := newUploads(*flags.uploadDir, int64(*flags.maxUpload)<<20, *flags.uploadExp)
+	if err != nil {
+		cleanup()
+		log.Fatalf("Error opening the upload directory: %v", err)
+	}
+	ups.quota, ups.perClient = int64(*flags.uploadMax)<<20, *flags.perClient
+
+	s := &server{
+		flags:      fs,
+		fd:         fd,
+		assets:     assets,
+		detectors:  make(chan *pooledDetector, *flags.workers),
+		maxSize:    int64(*flags.maxSize) << 20,
+		maxPixels:  *flags.maxPixels * 1000000,
+		proxies:    trusted,
+		tracer:     tr,
+		audit:      al,
+		adminToken: *flags.adminToken,
+		profiles:   conf.profiles,
+		options:    make(map[string]bool),
+		tenants:    newTenantCache(maxTenants),
+		maskDir:    *flags.maskDir,
+		uploads:    ups,
+		origins:    flags.origins,
+		maxAge:     *flags.maxAge,
+	}
+	for _, name := range flags.options {
+		s.options[name] = true
+	}
+	if s.cfg, err = s.newConfig(s.snapshot(1)); err != nil {
+		cleanup()
+		log.Fatalf("Error configuring the server: %v", err)
+	}
+	for i := 0; i < *flags.workers; i++ {
+		s.detectors <- &pooledDetector{}
+	}
+	srv := &http.Server{
+		Addr:              *flags.addr,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       5 * time.Minute,
+		WriteTimeout:      5 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+	}
+	if *flags.tlsCert != "" {
+		cr := &certReloader{certFile: *flags.tlsCert, keyFile: *flags.tlsKey}
+		if _, err := cr.GetCertificate(nil); err != nil {
+			log.Fatalf("Error loading the TLS certificate: %v", err)
+		}
+		srv.TLSConfig = &tls.Config{GetCertificate: cr.GetCertificate, MinVersion: tls.VersionTLS12}
+	}
+
+	// The containers are stopped with SIGTERM: the requests in progress are completed first.
+	done := make(chan struct{})
+	go ups.expire(done)
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		close(done)
+	}()
+
+	log.Printf("Serving on %s", *flags.addr)
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		cleanup()
+		log.Fatal(err)
+	}
+	<-done
+	tr.shutdown()
+	fd.Close()
+}
+
+// serveSettings are the settings of the flags of the serve command.
+type serveSettings struct {
+	addr       *string
+	tlsCert    *string
+	tlsKey     *string
+	maxSize    *int
+	maxPixels  *int
+	maxUpload  *int
+	uploadDir  *string
+	uploadExp  *time.Duration
+	uploadMax  *int
+	perClient  *int
+	workers    *int
+	maskFile   *string
+	maskDir    *string
+	audit      *string
+	auditThumb *int
+	adminToken *string
+	proxies    listFlag
+	options    listFlag
+	origins    listFlag
+	maxAge     *time.Duration
+	fd         *facemask.Detector
+}
+
+// serveFlags defines the flags of the serve command.
+func serveFlags(fs *flag.FlagSet) *serveSettings {
+	st := &serveSettings{
+		addr:       fs.String("addr", ":8080", "Address the server listens on"),
+		tlsCert:    fs.String("tls-cert", "", "TLS certificate file, reloaded when it changes"),
+		tlsKey:     fs.String("tls-key", "", "TLS private key file"),
+		maxSize:    fs.Int("max-size", 32, "Maximum size of the uploaded images in MB"),
+		maxPixels:  fs.Int("max-megapixels", 50, "Maximum resolution of the uploaded images in megapixels"),
+		maxUpload:  fs.Int("max-upload", 2048, "Maximum size of the resumable uploads in MB"),
+		uploadDir:  fs.String("upload-dir", "", "Directory of the resumable uploads, kept over the restarts (default a temporary directory)"),
+		uploadExp:  fs.Duration("upload-expiry", 24*time.Hour, "Time after their last change the resumable uploads are removed"),
+		uploadMax:  fs.Int("upload-quota", 0, "Maximum total size of the stored resumable uploads in MB, 0 for no limit"),
+		perClient:  fs.Int("upload-per-client", 0, "Maximum number of the incomplete resumable uploads of a client, 0 for no limit"),
+		workers:    fs.Int("workers", runtime.NumCPU(), "Number of the images processed at once"),
+		maskFile:   fs.String("mask", facemask.DefaultMask, "Mask image, mask pack directory or manifest file"),
+		maskDir:    fs.String("mask-dir", "", "Directory of the masks the clients can select per request by their file name"),
+		audit:      fs.String("audit", "", "JSON Lines file of the audit records of the processed images, - writes them to stdout"),
+		auditThumb: fs.Int("audit-thumbnail", 0, "Size of the thumbnails of the masked outputs included in the audit records, 0 logs no pixel data"),
+		adminToken: fs.String("admin-token", "", "Bearer token of the admin endpoints changing the configuration at runtime and of the /debug/pprof profiles, which are disabled without it"),
+		options:    listFlag{"mode", "opacity", "min", "max", "q"},
+		maxAge:     fs.Duration("cache-max-age", 0, "Time the results of the uploads are cached by the browsers and the CDNs, 0 revalidates them by their ETag"),
+		fd:         detectorFlags(fs),
+	}
+	// The overlay flags are read through the flag set, by the configurations built from it.
+	fs.String("mode", "mask", "Overlay mode: "+strings.Join(facemask.Renderers(), ", "))
+	fs.Float64("opacity", 1, "Opacity of the mask between 0 and 1")
+	fs.Bool("debug", false, "Draw the landmark mesh over the faces, to check the landmark quality")
+	fs.Var(&st.origins, "cors-origins", "Comma separated `origins` of the browser clients allowed to call the server, * allows any")
+	fs.Var(&st.options, "request-options", "Comma separated `flags` the clients can set per request, from: "+strings.Join(requestFlags, ", "))
+	fs.Var(&st.proxies, "trusted-proxies", "Comma separated `addresses` or CIDR ranges of the reverse proxies whose X-Forwarded-For header is trusted")
+	return st
+}
+
+// server handles the HTTP requests, processing at most as many images at once as many detectors it has.
+type server struct {
+	// flags are the flags of the serve command, holding the current settings, and fd the
+	// detector bound to them.
+	flags *flag.FlagSet
+	fd    *facemask.Detector
+	// assets is the directory of the extracted embedded assets, if any.
+	assets    string
+	detectors chan *pooledDetector
+	// cfg is the current configuration, replaced on every change.
+	mu  sync.RWMutex
+	cfg *serverConfig
+	// maxSize is the maximum size of the uploads in bytes and maxPixels their maximum
+	// resolution, checked before decoding them.
+	maxSize   int64
+	maxPixels int
+	// proxies are the networks of the trusted reverse proxies.
+	proxies []*net.IPNet
+	tracer  *tracer
+	audit   *auditLog
+	// adminToken authenticates the admin requests, which are disabled without it.
+	adminToken string
+	// profiles are the configuration profiles the clients can select per request, options
+	// the flags they can set per request and maskDir the directory of their masks.
+	profiles map[string]map[string]string
+	options  map[string]bool
+	maskDir  string
+	// tenants caches the configurations of the per request settings of the current generation.
+	tenants *tenantCache
+	uploads *uploads
+	// origins are the origins of the browser clients allowed by CORS, and maxAge the time
+	// the results of the uploads are cached.
+	origins []string
+	maxAge  time.Duration
+}
+
+// pooledDetector is a detector of the pool, with the configuration it's cloned from.
+type pooledDetector struct {
+	fd  *facemask.Detector
+	cfg *serverConfig
+}
+
+// detector takes a detector of the pool, cloned again from the configuration if it differs
+// from the one of its previous use. It must be returned to the pool after the use.
+func (s *server) detector(cfg *serverConfig) *pooledDetector {
+	pd := <-s.detectors
+	if pd.fd == nil || pd.cfg != cfg {
+		pd.fd, pd.cfg = cfg.detector.Clone(), cfg
+	}
+	return pd
+}
+
+// assetPath returns the path of the asset, the extracted embedded copy if it's missing.
+func (s *server) assetPath(path string) string {
+	return extractedPath(s.assets, path)
+}
+
+// serverFlags are the flags of the serve command not affecting the processing of the images,
+// and the configuration flags, whose settings are applied to the other flags.
+var serverFlags = map[string]bool{
+	"addr": true, "tls-cert": true, "tls-key": true, "max-size": true, "max-megapixels": true,
+	"max-upload": true, "upload-dir": true, "upload-expiry": true, "upload-quota": true,
+	"upload-per-client": true, "workers": true, "audit": true,
+	"audit-thumbnail": true, "trusted-proxies": true, "admin-token": true, "mask-dir": true,
+	"request-options": true, "cors-origins": true, "cache-max-age": true, "config": true, "profile": true,
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mask", s.traced(s.handleMask))
+	mux.HandleFunc("/detect", s.traced(s.handleDetect))
+	mux.HandleFunc("/composite", s.traced(s.handleComposite))
+	mux.HandleFunc("/uploads", s.traced(s.handleUploads))
+	mux.HandleFunc("/uploads/", s.traced(s.handleUploads))
+	if s.adminToken != "" {
+		mux.HandleFunc("/admin/config", s.admin(s.handleConfig))
+		// The profiles of the running server, e.g. of a slow production traffic.
+		mux.HandleFunc("/debug/pprof/", s.admin(pprof.Index))
+		mux.HandleFunc("/debug/pprof/cmdline", s.admin(pprof.Cmdline))
+		mux.HandleFunc("/debug/pprof/profile", s.admin(pprof.Profile))
+		mux.HandleFunc("/debug/pprof/symbol", s.admin(pprof.Symbol))
+		mux.HandleFunc("/debug/pprof/trace", s.admin(pprof.Trace))
+	}
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+	return withRequestID(s.cors(mux))
+}
+
+// traced records the span of the requests of the handler, with the pipeline stages of the
+// processed image as its children.
+func (s *server) traced(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sp := s.tracer.start(r.Header.Get("traceparent"), r.Method+" "+r.URL.Path)
+		if sp == nil {
+			h(w, r)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h(sw, r.WithContext(context.WithValue(r.Context(), spanKey{}, sp)))
+		sp.setAttr(
+			stringAttr("http.request.method", r.Method),
+			stringAttr("url.path", r.URL.Path),
+			stringAttr("client.address", s.clientIP(r)),
+			intAttr("http.response.status_code", sw.status),
+		)
+		if sw.status >= 500 {
+			sp.setError(errors.New(http.StatusText(sw.status)))
+		}
+		sp.finish()
+	}
+}
+
+// statusWriter records the status of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// handleMask returns the posted image with the overlays rendered over the faces, in the format
+// of the upload for the PNG images and as JPEG otherwise. The X-Faces header holds the number
+// of the faces. With the upload query parameter the completed resumable upload is processed
+// instead, either an image or an MJPEG stream, which can also be fetched with GET and HEAD,
+// so the results can be cached by the CDNs. The ETag of the results identifies the source
+// and the processing settings.
+func (s *server) handleMask(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodGet, http.MethodHead:
+		if r.URL.Query().Get("upload") == "" {
+			http.Error(w, "the upload query parameter is required", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg, cfgErr := s.requestConfig(r.URL.Query())
+	rec, fail := s.newRecord(w, r, start, cfg)
+	defer s.writeRecord(rec, start)
+	if cfgErr != nil {
+		fail(http.StatusBadRequest, cfgErr)
+		return
+	}
+
+	var (
+		data   []byte
+		status int
+		err    error
+		etag   string
+		id     = r.URL.Query().Get("upload")
+	)
+	if id != "" {
+		var (
+			path string
+			info uploadInfo
+		)
+		if path, info, status, err = s.uploads.completed(id); err != nil {
+			fail(status, err)
+			return
+		}
+		rec.Source, rec.Size = info.Hash, int(info.Length)
+		etag = s.etag(rec.Source, cfg)
+		if s.notModified(w, r, etag) {
+			rec.Status = http.StatusNotModified
+			return
+		}
+		// The results already produced are described to HEAD without processing the upload
+		// again, and so are the streams, whose length and faces are only known once streamed.
+		if result, ok := info.Results[etag]; ok && r.Method == http.MethodHead {
+			w.Header().Set("Content-Type", result.Type)
+			w.Header().Set("Content-Length", strconv.Itoa(result.Length))
+			w.Header().Set("X-Faces", strconv.Itoa(result.Faces))
+			rec.Faces = result.Faces
+			return
+		}
+		if isMJPEG(path) {
+			if r.Method == http.MethodHead {
+				w.Header().Set("Content-Type", "video/x-motion-jpeg")
+				return
+			}
+			s.maskStream(w, r, path, cfg, rec, fail)
+			return
+		}
+		data, status, err = s.readSource(facemask.FileSource(path), s.uploads.maxSize)
+	} else {
+		data, status, err = s.readImage(w, r)
+		if data != nil {
+			sum := sha256.Sum256(data)
+			rec.Source, rec.Size = hex.EncodeToString(sum[:]), len(data)
+			s.notModified(w, r, s.etag(rec.Source, cfg))
+		}
+	}
+	if err != nil {
+		fail(status, err)
+		return
+	}
+	format := imageFormat(data)
+
+	sp := spanFrom(r.Context())
+	pd := s.detector(cfg)
+	defer func() { s.detectors <- pd }()
+	fd := pd.fd
+	fd.Hooks.OnStage = sp.stageHook()
+	// The localization is seeded by the source, so the result of an ETag is always the same.
+	fd.Seed = imageSeed(rec.Source)
+
+	var buf bytes.Buffer
+	faces, status, err := s.mask(fd, cfg, data, &buf, format)
+	rec.Faces = faces
+	if err != nil {
+		fail(status, err)
+		return
+	}
+	s.audit.addThumbnail(rec, fd.Image())
+	if id != "" {
+		result := uploadResult{Type: "image/" + format.String(), Length: buf.Len(), Faces: faces}
+		if err := s.uploads.addResult(id, etag, result); err != nil {
+			log.Printf("%s: error recording the result of the upload %s: %v", rec.RequestID, id, err)
+		}
+	}
+	w.Header().Set("Content-Type", "image/"+format.String())
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("X-Faces", strconv.Itoa(faces))
+	sp.setAttr(intAttr("facemask.faces", faces))
+	w.Write(buf.Bytes())
+	log.Printf("%s %s %s %s: %d faces in %v", rec.RequestID, rec.Client, r.Method, r.URL.Path, faces, time.Since(start).Round(time.Millisecond))
+}
+
+// newRecord returns the audit record of the request processed with the configuration, and the
+// function failing the request with the status, recording the error.
+func (s *server) newRecord(w http.ResponseWriter, r *http.Request, start time.Time, cfg *serverConfig) (*auditRecord, func(int, error)) {
+	rec := &auditRecord{
+		Time:      start.UTC(),
+		RequestID: requestID(r.Context()),
+		Client:    s.clientIP(r),
+		Endpoint:  r.URL.Path,
+		Params:    cfg.params,
+		Status:    http.StatusOK,
+	}
+	return rec, func(status int, err error) {
+		rec.Status, rec.Error = status, err.Error()
+		http.Error(w, err.Error(), status)
+	}
+}
+
+// writeRecord writes the audit record at the end of the request.
+func (s *server) writeRecord(rec *auditRecord, start time.Time) {
+	if err := s.audit.write(rec, start); err != nil {
+		log.Printf("Error writing the audit log: %v", err)
+	}
+}
+
+// imageFormat returns the format of the results of the image: PNG for the PNG images and JPEG otherwise.
+func imageFormat(data []byte) facemask.Format {
+	if _, name, _ := image.DecodeConfig(bytes.NewReader(data)); name == "png" {
+		return facemask.PNG
+	}
+	return facemask.JPEG
+}
+
+// mask renders the overlays over the faces of the image and encodes the result to w, returning
+// the number of the faces, with the status of the response in case of an error.
+func (s *server) mask(fd *facemask.Detector, cfg *serverConfig, data []byte, w io.Writer, format facemask.Format) (int, int, error) {
+	faces, err := fd.DetectReader(bytes.NewReader(data))
+	if err != nil {
+		return 0, http.StatusUnprocessableEntity, fmt.Errorf("detection error: %v", err)
+	}
+	infos := fd.LocalizeFaces(faces)
+	if err := fd.Render(infos, cfg.renderer); err != nil {
+		return len(infos), http.StatusInternalServerError, fmt.Errorf("error rendering the overlays: %v", err)
+	}
+	if cfg.debug {
+		mesh := &facemask.MeshRenderer{}
+		for _, face := range infos {
+			mesh.Render(fd.Canvas(), face)
+		}
+	}
+	if err := fd.OverlayTo(w, format); err != nil {
+		return len(infos), http.StatusInternalServerError, fmt.Errorf("error encoding the image: %v", err)
+	}
+	return len(infos), http.StatusOK, nil
+}
+
+// maskStream returns the MJPEG stream of the upload, e.g. a video converted by ffmpeg -f mjpeg,
+// with the overlays rendered over the faces of every frame. The frames are written as soon as
+// they are masked, so the number of the faces of all the frames is sent in the X-Faces trailer.
+// The failed frames are dropped rather than passed through unmasked.
+func (s *server) maskStream(w http.ResponseWriter, r *http.Request, path string, cfg *serverConfig, rec *auditRecord, fail func(int, error)) {
+	start := time.Now()
+	f, err := os.Open(path)
+	if err != nil {
+		fail(http.StatusInternalServerError, fmt.Errorf("error reading the upload: %v", err))
+		return
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+
+	sp := spanFrom(r.Context())
+	pd := s.detector(cfg)
+	defer func() { s.detectors <- pd }()
+	fd := pd.fd
+	fd.Hooks.OnStage = sp.stageHook()
+	// The frames of a stream have the same size, so they are drawn into the same context.
+	fd.ReuseContext = true
+	defer func() { fd.ReuseContext = false }()
+
+	w.Header().Set("Content-Type", "video/x-motion-jpeg")
+	w.Header().Set("Trailer", "X-Faces")
+	var buf bytes.Buffer
+	frames := 0
+	for ; ; frames++ {
+		data, err := readFrame(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			err = fmt.Errorf("frame %d: %v", frames, err)
+			if frames == 0 {
+				fail(http.StatusUnsupportedMediaType, err)
+				return
+			}
+			rec.Status, rec.Error = http.StatusUnprocessableEntity, err.Error()
+			break
+		}
+		// Every frame is checked against the limits, as any of them can declare a resolution
+		// whose decoding exhausts the memory.
+		if _, status, err := s.readSource(facemask.BytesSource{Label: "frame", Data: data}, s.maxSize); err != nil {
+			if frames == 0 {
+				fail(status, fmt.Errorf("frame %d: %v", frames, err))
+				return
+			}
+			log.Printf("%s %s: skipping frame %d: %v", rec.RequestID, rec.Client, frames, err)
+			continue
+		}
+		buf.Reset()
+		faces, _, err := s.mask(fd, cfg, data, &buf, facemask.JPEG)
+		if err != nil {
+			log.Printf("%s %s: skipping frame %d: %v", rec.RequestID, rec.Client, frames, err)
+			continue
+		}
+		rec.Faces += faces
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			rec.Status, rec.Error = http.StatusBadRequest, err.Error()
+			break
+		}
+	}
+	w.Header().Set("X-Faces", strconv.Itoa(rec.Faces))
+	sp.setAttr(intAttr("facemask.faces", rec.Faces))
+	log.Printf("%s %s %s %s: %d faces in %d frames in %v", rec.RequestID, rec.Client, r.Method, r.URL.Path, rec.Faces, frames, time.Since(start).Round(time.Millisecond))
+}
+
+// etag returns the ETag of the result, derived from the hash of the source and the processing
+// settings.
+func (s *server) etag(source string, cfg *serverConfig) string {
+	params := make([]string, 0, len(cfg.params))
+	for name, value := range cfg.params {
+		params = append(params, name+"="+value)
+	}
+	sort.Strings(params)
+	sum := sha256.Sum256([]byte(source + "\n" + strings.Join(params, "\n")))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// notModified sets the ETag of the result with the caching headers of the results fetched with
+// GET and HEAD. It reports whether the result is the one the client has, which it answers with
+// 304 Not Modified.
+func (s *server) notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if r.Method == http.MethodPost {
+		return false
+	}
+	if s.maxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(s.maxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if match = strings.TrimSpace(match); match == etag || match == "*" || match == "W/"+etag {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// hashFile returns the SHA-256 hash of the file and its size.
+func hashFile(path string) (string, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	n, err := io.Copy(hash, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), int(n), nil
+}
+
+// isMJPEG reports whether the file is an MJPEG stream, i.e. more than one concatenated JPEG frame.
+func isMJPEG(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if _, err := readFrame(br); err != nil {
+		return false
+	}
+	_, err = br.Peek(1)
+	return err == nil
+}
+
+// readImage reads the uploaded image, rejecting the too large uploads and images, and the
+// unsupported formats, with the status of the response.
+func (s *server) readImage(w http.ResponseWriter, r *http.Request) ([]byte, int, error) {
+	if r.ContentLength > s.maxSize {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("the image exceeds %d MB", s.maxSize>>20)
+	}
+	return s.readSource(facemask.ReaderSource{Label: "request", Reader: r.Body}, s.maxSize)
+}
+
+// readSource reads the image of the source within the maximum size and the -max-megapixels
+// resolution, with the status of the response in case it's rejected.
+func (s *server) readSource(src facemask.ImageSource, maxSize int64) ([]byte, int, error) {
+	data, _, err := facemask.ReadSource(src, facemask.SourceLimits{MaxSize: maxSize, MaxPixels: s.maxPixels})
+	var serr *facemask.SourceError
+	switch {
+	case errors.As(err, &serr) && serr.TooLarge:
+		return nil, http.StatusRequestEntityTooLarge, err
+	case errors.As(err, &serr):
+		return nil, http.StatusUnsupportedMediaType, err
+	case err != nil:
+		return nil, http.StatusBadRequest, err
+	}
+	return data, http.StatusOK, nil
+}
+
+// clientIP returns the address of the client. Behind the trusted proxies it's the last address
+// of the X-Forwarded-For header not added by one of them, since the clients can send the header
+// themselves, with any address.
+func (s *server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !s.trusted(host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		host = hop
+		if !s.trusted(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// trusted reports whether the address is one of the trusted proxies.
+func (s *server) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks parses the addresses and the CIDR ranges.
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// certReloader loads the TLS certificate again when its file changes, so the renewed
+// certificates, e.g. by certbot or cert-manager, are used without restarting the server.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// GetCertificate returns the current certificate, implementing tls.Config.GetCertificate.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	fi, err := os.Stat(cr.certFile)
+	if err != nil {
+		if cr.cert != nil {
+			return cr.cert, nil
+		}
+		return nil, err
+	}
+	if cr.cert != nil && fi.ModTime().Equal(cr.modTime) {
+		return cr.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		// The certificate and the key files are not replaced at once: the previous
+		// certificate is kept until both are updated.
+		if cr.cert != nil {
+			return cr.cert, nil
+		}
+		return nil, err
+	}
+	cr.cert, cr.modTime = &cert, fi.ModTime()
+	return cr.cert, nil
+}
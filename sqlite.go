@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// The SQLite driver of the -events database, using cgo.
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"time"
+
+	"github.com/fogleman/gg"
+	"github.com/golang/freetype/truetype"
+)
+
+// The processing stages of a stream frame timed by the stats.
+const (
+	stageDetect = iota
+	stageLocalize
+	stageRender
+	stageEncode
+	numStages
+)
+
+var stageNames = [numStages]string{"detect", "localize", "render", "encode"}
+
+// statsSmoothing is the weight of the latest frame in the running averages of the stats,
+// so the figures stay readable while following the changes within a second or so.
+const statsSmoothing = 0.1
+
+// frameStats measures the frame rate and the latency of the stages of a stream, averaged
+// over the recent frames. The methods of a nil frameStats do nothing.
+type frameStats struct {
+	fps     float64
+	latency [numStages]time.Duration
+
+	frameStart time.Time
+	lapStart   time.Time
+}
+
+// begin marks the start of the next frame.
+func (fs *frameStats) begin() {
+	if fs == nil {
+		return
+	}
+	now := time.Now()
+	if !fs.frameStart.IsZero() {
+		if elapsed := now.Sub(fs.frameStart).Seconds(); elapsed > 0 {
+			fs.fps = smooth(fs.fps, 1/elapsed)
+		}
+	}
+	fs.frameStart, fs.lapStart = now, now
+}
+
+// lap marks the end of the stage, which started at the end of the previous one.
+func (fs *frameStats) lap(stage int) {
+	if fs == nil {
+		return
+	}
+	now := time.Now()
+	fs.latency[stage] = time.Duration(smooth(float64(fs.latency[stage]), float64(now.Sub(fs.lapStart))))
+	fs.lapStart = now
+}
+
+// smooth returns the running average updated with the value, starting from the first value.
+func smooth(avg, value float64) float64 {
+	if avg == 0 {
+		return value
+	}
+	return avg + statsSmoothing*(value-avg)
+}
+
+// draw draws the stats, with the number of faces and the mask of the frame, in the top left
+// corner of the frame. The encoding latency is the one of the previous frame.
+func (fs *frameStats) draw(ctx *gg.Context, f *truetype.Font, faces int, mask string) {
+	lines := []string{
+		fmt.Sprintf("%-8s %5.1f", "fps", fs.fps),
+		fmt.Sprintf("%-8s %5d", "faces", faces),
+	}
+	if mask != "" {
+		lines = append(lines, fmt.Sprintf("%-8s %s", "mask", mask))
+	}
+	for i, name := range stageNames {
+		lines = append(lines, fmt.Sprintf("%-8s %5.1f ms", name, fs.latency[i].Seconds()*1000))
+	}
+	size := math.Max(10, float64(ctx.Height())/40)
+	ctx.Push()
+	defer ctx.Pop()
+
+	ctx.SetFontFace(truetype.NewFace(f, &truetype.Options{Size: size}))
+	var width float64
+	for _, line := range lines {
+		if w, _ := ctx.MeasureString(line); w > width {
+			width = w
+		}
+	}
+	margin, height := size/2, size*1.3
+	ctx.SetColor(color.NRGBA{A: 160})
+	ctx.DrawRectangle(0, 0, width+2*margin, float64(len(lines))*height+2*margin)
+	ctx.Fill()
+	ctx.SetColor(color.White)
+	for i, line := range lines {
+		ctx.DrawStringAnchored(line, margin, margin+float64(i)*height, 0, 1)
+	}
+}
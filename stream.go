@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// streamSource is the source and destination path selecting the stream mode.
+const streamSource = "-"
+
+// processStream masks the MJPEG stream, i.e. the concatenated JPEG frames, read from
+// the standard input. Every frame is written and flushed as soon as it's encoded, so the
+// downstream players can start consuming it immediately and the memory use stays bounded.
+// The destination can also be the URL of a live streaming server. The live controls,
+// if not nil, take the snapshots of the masked frames.
+func processStream(fd *facemask.Detector, renderer facemask.Renderer, destination string, onError string, controls *liveControls) (err error) {
+	var out io.Writer = os.Stdout
+	switch {
+	case isBroadcast(destination):
+		var b *broadcaster
+		if b, err = startBroadcast(destination); err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := b.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		out = b
+	case destination != streamSource:
+		f, err := os.Create(destination)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	r := bufio.NewReader(os.Stdin)
+
+	// The frames of a stream have the same size, so they are drawn into the same context.
+	fd.ReuseContext = true
+
+	for frame := 0; ; frame++ {
+		data, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("frame %d: %v", frame, err)
+		}
+		if err := processFrame(fd, renderer, data, w, frame, controls); err != nil {
+			// The failed frames are dropped rather than passed through unmasked.
+			if onError == "stop" {
+				return fmt.Errorf("frame %d: %v", frame, err)
+			}
+			log.Printf("Skipping frame %d: %v", frame, err)
+			continue
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// processFrame masks the faces of the JPEG frame and encodes the result to w.
+func processFrame(fd *facemask.Detector, renderer facemask.Renderer, data []byte, w io.Writer, frame int, controls *liveControls) error {
+	stats := controls.frameStats()
+	stats.begin()
+	faces, err := fd.DetectReader(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("detection error: %v", err)
+	}
+	stats.lap(stageDetect)
+	infos := fd.LocalizeFaces(faces)
+	stats.lap(stageLocalize)
+	if err := fd.Render(infos, renderer); err != nil {
+		return fmt.Errorf("error rendering the overlays: %v", err)
+	}
+	stats.lap(stageRender)
+	if controls != nil {
+		if err := controls.update(fd, frame, infos); err != nil {
+			return err
+		}
+	}
+	if err := fd.OverlayTo(w, facemask.JPEG); err != nil {
+		return err
+	}
+	stats.lap(stageEncode)
+	return nil
+}
+
+// errFrame is returned when the stream doesn't continue with a JPEG frame.
+var errFrame = errors.New("invalid JPEG frame")
+
+// readFrame reads the next JPEG frame of the stream. It walks the marker segments up to
+// the end of image marker instead of searching for it, since the markers can also occur
+// inside the segments, e.g. in the embedded thumbnails. It returns io.EOF at the end of the stream.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errFrame
+		}
+		return nil, err
+	}
+	if soi[0] != 0xff || soi[1] != 0xd8 {
+		return nil, errFrame
+	}
+	buf.Write(soi)
+
+	for {
+		marker, err := readMarker(r)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write([]byte{0xff, marker})
+		switch {
+		case marker == 0xd9: // end of image
+			return buf.Bytes(), nil
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7: // no payload
+			continue
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, errFrame
+		}
+		n := int(length[0])<<8 | int(length[1])
+		if n < 2 {
+			return nil, errFrame
+		}
+		buf.Write(length[:])
+		if _, err := io.CopyN(&buf, r, int64(n-2)); err != nil {
+			return nil, errFrame
+		}
+		if marker == 0xda { // start of scan, followed by the entropy coded data
+			if err := readScan(r, &buf); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// readMarker reads the next marker, skipping its fill bytes.
+func readMarker(r *bufio.Reader) (byte, error) {
+	c, err := r.ReadByte()
+	if err != nil || c != 0xff {
+		return 0, errFrame
+	}
+	for {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, errFrame
+		}
+		if c != 0xff {
+			return c, nil
+		}
+	}
+}
+
+// readScan copies the entropy coded data up to the next marker, which is left unread.
+// Within the data the 0xff bytes are followed either by a zero byte or a restart marker.
+func readScan(r *bufio.Reader, buf *bytes.Buffer) error {
+	for {
+		b, err := r.Peek(2)
+		if err != nil {
+			return errFrame
+		}
+		if b[0] != 0xff {
+			buf.WriteByte(b[0])
+			r.Discard(1)
+			continue
+		}
+		if b[1] != 0 && (b[1] < 0xd0 || b[1] > 0xd7) {
+			return nil
+		}
+		buf.Write(b)
+		r.Discard(2)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// requestFlags are the flags of the serve command the clients can be allowed to set per
+// request with -request-options: the mask, its styling and the detection thresholds.
+var requestFlags = []string{
+	"mask", "mode", "opacity", "min", "max", "q", "iou", "landmark-q", "min-ipd", "max-ipd", "mirror",
+}
+
+// maxTenants is the number of the cached per request configurations, the least recently
+// used ones being evicted when exceeded, since the clients can send any values.
+const maxTenants = 64
+
+// checkRequestOptions checks that the flags of -request-options can be set per request.
+// The masks are selected from the mask directory only, so the clients can't read other files.
+func checkRequestOptions(options []string, maskDir string) error {
+	for _, name := range options {
+		found := false
+		for _, f := range requestFlags {
+			found = found || f == name
+		}
+		if !found {
+			return fmt.Errorf("%s can't be set per request, the request options are: %s", name, strings.Join(requestFlags, ", "))
+		}
+		if name == "mask" && maskDir == "" {
+			return fmt.Errorf("the mask request option requires the -mask-dir directory")
+		}
+	}
+	return nil
+}
+
+// requestConfig returns the configuration of the request: the current one, changed by the
+// configuration profile of the profile query parameter, then by the options set in the
+// other query parameters, e.g. /mask?profile=party&min=40, besides the upload. The configurations are cached,
+// so the tenants with the same settings share them. On error the current configuration is
+// returned, for the audit record.
+func (s *server) requestConfig(query url.Values) (*serverConfig, error) {
+	cfg := s.config()
+	if len(query) == 0 {
+		return cfg, nil
+	}
+	values := make(map[string]string)
+	profile := query.Get("profile")
+	if profile != "" {
+		settings, ok := s.profiles[profile]
+		if !ok {
+			return cfg, fmt.Errorf("profile %q not found", profile)
+		}
+		for name, value := range settings {
+			if !runtimeFlags[name] {
+				return cfg, fmt.Errorf("profile %q: %s can't be set per request", profile, name)
+			}
+			values[name] = value
+		}
+	}
+	for name := range query {
+		if name == "profile" || name == "upload" {
+			continue
+		}
+		if !s.options[name] {
+			return cfg, fmt.Errorf("%s can't be set per request", name)
+		}
+		value := query.Get(name)
+		if name == "mask" {
+			if value != filepath.Base(value) || value == "." || value == ".." {
+				return cfg, fmt.Errorf("invalid mask %q", value)
+			}
+			value = filepath.Join(s.maskDir, value)
+		}
+		values[name] = value
+	}
+
+	key := []string{"profile=" + profile}
+	for name, value := range values {
+		key = append(key, name+"="+value)
+	}
+	sort.Strings(key)
+
+	// The configurations are built outside of the lock, as their detection check takes a
+	// while, from a snapshot of the flags changed by the values.
+	key = append(key, fmt.Sprintf("gen=%d", cfg.gen))
+	c, err := s.tenants.get(strings.Join(key, "&"), func() (*serverConfig, error) {
+		s.mu.Lock()
+		restore, err := s.setFlags(values)
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		snap := s.snapshot(s.cfg.gen)
+		restore()
+		s.mu.Unlock()
+
+		c, err := s.newConfig(snap)
+		if err != nil {
+			return nil, err
+		}
+		if profile != "" {
+			c.params["profile"] = profile
+		}
+		return c, nil
+	})
+	if err != nil {
+		return cfg, err
+	}
+	return c, nil
+}
+
+// tenantCache caches the configurations of the per request settings, evicting the least
+// recently used ones. Each configuration is built once, the concurrent requests of the same
+// settings waiting for the build in progress.
+type tenantCache struct {
+	mu   sync.Mutex
+	size int
+	// lru holds the *tenantEntry of the cached configurations, the most recently used first.
+	lru     *list.List
+	entries map[string]*list.Element
+	calls   map[string]*tenantCall
+}
+
+type tenantEntry struct {
+	key string
+	cfg *serverConfig
+}
+
+// tenantCall is a configuration being built.
+type tenantCall struct {
+	done chan struct{}
+	cfg  *serverConfig
+	err  error
+}
+
+// newTenantCache returns the cache of the size.
+func newTenantCache(size int) *tenantCache {
+	return &tenantCache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		calls:   make(map[string]*tenantCall),
+	}
+}
+
+// get returns the configuration of the key, built by build if it's not cached. The failed
+// builds aren't cached.
+func (c *tenantCache) get(key string, build func() (*serverConfig, error)) (*serverConfig, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*tenantEntry).cfg, nil
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.cfg, call.err
+	}
+	call := &tenantCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	call.cfg, call.err = build()
+	close(call.done)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The call is left out of the cache if it was reset meanwhile.
+	if c.calls[key] != call {
+		return call.cfg, call.err
+	}
+	delete(c.calls, key)
+	if call.err == nil {
+		c.entries[key] = c.lru.PushFront(&tenantEntry{key: key, cfg: call.cfg})
+		for c.lru.Len() > c.size {
+			e := c.lru.Back()
+			c.lru.Remove(e)
+			delete(c.entries, e.Value.(*tenantEntry).key)
+		}
+	}
+	return call.cfg, call.err
+}
+
+// reset drops the cached configurations, outdated by a change of the configuration.
+func (c *tenantCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.calls = make(map[string]*tenantCall)
+}
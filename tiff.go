@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	facemask "github.com/esimov/facemask/core"
+	"golang.org/x/image/tiff"
+)
+
+// The TIFF tags read from the source pages and written to the output.
+const (
+	tagNewSubfileType  = 254
+	tagImageWidth      = 256
+	tagImageLength     = 257
+	tagBitsPerSample   = 258
+	tagCompression     = 259
+	tagPhotometric     = 262
+	tagStripOffsets    = 273
+	tagSamplesPerPixel = 277
+	tagRowsPerStrip    = 278
+	tagStripByteCounts = 279
+	tagXResolution     = 282
+	tagYResolution     = 283
+	tagResolutionUnit  = 296
+)
+
+// The TIFF field types.
+const (
+	tiffShort    = 3
+	tiffLong     = 4
+	tiffRational = 5
+)
+
+var errTIFF = errors.New("invalid TIFF file")
+
+// isTIFF reports whether the file is a TIFF image, based on its extension.
+func isTIFF(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".tif" || ext == ".tiff"
+}
+
+// tiffPage is a page of the multi-page TIFF file with its resolution tags.
+type tiffPage struct {
+	ifd           uint32
+	xres, yres    [2]uint32
+	unit          uint16
+	hasResolution bool
+}
+
+// processTIFF masks the faces on every page of the multi-page TIFF file and writes
+// the pages into a multi-page TIFF file at the resolved output path, preserving the
+// resolution of the pages. The reports of the pages are returned.
+func processTIFF(fd *facemask.Detector, renderer facemask.Renderer, source string, out output) ([]facemask.Report, string, error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	order, pages, err := readTIFFPages(f)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The file is written into a temporary file first, since the output path
+	// may depend on the number of faces found on all the pages.
+	tmp, err := ioutil.TempFile("", "facemask*.tif")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var (
+		reports []facemask.Report
+		faces   int
+	)
+	tw, err := newTIFFWriter(tmp)
+	if err != nil {
+		return nil, "", err
+	}
+	for i, page := range pages {
+		img, err := tiff.Decode(&tiffPageReader{ra: f, order: order, ifd: page.ifd})
+		if err != nil {
+			return nil, "", fmt.Errorf("page %d: %v", i+1, err)
+		}
+		dets, err := fd.DetectImage(img)
+		if err != nil {
+			return nil, "", fmt.Errorf("page %d: detection error: %v", i+1, err)
+		}
+		infos := fd.LocalizeFaces(dets)
+		if err := fd.Render(infos, renderer); err != nil {
+			return nil, "", fmt.Errorf("page %d: error rendering the overlays: %v", i+1, err)
+		}
+		if err := tw.addPage(fd.Image(), page); err != nil {
+			return nil, "", err
+		}
+		reports = append(reports, facemask.NewReport(fmt.Sprintf("%s#page=%d", source, i+1), infos))
+		faces += len(infos)
+	}
+
+	destination, err := out.resolve(source, faces)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := copyOutput(destination, tmp); err != nil {
+		return nil, "", fmt.Errorf("error creating the image output: %v", err)
+	}
+	return reports, destination, nil
+}
+
+// readTIFFPages walks the chain of the image file directories of the TIFF file.
+func readTIFFPages(r io.ReaderAt) (binary.ByteOrder, []tiffPage, error) {
+	var head [8]byte
+	if _, err := r.ReadAt(head[:], 0); err != nil {
+		return nil, nil, errTIFF
+	}
+	var order binary.ByteOrder
+	switch string(head[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, nil, errTIFF
+	}
+
+	var pages []tiffPage
+	seen := make(map[uint32]bool)
+	for ifd := order.Uint32(head[4:]); ifd != 0; {
+		if seen[ifd] {
+			return nil, nil, errTIFF
+		}
+		seen[ifd] = true
+
+		var count [2]byte
+		if _, err := r.ReadAt(count[:], int64(ifd)); err != nil {
+			return nil, nil, errTIFF
+		}
+		n := int(order.Uint16(count[:]))
+		entries := make([]byte, n*12+4)
+		if _, err := r.ReadAt(entries, int64(ifd)+2); err != nil {
+			return nil, nil, errTIFF
+		}
+		page := tiffPage{ifd: ifd}
+		for i := 0; i < n; i++ {
+			e := entries[i*12 : i*12+12]
+			tag, typ, value := order.Uint16(e), order.Uint16(e[2:]), e[8:12]
+			switch {
+			case (tag == tagXResolution || tag == tagYResolution) && typ == tiffRational:
+				var rat [8]byte
+				if _, err := r.ReadAt(rat[:], int64(order.Uint32(value))); err != nil {
+					return nil, nil, errTIFF
+				}
+				res := [2]uint32{order.Uint32(rat[:]), order.Uint32(rat[4:])}
+				if tag == tagXResolution {
+					page.xres = res
+				} else {
+					page.yres = res
+				}
+				page.hasResolution = true
+			case tag == tagResolutionUnit && typ == tiffShort:
+				page.unit = order.Uint16(value)
+			}
+		}
+		pages = append(pages, page)
+		ifd = order.Uint32(entries[n*12:])
+	}
+	if len(pages) == 0 {
+		return nil, nil, errTIFF
+	}
+	return order, pages, nil
+}
+
+// tiffPageReader reads the TIFF file as if the page was its first image,
+// by substituting the offset of the first image file directory in the header.
+type tiffPageReader struct {
+	ra    io.ReaderAt
+	order binary.ByteOrder
+	ifd   uint32
+	off   int64
+}
+
+func (r *tiffPageReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.ra.ReadAt(p, off)
+	var head [4]byte
+	r.order.PutUint32(head[:], r.ifd)
+	for i := int64(4); i < 8; i++ {
+		if i >= off && i < off+int64(n) {
+			p[i-off] = head[i-4]
+		}
+	}
+	return n, err
+}
+
+func (r *tiffPageReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.off)
+	r.off += int64(n)
+	return n, err
+}
+
+// tiffWriter writes a multi-page TIFF file of Deflate compressed RGB pages.
+// The pages are written as soon as they are added.
+type tiffWriter struct {
+	f *os.File
+	// pos is the end of the written data and next the offset of the pointer
+	// to the next image file directory.
+	pos, next int64
+}
+
+func newTIFFWriter(f *os.File) (*tiffWriter, error) {
+	if _, err := f.Write([]byte("II*\x00\x00\x00\x00\x00")); err != nil {
+		return nil, err
+	}
+	return &tiffWriter{f: f, pos: 8, next: 4}, nil
+}
+
+// write writes the data at the end of the file, aligned to a word boundary.
+func (tw *tiffWriter) write(data []byte) (uint32, error) {
+	tw.pos += tw.pos & 1
+	if _, err := tw.f.WriteAt(data, tw.pos); err != nil {
+		return 0, err
+	}
+	off := tw.pos
+	tw.pos += int64(len(data))
+	return uint32(off), nil
+}
+
+// addPage adds the image as the next page with the resolution of the source page.
+// The 16 bit images keep their precision.
+func (tw *tiffWriter) addPage(img image.Image, page tiffPage) error {
+	le := binary.LittleEndian
+	b := img.Bounds()
+	depth := 8
+	if _, ok := img.(*image.NRGBA64); ok {
+		depth = 16
+	}
+
+	var pixels bytes.Buffer
+	zw := zlib.NewWriter(&pixels)
+	row := make([]byte, b.Dx()*3*depth/8)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			i := (x - b.Min.X) * 3 * depth / 8
+			if depth == 16 {
+				le.PutUint16(row[i:], uint16(r))
+				le.PutUint16(row[i+2:], uint16(g))
+				le.PutUint16(row[i+4:], uint16(bl))
+			} else {
+				row[i], row[i+1], row[i+2] = uint8(r>>8), uint8(g>>8), uint8(bl>>8)
+			}
+		}
+		zw.Write(row)
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	strip, err := tw.write(pixels.Bytes())
+	if err != nil {
+		return err
+	}
+	bits := make([]byte, 6)
+	for i := 0; i < 3; i++ {
+		le.PutUint16(bits[i*2:], uint16(depth))
+	}
+	bitsOff, err := tw.write(bits)
+	if err != nil {
+		return err
+	}
+
+	type entry struct {
+		tag, typ     uint16
+		count, value uint32
+	}
+	entries := []entry{
+		{tagNewSubfileType, tiffLong, 1, 2}, // a page of a multi-page image
+		{tagImageWidth, tiffLong, 1, uint32(b.Dx())},
+		{tagImageLength, tiffLong, 1, uint32(b.Dy())},
+		{tagBitsPerSample, tiffShort, 3, bitsOff},
+		{tagCompression, tiffShort, 1, 8}, // Deflate
+		{tagPhotometric, tiffShort, 1, 2}, // RGB
+		{tagStripOffsets, tiffLong, 1, strip},
+		{tagSamplesPerPixel, tiffShort, 1, 3},
+		{tagRowsPerStrip, tiffLong, 1, uint32(b.Dy())},
+		{tagStripByteCounts, tiffLong, 1, uint32(pixels.Len())},
+	}
+	if page.hasResolution {
+		rat := make([]byte, 16)
+		le.PutUint32(rat, page.xres[0])
+		le.PutUint32(rat[4:], page.xres[1])
+		le.PutUint32(rat[8:], page.yres[0])
+		le.PutUint32(rat[12:], page.yres[1])
+		off, err := tw.write(rat)
+		if err != nil {
+			return err
+		}
+		entries = append(entries,
+			entry{tagXResolution, tiffRational, 1, off},
+			entry{tagYResolution, tiffRational, 1, off + 8},
+		)
+		if page.unit != 0 {
+			entries = append(entries, entry{tagResolutionUnit, tiffShort, 1, uint32(page.unit)})
+		}
+	}
+
+	ifd := make([]byte, 2+len(entries)*12+4)
+	le.PutUint16(ifd, uint16(len(entries)))
+	for i, e := range entries {
+		p := ifd[2+i*12:]
+		le.PutUint16(p, e.tag)
+		le.PutUint16(p[2:], e.typ)
+		le.PutUint32(p[4:], e.count)
+		le.PutUint32(p[8:], e.value)
+	}
+	off, err := tw.write(ifd)
+	if err != nil {
+		return err
+	}
+	// Link the directory to the previous one.
+	var ptr [4]byte
+	le.PutUint32(ptr[:], off)
+	if _, err := tw.f.WriteAt(ptr[:], tw.next); err != nil {
+		return err
+	}
+	tw.next = int64(off) + int64(len(ifd)) - 4
+	return nil
+}
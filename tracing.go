@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The kinds and the status codes of the OTLP spans.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanStatusError  = 2
+)
+
+// tracer exports the spans of the served requests and of their pipeline stages to an
+// OpenTelemetry collector, with the OTLP/HTTP protocol in its JSON encoding. It's configured
+// by the standard OTEL_* environment variables, like the SDKs of the other services, and
+// continues the traces of the W3C traceparent headers. The methods of a nil tracer do nothing.
+type tracer struct {
+	endpoint string
+	headers  map[string]string
+	resource []otlpAttr
+	client   *http.Client
+	sampler  sampler
+
+	// The spans are exported in batches, every delay or batch spans, whichever comes
+	// first. The spans ended while the queue is full are dropped.
+	spans chan *span
+	delay time.Duration
+	batch int
+	done  chan struct{}
+}
+
+// newTracer returns the tracer configured by the environment, or nil when no OTLP endpoint
+// is set or the tracing is disabled.
+func newTracer() (*tracer, error) {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return nil, nil
+	}
+	switch exporter := os.Getenv("OTEL_TRACES_EXPORTER"); exporter {
+	case "", "otlp":
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported traces exporter %q (available: otlp)", exporter)
+	}
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+	if protocol := otelEnv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", "OTEL_EXPORTER_OTLP_PROTOCOL"); protocol != "" && protocol != "http/json" {
+		return nil, fmt.Errorf("unsupported OTLP protocol %q (available: http/json)", protocol)
+	}
+	headers, err := parseOtelList(otelEnv("OTEL_EXPORTER_OTLP_TRACES_HEADERS", "OTEL_EXPORTER_OTLP_HEADERS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP headers: %v", err)
+	}
+	timeout, err := otelMillis(otelEnv("OTEL_EXPORTER_OTLP_TRACES_TIMEOUT", "OTEL_EXPORTER_OTLP_TIMEOUT"), 10000)
+	if err != nil {
+		return nil, err
+	}
+	delay, err := otelMillis(os.Getenv("OTEL_BSP_SCHEDULE_DELAY"), 5000)
+	if err != nil {
+		return nil, err
+	}
+	queue, err := otelInt(os.Getenv("OTEL_BSP_MAX_QUEUE_SIZE"), 2048)
+	if err != nil {
+		return nil, err
+	}
+	batch, err := otelInt(os.Getenv("OTEL_BSP_MAX_EXPORT_BATCH_SIZE"), 512)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSampler(os.Getenv("OTEL_TRACES_SAMPLER"), os.Getenv("OTEL_TRACES_SAMPLER_ARG"))
+	if err != nil {
+		return nil, err
+	}
+
+	attrs, err := parseOtelList(os.Getenv("OTEL_RESOURCE_ATTRIBUTES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid resource attributes: %v", err)
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		attrs["service.name"] = name
+	} else if attrs["service.name"] == "" {
+		attrs["service.name"] = "facemask"
+	}
+	if Version != "" && attrs["service.version"] == "" {
+		attrs["service.version"] = Version
+	}
+	var resource []otlpAttr
+	for k, v := range attrs {
+		resource = append(resource, stringAttr(k, v))
+	}
+
+	t := &tracer{
+		endpoint: endpoint,
+		headers:  headers,
+		resource: resource,
+		client:   &http.Client{Timeout: timeout},
+		sampler:  s,
+		spans:    make(chan *span, queue),
+		delay:    delay,
+		batch:    batch,
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t, nil
+}
+
+// start starts the server span of a request, continuing the trace of the traceparent header,
+// if any. It returns nil for the traces not sampled.
+func (t *tracer) start(traceparent, name string) *span {
+	if t == nil {
+		return nil
+	}
+	sp := &span{tracer: t, name: name, kind: spanKindServer, start: time.Now()}
+	parent, ok := parseTraceparent(traceparent)
+	if ok {
+		sp.traceID, sp.parentID = parent.traceID, parent.spanID
+	} else {
+		rand.Read(sp.traceID[:])
+	}
+	rand.Read(sp.spanID[:])
+	if !t.sampler.sample(sp.traceID, parent, ok) {
+		return nil
+	}
+	return sp
+}
+
+// shutdown exports the remaining spans. The tracer can't be used afterwards.
+func (t *tracer) shutdown() {
+	if t == nil {
+		return
+	}
+	close(t.spans)
+	<-t.done
+}
+
+// run exports the ended spans in batches.
+func (t *tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.delay)
+	defer ticker.Stop()
+
+	var spans []*span
+	for {
+		select {
+		case sp, ok := <-t.spans:
+			if !ok {
+				t.export(spans)
+				return
+			}
+			if spans = append(spans, sp); len(spans) >= t.batch {
+				t.export(spans)
+				spans = nil
+			}
+		case <-ticker.C:
+			t.export(spans)
+			spans = nil
+		}
+	}
+}
+
+// export posts the spans to the collector. The failed exports are logged and dropped.
+func (t *tracer) export(spans []*span) {
+	if len(spans) == 0 {
+		return
+	}
+	data := make([]otlpSpan, len(spans))
+	for i, sp := range spans {
+		data[i] = sp.otlp()
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": t.resource},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "facemask", "version": Version},
+				"spans": data,
+			}},
+		}},
+	})
+	if err != nil {
+		log.Printf("Error exporting the traces: %v", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error exporting the traces: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		log.Printf("Error exporting the traces: %v", err)
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("Error exporting the traces: %s", resp.Status)
+	}
+}
+
+// span is an operation of a trace. The methods of a nil span, the span of the traces
+// not sampled, do nothing.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []otlpAttr
+	err      error
+}
+
+// setAttr sets the attributes of the span.
+func (sp *span) setAttr(attrs ...otlpAttr) {
+	if sp == nil {
+		return
+	}
+	sp.attrs = append(sp.attrs, attrs...)
+}
+
+// setError marks the span as failed.
+func (sp *span) setError(err error) {
+	if sp == nil {
+		return
+	}
+	sp.err = err
+}
+
+// finish ends the span, queueing it for the export.
+func (sp *span) finish() {
+	if sp == nil {
+		return
+	}
+	sp.end = time.Now()
+	select {
+	case sp.tracer.spans <- sp:
+	default:
+	}
+}
+
+// stageHook returns the OnStage hook of the detectors, recording the pipeline stages as
+// the child spans of the span.
+func (sp *span) stageHook() func(stage string, start time.Time, err error) {
+	if sp == nil {
+		return nil
+	}
+	return func(stage string, start time.Time, err error) {
+		child := &span{tracer: sp.tracer, traceID: sp.traceID, parentID: sp.spanID, name: stage, kind: spanKindInternal, start: start, err: err}
+		rand.Read(child.spanID[:])
+		child.finish()
+	}
+}
+
+// otlp returns the span in the OTLP JSON encoding.
+func (sp *span) otlp() otlpSpan {
+	s := otlpSpan{
+		TraceID:    hex.EncodeToString(sp.traceID[:]),
+		SpanID:     hex.EncodeToString(sp.spanID[:]),
+		Name:       sp.name,
+		Kind:       sp.kind,
+		Start:      strconv.FormatInt(sp.start.UnixNano(), 10),
+		End:        strconv.FormatInt(sp.end.UnixNano(), 10),
+		Attributes: sp.attrs,
+	}
+	if sp.parentID != [8]byte{} {
+		s.ParentSpanID = hex.EncodeToString(sp.parentID[:])
+	}
+	if sp.err != nil {
+		s.Status = otlpStatus{Code: spanStatusError, Message: sp.err.Error()}
+	}
+	return s
+}
+
+// spanKey is the context key of the span of a request.
+type spanKey struct{}
+
+// spanFrom returns the span of the request context, nil if it's not traced.
+func spanFrom(ctx context.Context) *span {
+	sp, _ := ctx.Value(spanKey{}).(*span)
+	return sp
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       otlpStatus `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+func stringAttr(key, value string) otlpAttr {
+	return otlpAttr{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+// The 64 bit integers are encoded as strings in the OTLP JSON encoding.
+func intAttr(key string, value int) otlpAttr {
+	return otlpAttr{Key: key, Value: map[string]string{"intValue": strconv.Itoa(value)}}
+}
+
+// spanContext identifies the parent span of a trace continued from another service.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// parseTraceparent parses the W3C traceparent header, version-traceid-parentid-flags.
+func parseTraceparent(h string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || len(traceID) != 16 || len(spanID) != 8 || len(flags) != 1 {
+		return sc, false
+	}
+	copy(sc.traceID[:], traceID)
+	copy(sc.spanID[:], spanID)
+	if sc.traceID == [16]byte{} || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+	sc.sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// sampler decides which traces are recorded, like the samplers of OTEL_TRACES_SAMPLER.
+type sampler struct {
+	// parentBased follows the decision of the parent span, when there's one.
+	parentBased bool
+	// ratio is the ratio of the traces sampled without a parent.
+	ratio float64
+}
+
+func newSampler(name, arg string) (sampler, error) {
+	s := sampler{parentBased: strings.HasPrefix(name, "parentbased_"), ratio: 1}
+	switch strings.TrimPrefix(name, "parentbased_") {
+	case "", "always_on":
+	case "always_off":
+		s.ratio = 0
+	case "traceidratio":
+		if arg != "" {
+			ratio, err := strconv.ParseFloat(arg, 64)
+			if err != nil || ratio < 0 || ratio > 1 {
+				return s, fmt.Errorf("invalid sampler ratio %q", arg)
+			}
+			s.ratio = ratio
+		}
+	default:
+		return s, fmt.Errorf("unsupported traces sampler %q", name)
+	}
+	if name == "" {
+		s.parentBased = true
+	}
+	return s, nil
+}
+
+// sample decides whether the trace is sampled. The ratio is applied to the random
+// lower half of the trace ID, so all the services sample the same traces.
+func (s sampler) sample(traceID [16]byte, parent spanContext, hasParent bool) bool {
+	if s.parentBased && hasParent {
+		return parent.sampled
+	}
+	switch s.ratio {
+	case 0:
+		return false
+	case 1:
+		return true
+	}
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < uint64(s.ratio*(1<<63))
+}
+
+// otelEnv returns the first variable set of the environment, the signal specific ones first.
+func otelEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseOtelList parses the comma separated key=value list of the headers and the resource
+// attributes, whose values are URL encoded.
+func parseOtelList(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid item %q", item)
+		}
+		v, err := url.QueryUnescape(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, err
+		}
+		m[strings.TrimSpace(kv[0])] = v
+	}
+	return m, nil
+}
+
+// otelMillis parses the durations in milliseconds of the environment.
+func otelMillis(s string, def int) (time.Duration, error) {
+	n, err := otelInt(s, def)
+	return time.Duration(n) * time.Millisecond, err
+}
+
+func otelInt(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, errors.New("invalid OpenTelemetry setting " + strconv.Quote(s))
+	}
+	return n, nil
+}
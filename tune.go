@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	facemask "github.com/esimov/facemask/core"
+	pigo "github.com/esimov/pigo/core"
+)
+
+// tuneGrid holds the detection parameter values searched by the tune command.
+var tuneGrid = struct {
+	shift, scale, q []float64
+	min, max        []int
+}{
+	shift: []float64{0.05, 0.1, 0.15, 0.2},
+	scale: []float64{1.05, 1.1, 1.2},
+	min:   []int{20, 40, 80},
+	max:   []int{500, 1000},
+	q:     []float64{2, 5, 8, 12},
+}
+
+// tuneResult is the accuracy of a detection parameter set.
+type tuneResult struct {
+	shift, scale, q float64
+	min, max        int
+	eval            facemask.Evaluation
+}
+
+// tuneCommand grid searches the detection parameters against the ground truth face boxes
+// of a sample set and reports the parameter set with the best F1 score.
+func tuneCommand(args []string) {
+	fs := flag.NewFlagSet("tune", flag.ExitOnError)
+	flags := tuneFlags(fs)
+	fd := flags.fd
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: facemask tune -in samples/ -truth truth.json [-out tuned.yaml]\n\n")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	defer fd.Close()
+
+	if len(*flags.source) == 0 || len(*flags.truth) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	boxes, err := facemask.LoadTruth(*flags.truth)
+	if err != nil {
+		log.Fatalf("Error loading the ground truth: %v", err)
+	}
+
+	var results []*tuneResult
+	for _, shift := range tuneGrid.shift {
+		for _, scale := range tuneGrid.scale {
+			for _, min := range tuneGrid.min {
+				for _, max := range tuneGrid.max {
+					fd.ShiftFactor, fd.ScaleFactor, fd.MinSize, fd.MaxSize = shift, scale, min, max
+
+					var byQ []*tuneResult
+					for _, q := range tuneGrid.q {
+						byQ = append(byQ, &tuneResult{shift: shift, scale: scale, min: min, max: max, q: q})
+					}
+					for file, truth := range boxes {
+						faces, err := fd.DetectFaces(filepath.Join(*flags.source, file))
+						if err != nil {
+							log.Fatalf("Detection error: %v", err)
+						}
+						// The quality threshold doesn't need a new detection run.
+						for _, r := range byQ {
+							r.eval.Add(qualityFilter(faces, r.q), truth, *flags.matchAt)
+						}
+					}
+					results = append(results, byQ...)
+				}
+			}
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if f1, other := results[i].eval.F1(), results[j].eval.F1(); f1 != other {
+			return f1 > other
+		}
+		return results[i].eval.MeanIoU() > results[j].eval.MeanIoU()
+	})
+
+	fmt.Printf("%-6s %-6s %-5s %-5s %-5s %-9s %-9s %-9s\n", "shift", "scale", "min", "max", "q", "precision", "recall", "f1")
+	for i, r := range results {
+		if i == 5 {
+			break
+		}
+		fmt.Printf("%-6g %-6g %-5d %-5d %-5g %-9.3f %-9.3f %-9.3f\n",
+			r.shift, r.scale, r.min, r.max, r.q, r.eval.Precision(), r.eval.Recall(), r.eval.F1())
+	}
+
+	if *flags.output != "" && len(results) > 0 {
+		if err := writeProfile(*flags.output, *flags.name, results[0]); err != nil {
+			log.Fatalf("Error writing the profile: %v", err)
+		}
+	}
+}
+
+// tuneSettings are the settings of the flags of the tune command.
+type tuneSettings struct {
+	source  *string
+	truth   *string
+	output  *string
+	name    *string
+	matchAt *float64
+	fd      *facemask.Detector
+}
+
+// tuneFlags defines the flags of the tune command.
+func tuneFlags(fs *flag.FlagSet) *tuneSettings {
+	return &tuneSettings{
+		source:  fs.String("in", "", "Directory of the sample images"),
+		truth:   fs.String("truth", "", "Ground truth face boxes (JSON)"),
+		output:  fs.String("out", "", "Configuration file the best parameters are written to as a profile (optional)"),
+		name:    fs.String("name", "tuned", "Name of the written profile"),
+		matchAt: fs.Float64("match-iou", 0.5, "Minimum IoU of a detection matching a ground truth box"),
+		fd:      detectorFlags(fs),
+	}
+}
+
+// qualityFilter returns the detections above the quality threshold.
+func qualityFilter(faces []pigo.Detection, q float64) []pigo.Detection {
+	var out []pigo.Detection
+	for _, f := range faces {
+		if float64(f.Q) > q {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// writeProfile writes the tuned parameters as a configuration file profile,
+// to be used with -config and -profile.
+func writeProfile(path, name string, r *tuneResult) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f, "profile: %s\nprofiles:\n  %s:\n", name, name)
+	for _, kv := range [][2]string{
+		{"shift", strconv.FormatFloat(r.shift, 'g', -1, 64)},
+		{"scale", strconv.FormatFloat(r.scale, 'g', -1, 64)},
+		{"min", strconv.Itoa(r.min)},
+		{"max", strconv.Itoa(r.max)},
+		{"q", strconv.FormatFloat(r.q, 'g', -1, 64)},
+	} {
+		fmt.Fprintf(f, "    %s: %s\n", kv[0], kv[1])
+	}
+	return f.Close()
+}
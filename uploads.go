@@ -0,0 +1,426 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tusVersion is the version of the tus resumable upload protocol implemented by the uploads.
+const tusVersion = "1.0.0"
+
+// uploadSweep is the longest interval at which the expired uploads are removed.
+const uploadSweep = 10 * time.Minute
+
+// errUploadQuota and errClientQuota reject the uploads exceeding the quotas.
+var (
+	errUploadQuota = errors.New("the upload storage is full, try again later")
+	errClientQuota = errors.New("too many incomplete uploads of the client")
+)
+
+// uploads stores the resumable uploads, following the core protocol of tus (https://tus.io)
+// with the creation, termination and expiration extensions. An upload is the data file named
+// by its ID and its info file, the offset being the size of the data file, so the uploads
+// survive the restarts of the server.
+type uploads struct {
+	dir     string
+	maxSize int64
+	// expiry is the time after the last change the uploads are removed, whether they are
+	// completed or not.
+	expiry time.Duration
+	// quota is the maximum total length of the stored uploads and perClient the maximum
+	// number of the incomplete uploads of a client. Zero doesn't limit them.
+	quota     int64
+	perClient int
+
+	mu   sync.Mutex
+	busy map[string]bool
+	// createMu serializes the creations, so the quotas are checked against the stored uploads.
+	createMu sync.Mutex
+}
+
+// uploadInfo is the info file of an upload.
+type uploadInfo struct {
+	Length int64 `json:"length"`
+	// Client is the address of the client which created the upload.
+	Client string `json:"client,omitempty"`
+	// Hash is the SHA-256 hash of the completed upload.
+	Hash string `json:"hash,omitempty"`
+	// Results are the metadata of the results of the upload by their ETag, answering the
+	// HEAD requests without processing the upload again.
+	Results map[string]uploadResult `json:"results,omitempty"`
+}
+
+// uploadResult is the metadata of a result of an upload.
+type uploadResult struct {
+	Type   string `json:"type"`
+	Length int    `json:"length"`
+	Faces  int    `json:"faces"`
+}
+
+// newUploads stores the uploads in the directory, removing the expired ones.
+func newUploads(dir string, maxSize int64, expiry time.Duration) (*uploads, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	u := &uploads{dir: dir, maxSize: maxSize, expiry: expiry, busy: make(map[string]bool)}
+	u.sweep()
+	return u, nil
+}
+
+// expire removes the expired uploads periodically, until done is closed.
+func (u *uploads) expire(done <-chan struct{}) {
+	interval := u.expiry / 2
+	if interval > uploadSweep {
+		interval = uploadSweep
+	} else if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			u.sweep()
+		}
+	}
+}
+
+// path returns the path of the data file of the upload.
+func (u *uploads) path(id string) string {
+	return filepath.Join(u.dir, id)
+}
+
+// stat returns the length and the offset of the upload, and the time of its last change.
+func (u *uploads) stat(id string) (int64, int64, time.Time, error) {
+	info, err := u.info(id)
+	if err != nil {
+		return 0, 0, time.Time{}, err
+	}
+	fi, err := os.Stat(u.path(id))
+	if err != nil {
+		return 0, 0, time.Time{}, err
+	}
+	return info.Length, fi.Size(), fi.ModTime(), nil
+}
+
+// info reads the info file of the upload.
+func (u *uploads) info(id string) (uploadInfo, error) {
+	var info uploadInfo
+	data, err := ioutil.ReadFile(u.path(id) + ".json")
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+// writeInfo writes the info file of the upload, which must be acquired.
+func (u *uploads) writeInfo(id string, info uploadInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(u.path(id)+".json", data, 0600)
+}
+
+// create creates an empty upload of the length for the client, returning its ID. The uploads
+// exceeding the quotas are rejected with errUploadQuota and errClientQuota.
+func (u *uploads) create(length int64, client string) (string, error) {
+	u.createMu.Lock()
+	defer u.createMu.Unlock()
+	u.sweep()
+
+	if u.quota > 0 || u.perClient > 0 {
+		total, incomplete, err := u.usage(client)
+		if err != nil {
+			return "", err
+		}
+		if u.quota > 0 && total+length > u.quota {
+			return "", errUploadQuota
+		}
+		if u.perClient > 0 && incomplete >= u.perClient {
+			return "", errClientQuota
+		}
+	}
+
+	var b [16]byte
+	rand.Read(b[:])
+	id := hex.EncodeToString(b[:])
+	if err := u.writeInfo(id, uploadInfo{Length: length, Client: client}); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(u.path(id), nil, 0600); err != nil {
+		os.Remove(u.path(id) + ".json")
+		return "", err
+	}
+	return id, nil
+}
+
+// usage returns the total length of the stored uploads and the number of the incomplete
+// uploads of the client.
+func (u *uploads) usage(client string) (int64, int, error) {
+	files, err := filepath.Glob(filepath.Join(u.dir, "*.json"))
+	if err != nil {
+		return 0, 0, err
+	}
+	var (
+		total      int64
+		incomplete int
+	)
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".json")
+		info, err := u.info(id)
+		if err != nil {
+			continue
+		}
+		total += info.Length
+		if fi, err := os.Stat(u.path(id)); err == nil && fi.Size() < info.Length && info.Client == client {
+			incomplete++
+		}
+	}
+	return total, incomplete, nil
+}
+
+// complete records the hash of the upload completed by the last chunk, which must be acquired.
+func (u *uploads) complete(id string) error {
+	info, err := u.info(id)
+	if err != nil {
+		return err
+	}
+	if info.Hash, _, err = hashFile(u.path(id)); err != nil {
+		return err
+	}
+	return u.writeInfo(id, info)
+}
+
+// addResult records the metadata of the result of the upload with the ETag. It's skipped
+// while the upload is changed by another request, the result being recorded by the next one.
+func (u *uploads) addResult(id, etag string, result uploadResult) error {
+	if !u.acquire(id) {
+		return nil
+	}
+	defer u.release(id)
+	info, err := u.info(id)
+	if err != nil {
+		return err
+	}
+	if info.Results == nil {
+		info.Results = make(map[string]uploadResult)
+	}
+	info.Results[etag] = result
+	return u.writeInfo(id, info)
+}
+
+// remove removes the upload.
+func (u *uploads) remove(id string) {
+	os.Remove(u.path(id))
+	os.Remove(u.path(id) + ".json")
+}
+
+// sweep removes the uploads not changed within the expiry time.
+func (u *uploads) sweep() {
+	files, err := filepath.Glob(filepath.Join(u.dir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".json")
+		if _, _, modTime, err := u.stat(id); err != nil || time.Since(modTime) > u.expiry {
+			if u.acquire(id) {
+				u.remove(id)
+				u.release(id)
+			}
+		}
+	}
+}
+
+// acquire locks the upload for a single change at once, reporting whether it's free.
+func (u *uploads) acquire(id string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.busy[id] {
+		return false
+	}
+	u.busy[id] = true
+	return true
+}
+
+func (u *uploads) release(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.busy, id)
+}
+
+// completed returns the path of the data file of the completed upload and its info, with
+// the status of the response in case it doesn't exist or it's incomplete.
+func (u *uploads) completed(id string) (string, uploadInfo, int, error) {
+	if !validUploadID(id) {
+		return "", uploadInfo{}, http.StatusNotFound, errors.New("upload not found")
+	}
+	info, err := u.info(id)
+	if err != nil {
+		return "", info, http.StatusNotFound, errors.New("upload not found")
+	}
+	fi, err := os.Stat(u.path(id))
+	if err != nil {
+		return "", info, http.StatusNotFound, errors.New("upload not found")
+	}
+	if fi.Size() < info.Length {
+		return "", info, http.StatusConflict, fmt.Errorf("the upload is incomplete: %d of %d bytes", fi.Size(), info.Length)
+	}
+	if info.Hash == "" {
+		// The upload is completed by a chunk whose hashing failed.
+		if info.Hash, _, err = hashFile(u.path(id)); err != nil {
+			return "", info, http.StatusInternalServerError, fmt.Errorf("error reading the upload: %v", err)
+		}
+	}
+	return u.path(id), info, http.StatusOK, nil
+}
+
+// validUploadID reports whether the ID is one generated by create, so it can't point
+// outside of the upload directory.
+func validUploadID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// handleUploads creates the uploads on POST /uploads, and returns the offset of the upload
+// on HEAD /uploads/<id>, appends the chunk at the offset on PATCH and removes it on DELETE.
+// The completed uploads are processed by posting to /mask?upload=<id>.
+func (s *server) handleUploads(w http.ResponseWriter, r *http.Request) {
+	u := s.uploads
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if v := r.Header.Get("Tus-Resumable"); v != "" && v != tusVersion && r.Method != http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/uploads"), "/")
+	if id == "" {
+		switch r.Method {
+		case http.MethodOptions:
+			w.Header().Set("Tus-Version", tusVersion)
+			w.Header().Set("Tus-Extension", "creation,termination,expiration")
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(u.maxSize, 10))
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodPost:
+			length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+			if err != nil || length <= 0 {
+				http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+				return
+			}
+			if length > u.maxSize {
+				http.Error(w, fmt.Sprintf("the upload exceeds %d MB", u.maxSize>>20), http.StatusRequestEntityTooLarge)
+				return
+			}
+			id, err := u.create(length, s.clientIP(r))
+			switch err {
+			case nil:
+			case errUploadQuota:
+				http.Error(w, err.Error(), http.StatusInsufficientStorage)
+				return
+			case errClientQuota:
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+				return
+			default:
+				http.Error(w, fmt.Sprintf("error creating the upload: %v", err), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Location", "/uploads/"+id)
+			w.Header().Set("Upload-Expires", time.Now().Add(u.expiry).UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.Header().Set("Allow", "OPTIONS, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if !validUploadID(id) {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead, http.MethodPatch, http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "HEAD, PATCH, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !u.acquire(id) {
+		http.Error(w, "the upload is being changed by another request", http.StatusLocked)
+		return
+	}
+	defer u.release(id)
+	length, offset, modTime, err := u.stat(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Length", strconv.FormatInt(length, 10))
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Expires", modTime.Add(u.expiry).UTC().Format(http.TimeFormat))
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			http.Error(w, "the chunks must be sent as application/offset+octet-stream", http.StatusUnsupportedMediaType)
+			return
+		}
+		if r.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			http.Error(w, fmt.Sprintf("the upload continues at offset %d", offset), http.StatusConflict)
+			return
+		}
+		f, err := os.OpenFile(u.path(id), os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error opening the upload: %v", err), http.StatusInternalServerError)
+			return
+		}
+		// The data received before a broken connection is kept, so the upload resumes after it.
+		n, err := io.Copy(f, io.LimitReader(r.Body, length-offset))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		offset += n
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Expires", time.Now().Add(u.expiry).UTC().Format(http.TimeFormat))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error writing the upload: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if offset == length {
+			if n, _ := r.Body.Read(make([]byte, 1)); n > 0 {
+				http.Error(w, "the chunk exceeds the upload length", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err := u.complete(id); err != nil {
+				log.Printf("Error hashing the upload %s: %v", id, err)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		u.remove(id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	facemask "github.com/esimov/facemask/core"
+)
+
+// maxJobSize is the maximum size of the downloaded source images of the worker jobs.
+const maxJobSize = 256 << 20
+
+// jobClient downloads the sources and uploads the outputs of the worker jobs.
+var jobClient = &http.Client{Timeout: 5 * time.Minute}
+
+// workerJob is an image processing job consumed from the message queue. The source and the
+// output are either http(s) URLs, e.g. the presigned URLs of an object store, or file paths
+// relative to the -in and the -out directories of the workers, shared by them: the source is
+// downloaded with GET and the output uploaded with PUT. The source can also be the
+// s3://bucket/key URI of an object.
+type workerJob struct {
+	ID     string `json:"id,omitempty"`
+	Source string `json:"source"`
+	Output string `json:"output,omitempty"`
+	// Reply is the subject or the Redis list of the result, instead of the -results one.
+	Reply string `json:"reply,omitempty"`
+}
+
+// workerResult is the result of a job published to the message queue.
+type workerResult struct {
+	ID     string                `json:"id,omitempty"`
+	Source string                `json:"source"`
+	Output string                `json:"output,omitempty"`
+	Faces  []facemask.FaceReport `json:"faces"`
+	Error  string                `json:"error,omitempty"`
+}
+
+// jobBroker is the message queue the worker consumes the jobs from.
+type jobBroker interface {
+	// receive blocks until the next job, returning it with the reply subject, if any.
+	receive() ([]byte, string, error)
+	// publish publishes the result to the subject or the list.
+	publish(to string, data []byte) error
+	// ack acknowledges the last job received, once its result is published.
+	ack() error
+	Close() error
+}
+
+// natsBroker consumes the jobs of a NATS subject.
+type natsBroker struct {
+	*natsConn
+}
+
+func (nb natsBroker) receive() ([]byte, string, error) {
+	msg, err := nb.next()
+	return msg.Data, msg.Reply, err
+}
+
+// ack does nothing, the core NATS delivery being at most once.
+func (nb natsBroker) ack() error { return nil }
+
+// redisPoll is the interval at which the idle Redis workers requeue the expired jobs.
+const redisPoll = 5 * time.Second
+
+// redisReplyExpiry is the time the reply lists of the jobs are kept after their last result,
+// so the late results, pushed after the producer is gone, don't accumulate.
+const redisReplyExpiry = time.Hour
+
+// redisBroker consumes the jobs of a Redis list, pushing the results to a list too. The jobs
+// are leased for the visibility timeout until they are acknowledged, and the jobs whose lease
+// expired, e.g. of the dead workers, are requeued by the idle workers. The connection is
+// dropped by the failed commands and redialed by the next ones.
+type redisBroker struct {
+	url        string
+	key        string
+	results    string
+	visibility time.Duration
+	rc         *redisConn
+	// job is the last job received, acknowledged by ack.
+	job string
+}
+
+func (rb *redisBroker) receive() ([]byte, string, error) {
+	for {
+		rc, err := rb.conn()
+		if err != nil {
+			return nil, "", err
+		}
+		job, err := rc.take(rb.key, rb.visibility, redisPoll)
+		if err == errRedisNil {
+			if n, err := rc.requeue(rb.key); err != nil {
+				return nil, "", rb.check(err)
+			} else if n > 0 {
+				log.Printf("Requeued %d expired jobs", n)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, "", rb.check(err)
+		}
+		rb.job = job
+		return []byte(job), "", nil
+	}
+}
+
+func (rb *redisBroker) ack() error {
+	rc, err := rb.conn()
+	if err != nil {
+		return err
+	}
+	return rb.check(rc.ack(rb.key, rb.job))
+}
+
+func (rb *redisBroker) publish(to string, data []byte) error {
+	rc, err := rb.conn()
+	if err != nil {
+		return err
+	}
+	if err := rc.push(to, string(data)); err != nil {
+		return rb.check(err)
+	}
+	if to == rb.results {
+		return nil
+	}
+	return rb.check(rc.expire(to, redisReplyExpiry))
+}
+
+// conn returns the connection, redialing it if it was dropped.
+func (rb *redisBroker) conn() (*redisConn, error) {
+	if rb.rc == nil {
+		rc, err := dialRedis(rb.url)
+		if err != nil {
+			return nil, err
+		}
+		rb.rc = rc
+	}
+	return rb.rc, nil
+}
+
+// check drops the connection after an error.
+func (rb *redisBroker) check(err error) error {
+	if err != nil && rb.rc != nil {
+		rb.rc.Close()
+		rb.rc = nil
+	}
+	return err
+}
+
+func (rb *redisBroker) Close() error {
+	if rb.rc == nil {
+		return nil
+	}
+	return rb.rc.Close()
+}
+
+// openBroker connects to the NATS or the Redis broker of the URL, subscribing to the
+// subject, or to the Redis list, of the jobs. The results are published to the results
+// subject or list, unless the jobs have their reply.
+func openBroker(rawurl, subject, results, group string, visibility time.Duration) (jobBroker, error) {
+	if strings.HasPrefix(rawurl, "redis://") {
+		rb := &redisBroker{url: rawurl, key: subject, results: results, visibility: visibility}
+		if _, err := rb.conn(); err != nil {
+			return nil, err
+		}
+		return rb, nil
+	}
+	nc, err := dialNATS(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if err := nc.subscribe(subject, group, 1); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return natsBroker{nc}, nil
+}
+
+// workerCommand consumes the image processing jobs from a NATS subject or a Redis list and
+// publishes the results. The NATS workers subscribe in a queue group and the Redis workers
+// pop the jobs from the same list, so any number of them can share the jobs.
+func workerCommand(args []string) {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	flags := workerFlags(fs)
+	fd := flags.fd
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: facemask worker -broker nats://localhost:4222 -subject images.in\n\n")
+		fs.PrintDefaults()
+	}
+	parseFlags(fs, args)
+	defer fd.Close()
+
+	if len(*flags.subject) == 0 || len(*flags.results) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	mr, err := maskRenderer(*flags.maskFile, maskOptions{})
+	if err != nil {
+		log.Fatalf("Error loading the mask: %v", err)
+	}
+	facemask.Register("mask", mr)
+	if !isMaskPack(*flags.maskFile) {
+		facemask.Register("mask3d", facemask.NewMask3DRenderer(*flags.maskFile))
+	}
+	renderer, err := facemask.Lookup(*flags.mode)
+	if err != nil {
+		log.Fatalf("Overlay mode not supported: %v", err)
+	}
+
+	jb, err := openBroker(*flags.broker, *flags.subject, *flags.results, *flags.group, *flags.visible)
+	if err != nil {
+		log.Fatalf("Error connecting to the broker: %v", err)
+	}
+	defer jb.Close()
+	log.Printf("Waiting for the jobs on %s", *flags.subject)
+
+	// The brokers reconnect by themselves, so the failures are retried with a growing backoff.
+	backoff := time.Second
+	for {
+		data, reply, err := jb.receive()
+		if err != nil {
+			log.Printf("Error receiving the jobs: %v, retrying in %v", err, backoff)
+			time.Sleep(backoff)
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+		var (
+			job    workerJob
+			result workerResult
+		)
+		if err := json.Unmarshal(data, &job); err != nil {
+			result.Error = fmt.Sprintf("invalid job: %v", err)
+		} else {
+			result = runJob(fd, renderer, job, *flags.inDir, *flags.outDir, *flags.pdfDPI)
+		}
+		if result.Error != "" {
+			log.Printf("Job %s failed: %s", result.Source, result.Error)
+		}
+		if data, err = json.Marshal(result); err != nil {
+			log.Printf("Error encoding the result of %s: %v", result.Source, err)
+			continue
+		}
+		to := *flags.results
+		switch {
+		case job.Reply != "":
+			to = job.Reply
+		case reply != "":
+			to = reply
+		}
+		// The jobs whose result isn't published are left to be requeued.
+		if err := jb.publish(to, data); err != nil {
+			log.Printf("Error publishing the result of %s: %v", result.Source, err)
+			continue
+		}
+		if err := jb.ack(); err != nil {
+			log.Printf("Error acknowledging the job %s: %v", result.Source, err)
+		}
+	}
+}
+
+// workerSettings are the settings of the flags of the worker command.
+type workerSettings struct {
+	broker   *string
+	subject  *string
+	results  *string
+	group    *string
+	visible  *time.Duration
+	inDir    *string
+	outDir   *string
+	maskFile *string
+	mode     *string
+	pdfDPI   *int
+	fd       *facemask.Detector
+}
+
+// workerFlags defines the flags of the worker command.
+func workerFlags(fs *flag.FlagSet) *workerSettings {
+	return &workerSettings{
+		broker:   fs.String("broker", "nats://localhost:4222", "Message broker URL, nats://[user:password@]host[:port], tls://[user:password@]host[:port] or redis://[:password@]host[:port][/db]"),
+		subject:  fs.String("subject", "images.in", "Subject, or Redis list, of the jobs"),
+		results:  fs.String("results", "images.out", "Subject, or Redis list, of the results, unless the job has its reply"),
+		group:    fs.String("group", "facemask", "Queue group of the workers sharing the jobs"),
+		visible:  fs.Duration("visibility", 10*time.Minute, "Time the Redis jobs are leased to the worker, after which they are requeued unless processed"),
+		inDir:    fs.String("in", "", "Directory of the local job sources, whose paths are relative to it; without it the jobs only read URLs"),
+		outDir:   fs.String("out", "", "Directory of the local job outputs, whose paths are relative to it, and of the jobs without an output"),
+		maskFile: fs.String("mask", facemask.DefaultMask, "Mask image, mask pack directory or manifest file"),
+		mode:     fs.String("mode", "mask", "Overlay mode: "+strings.Join(facemask.Renderers(), ", ")),
+		pdfDPI:   fs.Int("pdf-dpi", 150, "Resolution of the rasterized PDF pages in dots per inch"),
+		fd:       detectorFlags(fs),
+	}
+}
+
+// runJob processes the image of the job. The failures are reported in the result.
+func runJob(fd *facemask.Detector, renderer facemask.Renderer, job workerJob, inDir, outDir string, pdfDPI int) workerResult {
+	result := workerResult{ID: job.ID, Source: job.Source, Output: job.Output}
+	if job.Source == "" {
+		result.Error = "invalid job: no source"
+		return result
+	}
+	tmp, err := ioutil.TempDir("", "facemask")
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer os.RemoveAll(tmp)
+
+	var source string
+	if facemask.IsRemote(job.Source) {
+		if source, err = download(job.Source, tmp); err != nil {
+			result.Error = fmt.Sprintf("error downloading the source: %v", err)
+			return result
+		}
+	} else if source, err = jobPath(inDir, job.Source, "-in"); err != nil {
+		result.Error = fmt.Sprintf("invalid source: %v", err)
+		return result
+	}
+	var out output
+	switch {
+	case isURL(job.Output):
+		// The output is encoded in the format of the URL path, or of the source.
+		ext := path.Ext(urlPath(job.Output))
+		if ext == "" {
+			ext = filepath.Ext(source)
+		}
+		out.path = filepath.Join(tmp, "output"+ext)
+	case job.Output != "":
+		if out.path, err = jobPath(outDir, job.Output, "-out"); err != nil {
+			result.Error = fmt.Sprintf("invalid output: %v", err)
+			return result
+		}
+	case outDir != "":
+		out = output{template: defaultOutTemplate, dir: outDir, root: inDir}
+	default:
+		result.Error = "invalid job: no output and no -out directory"
+		return result
+	}
+	if out.path != "" && !outputSupported(source, out.path) {
+		result.Error = fmt.Sprintf("output file type not supported: %v", filepath.Ext(out.path))
+		return result
+	}
+
+	var (
+		pages []facemask.Report
+		dest  string
+	)
+	switch {
+	case isPDF(source):
+		pages, dest, err = processPDF(fd, renderer, source, out, pdfDPI)
+	case isTIFF(source):
+		pages, dest, err = processTIFF(fd, renderer, source, out)
+	default:
+		var (
+			report facemask.Report
+			encode func() error
+		)
+		if report, dest, encode, err = processImage(fd, renderer, source, out, "", "", false, 0, false); err == nil {
+			pages, err = []facemask.Report{report}, encode()
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	// The faces of all the pages of the documents are reported together.
+	result.Faces = []facemask.FaceReport{}
+	for _, page := range pages {
+		result.Faces = append(result.Faces, page.Faces...)
+	}
+	if isURL(job.Output) {
+		if err := upload(dest, job.Output); err != nil {
+			result.Error = fmt.Sprintf("error uploading the output: %v", err)
+		}
+		return result
+	}
+	// The outputs are reported relative to the -out directory, like the job gives them.
+	if result.Output, err = filepath.Rel(outDir, dest); err != nil {
+		result.Output = dest
+	}
+	return result
+}
+
+// jobPath resolves the local path of a job in the directory of the flag. The paths have to
+// be relative and stay in the directory, so the jobs can't read or overwrite the other files
+// of the worker machines.
+func jobPath(dir, p, flag string) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("the local paths need the %s directory of the worker", flag)
+	}
+	clean := filepath.Clean(filepath.FromSlash(p))
+	if filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" || clean == ".." ||
+		strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not a path relative to the %s directory", p, flag)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// isURL reports whether the job source or output is an http(s) URL.
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// urlPath returns the path of the URL, without the query of the presigned URLs.
+func urlPath(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+// download downloads the source image of the URL or of the s3:// URI into the directory,
+// keeping its file name.
+func download(rawurl, dir string) (string, error) {
+	src, err := facemask.OpenSource(rawurl)
+	if err != nil {
+		return "", err
+	}
+	switch s := src.(type) {
+	case facemask.URLSource:
+		s.Client = jobClient
+		src = s
+	case *facemask.S3Source:
+		s.Client = jobClient
+	}
+	rc, err := src.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	name := path.Base(urlPath(rawurl))
+	if name == "." || name == "/" {
+		name = "source"
+	}
+	dst := filepath.Join(dir, name)
+	f, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, io.LimitReader(rc, maxJobSize+1))
+	if err != nil {
+		return "", err
+	}
+	if n > maxJobSize {
+		return "", fmt.Errorf("the source exceeds %d MB", maxJobSize>>20)
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if filepath.Ext(dst) != "" {
+		return dst, nil
+	}
+	// The format of the sources without an extension is sniffed from their content.
+	_, format, err := facemask.ReadSource(facemask.FileSource(dst), facemask.SourceLimits{MaxSize: maxJobSize})
+	if err != nil {
+		return "", err
+	}
+	return dst + "." + format, os.Rename(dst, dst+"."+format)
+}
+
+// upload uploads the output image to the URL with PUT.
+func upload(file, rawurl string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, rawurl, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if ct := mime.TypeByExtension(filepath.Ext(file)); ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	resp, err := jobClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}